@@ -23,7 +23,9 @@ var (
 )
 
 // alert on USB disconnection
-func monitorUSB(ctx context.Context, logger servicelog.Logger, config Config, proxy *serverProxy) {
+func monitorUSB(ctx context.Context, logger servicelog.Logger, config Config, proxy *serverProxy, site *siteState) {
+	// Stop monitoring the camera when done
+	defer stopCameraMonitor(logger, site)
 	timer := time.NewTimer(0)
 	usbDetected := false // true if usb cammera has been detected once
 	usbMissing := false  // True if USB camera has gone from detected to missing
@@ -45,7 +47,14 @@ func monitorUSB(ctx context.Context, logger servicelog.Logger, config Config, pr
 				usbDetected = false
 				usbMissing = true
 			}
+			site.usbChecked(connectedCameras)
+			if connectedCameras == 0 {
+				stopCameraMonitor(logger, site)
+			}
 			if connectedCameras > 0 {
+				if config.CameraMonitorSeconds > 0 {
+					startCameraMonitor(ctx, logger, config, site)
+				}
 				usbDetected = true
 				if usbMissing {
 					logger.Info("USB camera detected")
@@ -61,3 +70,31 @@ func monitorUSB(ctx context.Context, logger servicelog.Logger, config Config, pr
 		}
 	}
 }
+
+// startCameraMonitor starts reading the camera control values,
+// if not already started
+func startCameraMonitor(ctx context.Context, logger servicelog.Logger, config Config, site *siteState) {
+	site.cameraMutex.Lock()
+	monitored := site.camera != nil
+	site.cameraMutex.Unlock()
+	if monitored {
+		return
+	}
+	cam, err := camera.New(0, 5*time.Minute)
+	if err != nil {
+		logger.Error("failed to open camera for monitoring", servicelog.Error(err))
+		return
+	}
+	logger.Info("monitoring camera", servicelog.String("serialNumber", cam.SerialNumber))
+	site.monitoring(cam)
+	go cam.Monitor(ctx, logger, time.Duration(config.CameraMonitorSeconds)*time.Second)
+}
+
+// stopCameraMonitor releases the camera being monitored, if any
+func stopCameraMonitor(logger servicelog.Logger, site *siteState) {
+	if cam := site.monitoring(nil); cam != nil {
+		if err := cam.Join(); err != nil {
+			logger.Error("failed to close monitored camera", servicelog.Error(err))
+		}
+	}
+}
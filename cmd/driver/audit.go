@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
+)
+
+// parseAuditTime accepts a date or a RFC3339 time. Dates are local.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// printAudit prints the records as a table
+func printAudit(w io.Writer) (func(audit.Record) error, func() error) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tSIZE\tDURATION\tID\tPATH\tDETAIL")
+	emit := func(r audit.Record) error {
+		id := r.MediaID
+		if id == "" {
+			id = r.AlertID
+		}
+		detail := r.Error
+		if detail == "" {
+			detail = r.Message
+		}
+		if detail == "" {
+			detail = r.Hash
+		}
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			r.Time.Local().Format(time.RFC3339), r.Event, r.Size,
+			time.Duration(r.DurationMs)*time.Millisecond, id, r.Path, detail)
+		return err
+	}
+	return emit, tw.Flush
+}
+
+// auditCommand implements the `audit` subcommand
+func auditCommand(config Config, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	from := flags.String("from", "", "only records after this date (2006-01-02) or time (RFC3339)")
+	to := flags.String("to", "", "only records before this date (2006-01-02) or time (RFC3339)")
+	file := flags.String("file", "", "only records of files whose path contains this text")
+	events := flags.String("event", "", "comma separated list of events (detected, attempt, success, skipped, held, failure, transferred, expired, alert_raised, alert_cleared)")
+	asJSON := flags.Bool("json", false, "print the records in JSON lines format")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var (
+		filter audit.Filter
+		err    error
+	)
+	if filter.From, err = parseAuditTime(*from); err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	if filter.To, err = parseAuditTime(*to); err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	filter.Path = *file
+	if *events != "" {
+		for _, event := range strings.Split(*events, ",") {
+			filter.Events = append(filter.Events, audit.Event(strings.TrimSpace(event)))
+		}
+	}
+	var (
+		emit  func(audit.Record) error
+		flush = func() error { return nil }
+	)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		emit = func(r audit.Record) error { return encoder.Encode(r) }
+	} else {
+		emit, flush = printAudit(os.Stdout)
+	}
+	if err := audit.Query(config.AuditFile, filter, emit); err != nil {
+		return err
+	}
+	return flush()
+}
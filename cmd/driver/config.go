@@ -1,15 +1,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+	"github.com/warpcomdev/asicamera2/internal/driver/httpauth"
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/overlay"
+	"github.com/warpcomdev/asicamera2/internal/driver/preview"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type Config struct {
@@ -33,7 +48,168 @@ type Config struct {
 	LogFileSizeMb       int               `json:"LogFileSizeMb" toml:"LogFileSizeMb" yaml:"LogFileSizeMb"`
 	LogFileNumber       int               `json:"LogFileNumber" toml:"LogFileNumber" yaml:"LogFileNumber"`
 	Debug               bool              `json:"Debug" toml:"Debug" yaml:"Debug"`
+	LogLevel            string            `json:"LogLevel" toml:"LogLevel" yaml:"LogLevel"` // debug, info, warn or error
 	DenyList            []string          `json:"DenyList" toml:"DenyList" yaml:"DenyList"` // Files not uploaded
+	UploadPolicy        string            `json:"UploadPolicy" toml:"UploadPolicy" yaml:"UploadPolicy"`
+	UploadClasses       []UploadClass     `json:"UploadClasses" toml:"UploadClasses" yaml:"UploadClasses"`
+	UploadReservedSlots int               `json:"UploadReservedSlots" toml:"UploadReservedSlots" yaml:"UploadReservedSlots"` // Slots only for small files
+	UploadSmallFileKb   int               `json:"UploadSmallFileKb" toml:"UploadSmallFileKb" yaml:"UploadSmallFileKb"`
+	WatchMode           string            `json:"WatchMode" toml:"WatchMode" yaml:"WatchMode"`    // notify, poll or hybrid
+	WatchModes          map[string]string `json:"WatchModes" toml:"WatchModes" yaml:"WatchModes"` // per folder overrides
+	PollIntervalSeconds int               `json:"PollIntervalSeconds" toml:"PollIntervalSeconds" yaml:"PollIntervalSeconds"`
+	// Reconciliation with backend media. Disabled if interval is 0.
+	ReconcileIntervalHours int  `json:"ReconcileIntervalHours" toml:"ReconcileIntervalHours" yaml:"ReconcileIntervalHours"`
+	ReconcileRequeue       bool `json:"ReconcileRequeue" toml:"ReconcileRequeue" yaml:"ReconcileRequeue"`
+	// Processing before upload, per mime type
+	Hooks              []HookConfig `json:"Hooks" toml:"Hooks" yaml:"Hooks"`
+	DisableFitsPreview bool         `json:"DisableFitsPreview" toml:"DisableFitsPreview" yaml:"DisableFitsPreview"`
+	// Dashboard for site technicians
+	CameraMonitorSeconds int    `json:"CameraMonitorSeconds" toml:"CameraMonitorSeconds" yaml:"CameraMonitorSeconds"` // 0 to disable
+	DashboardPreview     string `json:"DashboardPreview" toml:"DashboardPreview" yaml:"DashboardPreview"`             // URL of the live preview
+	// Live preview streams
+	Preview                []PreviewConfig   `json:"Preview" toml:"Preview" yaml:"Preview"`
+	PreviewFramesPerSecond int               `json:"PreviewFramesPerSecond" toml:"PreviewFramesPerSecond" yaml:"PreviewFramesPerSecond"`
+	PreviewThreads         int               `json:"PreviewThreads" toml:"PreviewThreads" yaml:"PreviewThreads"`
+	PreviewRawPool         int               `json:"PreviewRawPool" toml:"PreviewRawPool" yaml:"PreviewRawPool"`
+	PreviewJpegPool        int               `json:"PreviewJpegPool" toml:"PreviewJpegPool" yaml:"PreviewJpegPool"`
+	PreviewImageKb         int               `json:"PreviewImageKb" toml:"PreviewImageKb" yaml:"PreviewImageKb"`
+	PreviewRenditions      []RenditionConfig `json:"PreviewRenditions" toml:"PreviewRenditions" yaml:"PreviewRenditions"`
+	PreviewStatsSeconds    int               `json:"PreviewStatsSeconds" toml:"PreviewStatsSeconds" yaml:"PreviewStatsSeconds"` // frame statistics interval, < 0 to disable
+	PreviewPanicOnStuck    bool              `json:"PreviewPanicOnStuck" toml:"PreviewPanicOnStuck" yaml:"PreviewPanicOnStuck"` // restart the service if a stuck pipeline cannot be recycled
+	// Local HTTP server security
+	BindAddress      string       `json:"BindAddress" toml:"BindAddress" yaml:"BindAddress"` // empty for all interfaces
+	TLSCertFile      string       `json:"TLSCertFile" toml:"TLSCertFile" yaml:"TLSCertFile"`
+	TLSKeyFile       string       `json:"TLSKeyFile" toml:"TLSKeyFile" yaml:"TLSKeyFile"`
+	TLSSelfSigned    bool         `json:"TLSSelfSigned" toml:"TLSSelfSigned" yaml:"TLSSelfSigned"` // generate the cert if missing
+	EnablePprof      bool         `json:"EnablePprof" toml:"EnablePprof" yaml:"EnablePprof"`
+	Auth             []AuthConfig `json:"Auth" toml:"Auth" yaml:"Auth"`
+	AuthCacheMinutes int          `json:"AuthCacheMinutes" toml:"AuthCacheMinutes" yaml:"AuthCacheMinutes"` // cache of backend logins
+	// Health checks
+	HealthMinFreeMb int `json:"HealthMinFreeMb" toml:"HealthMinFreeMb" yaml:"HealthMinFreeMb"`
+	// Tracing of the upload pipeline
+	TraceExporter    string            `json:"TraceExporter" toml:"TraceExporter" yaml:"TraceExporter"` // empty (disabled), otlp or file
+	TraceEndpoint    string            `json:"TraceEndpoint" toml:"TraceEndpoint" yaml:"TraceEndpoint"` // OTLP/HTTP traces URL
+	TraceHeaders     map[string]string `json:"TraceHeaders" toml:"TraceHeaders" yaml:"TraceHeaders"`
+	TraceFile        string            `json:"TraceFile" toml:"TraceFile" yaml:"TraceFile"`
+	TraceSampleRatio float64           `json:"TraceSampleRatio" toml:"TraceSampleRatio" yaml:"TraceSampleRatio"`
+	// Upload audit journal
+	DisableAudit       bool   `json:"DisableAudit" toml:"DisableAudit" yaml:"DisableAudit"`
+	AuditFile          string `json:"AuditFile" toml:"AuditFile" yaml:"AuditFile"`
+	AuditFileSizeMb    int    `json:"AuditFileSizeMb" toml:"AuditFileSizeMb" yaml:"AuditFileSizeMb"`
+	AuditFileNumber    int    `json:"AuditFileNumber" toml:"AuditFileNumber" yaml:"AuditFileNumber"`
+	AuditRetentionDays int    `json:"AuditRetentionDays" toml:"AuditRetentionDays" yaml:"AuditRetentionDays"` // 0 keeps the files forever
+	AuditCompress      bool   `json:"AuditCompress" toml:"AuditCompress" yaml:"AuditCompress"`
+}
+
+// UploadClass groups mime types for upload scheduling
+type UploadClass struct {
+	Name      string   `json:"Name" toml:"Name" yaml:"Name"`
+	MimeTypes []string `json:"MimeTypes" toml:"MimeTypes" yaml:"MimeTypes"` // mime type prefixes
+	Weight    int      `json:"Weight" toml:"Weight" yaml:"Weight"`
+}
+
+// PreviewConfig describes a live preview stream
+type PreviewConfig struct {
+	Camera        string        `json:"Camera" toml:"Camera" yaml:"Camera"`                      // name in the URL
+	Folder        string        `json:"Folder" toml:"Folder" yaml:"Folder"`                      // defaults to the capture folder
+	FolderPattern string        `json:"FolderPattern" toml:"FolderPattern" yaml:"FolderPattern"` // regexp of subfolders watched
+	Stretch       StretchConfig `json:"Stretch" toml:"Stretch" yaml:"Stretch"`                   // default display stretch
+	Source        string        `json:"Source" toml:"Source" yaml:"Source"`                      // jpeg (default) or ser
+	Bayer         string        `json:"Bayer" toml:"Bayer" yaml:"Bayer"`                         // pattern of MONO SER videos, defaults to the camera's
+	Overlay       OverlayConfig `json:"Overlay" toml:"Overlay" yaml:"Overlay"`                   // text and graphics drawn on the frames
+}
+
+// StretchConfig describes the display stretch of a live preview
+type StretchConfig struct {
+	Mode     string  `json:"Mode" toml:"Mode" yaml:"Mode"`             // none, auto, stf, asinh or gamma
+	Clip     float64 `json:"Clip" toml:"Clip" yaml:"Clip"`             // percent of shadows and highlights clipped
+	Target   float64 `json:"Target" toml:"Target" yaml:"Target"`       // median after the stf, from 0 to 1
+	Strength float64 `json:"Strength" toml:"Strength" yaml:"Strength"` // factor of the asinh stretch
+	Gamma    float64 `json:"Gamma" toml:"Gamma" yaml:"Gamma"`
+}
+
+// Stretch builds the stretch of the preview
+func (c StretchConfig) Stretch() jpeg.Stretch {
+	mode, _ := jpeg.ParseStretchMode(c.Mode) // already validated by config.Check
+	return jpeg.Stretch{
+		Mode:     mode,
+		Clip:     c.Clip,
+		Target:   c.Target,
+		Strength: c.Strength,
+		Gamma:    c.Gamma,
+	}
+}
+
+// RenditionConfig describes a size and quality of the live preview
+type RenditionConfig struct {
+	Name    string `json:"Name" toml:"Name" yaml:"Name"`          // name in the URL
+	Width   int    `json:"Width" toml:"Width" yaml:"Width"`       // maximum width, 0 for the source width
+	Quality int    `json:"Quality" toml:"Quality" yaml:"Quality"` // jpeg quality, 0 for the default
+}
+
+// OverlayConfig describes the text and graphics drawn on a live preview
+type OverlayConfig struct {
+	Text       []string `json:"Text" toml:"Text" yaml:"Text"`                   // lines, with {time}, {camera}, {site}, {frame}, {exposure}, {gain}, {file}
+	TextCorner string   `json:"TextCorner" toml:"TextCorner" yaml:"TextCorner"` // top-left, top-right, bottom-left or bottom-right
+	TimeFormat string   `json:"TimeFormat" toml:"TimeFormat" yaml:"TimeFormat"` // Go time layout
+	Site       string   `json:"Site" toml:"Site" yaml:"Site"`                   // defaults to the CameraID
+	Scale      int      `json:"Scale" toml:"Scale" yaml:"Scale"`                // pixels per font dot, 0 for automatic
+	Color      string   `json:"Color" toml:"Color" yaml:"Color"`                // #RRGGBB
+	Background bool     `json:"Background" toml:"Background" yaml:"Background"` // dark box behind the text
+	Compass    bool     `json:"Compass" toml:"Compass" yaml:"Compass"`
+	NorthAngle float64  `json:"NorthAngle" toml:"NorthAngle" yaml:"NorthAngle"` // degrees clockwise from the top of the image
+	SkyView    bool     `json:"SkyView" toml:"SkyView" yaml:"SkyView"`          // all-sky camera looking up
+	Crosshair  bool     `json:"Crosshair" toml:"Crosshair" yaml:"Crosshair"`
+	Grid       int      `json:"Grid" toml:"Grid" yaml:"Grid"` // cells per side, 0 for none
+	Logo       string   `json:"Logo" toml:"Logo" yaml:"Logo"` // PNG file
+	LogoCorner string   `json:"LogoCorner" toml:"LogoCorner" yaml:"LogoCorner"`
+}
+
+// Enabled is true if the overlay draws anything
+func (c OverlayConfig) Enabled() bool {
+	return len(c.Text) > 0 || c.Compass || c.Crosshair || c.Grid > 0 || c.Logo != ""
+}
+
+// Options of the overlay
+func (c OverlayConfig) Options() overlay.Options {
+	return overlay.Options{
+		Text:       c.Text,
+		TextCorner: overlay.Corner(c.TextCorner),
+		TimeFormat: c.TimeFormat,
+		Site:       c.Site,
+		Scale:      c.Scale,
+		Color:      c.Color,
+		Background: c.Background,
+		Compass:    c.Compass,
+		NorthAngle: c.NorthAngle,
+		SkyView:    c.SkyView,
+		Crosshair:  c.Crosshair,
+		Grid:       c.Grid,
+		Logo:       c.Logo,
+		LogoCorner: overlay.Corner(c.LogoCorner),
+	}
+}
+
+// AuthConfig describes the authentication of the paths under Prefix
+type AuthConfig struct {
+	Prefix  string            `json:"Prefix" toml:"Prefix" yaml:"Prefix"`
+	Methods []string          `json:"Methods" toml:"Methods" yaml:"Methods"` // basic, bearer, backend
+	Users   map[string]string `json:"Users" toml:"Users" yaml:"Users"`       // password or sha256:<hex>
+	Tokens  []string          `json:"Tokens" toml:"Tokens" yaml:"Tokens"`
+}
+
+// HookConfig describes a pre-upload hook
+type HookConfig struct {
+	Name           string   `json:"Name" toml:"Name" yaml:"Name"`
+	MimeTypes      []string `json:"MimeTypes" toml:"MimeTypes" yaml:"MimeTypes"` // mime type prefixes
+	Command        []string `json:"Command" toml:"Command" yaml:"Command"`       // command line templates
+	Processor      string   `json:"Processor" toml:"Processor" yaml:"Processor"` // registered Go processor
+	Output         string   `json:"Output" toml:"Output" yaml:"Output"`
+	OutputType     string   `json:"OutputType" toml:"OutputType" yaml:"OutputType"`
+	Mode           string   `json:"Mode" toml:"Mode" yaml:"Mode"` // replace or append
+	TimeoutSeconds int      `json:"TimeoutSeconds" toml:"TimeoutSeconds" yaml:"TimeoutSeconds"`
+	WorkDir        string   `json:"WorkDir" toml:"WorkDir" yaml:"WorkDir"`
+	KeepOutput     bool     `json:"KeepOutput" toml:"KeepOutput" yaml:"KeepOutput"`
 }
 
 func normalizeExtension(ext string) string {
@@ -75,8 +251,12 @@ func (config *Config) Check(configPath string) error {
 			".quicktime": "video/quicktime",
 			".webm":      "video/webm",
 			".avi":       "video/x-msvideo",
+			".ser":       "video/x-ser",
 			".jpg":       "image/jpeg",
 			".png":       "image/png",
+			".fit":       "image/fits",
+			".fits":      "image/fits",
+			".fts":       "image/fits",
 		}
 	}
 	normalizedTypes := make(map[string]string, len(config.MimeTypes))
@@ -114,15 +294,288 @@ func (config *Config) Check(configPath string) error {
 	if config.LogFileNumber <= 0 {
 		config.LogFileNumber = 100
 	}
+	switch config.LogLevel {
+	case "":
+		config.LogLevel = "info"
+		if config.Debug {
+			config.LogLevel = "debug"
+		}
+	case "debug", "info", "warn", "error":
+		break
+	default:
+		return fmt.Errorf("logLevel %q is not one of debug, info, warn, error", config.LogLevel)
+	}
 	if config.CameraID == "" {
 		return errors.New("cameraID config parameter is required")
 	}
 	if config.DenyList == nil {
 		config.DenyList = []string{}
 	}
+	switch backend.UploadPolicy(config.UploadPolicy) {
+	case "":
+		config.UploadPolicy = string(backend.PolicyFIFO)
+	case backend.PolicyFIFO, backend.PolicyNewest, backend.PolicySmallest:
+		break
+	default:
+		return fmt.Errorf("uploadPolicy %q is not one of fifo, newest, smallest", config.UploadPolicy)
+	}
+	for i, class := range config.UploadClasses {
+		if class.Name == "" {
+			return fmt.Errorf("uploadClasses entry %d has no name", i)
+		}
+		if class.Weight < 1 {
+			config.UploadClasses[i].Weight = 1
+		}
+	}
+	checkMode := func(mode string) (string, error) {
+		switch watcher.WatchMode(mode) {
+		case "":
+			return string(watcher.WatchNotify), nil
+		case watcher.WatchNotify, watcher.WatchPoll, watcher.WatchHybrid:
+			return mode, nil
+		default:
+			return "", fmt.Errorf("watchMode %q is not one of notify, poll, hybrid", mode)
+		}
+	}
+	var err error
+	if config.WatchMode, err = checkMode(config.WatchMode); err != nil {
+		return err
+	}
+	for folder, mode := range config.WatchModes {
+		if config.WatchModes[folder], err = checkMode(mode); err != nil {
+			return err
+		}
+	}
+	if config.PollIntervalSeconds < 1 {
+		config.PollIntervalSeconds = 30
+	}
+	if config.ReconcileIntervalHours < 0 {
+		config.ReconcileIntervalHours = 0
+	}
+	if config.UploadReservedSlots < 0 {
+		config.UploadReservedSlots = 0
+	}
+	if config.UploadReservedSlots > 0 && config.UploadSmallFileKb <= 0 {
+		config.UploadSmallFileKb = 4096
+	}
+	for i, hook := range config.Hooks {
+		if hook.Name == "" {
+			return fmt.Errorf("hooks entry %d has no name", i)
+		}
+		if hook.TimeoutSeconds < 0 {
+			config.Hooks[i].TimeoutSeconds = 0
+		}
+	}
+	if err := hooks.Validate(config.UploadHooks()); err != nil {
+		return err
+	}
+	if config.PreviewFramesPerSecond < 1 {
+		config.PreviewFramesPerSecond = 1
+	}
+	if config.PreviewThreads < 1 {
+		config.PreviewThreads = 2
+	}
+	if config.PreviewImageKb < 1 {
+		config.PreviewImageKb = 1024
+	}
+	if config.PreviewStatsSeconds == 0 {
+		config.PreviewStatsSeconds = 10
+	}
+	cameras := make(map[string]bool, len(config.Preview))
+	for i, stream := range config.Preview {
+		if stream.Camera == "" {
+			config.Preview[i].Camera = strconv.Itoa(i)
+		}
+		if cameras[config.Preview[i].Camera] {
+			return fmt.Errorf("preview camera %q is duplicated", config.Preview[i].Camera)
+		}
+		cameras[config.Preview[i].Camera] = true
+		if _, err := regexp.Compile(stream.FolderPattern); err != nil {
+			return fmt.Errorf("preview camera %q folderPattern: %w", config.Preview[i].Camera, err)
+		}
+		if _, err := jpeg.ParseStretchMode(stream.Stretch.Mode); err != nil {
+			return fmt.Errorf("preview camera %q stretch: %w", config.Preview[i].Camera, err)
+		}
+		switch stream.Source {
+		case "", previewSourceJpeg, previewSourceSER:
+			break
+		default:
+			return fmt.Errorf("preview camera %q source %q is not one of jpeg, ser", config.Preview[i].Camera, stream.Source)
+		}
+		if stream.Bayer != "" {
+			if _, err := jpeg.ParseBayerPattern(stream.Bayer); err != nil {
+				return fmt.Errorf("preview camera %q bayer: %w", config.Preview[i].Camera, err)
+			}
+		}
+		if o := &config.Preview[i].Overlay; o.Enabled() {
+			if o.Site == "" {
+				o.Site = config.CameraID
+			}
+			if o.Scale < 0 || o.Grid < 0 {
+				return fmt.Errorf("preview camera %q overlay: invalid scale %d or grid %d", config.Preview[i].Camera, o.Scale, o.Grid)
+			}
+			if _, err := overlay.New(o.Options()); err != nil {
+				return fmt.Errorf("preview camera %q overlay: %w", config.Preview[i].Camera, err)
+			}
+		}
+		if stream.Stretch.Clip < 0 || stream.Stretch.Clip >= 50 || stream.Stretch.Target < 0 || stream.Stretch.Target >= 1 || stream.Stretch.Strength < 0 || stream.Stretch.Gamma < 0 {
+			return fmt.Errorf("preview camera %q stretch: parameters out of range", config.Preview[i].Camera)
+		}
+	}
+	renditions := make(map[string]bool, len(config.PreviewRenditions))
+	for i, r := range config.PreviewRenditions {
+		if r.Name == "" {
+			return fmt.Errorf("preview rendition %d has no name", i)
+		}
+		if renditions[r.Name] {
+			return fmt.Errorf("preview rendition %q is duplicated", r.Name)
+		}
+		renditions[r.Name] = true
+		if r.Width < 0 || r.Quality < 0 || r.Quality > 100 {
+			return fmt.Errorf("preview rendition %q: invalid width %d or quality %d", r.Name, r.Width, r.Quality)
+		}
+	}
+	if config.TLSSelfSigned {
+		if config.TLSCertFile == "" {
+			config.TLSCertFile = filepath.Join(configDir, "tls", "cert.pem")
+		}
+		if config.TLSKeyFile == "" {
+			config.TLSKeyFile = filepath.Join(configDir, "tls", "key.pem")
+		}
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("both tlsCertFile and tlsKeyFile are required for TLS")
+	}
+	if config.HealthMinFreeMb < 1 {
+		config.HealthMinFreeMb = 1024
+	}
+	switch config.TraceExporter {
+	case "":
+		break
+	case "otlp":
+		if config.TraceEndpoint == "" {
+			return errors.New("traceEndpoint config parameter is required for the otlp exporter")
+		}
+	case "file":
+		if config.TraceFile == "" {
+			config.TraceFile = filepath.Join(config.LogFolder, "traces.jsonl")
+		}
+	default:
+		return fmt.Errorf("traceExporter %q is not one of otlp, file", config.TraceExporter)
+	}
+	if config.TraceSampleRatio <= 0 || config.TraceSampleRatio > 1 {
+		config.TraceSampleRatio = 1
+	}
+	if config.AuditFile == "" {
+		config.AuditFile = filepath.Join(config.LogFolder, "audit.jsonl")
+	}
+	if config.AuditFileSizeMb <= 0 {
+		config.AuditFileSizeMb = 64
+	}
+	if config.AuditFileNumber <= 0 {
+		config.AuditFileNumber = 100
+	}
+	if config.AuditRetentionDays < 0 {
+		config.AuditRetentionDays = 0
+	}
+	if config.AuthCacheMinutes < 1 {
+		config.AuthCacheMinutes = 10
+	}
+	if err := httpauth.Validate(config.AuthPolicies()); err != nil {
+		return err
+	}
+	if config.DashboardPreview == "" && len(config.Preview) > 0 {
+		config.DashboardPreview = preview.MJPEGPrefix + config.Preview[0].Camera
+	}
 	return nil
 }
 
+// TLS returns true if the local server must use TLS
+func (config Config) TLS() bool {
+	return config.TLSCertFile != ""
+}
+
+// AuthPolicies builds the authentication policies of the local server
+func (config Config) AuthPolicies() []httpauth.Policy {
+	policies := make([]httpauth.Policy, 0, len(config.Auth))
+	for _, auth := range config.Auth {
+		methods := make([]httpauth.Method, 0, len(auth.Methods))
+		for _, method := range auth.Methods {
+			methods = append(methods, httpauth.Method(strings.ToLower(method)))
+		}
+		policies = append(policies, httpauth.Policy{
+			Prefix:  auth.Prefix,
+			Methods: methods,
+			Users:   auth.Users,
+			Tokens:  auth.Tokens,
+		})
+	}
+	return policies
+}
+
+// redactedValue replaces the credentials in the logs
+const redactedValue = "********"
+
+// Redacted returns a copy of the config safe to log, with the
+// credentials masked: the api key, the passwords and tokens of
+// the auth policies and the values of the trace headers.
+func (config Config) Redacted() Config {
+	if config.ApiKey != "" {
+		config.ApiKey = redactedValue
+	}
+	auth := make([]AuthConfig, 0, len(config.Auth))
+	for _, a := range config.Auth {
+		if a.Users != nil {
+			users := make(map[string]string, len(a.Users))
+			for user := range a.Users {
+				users[user] = redactedValue
+			}
+			a.Users = users
+		}
+		if a.Tokens != nil {
+			tokens := make([]string, len(a.Tokens))
+			for i := range tokens {
+				tokens[i] = redactedValue
+			}
+			a.Tokens = tokens
+		}
+		auth = append(auth, a)
+	}
+	if config.Auth != nil {
+		config.Auth = auth
+	}
+	if config.TraceHeaders != nil {
+		headers := make(map[string]string, len(config.TraceHeaders))
+		for name := range config.TraceHeaders {
+			headers[name] = redactedValue
+		}
+		config.TraceHeaders = headers
+	}
+	return config
+}
+
+// PreviewOptions builds the options of the preview pipelines
+func (config Config) PreviewOptions() preview.Options {
+	renditions := make([]jpeg.Rendition, 0, len(config.PreviewRenditions))
+	for _, r := range config.PreviewRenditions {
+		renditions = append(renditions, jpeg.Rendition{
+			Name:    r.Name,
+			Width:   r.Width,
+			Quality: r.Quality,
+		})
+	}
+	return preview.Options{
+		FramesPerSecond: config.PreviewFramesPerSecond,
+		RawPoolSize:     config.PreviewRawPool,
+		JpegPoolSize:    config.PreviewJpegPool,
+		ImageSize:       config.PreviewImageKb * 1024,
+		StatsInterval:   time.Duration(config.PreviewStatsSeconds) * time.Second,
+		Threads:         config.PreviewThreads,
+		Renditions:      renditions,
+		PanicOnStuck:    config.PreviewPanicOnStuck,
+	}
+}
+
 func (c Config) FileTypes() map[string]struct{} {
 	buffer := make(map[string]struct{}, len(c.MimeTypes))
 	for k := range c.MimeTypes {
@@ -131,14 +584,119 @@ func (c Config) FileTypes() map[string]struct{} {
 	return buffer
 }
 
+// WatchSettings returns the watcher settings that can be reloaded
+func (config Config) WatchSettings() watcher.Settings {
+	return watcher.Settings{
+		FileTypes:  config.FileTypes(),
+		MonitorFor: time.Duration(config.MonitorForMinutes) * time.Minute,
+		Expiration: time.Duration(config.ExpireAfterDays) * time.Hour * 24,
+		DenyList:   config.DenyList,
+	}
+}
+
+// WatchConfig returns the change detection settings for the given folder
+func (config Config) WatchConfig(folder string) watcher.WatchConfig {
+	mode, ok := config.WatchModes[folder]
+	if !ok {
+		mode = config.WatchMode
+	}
+	return watcher.WatchConfig{
+		Mode:         watcher.WatchMode(mode),
+		PollInterval: time.Duration(config.PollIntervalSeconds) * time.Second,
+	}
+}
+
+// UploadHooks builds the pre-upload hook configuration
+func (config Config) UploadHooks() []hooks.Hook {
+	result := make([]hooks.Hook, 0, len(config.Hooks))
+	for _, hook := range config.Hooks {
+		result = append(result, hooks.Hook{
+			Name:       hook.Name,
+			MimeTypes:  hook.MimeTypes,
+			Command:    hook.Command,
+			Processor:  hook.Processor,
+			Output:     hook.Output,
+			OutputType: hook.OutputType,
+			Mode:       hooks.Mode(hook.Mode),
+			Timeout:    time.Duration(hook.TimeoutSeconds) * time.Second,
+			WorkDir:    hook.WorkDir,
+			KeepOutput: hook.KeepOutput,
+		})
+	}
+	// Built-in preview for FITS images. The first matching hook wins,
+	// so a configured hook for image/fits replaces this one.
+	if !config.DisableFitsPreview {
+		result = append(result, hooks.Hook{
+			Name:       fitsPreviewHook,
+			MimeTypes:  []string{"image/fits"},
+			Processor:  fitsPreviewHook,
+			Output:     "{{.Name}}.preview.jpg",
+			OutputType: "image/jpeg",
+			Mode:       hooks.ModeAppend,
+			Timeout:    5 * time.Minute,
+		})
+	}
+	return result
+}
+
+// Scheduler builds the upload scheduler configuration
+func (config Config) Scheduler() backend.SchedulerConfig {
+	classes := make([]backend.UploadClass, 0, len(config.UploadClasses))
+	for _, class := range config.UploadClasses {
+		classes = append(classes, backend.UploadClass{
+			Name:      class.Name,
+			MimeTypes: class.MimeTypes,
+			Weight:    class.Weight,
+		})
+	}
+	return backend.SchedulerConfig{
+		Policy:         backend.UploadPolicy(config.UploadPolicy),
+		Classes:        classes,
+		ReservedSlots:  config.UploadReservedSlots,
+		SmallFileBytes: int64(config.UploadSmallFileKb) * 1024,
+	}
+}
+
+// Journal opens the upload audit journal, nil if disabled
+func (config Config) Journal() (*audit.Journal, error) {
+	if config.DisableAudit {
+		return nil, nil
+	}
+	return audit.Open(config.AuditFile, config.AuditFileSizeMb, config.AuditFileNumber, config.AuditRetentionDays, config.AuditCompress)
+}
+
+// Tracer builds the tracer for the upload pipeline, nil if disabled
+func (config Config) Tracer(logger servicelog.Logger) (*tracing.Tracer, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch config.TraceExporter {
+	case "otlp":
+		exporter, err = tracing.NewOTLPExporter(context.Background(), config.TraceEndpoint, config.TraceHeaders)
+	case "file":
+		exporter, err = tracing.NewFileExporter(config.TraceFile, config.LogFileSizeMb, config.LogFileNumber)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tracing.New(logger, exporter, config.TraceSampleRatio,
+		attribute.String("service.name", "asicamera2"),
+		attribute.String("service.instance.id", config.CameraID),
+	), nil
+}
+
 func (config Config) Server(logger servicelog.Logger) *backend.Server {
 	var client backend.Client = &http.Client{
 		Timeout: time.Duration(config.ApiTimeoutSeconds) * time.Second,
-		Transport: &http.Transport{
+		// Propagates the trace context to the backend
+		Transport: otelhttp.NewTransport(&http.Transport{
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: config.ApiSkipVerify,
 			},
-		},
+		}),
 	}
 	if config.Debug {
 		client = debugClient{
@@ -153,6 +711,7 @@ func (config Config) Server(logger servicelog.Logger) *backend.Server {
 		CameraID:    config.CameraID,
 		HTTPTimeout: time.Duration(config.ApiTimeoutSeconds) * time.Second,
 		Concurrency: config.ApiConcurrency,
+		Scheduler:   config.Scheduler(),
 	}
 	return backend.New(logger, client, apiConfig)
 }
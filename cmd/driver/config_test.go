@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedacted(t *testing.T) {
+	config := Config{
+		ApiUsername: "camera",
+		ApiKey:      "secret-api-key",
+		Auth: []AuthConfig{{
+			Prefix:  "/admin/",
+			Methods: []string{"basic", "bearer"},
+			Users:   map[string]string{"tech": "secret-password", "admin": "sha256:secret-hash"},
+			Tokens:  []string{"secret-token"},
+		}},
+		TraceHeaders: map[string]string{"Authorization": "Bearer secret-trace"},
+	}
+	logged, err := json.Marshal(config.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(logged), "secret") {
+		t.Errorf("redacted config contains secrets: %s", logged)
+	}
+	for _, kept := range []string{"camera", "/admin/", "tech", "Authorization"} {
+		if !strings.Contains(string(logged), kept) {
+			t.Errorf("redacted config lost %q: %s", kept, logged)
+		}
+	}
+	// The original config is not modified
+	if config.ApiKey != "secret-api-key" || config.Auth[0].Users["tech"] != "secret-password" ||
+		config.Auth[0].Tokens[0] != "secret-token" || config.TraceHeaders["Authorization"] != "Bearer secret-trace" {
+		t.Errorf("original config modified: %+v", config)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/admin"
+	"github.com/warpcomdev/asicamera2/internal/driver/camera"
+	"github.com/warpcomdev/asicamera2/internal/driver/dashboard"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+// Number of recent upload results displayed per folder
+const dashboardRecent = 20
+
+// siteState is the local state shared by the service
+// with the admin API and the dashboard
+type siteState struct {
+	config   *reloader
+	registry *admin.Registry
+	alerts   *dashboard.Alerts
+	// Camera connection, updated by monitorUSB
+	cameraMutex     sync.Mutex
+	cameraConnected int
+	cameraChecked   time.Time
+	camera          *camera.ASICamera
+	// Folder watcher state, updated by watchMedia
+	watchMutex   sync.Mutex
+	watchError   error
+	watchRunning time.Time // zero if not running
+}
+
+func newSiteState(config *reloader) *siteState {
+	return &siteState{
+		config:   config,
+		registry: admin.NewRegistry(),
+		alerts:   dashboard.NewAlerts(),
+	}
+}
+
+// usbChecked records the result of a USB check
+func (s *siteState) usbChecked(connected int) {
+	s.cameraMutex.Lock()
+	defer s.cameraMutex.Unlock()
+	s.cameraConnected = connected
+	s.cameraChecked = time.Now()
+}
+
+// watchState records whether the folder watcher is running
+// or failed with the given error
+func (s *siteState) watchState(err error) {
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+	s.watchError = err
+	if err != nil {
+		s.watchRunning = time.Time{}
+	} else if s.watchRunning.IsZero() {
+		s.watchRunning = time.Now()
+	}
+}
+
+// monitoring sets the camera being monitored, returns the previous one
+func (s *siteState) monitoring(cam *camera.ASICamera) *camera.ASICamera {
+	s.cameraMutex.Lock()
+	defer s.cameraMutex.Unlock()
+	prev := s.camera
+	s.camera = cam
+	return prev
+}
+
+func (s *siteState) cameraStatus() dashboard.Camera {
+	s.cameraMutex.Lock()
+	defer s.cameraMutex.Unlock()
+	status := dashboard.Camera{
+		Connected: s.cameraConnected,
+		Checked:   s.cameraChecked,
+	}
+	if s.camera != nil {
+		snapshot := s.camera.Snapshot()
+		status.Name = s.camera.Name
+		status.SerialNumber = s.camera.SerialNumber
+		status.Updated = snapshot.Updated
+		status.Values = snapshot.Values
+	}
+	return status
+}
+
+func folderStatus(w admin.Watcher) dashboard.Folder {
+	status := dashboard.Folder{
+		Folder:   w.Folder(),
+		Failures: make([]dashboard.FailedFile, 0, 8),
+		Recent:   make([]dashboard.RecentEvent, 0, dashboardRecent),
+	}
+	for _, task := range w.Tasks() {
+		status.Tasks += 1
+		if task.State == watcher.TaskUploading {
+			status.Uploads += 1
+		}
+	}
+	for _, failure := range w.Failures() {
+		status.Failures = append(status.Failures, dashboard.FailedFile{
+			Path:  failure.Path,
+			Time:  failure.Time,
+			Error: failure.Error,
+		})
+	}
+	results := w.Results()
+	for i := len(results) - 1; i >= 0 && len(status.Recent) < dashboardRecent; i-- {
+		status.Recent = append(status.Recent, dashboard.RecentEvent{
+			Path:   results[i].Path,
+			Time:   results[i].Time,
+			Status: string(results[i].Status),
+			Error:  results[i].Error,
+		})
+	}
+	return status
+}
+
+// dashboardStatus builds the dashboard.Provider for the site
+func dashboardStatus(config Config, site *siteState) dashboard.Provider {
+	return func(ctx context.Context) dashboard.Status {
+		watchers := site.registry.List()
+		status := dashboard.Status{
+			Time:     time.Now(),
+			CameraID: config.CameraID,
+			Camera:   site.cameraStatus(),
+			Folders:  make([]dashboard.Folder, 0, len(watchers)),
+			Alerts:   site.alerts.List(),
+			Disks:    make([]dashboard.Disk, 0, len(watchers)+1),
+			Preview:  config.DashboardPreview,
+		}
+		for _, w := range watchers {
+			status.Folders = append(status.Folders, folderStatus(w))
+			status.Disks = append(status.Disks, dashboard.Usage(w.Folder()))
+		}
+		status.Disks = append(status.Disks, dashboard.Usage(config.HistoryFolder))
+		return status
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/fits"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+// Name of the built-in hook that generates FITS previews
+const fitsPreviewHook = "fits-preview"
+
+func init() {
+	hooks.Register(fitsPreviewHook, fitsPreview)
+	inspectors["image/fits"] = inspectFITS
+}
+
+// openFITS opens the file and parses the FITS headers
+func openFITS(path string) (*os.File, *fits.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	image, err := fits.Open(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, image, nil
+}
+
+// inspectFITS validates the FITS file is complete and returns its headers
+func inspectFITS(path string) (map[string]string, error) {
+	file, image, err := openFITS(path)
+	if err != nil {
+		if errors.Is(err, fits.TruncatedError) {
+			return nil, fmt.Errorf("%w: %v", watcher.HeldBackError, err)
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return image.Metadata(), nil
+}
+
+// fitsPreview renders a stretched JPEG preview of the FITS image
+func fitsPreview(ctx context.Context, logger servicelog.Logger, input hooks.Input) error {
+	file, image, err := openFITS(input.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gray, width, height, err := image.Preview(fits.DefaultStretch)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rawFeat := jpeg.RawFeatures{
+		Features: jpeg.Features{Width: width, Height: height},
+		Format:   jpeg.PF_GRAY,
+	}
+	var raw, output jpeg.Image
+	defer raw.Free()
+	defer output.Free()
+	if err := raw.Alloc(len(gray)); err != nil {
+		return err
+	}
+	copy(raw.Slice(), gray)
+	if err := output.Alloc(jpeg.BufSize(rawFeat.Features, jpeg.TJSAMP_GRAY)); err != nil {
+		return err
+	}
+	compressor := jpeg.NewCompressor()
+	defer compressor.Free()
+	if _, err := compressor.Compress(&raw, rawFeat, &output, jpeg.TJSAMP_GRAY, 85, jpeg.TJFLAG_NOREALLOC); err != nil {
+		return err
+	}
+	logger.Debug("generated FITS preview", servicelog.Int("width", width), servicelog.Int("height", height))
+	return os.WriteFile(input.Output, output.Slice(), 0644)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/dashboard"
+	"github.com/warpcomdev/asicamera2/internal/driver/health"
+)
+
+// registerHealth registers the checks of the service components
+func registerHealth(registry *health.Registry, config Config, server *backend.Server, site *siteState, previews *previewSwitch) {
+	registry.Register("auth", health.Readiness, func(ctx context.Context) (interface{}, error) {
+		status := server.Health()
+		detail := map[string]interface{}{"lastAuth": status.LastAuth}
+		if status.LastAuthError != nil {
+			return detail, status.LastAuthError
+		}
+		if status.LastAuth.IsZero() {
+			return detail, errors.New("not authenticated yet")
+		}
+		return detail, nil
+	})
+	registry.Register("folder", health.Readiness, func(ctx context.Context) (interface{}, error) {
+		status := server.Health()
+		detail := map[string]interface{}{"lastPoll": status.LastFolder}
+		// Allow for a couple of missed polls
+		maxAge := 3 * time.Duration(config.ApiRefreshMinutes) * time.Minute
+		if status.LastFolder.IsZero() {
+			return detail, errors.New("folder not polled yet")
+		}
+		if age := time.Since(status.LastFolder); age > maxAge {
+			return detail, fmt.Errorf("last folder poll %s ago", age.Round(time.Second))
+		}
+		return detail, nil
+	})
+	registry.Register("watcher", health.Readiness, func(ctx context.Context) (interface{}, error) {
+		site.watchMutex.Lock()
+		running, err := site.watchRunning, site.watchError
+		site.watchMutex.Unlock()
+		folders := make([]string, 0, 1)
+		for _, w := range site.registry.List() {
+			folders = append(folders, w.Folder())
+		}
+		detail := map[string]interface{}{"folders": folders, "running": running}
+		if err != nil {
+			return detail, err
+		}
+		if running.IsZero() {
+			return detail, errors.New("folder watcher not running")
+		}
+		return detail, nil
+	})
+	registry.Register("disk", health.Readiness, func(ctx context.Context) (interface{}, error) {
+		paths := []string{config.HistoryFolder}
+		for _, w := range site.registry.List() {
+			paths = append(paths, w.Folder())
+		}
+		minFree := uint64(config.HealthMinFreeMb) * 1024 * 1024
+		disks := make([]dashboard.Disk, 0, len(paths))
+		var failed error
+		for _, path := range paths {
+			disk := dashboard.Usage(path)
+			disks = append(disks, disk)
+			switch {
+			case disk.Error != "":
+				failed = fmt.Errorf("%s: %s", path, disk.Error)
+			case disk.Free < minFree:
+				failed = fmt.Errorf("%s: %d MB free, below %d MB", path, disk.Free/1024/1024, config.HealthMinFreeMb)
+			}
+		}
+		return disks, failed
+	})
+	registry.Register("camera", health.Readiness, func(ctx context.Context) (interface{}, error) {
+		status := site.cameraStatus()
+		if status.Checked.IsZero() {
+			return status, errors.New("USB not checked yet")
+		}
+		if status.Connected == 0 {
+			return status, errors.New("no USB camera detected")
+		}
+		return status, nil
+	})
+	registry.Register("pipeline", health.Liveness, func(ctx context.Context) (interface{}, error) {
+		running, err := previews.Check()
+		return map[string]interface{}{"streams": running}, err
+	})
+}
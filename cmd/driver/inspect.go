@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/avi"
+	"github.com/warpcomdev/asicamera2/internal/driver/ser"
+	"github.com/warpcomdev/asicamera2/internal/driver/sidecar"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+// inspector checks a media file before upload and extracts its metadata.
+// It must return an error wrapping watcher.HeldBackError if the file is
+// not complete yet.
+type inspector func(path string) (map[string]string, error)
+
+// inspectors by mime type
+var inspectors = map[string]inspector{
+	"video/x-msvideo": inspectAVI,
+	"video/x-ser":     inspectSER,
+}
+
+// inspect the file with the inspector for its mime type, if any
+func inspect(path, mimeType string) (map[string]string, error) {
+	inspector, ok := inspectors[mimeType]
+	if !ok {
+		return nil, nil
+	}
+	return inspector(path)
+}
+
+// inspectAVI validates the AVI file is complete and returns its properties
+func inspectAVI(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	video, err := avi.Open(file, info.Size())
+	if err != nil {
+		if avi.IsIncomplete(err) {
+			return nil, fmt.Errorf("%w: %v", watcher.HeldBackError, err)
+		}
+		return nil, err
+	}
+	return withSidecar(path, video.Metadata()), nil
+}
+
+// inspectSER validates the frames of the SER file and returns its properties
+func inspectSER(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	video, err := ser.Open(file, info.Size())
+	if err != nil {
+		if errors.Is(err, ser.TruncatedError) {
+			return nil, fmt.Errorf("%w: %v", watcher.HeldBackError, err)
+		}
+		return nil, err
+	}
+	metadata, err := video.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	return withSidecar(path, metadata), nil
+}
+
+// withSidecar adds the exposure and gain that the capture software
+// saved next to the video, since AVI and SER files do not record them
+func withSidecar(path string, metadata map[string]string) map[string]string {
+	settings, ok := sidecar.Read(path)
+	if !ok {
+		return metadata
+	}
+	for key, value := range settings.Metadata() {
+		metadata[key] = value
+	}
+	return metadata
+}
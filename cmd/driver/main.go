@@ -1,230 +1,417 @@
-package main
-
-import (
-	"context"
-	"flag"
-	"fmt"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
-	"path/filepath"
-	"sync"
-	"time"
-
-	"github.com/BurntSushi/toml"
-	"github.com/kardianos/service"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/warpcomdev/asicamera2/internal/driver/camera"
-	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
-)
-
-var (
-	startMetric = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "asicamera_start",
-		Help: "Start timestamp of the app (unix)",
-	})
-
-	serviceStartMetric = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "asicamera_service_start",
-		Help: "Start timestamp of the service (unix)",
-	})
-
-	serviceStopMetric = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "asicamera_service_stop",
-		Help: "Stop timestamp of the service (unix)",
-	})
-
-	statusMetric = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "asicamera_service_status",
-		Help: "Service status",
-	})
-
-	infoMetric = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asicamera_service_info",
-			Help: "Service info",
-		},
-		[]string{
-			"start",
-			"libversion",
-		},
-	)
-)
-
-type program struct {
-	Logger servicelog.Logger
-	Config Config
-	Cancel func()
-}
-
-func (p *program) Start(s service.Service) error {
-	// Start should not block. Do the actual work async.
-	p.Logger.Info("start signal received")
-	if p.Cancel != nil {
-		if err := p.Stop(s); err != nil {
-			return err
-		}
-	}
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	p.Cancel = cancelFunc
-	serviceStartMetric.SetToCurrentTime()
-	statusMetric.Set(1)
-	go func() {
-		defer serviceStopMetric.SetToCurrentTime()
-		defer statusMetric.Set(0)
-		p.Run(ctx)
-	}()
-	return nil
-}
-
-func (p *program) Stop(s service.Service) error {
-	// Stop should not block. Return with a few seconds.
-	p.Logger.Info("stop signal received")
-	if p.Cancel != nil {
-		cancel := p.Cancel
-		p.Cancel = nil
-		// Close the service in the background
-		wait := make(chan struct{})
-		go func() {
-			defer close(wait)
-			cancel()
-		}()
-		// Wait up to two seconds for cancellation
-		select {
-		case <-wait:
-			break
-		case <-time.After(2 * time.Second):
-			break
-		}
-	}
-	return nil
-}
-
-func (p *program) Run(ctx context.Context) {
-	mux := &http.ServeMux{}
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/debug", http.DefaultServeMux)
-	//Caution with absolute timeouts! mjpeg hander is streaming
-	//We can use them because mpeghandler implements Hijack to fix
-	srv := &http.Server{
-		Addr:           fmt.Sprintf(":%d", p.Config.Port),
-		Handler:        mux,
-		ReadTimeout:    time.Duration(p.Config.ReadTimeoutSeconds) * time.Second,
-		WriteTimeout:   time.Duration(p.Config.WriteTimeoutSeconds) * time.Second,
-		MaxHeaderBytes: p.Config.MaxHeaderBytes,
-	}
-	apiServer := p.Config.Server(p.Logger)
-	var wg sync.WaitGroup
-	defer wg.Wait()
-	// Launch the HTTP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			defer srv.Close()
-			<-ctx.Done()
-		}()
-		srv.ListenAndServe()
-	}()
-	// launch the folder watcher
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		watchMedia(ctx, p.Logger, p.Config, apiServer)
-	}()
-}
-
-func main() {
-	svcConfig := &service.Config{
-		Name:        "AsiCameraDriver",
-		DisplayName: "ASI Camera image upload driver",
-		Description: "Upload ASI camera images to backend service",
-	}
-
-	var configPath string
-	flag.StringVar(&configPath, "c", "C:\\asicamera\\config.toml", "path to config file")
-	flag.Parse()
-
-	configPath, err := filepath.Abs(configPath)
-	if err != nil {
-		panic(err)
-	}
-
-	// Load config
-	var config Config
-	_, err = toml.DecodeFile(configPath, &config)
-	if err != nil {
-		panic(err)
-	}
-	if err := config.Check(configPath); err != nil {
-		panic(err)
-	}
-
-	prg := &program{
-		Config: config,
-	}
-	s, err := service.New(prg, svcConfig)
-	if err != nil {
-		log.Fatal("new service failed", err)
-	}
-
-	// Setup logging
-	errs := make(chan error, 16)
-	go func() {
-		for {
-			err := <-errs
-			if err != nil {
-				log.Print(err)
-			}
-		}
-	}()
-	rootLogger, err := s.Logger(errs)
-	if err != nil {
-		log.Fatal(err)
-	}
-	logger, err := servicelog.New(rootLogger, config.LogFolder, config.LogFileSizeMb, config.LogFileNumber, config.Debug)
-	if err != nil {
-		panic(err)
-	}
-	prg.Logger = logger
-	defer logger.Sync()
-
-	anonimizedConfig := config
-	anonimizedConfig.ApiKey = "********"
-	logger.Info("config", servicelog.Any("config", anonimizedConfig))
-
-	// Get SDK version
-	apiVersion, err := camera.ASIGetSDKVersion()
-	if err != nil {
-		logger.Fatal("Failed to get SDK version", servicelog.Error(err))
-		return
-	}
-	logger.Info("ASICamera2 SDK version", servicelog.String("apiVersion", apiVersion))
-
-	// Register startup metrics
-	startTime := time.Now()
-	startMetric.Set(float64(startTime.Unix()))
-	infoMetric.WithLabelValues(
-		startTime.Format(time.RFC3339),
-		apiVersion,
-	).Set(1)
-
-	args := flag.Args()
-	if len(args) > 0 {
-		err = service.Control(s, args[0])
-		if err != nil {
-			logger.Fatal("service control failed", servicelog.Error(err))
-		}
-		return
-	}
-
-	logger.Info("starting service manager")
-	err = s.Run()
-	if err != nil {
-		logger.Error("run failed", servicelog.Error(err))
-	}
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kardianos/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/warpcomdev/asicamera2/internal/driver/admin"
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/camera"
+	"github.com/warpcomdev/asicamera2/internal/driver/dashboard"
+	"github.com/warpcomdev/asicamera2/internal/driver/health"
+	"github.com/warpcomdev/asicamera2/internal/driver/httpauth"
+	"github.com/warpcomdev/asicamera2/internal/driver/preview"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tlscert"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+)
+
+var (
+	startMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "asicamera_start",
+		Help: "Start timestamp of the app (unix)",
+	})
+
+	serviceStartMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "asicamera_service_start",
+		Help: "Start timestamp of the service (unix)",
+	})
+
+	serviceStopMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "asicamera_service_stop",
+		Help: "Stop timestamp of the service (unix)",
+	})
+
+	statusMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "asicamera_service_status",
+		Help: "Service status",
+	})
+
+	infoMetric = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_service_info",
+			Help: "Service info",
+		},
+		[]string{
+			"start",
+			"libversion",
+		},
+	)
+)
+
+// Time to wait for the requests in flight when the HTTP server restarts
+const httpShutdownTimeout = 10 * time.Second
+
+type program struct {
+	Logger     servicelog.Logger
+	Config     Config
+	ConfigPath string
+	Cancel     func()
+}
+
+func (p *program) Start(s service.Service) error {
+	// Start should not block. Do the actual work async.
+	p.Logger.Info("start signal received")
+	if p.Cancel != nil {
+		if err := p.Stop(s); err != nil {
+			return err
+		}
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	p.Cancel = cancelFunc
+	serviceStartMetric.SetToCurrentTime()
+	statusMetric.Set(1)
+	go func() {
+		defer serviceStopMetric.SetToCurrentTime()
+		defer statusMetric.Set(0)
+		p.Run(ctx)
+	}()
+	return nil
+}
+
+func (p *program) Stop(s service.Service) error {
+	// Stop should not block. Return with a few seconds.
+	p.Logger.Info("stop signal received")
+	if p.Cancel != nil {
+		cancel := p.Cancel
+		p.Cancel = nil
+		// Close the service in the background
+		wait := make(chan struct{})
+		go func() {
+			defer close(wait)
+			cancel()
+		}()
+		// Wait up to two seconds for cancellation
+		select {
+		case <-wait:
+			break
+		case <-time.After(2 * time.Second):
+			break
+		}
+	}
+	return nil
+}
+
+func (p *program) Run(ctx context.Context) {
+	mux := &http.ServeMux{}
+	mux.Handle("/metrics", promhttp.Handler())
+	if p.Config.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	reload := newReloader(p.Logger, p.ConfigPath, p.Config)
+	site := newSiteState(reload)
+	site.registry.OnReload(func() (interface{}, error) {
+		return reload.Reload()
+	})
+	mux.Handle(admin.Prefix, admin.Handler(p.Logger, site.registry))
+	mux.Handle(dashboard.Prefix, dashboard.Handler(p.Logger, dashboardStatus(p.Config, site)))
+	previews := newPreviewSwitch(newPreview(p.Logger, p.Config, site))
+	defer previews.Close()
+	mux.Handle(preview.MJPEGPrefix, previews.Handler())
+	mux.Handle(preview.JPEGPrefix, previews.Handler())
+	mux.Handle(preview.WebSocketPrefix, previews.Handler())
+	mux.Handle(preview.StatsPrefix, previews.Handler())
+	var checks health.Registry
+	mux.Handle(health.LivenessPath, checks.Handler(p.Logger, health.Liveness))
+	mux.Handle(health.ReadinessPath, checks.Handler(p.Logger, health.Liveness, health.Readiness))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, dashboard.Prefix, http.StatusFound)
+	}))
+	apiServer := p.Config.Server(p.Logger)
+	// Record the upload outcomes in the audit journal
+	journal, err := p.Config.Journal()
+	if err != nil {
+		p.Logger.Fatal("failed to open audit journal", servicelog.Error(err))
+		return
+	}
+	if journal != nil {
+		audit.SetJournal(journal)
+		defer func() {
+			audit.SetJournal(nil)
+			if err := journal.Close(); err != nil {
+				p.Logger.Error("failed to close audit journal", servicelog.Error(err))
+			}
+		}()
+	}
+	// Trace the uploads, exporting after all the uploads end
+	tracer, err := p.Config.Tracer(p.Logger)
+	if err != nil {
+		p.Logger.Fatal("failed to create tracer", servicelog.Error(err))
+		return
+	}
+	if tracer != nil {
+		tracing.SetTracer(tracer)
+		defer func() {
+			tracing.SetTracer(nil)
+			if err := tracer.Close(); err != nil {
+				p.Logger.Error("failed to close tracer", servicelog.Error(err))
+			}
+		}()
+	}
+	registerHealth(&checks, p.Config, apiServer, site, previews)
+	// Restart requests for the HTTP server
+	restartHTTP := make(chan struct{}, 1)
+	reload.OnChange(func(prev, next Config) {
+		if prev.LogLevel != next.LogLevel {
+			if err := servicelog.SetLevel(next.LogLevel); err != nil {
+				p.Logger.Error("failed to set log level", servicelog.Error(err))
+			}
+		}
+		if prev.ApiConcurrency != next.ApiConcurrency {
+			apiServer.SetConcurrency(next.ApiConcurrency)
+		}
+		if prev.ApiUsername != next.ApiUsername || prev.ApiKey != next.ApiKey {
+			apiServer.SetCredentials(next.ApiUsername, next.ApiKey)
+		}
+		if !reflect.DeepEqual(prev.Scheduler(), next.Scheduler()) {
+			apiServer.SetScheduler(next.Scheduler())
+		}
+		if componentChanged(prev, next, componentPreview) {
+			previews.replace(newPreview(p.Logger, next, site))
+			p.Logger.Info("preview restarted")
+		}
+		if componentChanged(prev, next, componentHTTP) {
+			select {
+			case restartHTTP <- struct{}{}:
+			default:
+			}
+		}
+	})
+	srv, err := newHTTPServer(p.Logger, p.Config, mux, apiServer)
+	if err != nil {
+		p.Logger.Fatal("failed to build http server", servicelog.Error(err))
+		return
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Launch the HTTP server, and restart it when its settings change.
+	// If the new settings fail, the current server keeps running.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serving := serveHTTP(p.Logger, p.Config, srv)
+		for {
+			select {
+			case <-ctx.Done():
+				srv.Close()
+				<-serving
+				return
+			case <-restartHTTP:
+			}
+			config := reload.Current()
+			next, err := newHTTPServer(p.Logger, config, mux, apiServer)
+			if err != nil {
+				p.Logger.Error("failed to rebuild http server, keeping current one", servicelog.Error(err))
+				continue
+			}
+			p.Logger.Info("restarting http server")
+			shutdownCtx, cancel := context.WithTimeout(ctx, httpShutdownTimeout)
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				srv.Close()
+			}
+			cancel()
+			<-serving
+			srv = next
+			serving = serveHTTP(p.Logger, config, srv)
+		}
+	}()
+	// Reload the config file when it changes
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := reload.Watch(ctx); err != nil {
+			p.Logger.Error("failed to watch config file", servicelog.Error(err))
+		}
+	}()
+	// launch the folder watcher
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchMedia(ctx, p.Logger, p.Config, apiServer, site, previews)
+	}()
+}
+
+// newHTTPServer builds the local HTTP server with the given config
+func newHTTPServer(logger servicelog.Logger, config Config, mux http.Handler, apiServer *backend.Server) (*http.Server, error) {
+	authenticator, err := httpauth.New(logger, config.AuthPolicies(), apiServer.Login, time.Duration(config.AuthCacheMinutes)*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build auth policies: %w", err)
+	}
+	if config.TLSSelfSigned {
+		generated, err := tlscert.Ensure(config.TLSCertFile, config.TLSKeyFile, tlscert.LocalHosts())
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		}
+		if generated {
+			logger.Info("generated self-signed certificate", servicelog.String("cert", config.TLSCertFile))
+		}
+	}
+	//Caution with absolute timeouts! mjpeg hander is streaming
+	//We can use them because mpeghandler implements Hijack to fix
+	return &http.Server{
+		Addr:           net.JoinHostPort(config.BindAddress, strconv.Itoa(config.Port)),
+		Handler:        authenticator.Wrap(mux),
+		ReadTimeout:    time.Duration(config.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:   time.Duration(config.WriteTimeoutSeconds) * time.Second,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}, nil
+}
+
+// serveHTTP runs the server in the background, until closed
+func serveHTTP(logger servicelog.Logger, config Config, srv *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		if config.TLS() {
+			err = srv.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("http server failed", servicelog.Error(err))
+		}
+	}()
+	return done
+}
+
+func main() {
+	svcConfig := &service.Config{
+		Name:        "AsiCameraDriver",
+		DisplayName: "ASI Camera image upload driver",
+		Description: "Upload ASI camera images to backend service",
+	}
+
+	var configPath string
+	flag.StringVar(&configPath, "c", "C:\\asicamera\\config.toml", "path to config file")
+	flag.Parse()
+
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		panic(err)
+	}
+
+	// Load config
+	var config Config
+	_, err = toml.DecodeFile(configPath, &config)
+	if err != nil {
+		panic(err)
+	}
+	if err := config.Check(configPath); err != nil {
+		panic(err)
+	}
+
+	prg := &program{
+		Config:     config,
+		ConfigPath: configPath,
+	}
+	s, err := service.New(prg, svcConfig)
+	if err != nil {
+		log.Fatal("new service failed", err)
+	}
+
+	// Setup logging
+	errs := make(chan error, 16)
+	go func() {
+		for {
+			err := <-errs
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+	rootLogger, err := s.Logger(errs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := servicelog.New(rootLogger, config.LogFolder, config.LogFileSizeMb, config.LogFileNumber, config.Debug)
+	if err != nil {
+		panic(err)
+	}
+	prg.Logger = logger
+	defer logger.Sync()
+	if err := servicelog.SetLevel(config.LogLevel); err != nil {
+		panic(err)
+	}
+
+	logger.Info("config", servicelog.Any("config", config.Redacted()))
+
+	// Get SDK version
+	apiVersion, err := camera.ASIGetSDKVersion()
+	if err != nil {
+		logger.Fatal("Failed to get SDK version", servicelog.Error(err))
+		return
+	}
+	logger.Info("ASICamera2 SDK version", servicelog.String("apiVersion", apiVersion))
+
+	// Register startup metrics
+	startTime := time.Now()
+	startMetric.Set(float64(startTime.Unix()))
+	infoMetric.WithLabelValues(
+		startTime.Format(time.RFC3339),
+		apiVersion,
+	).Set(1)
+
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "audit" {
+		if err := auditCommand(config, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "reconcile" {
+		if err := reconcileCommand(logger, config, args[1:]); err != nil {
+			logger.Error("reconcile failed", servicelog.Error(err))
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		err = service.Control(s, args[0])
+		if err != nil {
+			logger.Fatal("service control failed", servicelog.Error(err))
+		}
+		return
+	}
+
+	logger.Info("starting service manager")
+	err = s.Run()
+	if err != nil {
+		logger.Error("run failed", servicelog.Error(err))
+	}
+}
@@ -4,31 +4,77 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/dashboard"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+	"github.com/warpcomdev/asicamera2/internal/driver/reconcile"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
 	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
 )
 
+// mimeTable maps extensions to media types, replaced on config reload
+type mimeTable struct {
+	mutex sync.Mutex
+	types map[string]string
+}
+
+func (m *mimeTable) lookup(ext string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mimeType, ok := m.types[ext]
+	return mimeType, ok
+}
+
+func (m *mimeTable) set(types map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.types = types
+}
+
+// hookRunner holds the pre-upload hooks, replaced on config reload
+type hookRunner struct {
+	mutex  sync.Mutex
+	runner *hooks.Runner
+}
+
+func (h *hookRunner) get() *hooks.Runner {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.runner
+}
+
+func (h *hookRunner) set(runner *hooks.Runner) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.runner = runner
+}
+
 type serverProxy struct {
 	logger          servicelog.Logger
 	server          *backend.Server
 	authChan        chan<- backend.AuthRequest
 	wg              *sync.WaitGroup
-	mimeTypes       map[string]string
+	mimeTypes       *mimeTable
+	hooks           *hookRunner
+	artefacts       *reconcile.Artefacts
 	cameraID        string
 	cameraKeepalive chan struct{}
+	alerts          *dashboard.Alerts
 }
 
 // Upload implements the watcher.Server interface
 func (s serverProxy) Upload(ctx context.Context, path string) error {
 	logger := s.logger
 	ext := normalizeExtension(filepath.Ext(path))
-	mimeType, ok := s.mimeTypes[ext]
+	mimeType, ok := s.mimeTypes.lookup(ext)
 	if !ok {
 		logger.Error("failed to detect media type", servicelog.String("path", path))
 		return errors.New("failed to detect media type")
@@ -38,11 +84,59 @@ func (s serverProxy) Upload(ctx context.Context, path string) error {
 	case s.cameraKeepalive <- struct{}{}:
 	default:
 	}
-	return s.server.Media(ctx, s.authChan, mimeType, path)
+	// Check the file is complete and extract metadata
+	metadata, err := inspect(path, mimeType)
+	if err != nil {
+		return err
+	}
+	// Run the pre-upload hooks, if any. Errors are reported to
+	// the watcher like upload errors, so they raise the same alerts.
+	result, err := s.hooks.get().Process(ctx, path, mimeType)
+	if err != nil {
+		return err
+	}
+	defer result.Cleanup()
+	media, err := reconcile.HookMedia(s.cameraID, result)
+	if err != nil {
+		return err
+	}
+	for i, artefact := range result.Artefacts {
+		options := backend.MediaOptions{ID: media[i].ID}
+		if !artefact.Generated || result.Replaced {
+			options.Metadata = metadata
+		}
+		if result.Replaced {
+			// Keep the timestamp of the original file
+			if info, err := os.Stat(result.Original); err == nil {
+				options.Timestamp = info.ModTime()
+			}
+		}
+		if err := s.server.MediaWith(ctx, s.authChan, artefact.MimeType, artefact.Path, options); err != nil {
+			return err
+		}
+	}
+	// Record what was uploaded for the files processed by hooks,
+	// so the reconciliation compares the backend with the artefacts.
+	if !result.Replaced && len(result.Artefacts) == 1 {
+		media = nil
+	}
+	if err := s.artefacts.Record(path, media); err != nil {
+		logger.Error("failed to record uploaded artefacts", servicelog.String("path", path), servicelog.Error(err))
+	}
+	return nil
 }
 
 // SendAlert implements the watcher.Server interface
 func (s serverProxy) SendAlert(ctx context.Context, id, name, severity, message string) {
+	if s.alerts.Raise(id, name, severity, message) {
+		audit.Log(audit.Record{
+			Event:     audit.AlertRaised,
+			AlertID:   id,
+			AlertName: name,
+			Severity:  severity,
+			Message:   message,
+		})
+	}
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -52,6 +146,9 @@ func (s serverProxy) SendAlert(ctx context.Context, id, name, severity, message
 
 // ClearAlert implements the watcher.Server interface
 func (s serverProxy) ClearAlert(ctx context.Context, id string) {
+	if s.alerts.Clear(id) {
+		audit.Log(audit.Record{Event: audit.AlertCleared, AlertID: id})
+	}
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -73,7 +170,7 @@ func slowEternalBackoff() backoff.BackOff {
 	return bo
 }
 
-func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, server *backend.Server) {
+func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, server *backend.Server, site *siteState, previews *previewSwitch) {
 	authChan := make(chan backend.AuthRequest, 16)
 	defer close(authChan)
 	var wg sync.WaitGroup
@@ -84,25 +181,73 @@ func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, se
 		defer wg.Done()
 		server.WatchAuth(ctx, authChan)
 	}()
+	// Pre-upload hooks, already validated by config.Check
+	runner, err := hooks.New(logger, config.UploadHooks())
+	if err != nil {
+		logger.Fatal("failed to build upload hooks", servicelog.Error(err))
+		return
+	}
+	artefacts := loadArtefacts(logger, config)
 	// Proxy to handle to watcher tasks
 	proxy := &serverProxy{
 		logger:          logger,
 		server:          server,
 		authChan:        authChan,
 		wg:              &wg,
-		mimeTypes:       config.MimeTypes,
+		mimeTypes:       &mimeTable{types: config.MimeTypes},
+		hooks:           &hookRunner{runner: runner},
+		artefacts:       artefacts,
 		cameraID:        config.CameraID,
 		cameraKeepalive: make(chan struct{}, 1),
+		alerts:          site.alerts,
 	}
+	// Restart requests for the folder watcher and the reconciliation
+	restartWatcher := make(chan struct{}, 1)
+	restartReconcile := make(chan struct{}, 1)
+	// Apply the settings that can change without restarting,
+	// and restart the components whose settings changed
+	site.config.OnChange(func(prev, next Config) {
+		if !reflect.DeepEqual(prev.MimeTypes, next.MimeTypes) {
+			proxy.mimeTypes.set(next.MimeTypes)
+		}
+		settings := next.WatchSettings()
+		for _, w := range site.registry.List() {
+			if watch, ok := w.(*watcher.FileWatch); ok {
+				watch.Update(settings)
+			}
+		}
+		if componentChanged(prev, next, componentHooks) {
+			runner, err := hooks.New(logger, next.UploadHooks())
+			if err != nil {
+				logger.Error("failed to rebuild upload hooks, keeping current ones", servicelog.Error(err))
+			} else {
+				proxy.hooks.set(runner)
+				logger.Info("upload hooks restarted")
+			}
+		}
+		if componentChanged(prev, next, componentWatcher) {
+			select {
+			case restartWatcher <- struct{}{}:
+			default:
+			}
+		} else if componentChanged(prev, next, componentReconcile) {
+			select {
+			case restartReconcile <- struct{}{}:
+			default:
+			}
+		}
+	})
+	// Alert on preview faults, until the watcher stops
+	alertPreview(ctx, config, proxy, previews)
+	defer previews.SetFaultHandler(nil)
 	// start USB monitor
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		monitorUSB(ctx, logger, config, proxy)
+		monitorUSB(ctx, logger, config, proxy, site)
 	}()
 	// start folder watcher
 	folderChan := make(chan string, 16)
-	defer close(folderChan)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -135,36 +280,75 @@ func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, se
 		}
 	}()
 	// Each time the update folder changes, create a new watcher
-	var cancelPrevWatcher func()
-	defer func() {
-		if cancelPrevWatcher != nil {
-			cancelPrevWatcher()
+	var (
+		folder          string
+		watcherCtx      context.Context
+		cancelWatcher   func()
+		cancelReconcile func()
+	)
+	// Periodically reconcile the folder with the backend,
+	// until the watcher or the reconciliation restarts
+	startReconcile := func(logger servicelog.Logger, config Config, watch *watcher.FileWatch) {
+		if cancelReconcile != nil {
+			cancelReconcile()
+			cancelReconcile = nil
 		}
-	}()
-	for folderUpdate := range folderChan {
-		if cancelPrevWatcher != nil {
-			cancelPrevWatcher()
-			cancelPrevWatcher = nil
+		if config.ReconcileIntervalHours <= 0 {
+			return
+		}
+		reconcileCtx, reconcileCancel := context.WithCancel(watcherCtx)
+		cancelReconcile = reconcileCancel
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scheduleReconcile(reconcileCtx, logger, config, server, authChan, watch, artefacts)
+		}()
+	}
+	var (
+		folderLogger servicelog.Logger
+		currentWatch *watcher.FileWatch
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			if cancelWatcher != nil {
+				cancelWatcher()
+			}
+			return
+		case folderUpdate := <-folderChan:
+			folder = folderUpdate
+		case <-restartWatcher:
+			if folder == "" {
+				continue
+			}
+			logger.Info("restarting folder watcher", servicelog.String("folder", folder))
+		case <-restartReconcile:
+			if currentWatch != nil {
+				logger.Info("restarting reconciliation", servicelog.String("folder", folder))
+				startReconcile(folderLogger, site.config.Current(), currentWatch)
+			}
+			continue
+		}
+		if cancelWatcher != nil {
+			cancelWatcher()
+			cancelWatcher = nil
 		}
-		logger = logger.With(servicelog.String("folder", folderUpdate))
+		current := site.config.Current()
+		folderLogger = logger.With(servicelog.String("folder", folder))
 		// Keep trying to watch until the folder name changes
-		watch := watcher.New(logger,
-			config.HistoryFolder,
-			proxy,
-			folderUpdate,
-			config.FileTypes(),
-			time.Duration(config.MonitorForMinutes)*time.Minute,
-			time.Duration(config.ExpireAfterDays)*time.Hour*24,
-			config.DenyList,
-		)
-		watcherCtx, watcherCancel := context.WithCancel(ctx)
-		cancelPrevWatcher = watcherCancel
+		watch := newFolderWatch(folderLogger, current, proxy, folder)
+		currentWatch = watch
+		watcherCtx, cancelWatcher = context.WithCancel(ctx)
+		// Expose the watcher in the admin API while it is active
+		site.registry.Add(watch)
+		startReconcile(folderLogger, current, watch)
 		wg.Add(1)
 		// Do the folder watching in a separate goroutine, because
 		// the process runs for as long as the context is not interrupted,
 		// but we still must react if some new folder name arrives.
-		go func(folderUpdate string) {
+		go func(logger servicelog.Logger, watcherCtx context.Context) {
 			defer wg.Done()
+			defer site.registry.Remove(watch)
 			alertName := "watch_folder"
 			alertTime := time.Now()
 			alertID := fmt.Sprintf("%s_%s_%s", config.CameraID, alertName, alertTime.Format(time.RFC3339))
@@ -174,6 +358,7 @@ func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, se
 				defer func() {
 					if returnError != nil {
 						logger.Error("folder watcher failed", servicelog.Error(returnError))
+						site.watchState(returnError)
 						returnError = backend.PermanentIfCancel(watcherCtx, returnError)
 					}
 				}()
@@ -196,6 +381,7 @@ func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, se
 					case <-time.After(30 * time.Second):
 						// the watcher has been running for 30 seconds,
 						// I think it's ok to clear the alert
+						site.watchState(nil)
 						if alertTriggered {
 							proxy.ClearAlert(ctx, alertID)
 						}
@@ -222,6 +408,6 @@ func watchMedia(ctx context.Context, logger servicelog.Logger, config Config, se
 				}
 				return err
 			}, backoff.WithContext(bo, watcherCtx))
-		}(folderUpdate)
+		}(folderLogger, watcherCtx)
 	}
 }
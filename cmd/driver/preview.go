@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/camera"
+	"github.com/warpcomdev/asicamera2/internal/driver/dirsource"
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/overlay"
+	"github.com/warpcomdev/asicamera2/internal/driver/preview"
+	"github.com/warpcomdev/asicamera2/internal/driver/sersource"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Sources of the preview streams
+const (
+	previewSourceJpeg = "jpeg" // newest jpeg or FITS file, repeated
+	previewSourceSER  = "ser"  // newest SER video, in a loop
+)
+
+// Quality of the frames of SER videos, before the renditions
+const serQuality = 90
+
+// newPreview builds the live preview streams. The source of each stream is
+// the newest jpeg or FITS file or SER video in the folder, or in the capture folder
+// if not set.
+func newPreview(logger servicelog.Logger, config Config, site *siteState) *preview.Server {
+	server := preview.New(logger, config.PreviewOptions())
+	for _, stream := range config.Preview {
+		stream := stream
+		// Empty pattern means no subfolders, only the folder itself
+		pattern := stream.FolderPattern
+		if pattern == "" {
+			pattern = "^$"
+		}
+		match := regexp.MustCompile(pattern) // already validated by config.Check
+		added := server.Add(stream.Camera, func(logger servicelog.Logger) (jpeg.ResumableSource, error) {
+			folder := stream.Folder
+			if folder == "" {
+				watchers := site.registry.List()
+				if len(watchers) == 0 {
+					return nil, errors.New("capture folder not known yet")
+				}
+				folder = watchers[0].Folder()
+			}
+			logger.Info("starting preview source", servicelog.String("folder", folder))
+			if stream.Source == previewSourceSER {
+				bayer := site.cameraBayer
+				if stream.Bayer != "" {
+					pattern, _ := jpeg.ParseBayerPattern(stream.Bayer) // already validated by config.Check
+					bayer = func() (jpeg.BayerPattern, bool) { return pattern, true }
+				}
+				return newSERSource(logger, folder, match, config.PreviewFramesPerSecond, bayer, site.cameraSettings)
+			}
+			source, err := dirsource.New(logger, folder, match, config.PreviewFramesPerSecond)
+			if err != nil {
+				return nil, err
+			}
+			source.SetCameraSettings(site.cameraSettings)
+			return source, nil
+		})
+		added.SetStretch(stream.Stretch.Stretch())
+		if stream.Overlay.Enabled() {
+			o, err := overlay.New(stream.Overlay.Options())
+			if err != nil {
+				logger.Error("preview overlay disabled", servicelog.String("camera", stream.Camera), servicelog.Error(err))
+			} else {
+				added.SetOverlay(o)
+			}
+		}
+	}
+	return server
+}
+
+// previewSwitch holds the preview server in use, replaced
+// when the preview settings change on config reload
+type previewSwitch struct {
+	mutex  sync.Mutex
+	server *preview.Server
+	faults preview.FaultHandler
+}
+
+func newPreviewSwitch(server *preview.Server) *previewSwitch {
+	return &previewSwitch{server: server}
+}
+
+func (p *previewSwitch) current() *preview.Server {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.server
+}
+
+// Handler serves the requests with the current preview server
+func (p *previewSwitch) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.current().Handler().ServeHTTP(w, r)
+	})
+}
+
+// Check the pipelines of the current preview server
+func (p *previewSwitch) Check() ([]string, error) {
+	return p.current().Check()
+}
+
+// SetFaultHandler sets the fault handler of the current
+// preview server, and of the servers that replace it
+func (p *previewSwitch) SetFaultHandler(handler preview.FaultHandler) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.faults = handler
+	p.server.SetFaultHandler(handler)
+}
+
+// replace the preview server, and close the previous one.
+// Viewers of the previous server are disconnected.
+func (p *previewSwitch) replace(server *preview.Server) {
+	p.mutex.Lock()
+	prev := p.server
+	p.server = server
+	server.SetFaultHandler(p.faults)
+	p.mutex.Unlock()
+	prev.SetFaultHandler(nil)
+	prev.Close()
+}
+
+// Close the current preview server
+func (p *previewSwitch) Close() {
+	p.current().Close()
+}
+
+// newSERSource replays the newest SER video in the folder, chosen
+// again every time the stream starts. MONO videos are demosaiced
+// with the bayer pattern, if known. Videos without sidecar settings
+// take the exposure and gain of the camera.
+func newSERSource(logger servicelog.Logger, folder string, match dirsource.Matcher, fps int, bayer func() (jpeg.BayerPattern, bool), settings jpeg.CameraSettings) (jpeg.ResumableSource, error) {
+	newest := func() (string, error) {
+		path, err := dirsource.NewestFile(logger, folder, match, []string{".ser"})
+		if err == nil && path == "" {
+			err = errors.New("no SER video in the folder")
+		}
+		return path, err
+	}
+	factory := jpeg.FrameCompressor{Subsampling: jpeg.TJSAMP_420, Quality: serQuality}
+	source := sersource.NewNewest(folder, newest, fps, factory)
+	source.SetMonoBayer(bayer)
+	source.SetCameraSettings(settings)
+	return source, nil
+}
+
+// Bayer patterns of the color cameras, from ASI_CAMERA_INFO
+var cameraBayerPatterns = map[camera.ASI_BAYER_PATTERN]jpeg.BayerPattern{
+	camera.ASI_BAYER_RG: jpeg.BayerRGGB,
+	camera.ASI_BAYER_BG: jpeg.BayerBGGR,
+	camera.ASI_BAYER_GR: jpeg.BayerGRBG,
+	camera.ASI_BAYER_GB: jpeg.BayerGBRG,
+}
+
+// cameraBayer returns the bayer pattern of the camera being
+// monitored, if it is a color camera
+func (s *siteState) cameraBayer() (jpeg.BayerPattern, bool) {
+	s.cameraMutex.Lock()
+	defer s.cameraMutex.Unlock()
+	if s.camera == nil || s.camera.IsColorCam != camera.ASI_TRUE {
+		return 0, false
+	}
+	pattern, ok := cameraBayerPatterns[s.camera.BayerPattern]
+	return pattern, ok
+}
+
+// cameraSettings returns the exposure and gain last read from the
+// camera being monitored, 0 if unknown
+func (s *siteState) cameraSettings() (time.Duration, int) {
+	s.cameraMutex.Lock()
+	defer s.cameraMutex.Unlock()
+	if s.camera == nil {
+		return 0, 0
+	}
+	values := s.camera.Snapshot().Values
+	// ASI_EXPOSURE is in microseconds
+	return time.Duration(values[camera.ASI_EXPOSURE.String()]) * time.Microsecond, values[camera.ASI_GAIN.String()]
+}
+
+// alertPreview raises an alert when a preview stream faults,
+// and clears it once the stream has been recycled
+func alertPreview(ctx context.Context, config Config, proxy *serverProxy, previews *previewSwitch) {
+	alertName := "preview_stuck"
+	var mutex sync.Mutex
+	alertIDs := make(map[string]string) // by preview camera
+	previews.SetFaultHandler(func(fault jpeg.Fault, recovered bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if recovered {
+			if alertID, ok := alertIDs[fault.Camera]; ok {
+				delete(alertIDs, fault.Camera)
+				proxy.ClearAlert(ctx, alertID)
+			}
+			return
+		}
+		alertID, ok := alertIDs[fault.Camera]
+		if !ok {
+			alertID = fmt.Sprintf("%s_%s_%s_%s", config.CameraID, alertName, fault.Camera, time.Now().Format(time.RFC3339))
+			alertIDs[fault.Camera] = alertID
+		}
+		proxy.SendAlert(ctx, alertID, alertName, "error", fmt.Sprintf("preview %s: %s", fault.Camera, fault.Error()))
+	})
+}
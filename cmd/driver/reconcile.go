@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+	"github.com/warpcomdev/asicamera2/internal/driver/reconcile"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+// newFolderWatch builds a FileWatch for the folder with the settings in config
+func newFolderWatch(logger servicelog.Logger, config Config, proxy watcher.Server, folder string) *watcher.FileWatch {
+	return watcher.New(logger,
+		config.HistoryFolder,
+		proxy,
+		folder,
+		config.FileTypes(),
+		time.Duration(config.MonitorForMinutes)*time.Minute,
+		time.Duration(config.ExpireAfterDays)*time.Hour*24,
+		config.DenyList,
+		config.WatchConfig(folder),
+	)
+}
+
+// loadArtefacts reads the media uploaded for the files processed by hooks.
+// If the file cannot be read, artefacts are not recorded nor reconciled.
+func loadArtefacts(logger servicelog.Logger, config Config) *reconcile.Artefacts {
+	path := filepath.Join(config.HistoryFolder, "artefacts.json")
+	artefacts, err := reconcile.LoadArtefacts(path)
+	if err != nil {
+		logger.Error("failed to load artefacts", servicelog.String("path", path), servicelog.Error(err))
+		return nil
+	}
+	return artefacts
+}
+
+// reconcileFolder compares the files in the folder with the media in the backend
+func reconcileFolder(ctx context.Context, config Config, server *backend.Server, authChan chan<- backend.AuthRequest, watch *watcher.FileWatch, artefacts *reconcile.Artefacts) (reconcile.Report, error) {
+	local, err := watch.Inventory()
+	if err != nil {
+		return reconcile.Report{}, err
+	}
+	remote, err := server.ListMedia(ctx, authChan)
+	if err != nil {
+		return reconcile.Report{}, err
+	}
+	grace := time.Duration(config.MonitorForMinutes) * time.Minute
+	return reconcile.Diff(config.CameraID, local, remote, grace, artefacts), nil
+}
+
+// scheduleReconcile runs a reconciliation periodically, until cancelled
+func scheduleReconcile(ctx context.Context, logger servicelog.Logger, config Config, server *backend.Server, authChan chan<- backend.AuthRequest, watch *watcher.FileWatch, artefacts *reconcile.Artefacts) {
+	interval := time.Duration(config.ReconcileIntervalHours) * time.Hour
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(interval)
+		}
+		logger.Info("starting reconciliation")
+		report, err := reconcileFolder(ctx, config, server, authChan, watch, artefacts)
+		if err != nil {
+			logger.Error("reconciliation failed", servicelog.Error(err))
+			continue
+		}
+		logger.Info("reconciliation complete",
+			servicelog.Int("local", report.Local),
+			servicelog.Int("remote", report.Remote),
+			servicelog.Int("pending", report.Pending),
+			servicelog.Int("rotated", report.Rotated),
+			servicelog.Int("missing", len(report.Missing)),
+			servicelog.Int("extra", len(report.Extra)),
+			servicelog.Int("sizeMismatch", len(report.SizeMismatch)),
+		)
+		if config.ReconcileRequeue {
+			if paths := report.Requeue(); len(paths) > 0 {
+				if err := watch.Requeue(ctx, paths); err != nil {
+					logger.Error("failed to requeue files", servicelog.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// printReport in human readable format
+func printReport(w io.Writer, report reconcile.Report) {
+	fmt.Fprintf(w, "camera %s: %d local files, %d backend media, %d pending, %d rotated\n", report.Camera, report.Local, report.Remote, report.Pending, report.Rotated)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "KIND\tID\tLOCAL SIZE\tREMOTE SIZE\tUPLOADED\tPATH")
+	uploaded := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, item := range report.Missing {
+		fmt.Fprintf(tw, "missing\t%s\t%d\t-\t%s\t%s\n", item.ID, item.LocalSize, uploaded(item.Uploaded), item.Path)
+	}
+	for _, item := range report.SizeMismatch {
+		fmt.Fprintf(tw, "size\t%s\t%d\t%d\t%s\t%s\n", item.ID, item.LocalSize, item.RemoteSize, uploaded(item.Uploaded), item.Path)
+	}
+	for _, item := range report.Extra {
+		fmt.Fprintf(tw, "extra\t%s\t-\t%d\t-\t-\n", item.ID, item.RemoteSize)
+	}
+}
+
+// reconcileCommand implements the `reconcile` subcommand
+func reconcileCommand(logger servicelog.Logger, config Config, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	folder := flags.String("folder", "", "local folder to reconcile (default: folder configured in the backend)")
+	requeue := flags.Bool("requeue", false, "upload again the missing and size-mismatched files")
+	asJSON := flags.Bool("json", false, "print the report in JSON format")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	server := config.Server(logger)
+	authChan := make(chan backend.AuthRequest, 16)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(authChan)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.WatchAuth(ctx, authChan)
+	}()
+	if *folder == "" {
+		var err error
+		if *folder, err = server.Folder(ctx, authChan); err != nil {
+			return fmt.Errorf("failed to get camera folder: %w", err)
+		}
+	}
+	logger = logger.With(servicelog.String("folder", *folder))
+	watch := newFolderWatch(logger, config, nil, *folder)
+	artefacts := loadArtefacts(logger, config)
+	report, err := reconcileFolder(ctx, config, server, authChan, watch, artefacts)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printReport(os.Stdout, report)
+	}
+	if !*requeue {
+		return nil
+	}
+	// Upload through the hooks, like the watcher does, with
+	// as much concurrency as the scheduler allows
+	runner, err := hooks.New(logger, config.UploadHooks())
+	if err != nil {
+		return err
+	}
+	proxy := serverProxy{
+		logger:    logger,
+		server:    server,
+		authChan:  authChan,
+		mimeTypes: &mimeTable{types: config.MimeTypes},
+		hooks:     &hookRunner{runner: runner},
+		artefacts: artefacts,
+		cameraID:  config.CameraID,
+	}
+	var (
+		uploads sync.WaitGroup
+		mutex   sync.Mutex
+		failed  int
+	)
+	for _, path := range report.Requeue() {
+		if _, ok := config.MimeTypes[normalizeExtension(filepath.Ext(path))]; !ok {
+			continue
+		}
+		uploads.Add(1)
+		go func(path string) {
+			defer uploads.Done()
+			err := proxy.Upload(ctx, path)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failed += 1
+				fmt.Fprintf(os.Stderr, "failed to upload %s: %v\n", path, err)
+				return
+			}
+			fmt.Fprintf(os.Stdout, "uploaded %s\n", path)
+		}(path)
+	}
+	uploads.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d uploads failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Time to wait for the config file to settle before reloading it
+const reloadDebounce = 2 * time.Second
+
+// Settings that are applied to the running components.
+// Any other change is logged, and applied on next restart.
+var liveSettings = map[string]bool{
+	"LogLevel":            true,
+	"DenyList":            true,
+	"MimeTypes":           true,
+	"MonitorForMinutes":   true,
+	"ExpireAfterDays":     true,
+	"ApiConcurrency":      true,
+	"ApiUsername":         true,
+	"ApiKey":              true,
+	"UploadPolicy":        true,
+	"UploadClasses":       true,
+	"UploadReservedSlots": true,
+	"UploadSmallFileKb":   true,
+}
+
+// Components restarted when their settings change
+const (
+	componentWatcher   = "watcher"
+	componentReconcile = "reconcile"
+	componentHooks     = "hooks"
+	componentPreview   = "preview"
+	componentHTTP      = "http"
+)
+
+// Settings applied by restarting the component that uses them.
+// The other components keep running.
+var componentSettings = map[string]string{
+	"WatchMode":              componentWatcher,
+	"WatchModes":             componentWatcher,
+	"PollIntervalSeconds":    componentWatcher,
+	"ReconcileIntervalHours": componentReconcile,
+	"ReconcileRequeue":       componentReconcile,
+	"Hooks":                  componentHooks,
+	"DisableFitsPreview":     componentHooks,
+	"Preview":                componentPreview,
+	"PreviewFramesPerSecond": componentPreview,
+	"PreviewThreads":         componentPreview,
+	"PreviewRawPool":         componentPreview,
+	"PreviewJpegPool":        componentPreview,
+	"PreviewImageKb":         componentPreview,
+	"PreviewRenditions":      componentPreview,
+	"PreviewStatsSeconds":    componentPreview,
+	"PreviewPanicOnStuck":    componentPreview,
+	"BindAddress":            componentHTTP,
+	"Port":                   componentHTTP,
+	"ReadTimeoutSeconds":     componentHTTP,
+	"WriteTimeoutSeconds":    componentHTTP,
+	"MaxHeaderBytes":         componentHTTP,
+	"TLSCertFile":            componentHTTP,
+	"TLSKeyFile":             componentHTTP,
+	"TLSSelfSigned":          componentHTTP,
+	"Auth":                   componentHTTP,
+	"AuthCacheMinutes":       componentHTTP,
+}
+
+var reloadMetric = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "asicamera_config_reload",
+		Help: "Configuration reloads",
+	},
+	[]string{
+		"result",
+	},
+)
+
+// ReloadResult lists the settings changed by a reload
+type ReloadResult struct {
+	Applied   []string `json:"applied"`
+	Restarted []string `json:"restarted"` // components restarted to apply them
+	Restart   []string `json:"restart"`   // changed, but require a restart
+}
+
+// reloader keeps the configuration in use, and applies the
+// changes in the config file to the running components
+type reloader struct {
+	logger       servicelog.Logger
+	path         string
+	reloadMutex  sync.Mutex // serializes reloads
+	currentMutex sync.Mutex
+	current      Config
+	appliers     []func(prev, next Config)
+}
+
+func newReloader(logger servicelog.Logger, path string, config Config) *reloader {
+	return &reloader{
+		logger:  logger,
+		path:    filepath.Clean(path),
+		current: config,
+	}
+}
+
+// Current returns the configuration in use
+func (r *reloader) Current() Config {
+	r.currentMutex.Lock()
+	defer r.currentMutex.Unlock()
+	return r.current
+}
+
+// OnChange registers a function to apply the live settings, and
+// restart the components whose settings changed. It is called after
+// every reload that changes any of them, once Current returns next.
+func (r *reloader) OnChange(apply func(prev, next Config)) {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	r.appliers = append(r.appliers, apply)
+}
+
+// Reload reads and checks the config file. If it is valid,
+// applies the live settings. Otherwise keeps the current config.
+func (r *reloader) Reload() (ReloadResult, error) {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	var next Config
+	if _, err := toml.DecodeFile(r.path, &next); err != nil {
+		reloadMetric.WithLabelValues("error").Inc()
+		return ReloadResult{}, err
+	}
+	if err := next.Check(r.path); err != nil {
+		reloadMetric.WithLabelValues("error").Inc()
+		return ReloadResult{}, err
+	}
+	prev := r.Current()
+	result := ReloadResult{Applied: []string{}, Restarted: []string{}, Restart: []string{}}
+	// Only copy the settings that can be applied, so the current
+	// config keeps matching the service that must be restarted.
+	applied := prev
+	appliedValue := reflect.ValueOf(&applied).Elem()
+	nextValue := reflect.ValueOf(next)
+	restarted := make(map[string]bool)
+	for _, name := range changedSettings(prev, next) {
+		component, restartable := componentSettings[name]
+		if !liveSettings[name] && !restartable {
+			result.Restart = append(result.Restart, name)
+			continue
+		}
+		if restartable {
+			restarted[component] = true
+		}
+		result.Applied = append(result.Applied, name)
+		appliedValue.FieldByName(name).Set(nextValue.FieldByName(name))
+	}
+	for component := range restarted {
+		result.Restarted = append(result.Restarted, component)
+	}
+	sort.Strings(result.Restarted)
+	if len(result.Restart) > 0 {
+		r.logger.Warn("config changes require a restart", servicelog.Any("settings", result.Restart))
+	}
+	if len(result.Applied) > 0 {
+		// Update the current config first, so the
+		// restarted components build from the new one.
+		r.currentMutex.Lock()
+		r.current = applied
+		r.currentMutex.Unlock()
+		for _, apply := range r.appliers {
+			apply(prev, applied)
+		}
+		r.logger.Info("config reloaded", servicelog.Any("settings", result.Applied), servicelog.Any("restarted", result.Restarted))
+	}
+	reloadMetric.WithLabelValues("ok").Inc()
+	return result, nil
+}
+
+// Watch the config file and reload it when it changes
+func (r *reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// Watch the folder, editors usually replace the file
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		return err
+	}
+	timer := time.NewTimer(reloadDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != r.path {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			timer.Reset(reloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.logger.Error("config watcher failed", servicelog.Error(err))
+		case <-timer.C:
+			if _, err := r.Reload(); err != nil {
+				r.logger.Error("config reload rejected, keeping current config", servicelog.Error(err))
+			}
+		}
+	}
+}
+
+// changedSettings returns the names of the fields that differ
+func changedSettings(prev, next Config) []string {
+	prevValue := reflect.ValueOf(prev)
+	nextValue := reflect.ValueOf(next)
+	changed := make([]string, 0, 8)
+	for i := 0; i < prevValue.NumField(); i++ {
+		if !reflect.DeepEqual(prevValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			changed = append(changed, prevValue.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// componentChanged is true if any setting of the component differs
+func componentChanged(prev, next Config, component string) bool {
+	prevValue := reflect.ValueOf(prev)
+	nextValue := reflect.ValueOf(next)
+	for name, owner := range componentSettings {
+		if owner != component {
+			continue
+		}
+		if !reflect.DeepEqual(prevValue.FieldByName(name).Interface(), nextValue.FieldByName(name).Interface()) {
+			return true
+		}
+	}
+	return false
+}
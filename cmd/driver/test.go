@@ -70,7 +70,7 @@ func test() {
 		// 	Quality:     95,
 		// 	Flags:       0,
 		// })
-		commonSource, err := dirsource.New(logger, os.Args[1], regexp.MustCompile(`\d{4}-\d{2}-\d{2}`))
+		commonSource, err := dirsource.New(logger, os.Args[1], regexp.MustCompile(`\d{4}-\d{2}-\d{2}`), frames_per_second)
 		if err != nil {
 			log.Fatal(err)
 		}
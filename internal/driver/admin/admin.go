@@ -0,0 +1,448 @@
+// Package admin exposes a local REST API to inspect and manage
+// the folder watchers: pending tasks, upload results and history.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+// Prefix of the API paths
+const Prefix = "/api/v1/"
+
+// Maximum time allowed for an operation on the watcher
+const execTimeout = 10 * time.Second
+
+// Watcher is the subset of watcher.FileWatch used by the API
+type Watcher interface {
+	Folder() string
+	Tasks() []watcher.TaskStatus
+	Results() []watcher.UploadResult
+	Failures() []watcher.UploadResult
+	History(ctx context.Context) ([]watcher.HistoryEntry, error)
+	ForceUpload(ctx context.Context, path string) error
+	RetryFailed(ctx context.Context) ([]string, error)
+	Forget(ctx context.Context, path string) error
+	Rescan() bool
+}
+
+// Registry of active watchers
+type Registry struct {
+	mutex    sync.Mutex
+	watchers map[string]Watcher
+	reload   func() (interface{}, error)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{watchers: make(map[string]Watcher)}
+}
+
+// Add a watcher to the registry, replacing any other for the same folder
+func (r *Registry) Add(w Watcher) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.watchers[w.Folder()] = w
+}
+
+// Remove the watcher from the registry, if it is still registered
+func (r *Registry) Remove(w Watcher) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if current, ok := r.watchers[w.Folder()]; ok && current == w {
+		delete(r.watchers, w.Folder())
+	}
+}
+
+// OnReload sets the function called to reload the configuration.
+// Errors are reported as an invalid configuration.
+func (r *Registry) OnReload(reload func() (interface{}, error)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reload = reload
+}
+
+// List the registered watchers, sorted by folder
+func (r *Registry) List() []Watcher {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := make([]Watcher, 0, len(r.watchers))
+	for _, w := range r.watchers {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Folder() < list[j].Folder() })
+	return list
+}
+
+// select the watchers matching the folder, or all if folder is empty
+func (r *Registry) selectFolder(folder string) ([]Watcher, error) {
+	if folder == "" {
+		return r.List(), nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	w, ok := r.watchers[folder]
+	if !ok {
+		return nil, errNotFound
+	}
+	return []Watcher{w}, nil
+}
+
+// find the watcher the path belongs to
+func (r *Registry) owner(path string) (Watcher, error) {
+	if path == "" {
+		return nil, errBadRequest
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		best       Watcher
+		bestFolder string
+	)
+	for _, w := range r.List() {
+		folder, err := filepath.Abs(w.Folder())
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(path, folder+string(filepath.Separator)) && len(folder) > len(bestFolder) {
+			best, bestFolder = w, folder
+		}
+	}
+	if best == nil {
+		return nil, errNotFound
+	}
+	return best, nil
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+// Error implements error
+func (e apiError) Error() string {
+	return e.message
+}
+
+var (
+	errNotFound   = apiError{status: http.StatusNotFound, message: "folder not found"}
+	errBadRequest = apiError{status: http.StatusBadRequest, message: "bad request"}
+)
+
+// Folder summary
+type Folder struct {
+	Folder   string `json:"folder"`
+	Tasks    int    `json:"tasks"`
+	Failures int    `json:"failures"`
+}
+
+// History entry including the folder
+type HistoryEntry struct {
+	Folder string `json:"folder"`
+	watcher.HistoryEntry
+}
+
+// Result entry including the folder
+type Result struct {
+	Folder string `json:"folder"`
+	watcher.UploadResult
+}
+
+// Task entry including the folder
+type Task struct {
+	Folder string `json:"folder"`
+	watcher.TaskStatus
+}
+
+type pathRequest struct {
+	Path string `json:"path"`
+}
+
+type folderRequest struct {
+	Folder string `json:"folder"`
+}
+
+type endpoint struct {
+	method  string
+	handler func(r *http.Request) (interface{}, error)
+}
+
+// Handler serves the admin API under Prefix
+func Handler(logger servicelog.Logger, registry *Registry) http.Handler {
+	routes := map[string]endpoint{
+		"folders": {http.MethodGet, registry.folders},
+		"tasks":   {http.MethodGet, registry.tasks},
+		"results": {http.MethodGet, registry.results},
+		"history": {http.MethodGet, registry.history},
+		"upload":  {http.MethodPost, registry.upload},
+		"retry":   {http.MethodPost, registry.retry},
+		"forget":  {http.MethodPost, registry.forget},
+		"rescan":  {http.MethodPost, registry.rescan},
+		"reload":  {http.MethodPost, registry.reloadConfig},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := routes[strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/")]
+		if !ok {
+			writeError(w, apiError{status: http.StatusNotFound, message: "not found"})
+			return
+		}
+		if r.Method != route.method {
+			w.Header().Set("Allow", route.method)
+			writeError(w, apiError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+			return
+		}
+		result, err := route.handler(r)
+		if err != nil {
+			if r.Method != http.MethodGet {
+				logger.Error("admin request failed", servicelog.String("path", r.URL.Path), servicelog.Error(err))
+			}
+			writeError(w, err)
+			return
+		}
+		if r.Method != http.MethodGet {
+			logger.Info("admin request", servicelog.String("path", r.URL.Path), servicelog.String("remote", r.RemoteAddr))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var apiErr apiError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.status
+	case errors.Is(err, watcher.NotInFolderError):
+		status = http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 64*1024)).Decode(v); err != nil {
+		return apiError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	return nil
+}
+
+func (reg *Registry) folders(r *http.Request) (interface{}, error) {
+	watchers := reg.List()
+	folders := make([]Folder, 0, len(watchers))
+	for _, w := range watchers {
+		folders = append(folders, Folder{
+			Folder:   w.Folder(),
+			Tasks:    len(w.Tasks()),
+			Failures: len(w.Failures()),
+		})
+	}
+	return folders, nil
+}
+
+func (reg *Registry) tasks(r *http.Request) (interface{}, error) {
+	watchers, err := reg.selectFolder(r.URL.Query().Get("folder"))
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]Task, 0, 16)
+	for _, w := range watchers {
+		for _, task := range w.Tasks() {
+			tasks = append(tasks, Task{Folder: w.Folder(), TaskStatus: task})
+		}
+	}
+	return tasks, nil
+}
+
+// results returns the most recent results first. If status=failure,
+// returns the outstanding failures instead.
+func (reg *Registry) results(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	watchers, err := reg.selectFolder(query.Get("folder"))
+	if err != nil {
+		return nil, err
+	}
+	status := watcher.ResultStatus(query.Get("status"))
+	results := make([]Result, 0, 16)
+	for _, w := range watchers {
+		items := w.Results()
+		if status == watcher.ResultFailure {
+			items = w.Failures()
+		}
+		for _, item := range items {
+			if status == "" || item.Status == status {
+				results = append(results, Result{Folder: w.Folder(), UploadResult: item})
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Time.After(results[j].Time) })
+	return results, nil
+}
+
+// history supports the filters:
+//   - q: substring of the path.
+//   - uploaded: true or false.
+//   - since: RFC3339 time, uploaded after.
+//   - limit: maximum number of entries.
+func (reg *Registry) history(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	watchers, err := reg.selectFolder(query.Get("folder"))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		search   = query.Get("q")
+		uploaded *bool
+		since    time.Time
+		limit    int
+	)
+	if v := query.Get("uploaded"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errBadRequest
+		}
+		uploaded = &b
+	}
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errBadRequest
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return nil, errBadRequest
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), execTimeout)
+	defer cancel()
+	entries := make([]HistoryEntry, 0, 64)
+	for _, w := range watchers {
+		history, err := w.History(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range history {
+			if search != "" && !strings.Contains(entry.Path, search) {
+				continue
+			}
+			if uploaded != nil && *uploaded == entry.Uploaded.IsZero() {
+				continue
+			}
+			if !since.IsZero() && !entry.Uploaded.After(since) {
+				continue
+			}
+			entries = append(entries, HistoryEntry{Folder: w.Folder(), HistoryEntry: entry})
+			if limit > 0 && len(entries) >= limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (reg *Registry) upload(r *http.Request) (interface{}, error) {
+	var req pathRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	w, err := reg.owner(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), execTimeout)
+	defer cancel()
+	if err := w.ForceUpload(ctx, req.Path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"folder": w.Folder(), "path": req.Path}, nil
+}
+
+func (reg *Registry) retry(r *http.Request) (interface{}, error) {
+	var req folderRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	watchers, err := reg.selectFolder(req.Folder)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), execTimeout)
+	defer cancel()
+	requeued := make([]string, 0, 16)
+	for _, w := range watchers {
+		paths, err := w.RetryFailed(ctx)
+		if err != nil {
+			return nil, err
+		}
+		requeued = append(requeued, paths...)
+	}
+	return map[string][]string{"requeued": requeued}, nil
+}
+
+func (reg *Registry) forget(r *http.Request) (interface{}, error) {
+	var req pathRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	w, err := reg.owner(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), execTimeout)
+	defer cancel()
+	if err := w.Forget(ctx, req.Path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"folder": w.Folder(), "path": req.Path}, nil
+}
+
+func (reg *Registry) rescan(r *http.Request) (interface{}, error) {
+	var req folderRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+	watchers, err := reg.selectFolder(req.Folder)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(watchers))
+	for _, w := range watchers {
+		if w.Rescan() {
+			folders = append(folders, w.Folder())
+		}
+	}
+	return map[string][]string{"rescanning": folders}, nil
+}
+
+func (reg *Registry) reloadConfig(r *http.Request) (interface{}, error) {
+	reg.mutex.Lock()
+	reload := reg.reload
+	reg.mutex.Unlock()
+	if reload == nil {
+		return nil, apiError{status: http.StatusNotFound, message: "reload not supported"}
+	}
+	result, err := reload()
+	if err != nil {
+		return nil, apiError{status: http.StatusUnprocessableEntity, message: err.Error()}
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+	"go.uber.org/zap"
+)
+
+type fakeWatcher struct {
+	folder  string
+	history []watcher.HistoryEntry
+	forced  []string
+}
+
+func (f *fakeWatcher) Folder() string                   { return f.folder }
+func (f *fakeWatcher) Tasks() []watcher.TaskStatus      { return nil }
+func (f *fakeWatcher) Results() []watcher.UploadResult  { return nil }
+func (f *fakeWatcher) Failures() []watcher.UploadResult { return nil }
+func (f *fakeWatcher) Rescan() bool                     { return true }
+
+func (f *fakeWatcher) History(ctx context.Context) ([]watcher.HistoryEntry, error) {
+	return f.history, nil
+}
+
+func (f *fakeWatcher) ForceUpload(ctx context.Context, path string) error {
+	f.forced = append(f.forced, path)
+	return nil
+}
+
+func (f *fakeWatcher) RetryFailed(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeWatcher) Forget(ctx context.Context, path string) error {
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	folder := t.TempDir()
+	w := &fakeWatcher{
+		folder: folder,
+		history: []watcher.HistoryEntry{
+			{Path: filepath.Join(folder, "a.jpg"), Uploaded: time.Now()},
+			{Path: filepath.Join(folder, "b.avi")},
+		},
+	}
+	registry := NewRegistry()
+	registry.Add(w)
+	handler := Handler(servicelog.Logger{Logger: zap.NewNop()}, registry)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/api/v1/history?uploaded=false", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history: status %d", rec.Code)
+	}
+	var entries []HistoryEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Base(entries[0].Path) != "b.avi" {
+		t.Errorf("history: unexpected entries %+v", entries)
+	}
+
+	target := filepath.Join(folder, "b.avi")
+	body, _ := json.Marshal(pathRequest{Path: target})
+	if rec := serve(http.MethodPost, "/api/v1/upload", string(body)); rec.Code != http.StatusOK {
+		t.Fatalf("upload: status %d", rec.Code)
+	}
+	if len(w.forced) != 1 || w.forced[0] != target {
+		t.Errorf("upload: forced %v", w.forced)
+	}
+
+	body, _ = json.Marshal(pathRequest{Path: filepath.Join(t.TempDir(), "other.jpg")})
+	if rec := serve(http.MethodPost, "/api/v1/upload", string(body)); rec.Code != http.StatusNotFound {
+		t.Errorf("upload outside folder: status %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/upload", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("upload with GET: status %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/api/v1/tasks?folder=missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown folder: status %d", rec.Code)
+	}
+
+	if rec := serve(http.MethodPost, "/api/v1/reload", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("reload without callback: status %d", rec.Code)
+	}
+	registry.OnReload(func() (interface{}, error) { return nil, errors.New("invalid config") })
+	if rec := serve(http.MethodPost, "/api/v1/reload", ""); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reload with invalid config: status %d", rec.Code)
+	}
+}
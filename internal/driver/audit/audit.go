@@ -0,0 +1,241 @@
+// Package audit keeps an append-only journal of the upload outcomes,
+// one JSON record per line, separate from the service logs.
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var auditErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "asicamera_audit_errors",
+	Help: "Number of audit records that could not be written",
+})
+
+// Event recorded in the journal
+type Event string
+
+const (
+	Detected     Event = "detected"      // file changed, started monitoring
+	Attempt      Event = "attempt"       // upload started
+	Success      Event = "success"       // file uploaded
+	Skipped      Event = "skipped"       // file not modified since last upload
+	Held         Event = "held"          // file not complete yet
+	Failure      Event = "failure"       // upload failed
+	Transferred  Event = "transferred"   // media sent to the backend
+	Expired      Event = "expired"       // file deleted after the retention period
+	AlertRaised  Event = "alert_raised"  // alert activated
+	AlertCleared Event = "alert_cleared" // alert deactivated
+)
+
+// Record of the journal
+type Record struct {
+	Time       time.Time `json:"time"`
+	Event      Event     `json:"event"`
+	Path       string    `json:"path,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Hash       string    `json:"sha256,omitempty"`
+	DurationMs int64     `json:"durationMs,omitempty"`
+	MediaID    string    `json:"mediaId,omitempty"`
+	MimeType   string    `json:"mimeType,omitempty"`
+	AlertID    string    `json:"alertId,omitempty"`
+	AlertName  string    `json:"alertName,omitempty"`
+	Severity   string    `json:"severity,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Journal appends records to a rotated file
+type Journal struct {
+	mutex  sync.Mutex
+	writer *lumberjack.Logger
+}
+
+// Open the journal in path. The file is rotated when it reaches sizeMb.
+// Rotated files are kept up to maxFiles files and maxAgeDays days
+// (0 keeps them forever), and compressed if compress is true.
+func Open(path string, sizeMb, maxFiles, maxAgeDays int, compress bool) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &Journal{
+		writer: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    sizeMb,
+			MaxBackups: maxFiles,
+			MaxAge:     maxAgeDays,
+			Compress:   compress,
+		},
+	}, nil
+}
+
+// Write a record. The time is set if empty.
+func (j *Journal) Write(record Record) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	_, err = j.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Close the journal
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.writer.Close()
+}
+
+var (
+	globalMutex   sync.RWMutex
+	globalJournal *Journal
+)
+
+// SetJournal sets the journal used by Log. nil disables the journal.
+func SetJournal(j *Journal) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	globalJournal = j
+}
+
+// Log writes the record to the journal, if enabled.
+// Errors are counted, but do not stop the uploads.
+func Log(record Record) {
+	globalMutex.RLock()
+	j := globalJournal
+	globalMutex.RUnlock()
+	if j == nil {
+		return
+	}
+	if err := j.Write(record); err != nil {
+		auditErrors.Inc()
+	}
+}
+
+// Filter for Query. Zero values match everything.
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Path   string  // substring of the path
+	Events []Event // any of these events
+}
+
+// Match checks if the record passes the filter
+func (f Filter) Match(record Record) bool {
+	if !f.From.IsZero() && record.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.Time.Before(f.To) {
+		return false
+	}
+	if f.Path != "" && !strings.Contains(record.Path, f.Path) {
+		return false
+	}
+	if len(f.Events) > 0 {
+		for _, event := range f.Events {
+			if record.Event == event {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Format of the timestamp lumberjack adds to the rotated files
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// journalFiles lists the rotated files and the current one, oldest first.
+// Rotated files older than since are skipped.
+func journalFiles(path string, since time.Time) ([]string, error) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(matches)+1)
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(match, ".gz"), ext)
+		stamp = strings.TrimPrefix(stamp, prefix)
+		// The timestamp is the time of rotation, the newest record
+		rotated, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		if !since.IsZero() && rotated.Before(since) {
+			continue
+		}
+		files = append(files, match)
+	}
+	// The timestamp format sorts lexicographically
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// Query calls fn with the records of the journal in path matching
+// the filter, oldest first, including the rotated files.
+func Query(path string, filter Filter, fn func(Record) error) error {
+	files, err := journalFiles(path, filter.From)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := queryFile(file, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryFile(path string, filter Filter, fn func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Skip lines truncated by a crash
+			continue
+		}
+		if filter.Match(record) {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
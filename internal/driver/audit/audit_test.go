@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeBackup(t *testing.T, path string, compress bool, records ...Record) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var encoder *json.Encoder
+	if compress {
+		gz := gzip.NewWriter(file)
+		defer gz.Close()
+		encoder = json.NewEncoder(gz)
+	} else {
+		encoder = json.NewEncoder(file)
+	}
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 12, 0, 0, 0, time.UTC)
+	}
+	// Rotated files, named after the time of rotation
+	writeBackup(t, filepath.Join(dir, "audit-2024-03-02T00-00-00.000.jsonl.gz"), true,
+		Record{Time: day(1), Event: Success, Path: "C:/capture/old.avi"},
+	)
+	writeBackup(t, filepath.Join(dir, "audit-2024-03-04T00-00-00.000.jsonl"), false,
+		Record{Time: day(3), Event: Failure, Path: "C:/capture/a.jpg", Error: "timeout"},
+	)
+	journal, err := Open(path, 1, 10, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []Record{
+		{Time: day(5), Event: Attempt, Path: "C:/capture/a.jpg"},
+		{Time: day(5), Event: Success, Path: "C:/capture/a.jpg", Size: 10},
+		{Time: day(6), Event: AlertRaised, AlertID: "usb"},
+	} {
+		if err := journal.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(filter Filter) []Record {
+		var result []Record
+		if err := Query(path, filter, func(r Record) error {
+			result = append(result, r)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if all := query(Filter{}); len(all) != 5 || all[0].Path != "C:/capture/old.avi" {
+		t.Errorf("expected all records, oldest first, got %+v", all)
+	}
+	if file := query(Filter{Path: "a.jpg"}); len(file) != 3 || file[0].Error != "timeout" {
+		t.Errorf("unexpected records for file: %+v", file)
+	}
+	if ranged := query(Filter{From: day(3), To: day(6)}); len(ranged) != 3 {
+		t.Errorf("unexpected records in range: %+v", ranged)
+	}
+	if events := query(Filter{Events: []Event{Success}}); len(events) != 2 {
+		t.Errorf("unexpected success records: %+v", events)
+	}
+}
@@ -0,0 +1,484 @@
+// Package avi inspects RIFF/AVI containers: it validates that the
+// file is complete, extracts the main video properties, and gives
+// access to the video frames (e.g. the JPEG images of a MJPEG stream).
+package avi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type aviError string
+
+// Error implements error
+func (e aviError) Error() string {
+	return string(e)
+}
+
+const (
+	NotAVIError       = aviError("not an AVI file")
+	TruncatedError    = aviError("truncated AVI file")
+	MissingMoviError  = aviError("AVI file has no movi list")
+	MissingIndexError = aviError("AVI file has no index")
+	NotMJPEGError     = aviError("AVI video stream is not MJPEG")
+	FrameRangeError   = aviError("frame index out of range")
+)
+
+// IsIncomplete returns true if the error means the file is not complete
+// yet (e.g. it is still being written), instead of being invalid.
+func IsIncomplete(err error) bool {
+	return errors.Is(err, TruncatedError) ||
+		errors.Is(err, MissingMoviError) ||
+		errors.Is(err, MissingIndexError)
+}
+
+// Info summarizes the properties of an AVI file
+type Info struct {
+	Width     int
+	Height    int
+	Frames    int     // number of video frames
+	FrameRate float64 // frames per second
+	Duration  time.Duration
+	Codec     string // FourCC of the video stream, e.g. MJPG
+	Streams   int
+	OpenDML   bool // AVI 2.0 file, may span several RIFF chunks
+	Indexed   bool // has idx1 or OpenDML index
+}
+
+// Metadata returns the properties in a format suitable for media metadata
+func (info Info) Metadata() map[string]string {
+	return map[string]string{
+		"codec":     info.Codec,
+		"width":     strconv.Itoa(info.Width),
+		"height":    strconv.Itoa(info.Height),
+		"frames":    strconv.Itoa(info.Frames),
+		"frameRate": strconv.FormatFloat(info.FrameRate, 'f', 3, 64),
+		"duration":  strconv.FormatFloat(info.Duration.Seconds(), 'f', 3, 64),
+	}
+}
+
+// span is a range of bytes in the file
+type span struct {
+	offset int64
+	size   int64
+}
+
+// File is a parsed AVI file
+type File struct {
+	Info
+	r           io.ReaderAt
+	movi        []span // data of every movi list
+	videoStream int    // index of the first video stream, -1 if none
+	frames      []span // video frames, built on demand
+}
+
+// Fields of the headers we use
+type mainHeader struct {
+	microSecPerFrame uint32
+	totalFrames      uint32
+	streams          uint32
+	width            uint32
+	height           uint32
+}
+
+type streamHeader struct {
+	fccType string
+	handler string
+	scale   uint32
+	rate    uint32
+	length  uint32
+}
+
+// parser keeps the state while walking the RIFF tree
+type parser struct {
+	r      io.ReaderAt
+	size   int64
+	main   mainHeader
+	stream int // index of the current strl
+	video  *streamHeader
+	codec  string
+	width  int32
+	height int32
+	odml   uint32 // total frames from the dmlh header
+	idx1   bool
+	indx   bool
+	movi   []span
+	video0 int
+}
+
+func (p *parser) read(offset int64, buf []byte) error {
+	if offset+int64(len(buf)) > p.size {
+		return TruncatedError
+	}
+	if _, err := p.r.ReadAt(buf, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return TruncatedError
+		}
+		return err
+	}
+	return nil
+}
+
+// chunk reads the header of the chunk at the offset. Returns the id,
+// the size of the data, and the offset of the next chunk.
+func (p *parser) chunk(offset, end int64) (id string, size int64, next int64, err error) {
+	var header [8]byte
+	if err := p.read(offset, header[:]); err != nil {
+		return "", 0, 0, err
+	}
+	id = string(header[:4])
+	size = int64(binary.LittleEndian.Uint32(header[4:]))
+	next = offset + 8 + size + (size & 1) // chunks are padded to even size
+	if offset+8+size > end {
+		return "", 0, 0, fmt.Errorf("%w: chunk %q at %d exceeds its container", TruncatedError, id, offset)
+	}
+	if next > end {
+		next = end // missing padding of the last chunk
+	}
+	return id, size, next, nil
+}
+
+// fourCC reads a FourCC at the offset
+func (p *parser) fourCC(offset int64) (string, error) {
+	var buf [4]byte
+	if err := p.read(offset, buf[:]); err != nil {
+		return "", err
+	}
+	return string(buf[:]), nil
+}
+
+// list walks the chunks between start and end
+func (p *parser) list(start, end int64) error {
+	for offset := start; offset+8 <= end; {
+		id, size, next, err := p.chunk(offset, end)
+		if err != nil {
+			return err
+		}
+		data := offset + 8
+		if id == "LIST" {
+			if size < 4 {
+				return fmt.Errorf("%w: empty list at %d", NotAVIError, offset)
+			}
+			listType, err := p.fourCC(data)
+			if err != nil {
+				return err
+			}
+			switch listType {
+			case "movi":
+				p.movi = append(p.movi, span{offset: data + 4, size: size - 4})
+			case "strl":
+				if err := p.list(data+4, data+size); err != nil {
+					return err
+				}
+				p.stream += 1
+			default: // hdrl, odml, INFO...
+				if err := p.list(data+4, data+size); err != nil {
+					return err
+				}
+			}
+		} else if err := p.leaf(id, data, size); err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// leaf parses the chunks we are interested in
+func (p *parser) leaf(id string, data, size int64) error {
+	switch id {
+	case "avih":
+		var buf [40]byte
+		if size < int64(len(buf)) {
+			return fmt.Errorf("%w: short avih", NotAVIError)
+		}
+		if err := p.read(data, buf[:]); err != nil {
+			return err
+		}
+		p.main = mainHeader{
+			microSecPerFrame: binary.LittleEndian.Uint32(buf[0:]),
+			totalFrames:      binary.LittleEndian.Uint32(buf[16:]),
+			streams:          binary.LittleEndian.Uint32(buf[24:]),
+			width:            binary.LittleEndian.Uint32(buf[32:]),
+			height:           binary.LittleEndian.Uint32(buf[36:]),
+		}
+	case "strh":
+		var buf [36]byte
+		if size < int64(len(buf)) {
+			return fmt.Errorf("%w: short strh", NotAVIError)
+		}
+		if err := p.read(data, buf[:]); err != nil {
+			return err
+		}
+		header := streamHeader{
+			fccType: string(buf[0:4]),
+			handler: string(buf[4:8]),
+			scale:   binary.LittleEndian.Uint32(buf[20:]),
+			rate:    binary.LittleEndian.Uint32(buf[24:]),
+			length:  binary.LittleEndian.Uint32(buf[32:]),
+		}
+		if header.fccType == "vids" && p.video == nil {
+			p.video = &header
+			p.video0 = p.stream
+		}
+	case "strf":
+		// BITMAPINFOHEADER of the first video stream
+		if p.video == nil || p.video0 != p.stream || p.codec != "" {
+			return nil
+		}
+		var buf [20]byte
+		if size < int64(len(buf)) {
+			return fmt.Errorf("%w: short strf", NotAVIError)
+		}
+		if err := p.read(data, buf[:]); err != nil {
+			return err
+		}
+		p.width = int32(binary.LittleEndian.Uint32(buf[4:]))
+		p.height = int32(binary.LittleEndian.Uint32(buf[8:]))
+		p.codec = string(buf[16:20])
+	case "indx":
+		// OpenDML super index. Space is reserved when recording starts,
+		// but entries are only in use once the file is complete.
+		var buf [8]byte
+		if size < int64(len(buf)) {
+			return nil
+		}
+		if err := p.read(data, buf[:]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(buf[4:]) > 0 {
+			p.indx = true
+		}
+	case "dmlh":
+		var buf [4]byte
+		if size < int64(len(buf)) {
+			return nil
+		}
+		if err := p.read(data, buf[:]); err != nil {
+			return err
+		}
+		p.odml = binary.LittleEndian.Uint32(buf[:])
+	case "idx1":
+		p.idx1 = size > 0
+	}
+	return nil
+}
+
+// Open parses the AVI file. It returns an error for which IsIncomplete
+// is true if the file is truncated or not finalized yet.
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	p := &parser{r: r, size: size, video0: -1}
+	openDML := false
+	for offset := int64(0); offset < size; {
+		var header [12]byte
+		if err := p.read(offset, header[:]); err != nil {
+			if offset == 0 {
+				return nil, NotAVIError
+			}
+			// Trailing garbage after a complete RIFF
+			break
+		}
+		if string(header[:4]) != "RIFF" {
+			if offset == 0 {
+				return nil, NotAVIError
+			}
+			break
+		}
+		form := string(header[8:12])
+		switch {
+		case offset == 0 && form != "AVI ":
+			return nil, NotAVIError
+		case offset > 0 && form != "AVIX":
+			return nil, fmt.Errorf("%w: unexpected RIFF form %q", NotAVIError, form)
+		case offset > 0:
+			openDML = true
+		}
+		riffSize := int64(binary.LittleEndian.Uint32(header[4:]))
+		// Recorders write the RIFF size when the file is closed
+		if riffSize < 4 {
+			return nil, fmt.Errorf("%w: RIFF size not set", TruncatedError)
+		}
+		end := offset + 8 + riffSize
+		if end > size {
+			return nil, fmt.Errorf("%w: RIFF size %d exceeds file size", TruncatedError, riffSize)
+		}
+		if err := p.list(offset+12, end); err != nil {
+			return nil, err
+		}
+		offset = end + (riffSize & 1)
+	}
+	if p.video == nil && p.main.streams == 0 {
+		return nil, fmt.Errorf("%w: missing headers", NotAVIError)
+	}
+	if len(p.movi) == 0 {
+		return nil, MissingMoviError
+	}
+	if !p.idx1 && !p.indx {
+		return nil, MissingIndexError
+	}
+	f := &File{
+		r:           r,
+		movi:        p.movi,
+		videoStream: p.video0,
+	}
+	f.Info = Info{
+		Width:   int(p.main.width),
+		Height:  int(p.main.height),
+		Frames:  int(p.main.totalFrames),
+		Streams: int(p.main.streams),
+		OpenDML: openDML || p.odml > 0,
+		Indexed: true,
+		Codec:   p.codec,
+	}
+	if p.odml > 0 {
+		f.Frames = int(p.odml)
+	}
+	if p.video != nil {
+		if p.video.length > 0 {
+			f.Frames = int(p.video.length)
+		}
+		if p.video.scale > 0 {
+			f.FrameRate = float64(p.video.rate) / float64(p.video.scale)
+		}
+		if f.Codec == "" {
+			f.Codec = p.video.handler
+		}
+	}
+	if p.width > 0 {
+		f.Width = int(p.width)
+	}
+	if p.height != 0 {
+		// Negative height means top-down bitmap
+		if p.height < 0 {
+			p.height = -p.height
+		}
+		f.Height = int(p.height)
+	}
+	if f.FrameRate == 0 && p.main.microSecPerFrame > 0 {
+		f.FrameRate = 1e6 / float64(p.main.microSecPerFrame)
+	}
+	if f.FrameRate > 0 {
+		f.Duration = time.Duration(float64(f.Frames) / f.FrameRate * float64(time.Second))
+	}
+	return f, nil
+}
+
+// isVideoChunk returns true if the chunk id belongs to the video stream
+// ("##dc" for compressed video, "##db" for uncompressed)
+func (f *File) isVideoChunk(id string) bool {
+	if f.videoStream < 0 || len(id) != 4 {
+		return false
+	}
+	if id[2:] != "dc" && id[2:] != "db" {
+		return false
+	}
+	stream, err := strconv.Atoi(id[:2])
+	return err == nil && stream == f.videoStream
+}
+
+// scan the movi lists for video frames
+func (f *File) scan() error {
+	if f.frames != nil {
+		return nil
+	}
+	p := &parser{r: f.r, size: 1<<63 - 1}
+	frames := make([]span, 0, f.Frames)
+	var walk func(start, end int64) error
+	walk = func(start, end int64) error {
+		for offset := start; offset+8 <= end; {
+			id, size, next, err := p.chunk(offset, end)
+			if err != nil {
+				return err
+			}
+			if id == "LIST" && size >= 4 {
+				// "rec " lists group the chunks of several streams
+				if err := walk(offset+12, offset+8+size); err != nil {
+					return err
+				}
+			} else if f.isVideoChunk(id) && size > 0 {
+				// Zero sized chunks are dropped frames
+				frames = append(frames, span{offset: offset + 8, size: size})
+			}
+			offset = next
+		}
+		return nil
+	}
+	for _, movi := range f.movi {
+		if err := walk(movi.offset, movi.offset+movi.size); err != nil {
+			return err
+		}
+	}
+	f.frames = frames
+	return nil
+}
+
+// FrameCount returns the number of non-empty video frames in the file
+func (f *File) FrameCount() (int, error) {
+	if err := f.scan(); err != nil {
+		return 0, err
+	}
+	return len(f.frames), nil
+}
+
+// ReadFrame reads the data of the video frame with the given index.
+// The buffer is reused if it is big enough.
+func (f *File) ReadFrame(index int, buf []byte) ([]byte, error) {
+	if err := f.scan(); err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(f.frames) {
+		return nil, FrameRangeError
+	}
+	frame := f.frames[index]
+	if int64(cap(buf)) < frame.size {
+		buf = make([]byte, frame.size)
+	}
+	buf = buf[:frame.size]
+	if _, err := f.r.ReadAt(buf, frame.offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// IsMJPEG returns true if the video stream is Motion JPEG
+func (f *File) IsMJPEG() bool {
+	switch f.Codec {
+	case "MJPG", "mjpg", "AVRn", "dmb1", "JPEG", "jpeg":
+		return true
+	}
+	return false
+}
+
+// MJPEGFrames calls fn with the JPEG image of every frame. The slice
+// is only valid during the call.
+func (f *File) MJPEGFrames(fn func(index int, jpeg []byte) error) error {
+	if !f.IsMJPEG() {
+		return fmt.Errorf("%w: %q", NotMJPEGError, f.Codec)
+	}
+	count, err := f.FrameCount()
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for index := 0; index < count; index++ {
+		if buf, err = f.ReadFrame(index, buf); err != nil {
+			return err
+		}
+		// Some encoders pad the frame, skip anything before the SOI marker
+		start := 0
+		for start+1 < len(buf) && !(buf[start] == 0xFF && buf[start+1] == 0xD8) {
+			start += 1
+		}
+		if start+1 >= len(buf) {
+			continue
+		}
+		if err := fn(index, buf[start:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// riff builds chunks for the tests
+type riff struct {
+	bytes.Buffer
+}
+
+func (b *riff) chunk(id string, data []byte) {
+	b.WriteString(id)
+	binary.Write(b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)&1 == 1 {
+		b.WriteByte(0)
+	}
+}
+
+func (b *riff) list(id, listType string, content []byte) {
+	b.chunk(id, append([]byte(listType), content...))
+}
+
+func le(values ...uint32) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// testAVI builds a MJPEG AVI with the given frames, 25 fps
+func testAVI(frames [][]byte, withIndex bool) []byte {
+	var strl riff
+	strl.chunk("strh", append([]byte("vidsMJPG"), le(0, 0, 0, 1, 25, 0, uint32(len(frames)), 0, 0, 0, 0, 0)...))
+	strl.chunk("strf", append(le(40, 640, 480, 1|24<<16), append([]byte("MJPG"), le(0, 0, 0, 0, 0)...)...))
+	var hdrl riff
+	hdrl.chunk("avih", le(40000, 0, 0, 0, uint32(len(frames)), 0, 1, 0, 640, 480, 0, 0, 0, 0))
+	hdrl.list("LIST", "strl", strl.Bytes())
+	var movi riff
+	for _, frame := range frames {
+		movi.chunk("00dc", frame)
+	}
+	var body riff
+	body.list("LIST", "hdrl", hdrl.Bytes())
+	body.list("LIST", "movi", movi.Bytes())
+	if withIndex {
+		body.chunk("idx1", make([]byte, 16*len(frames)))
+	}
+	var file riff
+	file.list("RIFF", "AVI ", body.Bytes())
+	return file.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	frames := [][]byte{
+		{0xFF, 0xD8, 1, 2, 3, 0xFF, 0xD9},
+		{0, 0xFF, 0xD8, 4, 5, 0xFF, 0xD9},
+	}
+	data := testAVI(frames, true)
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Width != 640 || f.Height != 480 || f.Frames != 2 || f.Codec != "MJPG" || f.FrameRate != 25 {
+		t.Fatalf("unexpected info %+v", f.Info)
+	}
+	if f.Duration != 80*time.Millisecond {
+		t.Fatalf("unexpected duration %v", f.Duration)
+	}
+	count := 0
+	err = f.MJPEGFrames(func(index int, jpeg []byte) error {
+		if jpeg[0] != 0xFF || jpeg[1] != 0xD8 || len(jpeg) < 7-index {
+			t.Errorf("unexpected frame %d: %v", index, jpeg)
+		}
+		count += 1
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Fatalf("got %d frames, %v", count, err)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	frames := [][]byte{{0xFF, 0xD8, 0xFF, 0xD9}}
+	data := testAVI(frames, false)
+	if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, MissingIndexError) {
+		t.Fatalf("expected missing index, got %v", err)
+	}
+	data = testAVI(frames, true)
+	truncated := data[:len(data)-10]
+	if _, err := Open(bytes.NewReader(truncated), int64(len(truncated))); !IsIncomplete(err) {
+		t.Fatalf("expected incomplete, got %v", err)
+	}
+	if _, err := Open(bytes.NewReader([]byte("not an avi file")), 15); !errors.Is(err, NotAVIError) {
+		t.Fatalf("expected not avi, got %v", err)
+	}
+}
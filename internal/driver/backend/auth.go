@@ -8,9 +8,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/cenkalti/backoff"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type serverError string
@@ -40,6 +44,36 @@ type auth struct {
 	username string
 	password string
 	client   Client
+	health   *healthState
+	current  *credentials // updated on config reload
+}
+
+// credentials shared by all the copies of the auth struct
+type credentials struct {
+	mutex      sync.Mutex
+	username   string
+	password   string
+	generation uint64
+}
+
+func (c *credentials) get() (string, string, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.username, c.password, c.generation
+}
+
+// SetCredentials replaces the credentials used to authenticate.
+// The next request authenticates again with the new ones.
+func (s *Server) SetCredentials(username, password string) {
+	c := s.auth.current
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.username == username && c.password == password {
+		return
+	}
+	c.username = username
+	c.password = password
+	c.generation += 1
 }
 
 type httpAuthRequest struct {
@@ -92,6 +126,11 @@ func (a auth) httpAuth(ctx context.Context, bo backoff.BackOff) (string, string,
 		authToken string
 		authErr   error
 	)
+	ctx, span := tracing.Start(ctx, "backend.httpAuth")
+	defer func() {
+		tracing.RecordError(span, authErr)
+		span.End()
+	}()
 	// Encode the auth body
 	credentials := httpAuthRequest{
 		ID:       a.username,
@@ -168,7 +207,8 @@ type AuthReply struct {
 
 type AuthRequest struct {
 	Reply chan AuthReply
-	fresh bool // whether to request fresh credentials
+	fresh bool              // whether to request fresh credentials
+	trace trace.SpanContext // span of the requester, if any
 }
 
 // Attend to authentication queries in the channel
@@ -176,6 +216,7 @@ func (a auth) WatchAuth(ctx context.Context, queries <-chan AuthRequest) {
 	logger := a.logger.With(servicelog.String("apiUrl", a.apiURL), servicelog.String("username", a.username))
 	bo := eternalBackoff()
 	lastReply := AuthReply{}
+	var generation uint64
 	for {
 		select {
 		case <-ctx.Done():
@@ -186,8 +227,15 @@ func (a auth) WatchAuth(ctx context.Context, queries <-chan AuthRequest) {
 				logger.Info("auth queries channel closed")
 				return
 			}
+			// Discard the token if the credentials have changed
+			if username, password, current := a.current.get(); current != generation {
+				logger.Info("credentials changed")
+				a.username, a.password, generation = username, password, current
+				lastReply = AuthReply{}
+			}
 			if query.fresh || lastReply.Token == "" {
-				id, token, err := a.httpAuth(ctx, bo)
+				id, token, err := a.httpAuth(trace.ContextWithSpanContext(ctx, query.trace), bo)
+				a.health.authenticated(err)
 				lastReply = AuthReply{
 					ID:     id,
 					Token:  token,
@@ -210,9 +258,15 @@ func (a auth) WatchAuth(ctx context.Context, queries <-chan AuthRequest) {
 // Get an authentication response from the channel
 func (a auth) getAuth(ctx context.Context, fresh bool, queries chan<- AuthRequest) (zero AuthReply, err error) {
 	logger := a.logger
+	ctx, span := tracing.Start(ctx, "backend.getAuth", attribute.Bool("fresh", fresh))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
 	query := AuthRequest{
 		fresh: fresh,
 		Reply: make(chan AuthReply, 1),
+		trace: trace.SpanContextFromContext(ctx),
 	}
 	select {
 	case <-ctx.Done():
@@ -231,6 +285,7 @@ func (a auth) getAuth(ctx context.Context, fresh bool, queries chan<- AuthReques
 				logger.Error("auth queries channel closed")
 				return reply, ctx.Err()
 			}
+			span.SetAttributes(attribute.Bool("cached", reply.Cached))
 			return reply, reply.Err
 		}
 	}
@@ -261,3 +316,15 @@ func (a *auth) Do(ctx context.Context, req *http.Request, auth chan<- AuthReques
 	}
 	return resp, nil
 }
+
+// Login validates the given credentials against the backend,
+// without retries. Used to authenticate local users.
+func (s *Server) Login(ctx context.Context, username, password string) error {
+	a := s.auth
+	a.username = username
+	a.password = password
+	// Do not mix local users in the service health
+	a.health = &healthState{}
+	_, _, err := a.httpAuth(ctx, &backoff.StopBackOff{})
+	return err
+}
@@ -101,6 +101,7 @@ func (s *Server) WatchFolder(ctx context.Context, authChan chan<- AuthRequest, f
 			logger.Error("failed to get folder", servicelog.Error(err))
 			continue
 		}
+		s.health.folderPolled()
 		if folder != lastFolder {
 			select {
 			case <-ctx.Done():
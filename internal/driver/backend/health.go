@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// Health of the connection with the backend
+type Health struct {
+	LastAuth      time.Time // last successful authentication
+	LastAuthError error     // error of the last authentication attempt, nil if it succeeded
+	LastFolder    time.Time // last successful folder poll
+}
+
+// healthState is shared by all the copies of the auth struct
+type healthState struct {
+	mutex sync.Mutex
+	Health
+}
+
+func (h *healthState) authenticated(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.LastAuthError = err
+	if err == nil {
+		h.LastAuth = time.Now()
+	}
+}
+
+func (h *healthState) folderPolled() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.LastFolder = time.Now()
+}
+
+// Health returns the status of the connection with the backend
+func (s *Server) Health() Health {
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	return s.health.Health
+}
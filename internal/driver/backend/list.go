@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// RemoteMedia is a media resource as listed by the backend
+type RemoteMedia struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Camera    string `json:"camera"`
+	Size      int64  `json:"size,omitempty"`
+	MediaType string `json:"-"` // picture or video
+}
+
+type mediaListResponse struct {
+	Data []RemoteMedia `json:"data"`
+	Next string        `json:"next"`
+}
+
+// httpMediaList implements getResource for a page of media resources
+type httpMediaList struct {
+	CameraID  string
+	MediaType string
+	Cursor    string
+	Response  mediaListResponse
+}
+
+// GetURL implements getResource
+func (hml *httpMediaList) GetURL(apiURL string) string {
+	// The cursor may be a full URL, an absolute path or an opaque token
+	switch {
+	case strings.HasPrefix(hml.Cursor, "http://") || strings.HasPrefix(hml.Cursor, "https://"):
+		return hml.Cursor
+	case strings.HasPrefix(hml.Cursor, "/"):
+		return apiURL + hml.Cursor
+	}
+	listURL := fmt.Sprintf("%s/api/%s?q:camera:eq=%s", apiURL, hml.MediaType, url.QueryEscape(hml.CameraID))
+	if hml.Cursor != "" {
+		listURL += "&next=" + url.QueryEscape(hml.Cursor)
+	}
+	return listURL
+}
+
+// ReadBody implements getResource
+func (hml *httpMediaList) ReadBody(body io.Reader) error {
+	hml.Response = mediaListResponse{}
+	decoder := json.NewDecoder(body)
+	return decoder.Decode(&hml.Response)
+}
+
+// ListMedia lists all the pictures and videos of this camera in the backend,
+// following the `next` cursor until all pages are read.
+func (s *Server) ListMedia(ctx context.Context, authChan chan<- AuthRequest) ([]RemoteMedia, error) {
+	result := make([]RemoteMedia, 0, 256)
+	for _, mediaType := range []string{"picture", "video"} {
+		logger := s.logger.With(servicelog.String("mediaType", mediaType))
+		page := &httpMediaList{
+			CameraID:  s.cameraID,
+			MediaType: mediaType,
+		}
+		seen := make(map[string]struct{})
+		for {
+			if err := s.getResource(ctx, authChan, page, sendOptions{maxRetries: 3}); err != nil {
+				logger.Error("failed to list media", servicelog.String("cursor", page.Cursor), servicelog.Error(err))
+				return nil, err
+			}
+			for _, item := range page.Response.Data {
+				item.MediaType = mediaType
+				result = append(result, item)
+			}
+			next := page.Response.Next
+			if next == "" || len(page.Response.Data) == 0 {
+				break
+			}
+			// Protect against cursors that loop
+			if _, found := seen[next]; found {
+				logger.Warn("media list cursor loops, stopping", servicelog.String("cursor", next))
+				break
+			}
+			seen[next] = struct{}{}
+			page.Cursor = next
+		}
+	}
+	return result, nil
+}
+
+// Folder returns the local folder configured for this camera in the backend
+func (s *Server) Folder(ctx context.Context, authChan chan<- AuthRequest) (string, error) {
+	bo := backoff.WithMaxRetries(eternalBackoff(), 3)
+	return s.httpFolder(ctx, bo, authChan)
+}
@@ -13,19 +13,25 @@ import (
 	"strings"
 	"time"
 
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // httpMediaRequest implements the Resource interface for media
 // (pictures and fotos)
 type httpMediaRequest struct {
-	ID        string       `json:"id"`
-	Timestamp string       `json:"timestamp"`
-	Camera    string       `json:"camera"`
-	Tags      []string     `json:"tags,omitempty"`
-	MediaType string       `json:"-"` // picture or video
-	MimeType  string       `json:"-"`
-	Buffer    bytes.Buffer `json:"-"`
+	ID        string            `json:"id"`
+	Timestamp string            `json:"timestamp"`
+	Camera    string            `json:"camera"`
+	Tags      []string          `json:"tags,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	MediaType string            `json:"-"` // picture or video
+	MimeType  string            `json:"-"`
+	Buffer    bytes.Buffer      `json:"-"`
 }
 
 // PostURL implements resource
@@ -59,10 +65,35 @@ func (hmr httpMediaRequest) PutBody() (io.ReadCloser, error) {
 	return hmr.PostBody()
 }
 
+// MediaID returns the backend ID of the media file in the given path
+func MediaID(cameraID, path string) string {
+	return fmt.Sprintf("%s_%s", cameraID, filepath.Base(path))
+}
+
+// MediaOptions customize a media upload
+type MediaOptions struct {
+	ID        string            // backend ID, defaults to MediaID(cameraID, path)
+	Timestamp time.Time         // defaults to the file modification time
+	Metadata  map[string]string // properties extracted from the file
+}
+
 // Media sends a media resource to the server
 func (s *Server) Media(ctx context.Context, authChan chan<- AuthRequest, mimeType string, path string) error {
+	return s.MediaWith(ctx, authChan, mimeType, path, MediaOptions{})
+}
+
+// MediaWith sends a media resource to the server, with the given options
+func (s *Server) MediaWith(ctx context.Context, authChan chan<- AuthRequest, mimeType string, path string, options MediaOptions) (returnErr error) {
 	logger := s.logger.With(servicelog.String("path", path), servicelog.String("mimeType", mimeType))
-	id := fmt.Sprintf("%s_%s", s.cameraID, filepath.Base(path))
+	ctx, span := tracing.Start(ctx, "backend.media", attribute.String("file.path", path), attribute.String("mime.type", mimeType))
+	defer func() {
+		tracing.RecordError(span, returnErr)
+		span.End()
+	}()
+	id := options.ID
+	if id == "" {
+		id = MediaID(s.cameraID, path)
+	}
 	var mediaType string
 	if strings.HasPrefix(mimeType, "video") {
 		mediaType = "video"
@@ -74,48 +105,83 @@ func (s *Server) Media(ctx context.Context, authChan chan<- AuthRequest, mimeTyp
 		logger.Error("failed to detect media type")
 		return UnknownMediaTypeError
 	}
-	// Limit concurrent uploads to the server, to preserve BW
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("failed to stat media file", servicelog.Error(err))
+		return err
+	}
+	span.SetAttributes(attribute.Int64("file.size", info.Size()))
+	// Limit concurrent uploads to the server, to preserve BW.
+	// The scheduler decides which pending upload goes first.
 	logger.Debug("getting concurrency token")
-	<-s.queue
+	_, queueSpan := tracing.Start(ctx, "backend.queue")
+	release, err := s.queue.acquire(ctx, mimeType, path, info.Size(), info.ModTime())
+	tracing.RecordError(queueSpan, err)
+	queueSpan.End()
+	if err != nil {
+		logger.Error("cancelled while waiting for concurrency token", servicelog.Error(err))
+		return err
+	}
 	defer func() {
-		s.queue <- struct{}{}
+		release()
 		logger.Debug("concurrency token released")
 	}()
 	logger.Debug("got concurrency token")
-	info, err := os.Stat(path)
-	if err != nil {
-		logger.Error("failed to stat media file", servicelog.Error(err))
-		return err
+	timestamp := options.Timestamp
+	if timestamp.IsZero() {
+		timestamp = info.ModTime()
 	}
 	media := httpMediaRequest{
 		ID:        id,
-		Timestamp: info.ModTime().UTC().Format(time.RFC3339),
+		Timestamp: timestamp.UTC().Format(time.RFC3339),
 		Camera:    s.cameraID,
 		Tags:      []string{"automatic"},
+		Size:      info.Size(),
+		Metadata:  options.Metadata,
 		MediaType: mediaType,
 		MimeType:  mimeType,
 	}
-	err = s.sendResource(ctx, authChan, media, sendOptions{
+	metadataCtx, metadataSpan := tracing.Start(ctx, "backend.metadata", attribute.String("media.id", id))
+	err = s.sendResource(metadataCtx, authChan, media, sendOptions{
 		maxRetries: 3,
 	})
+	tracing.RecordError(metadataSpan, err)
+	metadataSpan.End()
 	if err != nil {
 		logger.Error("failed to send media metadata")
 	} else {
 		// post file body
 		logger.Info("sending media contents")
+		start := time.Now()
+		contentsCtx, contentsSpan := tracing.Start(ctx, "backend.contents")
 		fileReq := &httpFileRequest{
 			ID:        id,
 			Path:      path,
 			MediaType: mediaType,
 			MimeType:  mimeType,
 			Logger:    logger,
+			Trace:     trace.SpanContextFromContext(contentsCtx),
 		}
-		err = s.sendResource(ctx, authChan, fileReq, sendOptions{
+		err = s.sendResource(contentsCtx, authChan, fileReq, sendOptions{
 			maxRetries: 3,
 			onlyPost:   true,
 		})
+		tracing.RecordError(contentsSpan, err)
+		contentsSpan.End()
 		if err == nil {
 			logger.Debug("done sending media contents")
+			fileReq.mutex.Lock()
+			hash := fileReq.hash
+			fileReq.mutex.Unlock()
+			audit.Log(audit.Record{
+				Event:      audit.Transferred,
+				Path:       path,
+				Size:       info.Size(),
+				Hash:       hash,
+				DurationMs: time.Since(start).Milliseconds(),
+				MediaID:    id,
+				MimeType:   mimeType,
+			})
 		} else {
 			logger.Error("failed to send media contents", servicelog.Error(err))
 		}
@@ -1,6 +1,9 @@
 package backend
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +17,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var MediaTransferCount = promauto.NewCounterVec(
@@ -91,6 +97,8 @@ type httpFileRequest struct {
 	MediaType string            `json:"mediaType"`
 	MimeType  string            `json:"mimeType"`
 	Logger    servicelog.Logger `json:"-"`
+	// Parent of the streaming spans, if tracing
+	Trace trace.SpanContext `json:"-"`
 	// Controls the lifetime of the pipe reader
 	pipeReader      io.ReadCloser     `json:"-"`
 	multipartWriter *multipart.Writer `json:"-"`
@@ -99,6 +107,8 @@ type httpFileRequest struct {
 	// Reports errors while reading
 	readError  error `json:"-"`
 	closeError error `json:"-"`
+	// Hash of the contents of the last complete transfer
+	hash string `json:"-"`
 }
 
 // Read implements ReadCloser
@@ -190,6 +200,7 @@ func (hfr *httpFileRequest) PostBody() (io.ReadCloser, error) {
 	stopper := make(chan struct{})
 	hfr.readError = nil
 	hfr.closeError = nil
+	hfr.hash = ""
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	// The returnErr in this closure is captured by a defer
@@ -201,6 +212,18 @@ func (hfr *httpFileRequest) PostBody() (io.ReadCloser, error) {
 			start   time.Time = time.Now()
 			written int64
 		)
+		// Trace the time streaming the file contents, if the upload is traced
+		span := trace.SpanFromContext(context.Background())
+		if hfr.Trace.IsValid() {
+			_, span = tracing.Start(trace.ContextWithSpanContext(context.Background(), hfr.Trace), "backend.stream")
+		}
+		defer func() {
+			span.SetAttributes(attribute.Int64("bytes", written))
+			if !errors.Is(returnErr, io.EOF) {
+				tracing.RecordError(span, returnErr)
+			}
+			span.End()
+		}()
 		defer func() {
 			if returnErr != nil && !errors.Is(returnErr, io.EOF) {
 				hfr.Logger.Error("failed to copy file contents", servicelog.Error(returnErr))
@@ -244,10 +267,14 @@ func (hfr *httpFileRequest) PostBody() (io.ReadCloser, error) {
 			reader: in,
 			stop:   stopper,
 		}
-		written, err = io.Copy(w, controlledIn)
+		hash := sha256.New()
+		written, err = io.Copy(io.MultiWriter(w, hash), controlledIn)
 		if err != nil {
 			return fmt.Errorf("error after copying %d bytes: %w", written, err)
 		}
+		hfr.mutex.Lock()
+		hfr.hash = hex.EncodeToString(hash.Sum(nil))
+		hfr.mutex.Unlock()
 		hfr.Logger.Debug("multipart transfer finished")
 		return nil
 	}()
@@ -9,6 +9,8 @@ import (
 
 	"github.com/cenkalti/backoff"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // validateURL validates a URL and returns it if valid
@@ -75,11 +77,25 @@ func (s *Server) sendResource(ctx context.Context, authChan chan<- AuthRequest,
 		maxRetries = 100
 	}
 	bo = backoff.WithMaxRetries(bo, uint64(maxRetries))
+	attempt := 0
 	err = backoff.Retry(func() (returnErr error) {
+		// Each attempt is a span, with the last response status
+		attempt++
+		ctx, span := tracing.Start(ctx, "backend.attempt", attribute.Int("attempt", attempt))
+		var resp *http.Response
+		defer func() {
+			if resp != nil {
+				span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+				if resp.Request != nil {
+					span.SetAttributes(attribute.String("http.method", resp.Request.Method))
+				}
+			}
+			tracing.RecordError(span, returnErr)
+			span.End()
+		}()
 		defer func() {
 			returnErr = PermanentIfCancel(ctx, returnErr)
 		}()
-		var resp *http.Response
 		if !opts.onlyPut {
 			// Build the request.
 			postBody, err := resource.PostBody()
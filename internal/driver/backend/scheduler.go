@@ -0,0 +1,351 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadQueueWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "asicamera_upload_queue_wait",
+			Help: "Time spent waiting for an upload slot (seconds)",
+			Buckets: []float64{
+				0.1, 1, 5, 30, 60, 300, 1800, 7200,
+			},
+		},
+		[]string{"class"},
+	)
+
+	uploadQueuePending = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_upload_queue_pending",
+			Help: "Number of uploads waiting for a slot",
+		},
+		[]string{"class"},
+	)
+)
+
+// UploadPolicy decides which pending upload gets the next free slot
+// within a class.
+type UploadPolicy string
+
+const (
+	PolicyFIFO     UploadPolicy = "fifo"     // first come, first served
+	PolicyNewest   UploadPolicy = "newest"   // most recently modified file first
+	PolicySmallest UploadPolicy = "smallest" // smallest file first
+)
+
+// UploadClass groups mime types that share a scheduling weight.
+// Free slots are distributed amongst classes with pending uploads
+// proportionally to their weights.
+type UploadClass struct {
+	Name      string
+	MimeTypes []string // mime type prefixes, e.g. "image/" or "video/x-msvideo"
+	Weight    int
+}
+
+// SchedulerConfig configures the upload scheduler
+type SchedulerConfig struct {
+	Policy         UploadPolicy
+	Classes        []UploadClass
+	ReservedSlots  int   // slots that can only be used by small files
+	SmallFileBytes int64 // files up to this size are small
+}
+
+const defaultClassName = "default"
+
+// uploadTicket is a pending request for an upload slot
+type uploadTicket struct {
+	mimeType string
+	path     string
+	size     int64
+	modTime  time.Time
+	class    *uploadQueue
+	seq      uint64
+	queued   time.Time
+	ready    chan struct{}
+	granted  bool // protected by scheduler mutex
+	reserved bool // true if the slot granted is a reserved one
+}
+
+// uploadQueue holds the pending tickets of an UploadClass
+type uploadQueue struct {
+	UploadClass
+	current int // smooth weighted round robin counter
+	pending []*uploadTicket
+}
+
+// scheduler replaces a plain token channel with a priority aware
+// pool of upload slots.
+type scheduler struct {
+	mutex         sync.Mutex
+	policy        UploadPolicy
+	queues        []*uploadQueue
+	generalSlots  int
+	reservedSlots int
+	generalFree   int // negative if the scheduler has been shrunk while busy
+	reservedFree  int
+	reservedWant  int // reserved slots configured
+	smallBytes    int64
+	seq           uint64
+}
+
+// splitSlots divides the concurrency in general and reserved slots.
+// Reserved slots are taken from the total concurrency, but at least
+// one general slot is kept.
+func splitSlots(concurrency, reserved int) (int, int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if reserved >= concurrency {
+		reserved = concurrency - 1
+	}
+	return concurrency - reserved, reserved
+}
+
+// newScheduler with the given number of slots.
+func newScheduler(concurrency int, config SchedulerConfig) *scheduler {
+	want := config.ReservedSlots
+	if want < 0 || config.SmallFileBytes <= 0 {
+		want = 0
+	}
+	general, reserved := splitSlots(concurrency, want)
+	policy := config.Policy
+	if policy == "" {
+		policy = PolicyFIFO
+	}
+	s := &scheduler{
+		policy:        policy,
+		generalSlots:  general,
+		reservedSlots: reserved,
+		generalFree:   general,
+		reservedFree:  reserved,
+		reservedWant:  want,
+		smallBytes:    config.SmallFileBytes,
+	}
+	hasDefault := false
+	for _, class := range config.Classes {
+		if class.Weight < 1 {
+			class.Weight = 1
+		}
+		if class.Name == defaultClassName {
+			hasDefault = true
+		}
+		s.queues = append(s.queues, &uploadQueue{UploadClass: class})
+	}
+	// Catch-all class for mime types not matched by any other
+	if !hasDefault {
+		s.queues = append(s.queues, &uploadQueue{UploadClass: UploadClass{
+			Name:   defaultClassName,
+			Weight: 1,
+		}})
+	}
+	return s
+}
+
+// classify returns the queue for the given mime type
+func (s *scheduler) classify(mimeType string) *uploadQueue {
+	var fallback *uploadQueue
+	for _, q := range s.queues {
+		if q.Name == defaultClassName {
+			fallback = q
+		}
+		for _, prefix := range q.MimeTypes {
+			if strings.HasPrefix(mimeType, prefix) {
+				return q
+			}
+		}
+	}
+	return fallback
+}
+
+// before returns true if ticket a must be served before ticket b
+func (s *scheduler) before(a, b *uploadTicket) bool {
+	switch s.policy {
+	case PolicyNewest:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.After(b.modTime)
+		}
+	case PolicySmallest:
+		if a.size != b.size {
+			return a.size < b.size
+		}
+	}
+	return a.seq < b.seq
+}
+
+// best returns the index of the best ticket in the queue matching the filter
+func (s *scheduler) best(q *uploadQueue, filter func(*uploadTicket) bool) int {
+	found := -1
+	for i, t := range q.pending {
+		if filter != nil && !filter(t) {
+			continue
+		}
+		if found < 0 || s.before(t, q.pending[found]) {
+			found = i
+		}
+	}
+	return found
+}
+
+// grant the slot to the ticket at the given position of the queue
+func (s *scheduler) grant(q *uploadQueue, index int, reserved bool) {
+	t := q.pending[index]
+	q.pending = append(q.pending[:index], q.pending[index+1:]...)
+	uploadQueuePending.WithLabelValues(q.Name).Dec()
+	uploadQueueWait.WithLabelValues(q.Name).Observe(time.Since(t.queued).Seconds())
+	t.granted = true
+	t.reserved = reserved
+	close(t.ready)
+}
+
+// dispatch free slots to pending tickets. Must be called with the mutex held.
+func (s *scheduler) dispatch() {
+	// Reserved slots go to the best small file, regardless of class
+	isSmall := func(t *uploadTicket) bool {
+		return t.size <= s.smallBytes
+	}
+	for s.reservedFree > 0 {
+		var (
+			bestQueue *uploadQueue
+			bestIndex = -1
+		)
+		for _, q := range s.queues {
+			index := s.best(q, isSmall)
+			if index < 0 {
+				continue
+			}
+			if bestIndex < 0 || s.before(q.pending[index], bestQueue.pending[bestIndex]) {
+				bestQueue, bestIndex = q, index
+			}
+		}
+		if bestIndex < 0 {
+			break
+		}
+		s.reservedFree -= 1
+		s.grant(bestQueue, bestIndex, true)
+	}
+	// General slots are distributed amongst classes by
+	// smooth weighted round robin
+	for s.generalFree > 0 {
+		var (
+			chosen *uploadQueue
+			total  int
+		)
+		for _, q := range s.queues {
+			if len(q.pending) == 0 {
+				continue
+			}
+			q.current += q.Weight
+			total += q.Weight
+			if chosen == nil || q.current > chosen.current {
+				chosen = q
+			}
+		}
+		if chosen == nil {
+			break
+		}
+		chosen.current -= total
+		s.generalFree -= 1
+		s.grant(chosen, s.best(chosen, nil), false)
+	}
+}
+
+// resize the number of slots. Uploads in progress are not interrupted,
+// if the concurrency is reduced new uploads wait until enough finish.
+func (s *scheduler) resize(concurrency int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	general, reserved := splitSlots(concurrency, s.reservedWant)
+	s.generalFree += general - s.generalSlots
+	s.reservedFree += reserved - s.reservedSlots
+	s.generalSlots, s.reservedSlots = general, reserved
+	s.dispatch()
+}
+
+// reconfigure the policy, classes and reserved slots. Pending uploads
+// are classified again, uploads in progress keep their slots.
+func (s *scheduler) reconfigure(config SchedulerConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	next := newScheduler(s.generalSlots+s.reservedSlots, config)
+	for _, q := range s.queues {
+		for _, t := range q.pending {
+			t.class = next.classify(t.mimeType)
+			t.class.pending = append(t.class.pending, t)
+			uploadQueuePending.WithLabelValues(q.Name).Dec()
+			uploadQueuePending.WithLabelValues(t.class.Name).Inc()
+		}
+	}
+	s.generalFree += next.generalSlots - s.generalSlots
+	s.reservedFree += next.reservedSlots - s.reservedSlots
+	s.policy, s.queues = next.policy, next.queues
+	s.generalSlots, s.reservedSlots = next.generalSlots, next.reservedSlots
+	s.reservedWant, s.smallBytes = next.reservedWant, next.smallBytes
+	s.dispatch()
+}
+
+// release the slot held by the ticket
+func (s *scheduler) release(t *uploadTicket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t.reserved {
+		s.reservedFree += 1
+	} else {
+		s.generalFree += 1
+	}
+	s.dispatch()
+}
+
+// acquire an upload slot for the given file. Blocks until the slot
+// is granted or the context is cancelled. The returned func must be called
+// to release the slot.
+func (s *scheduler) acquire(ctx context.Context, mimeType, path string, size int64, modTime time.Time) (func(), error) {
+	s.mutex.Lock()
+	s.seq += 1
+	t := &uploadTicket{
+		mimeType: mimeType,
+		path:     path,
+		size:     size,
+		modTime:  modTime,
+		class:    s.classify(mimeType),
+		seq:      s.seq,
+		queued:   time.Now(),
+		ready:    make(chan struct{}),
+	}
+	t.class.pending = append(t.class.pending, t)
+	uploadQueuePending.WithLabelValues(t.class.Name).Inc()
+	s.dispatch()
+	s.mutex.Unlock()
+	select {
+	case <-t.ready:
+		return func() { s.release(t) }, nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if t.granted {
+			// Granted while we were being cancelled, give the slot back
+			if t.reserved {
+				s.reservedFree += 1
+			} else {
+				s.generalFree += 1
+			}
+			s.dispatch()
+		} else {
+			for i, pending := range t.class.pending {
+				if pending == t {
+					t.class.pending = append(t.class.pending[:i], t.class.pending[i+1:]...)
+					uploadQueuePending.WithLabelValues(t.class.Name).Dec()
+					break
+				}
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type schedRequest struct {
+	mimeType string
+	path     string
+	size     int64
+	modTime  time.Time
+}
+
+// queueAll blocks the scheduler with a first upload, queues the requests
+// and returns the order in which they are granted
+func queueAll(t *testing.T, s *scheduler, requests []schedRequest) []string {
+	t.Helper()
+	ctx := context.Background()
+	blocker, err := s.acquire(ctx, "application/blocker", "blocker", 1<<40, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, len(requests))
+	for i, req := range requests {
+		req := req
+		go func() {
+			release, err := s.acquire(ctx, req.mimeType, req.path, req.size, req.modTime)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- req.path
+			release()
+		}()
+		// Wait until the request is queued, to keep arrival order
+		waitPending(s, i+1)
+	}
+	blocker()
+	order := make([]string, 0, len(requests))
+	for range requests {
+		order = append(order, <-granted)
+	}
+	return order
+}
+
+// waitPending waits until the scheduler has the given number of pending tickets
+func waitPending(s *scheduler, count int) {
+	for {
+		s.mutex.Lock()
+		pending := 0
+		for _, q := range s.queues {
+			pending += len(q.pending)
+		}
+		s.mutex.Unlock()
+		if pending == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkOrder(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSchedulerPolicies(t *testing.T) {
+	now := time.Now()
+	requests := []schedRequest{
+		{"video/mp4", "old-big", 4 << 30, now.Add(-2 * time.Hour)},
+		{"image/jpeg", "new-small", 1 << 20, now},
+		{"image/jpeg", "mid-medium", 8 << 20, now.Add(-time.Hour)},
+	}
+	cases := []struct {
+		policy UploadPolicy
+		want   []string
+	}{
+		{PolicyFIFO, []string{"old-big", "new-small", "mid-medium"}},
+		{PolicyNewest, []string{"new-small", "mid-medium", "old-big"}},
+		{PolicySmallest, []string{"new-small", "mid-medium", "old-big"}},
+	}
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			s := newScheduler(1, SchedulerConfig{Policy: c.policy})
+			checkOrder(t, queueAll(t, s, requests), c.want)
+		})
+	}
+}
+
+func TestSchedulerWeightedClasses(t *testing.T) {
+	now := time.Now()
+	s := newScheduler(1, SchedulerConfig{
+		Policy: PolicyFIFO,
+		Classes: []UploadClass{
+			{Name: "pictures", MimeTypes: []string{"image/"}, Weight: 2},
+			{Name: "videos", MimeTypes: []string{"video/"}, Weight: 1},
+		},
+	})
+	requests := []schedRequest{
+		{"video/mp4", "v1", 1, now},
+		{"video/mp4", "v2", 1, now},
+		{"image/jpeg", "p1", 1, now},
+		{"image/jpeg", "p2", 1, now},
+		{"image/jpeg", "p3", 1, now},
+		{"image/jpeg", "p4", 1, now},
+	}
+	checkOrder(t, queueAll(t, s, requests), []string{"p1", "v1", "p2", "p3", "v2", "p4"})
+}
+
+func TestSchedulerReservedSlot(t *testing.T) {
+	s := newScheduler(2, SchedulerConfig{
+		ReservedSlots:  1,
+		SmallFileBytes: 1024,
+	})
+	ctx := context.Background()
+	// The only general slot is taken by a big file
+	releaseBig, err := s.acquire(ctx, "video/mp4", "big", 1<<30, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseBig()
+	// A small file must still get the reserved slot
+	acquired := make(chan struct{})
+	go func() {
+		release, err := s.acquire(ctx, "image/jpeg", "small", 512, time.Now())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer release()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("small file did not get the reserved slot")
+	}
+	// And another big file must wait
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(waitCtx, "video/mp4", "big2", 1<<30, time.Now()); err == nil {
+		t.Fatal("big file must not use the reserved slot")
+	}
+}
+
+func TestSchedulerResize(t *testing.T) {
+	s := newScheduler(2, SchedulerConfig{})
+	ctx := context.Background()
+	first, err := s.acquire(ctx, "image/jpeg", "first", 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.acquire(ctx, "image/jpeg", "second", 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shrink while both slots are busy, releasing one must not free a slot
+	s.resize(1)
+	first()
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(timeout, "image/jpeg", "third", 1, time.Now()); err == nil {
+		t.Fatal("expected no free slot after shrinking")
+	}
+	// Growing again makes the slot available
+	s.resize(2)
+	third, err := s.acquire(ctx, "image/jpeg", "third", 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second()
+	third()
+	if s.generalFree != 2 {
+		t.Errorf("expected 2 free slots, got %d", s.generalFree)
+	}
+}
+
+func TestSchedulerReconfigure(t *testing.T) {
+	s := newScheduler(1, SchedulerConfig{})
+	ctx := context.Background()
+	blocker, err := s.acquire(ctx, "application/blocker", "blocker", 1<<40, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan string, 2)
+	for i, req := range []schedRequest{
+		{mimeType: "video/x-ser", path: "video", size: 1 << 30},
+		{mimeType: "image/jpeg", path: "image", size: 1},
+	} {
+		req := req
+		go func() {
+			release, err := s.acquire(ctx, req.mimeType, req.path, req.size, req.modTime)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			granted <- req.path
+			release()
+		}()
+		waitPending(s, i+1)
+	}
+	// The pending uploads move to the new classes
+	s.reconfigure(SchedulerConfig{
+		Policy:  PolicySmallest,
+		Classes: []UploadClass{{Name: "images", MimeTypes: []string{"image/"}, Weight: 1}},
+	})
+	s.mutex.Lock()
+	if len(s.queues) != 2 || len(s.queues[0].pending) != 1 || s.queues[0].pending[0].path != "image" {
+		t.Errorf("pending uploads not classified again")
+	}
+	s.mutex.Unlock()
+	blocker()
+	checkOrder(t, []string{<-granted, <-granted}, []string{"image", "video"})
+}
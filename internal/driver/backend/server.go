@@ -9,7 +9,7 @@ import (
 type Server struct {
 	auth
 	cameraID string
-	queue    chan struct{}
+	queue    *scheduler
 }
 
 type Config struct {
@@ -19,14 +19,11 @@ type Config struct {
 	CameraID    string
 	HTTPTimeout time.Duration
 	Concurrency int
+	Scheduler   SchedulerConfig
 }
 
 // Builds a new server
 func New(logger servicelog.Logger, client Client, config Config) *Server {
-	concurrency := config.Concurrency
-	if concurrency < 1 {
-		concurrency = 1
-	}
 	timeout := config.HTTPTimeout
 	if timeout <= 0 {
 		timeout = 10 * time.Second
@@ -38,12 +35,27 @@ func New(logger servicelog.Logger, client Client, config Config) *Server {
 			username: config.Username,
 			password: config.Password,
 			client:   client,
+			health:   &healthState{},
+			current: &credentials{
+				username: config.Username,
+				password: config.Password,
+			},
 		},
 		cameraID: config.CameraID,
-		queue:    make(chan struct{}, concurrency),
-	}
-	for i := 0; i < concurrency; i++ {
-		server.queue <- struct{}{}
+		queue:    newScheduler(config.Concurrency, config.Scheduler),
 	}
 	return server
 }
+
+// SetConcurrency changes the number of concurrent uploads.
+// Uploads in progress are not interrupted.
+func (s *Server) SetConcurrency(concurrency int) {
+	s.queue.resize(concurrency)
+}
+
+// SetScheduler changes the upload policy, classes and reserved slots.
+// Uploads in progress are not interrupted, pending ones are queued
+// again with the new classes.
+func (s *Server) SetScheduler(config SchedulerConfig) {
+	s.queue.reconfigure(config)
+}
@@ -51,6 +51,9 @@ type ASICamera struct {
 	lastOpen     time.Time
 	waiting      int
 	join, done   chan struct{}
+	// Last values read by Monitor
+	snapshotMutex sync.Mutex
+	snapshot      Snapshot
 }
 
 // Opens the connection to ASI camera, if not already open
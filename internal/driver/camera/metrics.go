@@ -84,8 +84,41 @@ var (
 		},
 		[]string{"camera"},
 	)
+
+	controlTypeExposure = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "control_type_exposure",
+			Help: "Value of ASI_CONTROL_TYPE ASI_EXPOSURE, in microseconds",
+		},
+		[]string{"camera"},
+	)
+
+	controlTypeGain = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "control_type_gain",
+			Help: "Value of ASI_CONTROL_TYPE ASI_GAIN",
+		},
+		[]string{"camera"},
+	)
 )
 
+// Snapshot of the control values read by Monitor
+type Snapshot struct {
+	Updated time.Time      `json:"updated"`
+	Values  map[string]int `json:"values"`
+}
+
+// Snapshot returns the last control values read by Monitor
+func (c *ASICamera) Snapshot() Snapshot {
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+	values := make(map[string]int, len(c.snapshot.Values))
+	for name, value := range c.snapshot.Values {
+		values[name] = value
+	}
+	return Snapshot{Updated: c.snapshot.Updated, Values: values}
+}
+
 func (c *ASICamera) Monitor(ctx context.Context, logger servicelog.Logger, interval time.Duration) {
 	metrics := map[ASI_CONTROL_TYPE]*prometheus.GaugeVec{
 		ASI_OVERCLOCK:         controlTypeOverclock,
@@ -94,6 +127,8 @@ func (c *ASICamera) Monitor(ctx context.Context, logger servicelog.Logger, inter
 		ASI_COOLER_POWER_PERC: controlTypeCoolerPowerPerc,
 		ASI_FAN_ON:            controlTypeFanOn,
 		ASI_ANTI_DEW_HEATER:   controlTypeAntiDewHeater,
+		ASI_EXPOSURE:          controlTypeExposure,
+		ASI_GAIN:              controlTypeGain,
 	}
 	var supported_metrics []ASI_CONTROL_TYPE
 	var currentInterval time.Duration = 0
@@ -137,6 +172,12 @@ func (c *ASICamera) Monitor(ctx context.Context, logger servicelog.Logger, inter
 						}
 					}
 				}
+				values := make(map[string]int, len(supported_metrics))
+				defer func() {
+					c.snapshotMutex.Lock()
+					defer c.snapshotMutex.Unlock()
+					c.snapshot = Snapshot{Updated: time.Now(), Values: values}
+				}()
 				for _, controlType := range supported_metrics {
 					alive := 0
 					metric, _, err := asiGetControlValue(c.CameraID, c.SerialNumber, controlType)
@@ -146,6 +187,7 @@ func (c *ASICamera) Monitor(ctx context.Context, logger servicelog.Logger, inter
 					} else {
 						gauge := metrics[controlType]
 						gauge.WithLabelValues(c.SerialNumber).Set(float64(metric))
+						values[controlType.String()] = metric
 					}
 					asiCameraUp.WithLabelValues(c.SerialNumber).Set(float64(alive))
 				}
@@ -0,0 +1,176 @@
+// Package dashboard serves a small web UI for site technicians,
+// with the state of the camera, the uploads, alerts and disks.
+// All assets are embedded, so it works without internet access.
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Prefix of the dashboard paths
+const Prefix = "/dashboard/"
+
+//go:embed static
+var static embed.FS
+
+// Camera connection state
+type Camera struct {
+	Connected    int            `json:"connected"`         // number of cameras detected
+	Checked      time.Time      `json:"checked,omitempty"` // last USB check
+	Name         string         `json:"name,omitempty"`
+	SerialNumber string         `json:"serialNumber,omitempty"`
+	Updated      time.Time      `json:"updated,omitempty"` // last read of control values
+	Values       map[string]int `json:"values,omitempty"`  // control values, by control type
+}
+
+// Folder upload state
+type Folder struct {
+	Folder   string        `json:"folder"`
+	Tasks    int           `json:"tasks"`
+	Uploads  int           `json:"uploads"` // uploads in progress
+	Failures []FailedFile  `json:"failures"`
+	Recent   []RecentEvent `json:"recent"`
+}
+
+// FailedFile is a file whose last upload failed
+type FailedFile struct {
+	Path  string    `json:"path"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// RecentEvent is a recent upload result
+type RecentEvent struct {
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Alert raised to the backend and not cleared yet
+type Alert struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+}
+
+// Disk usage of a folder
+type Disk struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Error string `json:"error,omitempty"`
+}
+
+// Status displayed in the dashboard
+type Status struct {
+	Time     time.Time `json:"time"`
+	CameraID string    `json:"cameraID"`
+	Camera   Camera    `json:"camera"`
+	Folders  []Folder  `json:"folders"`
+	Alerts   []Alert   `json:"alerts"`
+	Disks    []Disk    `json:"disks"`
+	Preview  string    `json:"preview,omitempty"` // URL of the live preview
+}
+
+// Provider collects the current status
+type Provider func(ctx context.Context) Status
+
+// Handler serves the static assets and the status under Prefix
+func Handler(logger servicelog.Logger, provider Provider) http.Handler {
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		// Can only happen if the embed directive is broken
+		panic(err)
+	}
+	files := http.StripPrefix(Prefix, http.FileServer(http.FS(assets)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path != Prefix+"status" {
+			files.ServeHTTP(w, r)
+			return
+		}
+		status := provider(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger.Debug("failed to send dashboard status", servicelog.Error(err))
+		}
+	})
+}
+
+// Alerts keeps track of the active alerts
+type Alerts struct {
+	mutex  sync.Mutex
+	active map[string]Alert
+}
+
+// NewAlerts creates an empty alert list
+func NewAlerts() *Alerts {
+	return &Alerts{active: make(map[string]Alert)}
+}
+
+// Raise an alert. Raising it again updates the message.
+// Returns true if the alert was not active.
+func (a *Alerts) Raise(id, name, severity, message string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	since := time.Now()
+	prev, active := a.active[id]
+	if active {
+		since = prev.Since
+	}
+	a.active[id] = Alert{
+		ID:       id,
+		Name:     name,
+		Severity: severity,
+		Message:  message,
+		Since:    since,
+	}
+	return !active
+}
+
+// Clear an alert. Returns true if the alert was active.
+func (a *Alerts) Clear(id string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, active := a.active[id]
+	delete(a.active, id)
+	return active
+}
+
+// List the active alerts, most recent first
+func (a *Alerts) List() []Alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	list := make([]Alert, 0, len(a.active))
+	for _, alert := range a.active {
+		list = append(list, alert)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.After(list[j].Since) })
+	return list
+}
+
+// Usage returns the disk usage of the volume holding the path
+func Usage(path string) Disk {
+	total, free, err := diskUsage(path)
+	disk := Disk{Path: path, Total: total, Free: free}
+	if err != nil {
+		disk.Error = err.Error()
+	}
+	return disk
+}
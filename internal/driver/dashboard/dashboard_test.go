@@ -0,0 +1,42 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestHandler(t *testing.T) {
+	alerts := NewAlerts()
+	alerts.Raise("usb_1", "usb_connection", "error", "No USB camera detected")
+	alerts.Raise("folder_1", "watch_folder", "error", "folder not found")
+	alerts.Clear("folder_1")
+	handler := Handler(servicelog.Logger{Logger: zap.NewNop()}, func(ctx context.Context) Status {
+		return Status{CameraID: "cam0", Alerts: alerts.List(), Disks: []Disk{Usage(t.TempDir())}}
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Prefix, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "app.js") {
+		t.Fatalf("index: status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Prefix+"status", nil))
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.CameraID != "cam0" || len(status.Alerts) != 1 || status.Alerts[0].ID != "usb_1" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(status.Disks) != 1 || status.Disks[0].Error != "" || status.Disks[0].Total == 0 {
+		t.Errorf("unexpected disk usage %+v", status.Disks)
+	}
+}
@@ -0,0 +1,174 @@
+"use strict";
+
+// Refresh interval, in milliseconds
+const REFRESH = 5000;
+
+// Control values that are stored multiplied by 10
+const TENTHS = ["ASI_TEMPERATURE"];
+
+function el(tag, text, className) {
+  const node = document.createElement(tag);
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  if (className) {
+    node.className = className;
+  }
+  return node;
+}
+
+function row(cells) {
+  const tr = el("tr");
+  for (const cell of cells) {
+    tr.appendChild(cell instanceof Node ? wrap(cell) : el("td", cell));
+  }
+  return tr;
+}
+
+function wrap(node) {
+  const td = el("td");
+  td.appendChild(node);
+  return td;
+}
+
+function fill(id, rows, empty, columns) {
+  const body = document.getElementById(id);
+  body.replaceChildren();
+  if (rows.length === 0) {
+    const td = el("td", empty);
+    td.colSpan = columns;
+    body.appendChild(el("tr")).appendChild(td);
+    return;
+  }
+  for (const r of rows) {
+    body.appendChild(r);
+  }
+}
+
+function ago(time) {
+  if (!time || time.startsWith("0001")) {
+    return "never";
+  }
+  const seconds = Math.round((Date.now() - new Date(time).getTime()) / 1000);
+  if (seconds < 60) {
+    return seconds + "s ago";
+  }
+  if (seconds < 3600) {
+    return Math.round(seconds / 60) + "m ago";
+  }
+  if (seconds < 86400) {
+    return Math.round(seconds / 3600) + "h ago";
+  }
+  return Math.round(seconds / 86400) + "d ago";
+}
+
+function bytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function renderCamera(camera) {
+  const dl = document.getElementById("camera-state");
+  dl.replaceChildren();
+  const add = (term, value, className) => {
+    dl.appendChild(el("dt", term));
+    dl.appendChild(el("dd", value, className));
+  };
+  if (camera.connected > 0) {
+    add("USB", camera.connected + " connected", "ok");
+  } else {
+    add("USB", "not detected", "error");
+  }
+  add("Checked", ago(camera.checked));
+  if (camera.name) {
+    add("Model", camera.name);
+    add("Serial", camera.serialNumber);
+    add("Read", ago(camera.updated));
+  }
+  const values = camera.values || {};
+  for (const name of Object.keys(values).sort()) {
+    let value = values[name];
+    if (TENTHS.includes(name)) {
+      value = (value / 10).toFixed(1);
+    }
+    add(name.replace(/^ASI_/, ""), String(value));
+  }
+}
+
+function renderFolders(folders) {
+  const container = document.getElementById("folders");
+  container.replaceChildren();
+  if (folders.length === 0) {
+    container.appendChild(el("p", "No folder being watched"));
+    return;
+  }
+  for (const folder of folders) {
+    container.appendChild(el("h3", folder.folder));
+    container.appendChild(el("p", folder.tasks + " files pending, " + folder.uploads + " uploading, " + folder.failures.length + " failed"));
+    const table = el("table");
+    table.appendChild(el("thead")).appendChild(row(["Status", "File", "When", "Error"]));
+    const body = table.appendChild(el("tbody"));
+    for (const failure of folder.failures) {
+      body.appendChild(row([el("span", "failed", "error"), failure.path, ago(failure.time), failure.error]));
+    }
+    for (const event of folder.recent) {
+      const className = event.status === "failure" ? "error" : event.status === "success" ? "ok" : "warning";
+      body.appendChild(row([el("span", event.status, className), event.path, ago(event.time), event.error || ""]));
+    }
+    container.appendChild(table);
+  }
+}
+
+function render(status) {
+  document.getElementById("camera-id").textContent = status.cameraID;
+  renderCamera(status.camera);
+  fill("alerts-body", status.alerts.map((alert) => row([
+    el("span", alert.severity, alert.severity),
+    alert.name,
+    alert.message,
+    ago(alert.since),
+  ])), "No active alerts", 4);
+  renderFolders(status.folders);
+  fill("disks-body", status.disks.map((disk) => {
+    if (disk.error) {
+      return row([disk.path, el("span", disk.error, "error"), "", ""]);
+    }
+    const bar = el("div", undefined, "bar");
+    const ratio = disk.total ? disk.free / disk.total : 0;
+    if (ratio < 0.1) {
+      bar.classList.add("low");
+    }
+    bar.appendChild(el("div")).style.width = Math.round(100 * (1 - ratio)) + "%";
+    return row([disk.path, bytes(disk.free), bytes(disk.total), bar]);
+  }), "No disks", 4);
+  const preview = document.getElementById("preview");
+  const img = document.getElementById("preview-img");
+  preview.hidden = !status.preview;
+  if (status.preview && img.getAttribute("src") !== status.preview) {
+    img.src = status.preview;
+  }
+}
+
+async function refresh() {
+  const updated = document.getElementById("updated");
+  try {
+    const response = await fetch("status", { cache: "no-store" });
+    if (!response.ok) {
+      throw new Error(response.status + " " + response.statusText);
+    }
+    render(await response.json());
+    updated.textContent = "updated " + new Date().toLocaleTimeString();
+    document.body.classList.remove("stale");
+  } catch (err) {
+    updated.textContent = "connection lost: " + err.message;
+    document.body.classList.add("stale");
+  }
+  setTimeout(refresh, REFRESH);
+}
+
+refresh();
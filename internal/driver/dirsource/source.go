@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/warpcomdev/asicamera2/internal/driver/fits"
 	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
 )
@@ -17,6 +18,12 @@ type frame struct {
 	src      *jpeg.Image
 	img      *jpeg.Image
 	features jpeg.JpegFeatures
+	metadata jpeg.Metadata
+}
+
+// Metadata implements jpeg.MetadataFrame
+func (f frame) Metadata() jpeg.Metadata {
+	return f.metadata
 }
 
 // Buffer implements jpeg.SrcFrame
@@ -24,6 +31,15 @@ func (f frame) Buffer() *jpeg.Image {
 	return f.img
 }
 
+// Features implements jpeg.FeaturesFrame, of the decompressed pixels
+func (f frame) Features() jpeg.RawFeatures {
+	format := jpeg.PF_RGB
+	if f.features.Subsampling == jpeg.TJSAMP_GRAY {
+		format = jpeg.PF_GRAY
+	}
+	return jpeg.RawFeatures{Features: f.features.Features, Format: format}
+}
+
 // Compress implements jpeg.SrcFrame
 func (f frame) Compress(compressor jpeg.Compressor, target *jpeg.Image) (zero jpeg.JpegFeatures, err error) {
 	if err := target.Copy(f.src); err != nil {
@@ -39,14 +55,36 @@ type Source struct {
 	match Matcher
 	// Decompression resources
 	decompressor jpeg.Decompressor
+	compressor   jpeg.Compressor // for the previews of FITS images
 	images       [2]jpeg.Image
 	currentImage int
 	// Latest decompressed image
 	mutex      sync.Mutex
 	newestData frame
 	// frame rate
-	watcher *Watcher
-	rate    *time.Ticker
+	watcher  *Watcher
+	interval time.Duration
+	rate     *time.Ticker
+	// Exposure and gain of the jpeg files, if not nil
+	camera jpeg.CameraSettings
+}
+
+// Extensions of the files shown
+var (
+	jpegExtensions = []string{".jpg", ".jpeg"}
+	fitsExtensions = []string{".fits", ".fit", ".fts"}
+	extensions     = append(append([]string(nil), jpegExtensions...), fitsExtensions...)
+)
+
+// hasExtension is true if the path ends with any of the extensions
+func hasExtension(path string, extensions []string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
 }
 
 // Name implements jpeg.Source
@@ -68,6 +106,7 @@ func (s *Source) Next(ctx context.Context, img *jpeg.Image) (jpeg.SrcFrame, erro
 					src:      &s.images[s.currentImage],
 					img:      img,
 					features: s.newestData.features,
+					metadata: s.newestData.metadata,
 				}
 			}()
 			if frame != nil {
@@ -87,8 +126,9 @@ func (rs *Source) Start(logger servicelog.Logger) error {
 		return err
 	}
 	// Set frame rate and decompressor
-	rs.rate = time.NewTicker(time.Second)
+	rs.rate = time.NewTicker(rs.interval)
 	rs.decompressor = jpeg.NewDecompressor()
+	rs.compressor = jpeg.NewCompressor()
 	// Start listener gopher for updates
 	go func(watcher *Watcher) {
 		latestFile := ""
@@ -101,8 +141,7 @@ func (rs *Source) Start(logger servicelog.Logger) error {
 			if info.IsDir() {
 				continue
 			}
-			lower := strings.ToLower(path)
-			if !strings.HasSuffix(lower, ".jpg") && !strings.HasSuffix(lower, ".jpeg") {
+			if !hasExtension(path, extensions) {
 				continue
 			}
 			// Do not send the same file several times in a row
@@ -121,7 +160,7 @@ func (rs *Source) Start(logger servicelog.Logger) error {
 		}
 	}(rs.watcher)
 	// seed with newest file
-	newest, err := newestFile(logger, rs.root, rs.match, []string{".jpg", ".jpeg"})
+	newest, err := NewestFile(logger, rs.root, rs.match, extensions)
 	if err != nil {
 		logger.Error("failed to get newest file", servicelog.Error(err))
 	} else {
@@ -133,23 +172,84 @@ func (rs *Source) Start(logger servicelog.Logger) error {
 }
 
 func (rs *Source) readImage(path string) error {
-	dirname, filename := filepath.Split(path)
-	fsys := os.DirFS(dirname)
 	imgIndex := 1 - rs.currentImage
-	features, err := jpeg.Decompressor.ReadFile(rs.decompressor, fsys, filename, &rs.images[imgIndex])
+	var (
+		features jpeg.JpegFeatures
+		metadata = jpeg.Metadata{Path: path}
+		err      error
+	)
+	if hasExtension(path, fitsExtensions) {
+		features, err = rs.readFITS(path, &rs.images[imgIndex], &metadata)
+	} else {
+		dirname, filename := filepath.Split(path)
+		features, err = jpeg.Decompressor.ReadFile(rs.decompressor, os.DirFS(dirname), filename, &rs.images[imgIndex])
+		metadata = metadata.WithSettings(rs.camera)
+	}
 	if err != nil {
 		return err
 	}
+	// The file is complete by now, its modification time is the capture time
+	if info, err := os.Stat(path); err == nil {
+		metadata.Timestamp = info.ModTime()
+	}
 	rs.mutex.Lock()
 	defer rs.mutex.Unlock()
 	rs.currentImage = imgIndex
 	rs.newestData = frame{
 		src:      &rs.images[rs.currentImage],
 		features: features,
+		metadata: metadata,
 	}
 	return nil
 }
 
+// Quality of the previews of FITS images
+const fitsQuality = 90
+
+// readFITS renders the stretched preview of the FITS image as a jpeg,
+// and takes the exposure and gain from its header
+func (rs *Source) readFITS(path string, target *jpeg.Image, metadata *jpeg.Metadata) (zero jpeg.JpegFeatures, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return zero, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return zero, err
+	}
+	image, err := fits.Open(file, info.Size())
+	if err != nil {
+		return zero, err
+	}
+	gray, width, height, err := image.Preview(fits.DefaultStretch)
+	if err != nil {
+		return zero, err
+	}
+	rawFeat := jpeg.RawFeatures{
+		Features: jpeg.Features{Width: width, Height: height},
+		Format:   jpeg.PF_GRAY,
+	}
+	var raw jpeg.Image
+	defer raw.Free()
+	if err := raw.Alloc(len(gray)); err != nil {
+		return zero, err
+	}
+	copy(raw.Slice(), gray)
+	if size := jpeg.BufSize(rawFeat.Features, jpeg.TJSAMP_GRAY); target.Cap() < size {
+		if err := target.Alloc(size); err != nil {
+			return zero, err
+		}
+	}
+	features, err := rs.compressor.Compress(&raw, rawFeat, target, jpeg.TJSAMP_GRAY, fitsQuality, jpeg.TJFLAG_NOREALLOC)
+	if err != nil {
+		return zero, err
+	}
+	metadata.Exposure, _ = image.Exposure()
+	metadata.Gain, _ = image.Gain()
+	return features, nil
+}
+
 func (rs *Source) Stop() {
 	// Close watcher
 	if err := rs.watcher.Close(); err != nil {
@@ -163,13 +263,27 @@ func (rs *Source) Stop() {
 	// Free frame rate and decompressor
 	rs.rate.Stop()
 	rs.decompressor.Free()
+	rs.compressor.Free()
 	rs.images[0].Free()
 	rs.images[1].Free()
 }
 
-func New(logger servicelog.Logger, root string, match Matcher) (*Source, error) {
+// SetCameraSettings sets the exposure and gain of the jpeg files,
+// usually those of the camera that captures them. FITS images
+// carry their own. Must be called before Start.
+func (rs *Source) SetCameraSettings(settings jpeg.CameraSettings) {
+	rs.camera = settings
+}
+
+// New Source for the newest jpeg or FITS file in the root folder or any
+// subfolder matching the Matcher, repeated at the given frame rate.
+func New(logger servicelog.Logger, root string, match Matcher, fps int) (*Source, error) {
+	if fps < 1 {
+		fps = 1
+	}
 	return &Source{
-		root:  root,
-		match: match,
+		root:     root,
+		match:    match,
+		interval: time.Second / time.Duration(fps),
 	}, nil
 }
@@ -166,7 +166,9 @@ func (w *Watcher) watch(logger servicelog.Logger, root string, match Matcher) {
 	}
 }
 
-func newestFile(logger servicelog.Logger, root string, dirMatch Matcher, fileExt []string) (string, error) {
+// NewestFile returns the newest file with one of the extensions in the
+// root folder, or in the subfolders matching dirMatch. Empty if none.
+func NewestFile(logger servicelog.Logger, root string, dirMatch Matcher, fileExt []string) (string, error) {
 	// Locate newest File
 	var (
 		newestPath string
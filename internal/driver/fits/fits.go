@@ -0,0 +1,360 @@
+// Package fits reads the headers and image data of FITS files,
+// and renders 8 bit previews of the images.
+package fits
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fitsError string
+
+// Error implements error
+func (e fitsError) Error() string {
+	return string(e)
+}
+
+const (
+	NotFITSError           = fitsError("not a FITS file")
+	TruncatedError         = fitsError("truncated FITS file")
+	NoImageError           = fitsError("FITS file has no image")
+	UnsupportedBitpixError = fitsError("unsupported BITPIX")
+)
+
+const (
+	blockSize = 2880 // FITS files are organized in blocks of this size
+	cardSize  = 80   // each header record is 80 characters long
+)
+
+// Header of a HDU. Keeps the order of the keywords.
+type Header struct {
+	Keys   []string
+	Values map[string]string // raw values, strings are unquoted
+}
+
+// Get returns the value of the keyword
+func (h Header) Get(key string) (string, bool) {
+	value, ok := h.Values[key]
+	return value, ok
+}
+
+// Int returns the value of the keyword as an integer
+func (h Header) Int(key string) (int, bool) {
+	value, ok := h.Values[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+// Float returns the value of the keyword as a float. Fortran
+// style exponents (1.0D3) are accepted.
+func (h Header) Float(key string) (float64, bool) {
+	value, ok := h.Values[key]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.Replace(value, "D", "E", 1), 64)
+	return f, err == nil
+}
+
+// Bool returns the value of a logical keyword
+func (h Header) Bool(key string) (bool, bool) {
+	value, ok := h.Values[key]
+	if !ok || (value != "T" && value != "F") {
+		return false, false
+	}
+	return value == "T", true
+}
+
+// parseCard splits a header record into keyword and value.
+// Commentary cards (COMMENT, HISTORY...) have no value.
+func parseCard(card string) (key, value string, hasValue bool) {
+	key = strings.TrimSpace(card[:8])
+	if len(card) < 10 || card[8:10] != "= " {
+		return key, "", false
+	}
+	value = strings.TrimSpace(card[10:])
+	if strings.HasPrefix(value, "'") {
+		// Quoted string, '' is an escaped quote
+		var text strings.Builder
+		for i := 1; i < len(value); i++ {
+			if value[i] == '\'' {
+				if i+1 < len(value) && value[i+1] == '\'' {
+					text.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			text.WriteByte(value[i])
+		}
+		// Trailing spaces are not significant
+		return key, strings.TrimRight(text.String(), " "), true
+	}
+	if comment := strings.IndexByte(value, '/'); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	return key, value, true
+}
+
+// readHeader reads a header, including the padding to the block size.
+// Returns the header and the number of bytes read.
+func readHeader(r io.Reader) (Header, int64, error) {
+	header := Header{Values: make(map[string]string)}
+	block := make([]byte, blockSize)
+	var read int64
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if read == 0 && errors.Is(err, io.EOF) {
+				return Header{}, 0, io.EOF
+			}
+			return Header{}, read, TruncatedError
+		}
+		read += blockSize
+		for offset := 0; offset < blockSize; offset += cardSize {
+			card := string(block[offset : offset+cardSize])
+			key, value, hasValue := parseCard(card)
+			if key == "END" {
+				return header, read, nil
+			}
+			if !hasValue || key == "" {
+				continue
+			}
+			if _, found := header.Values[key]; !found {
+				header.Keys = append(header.Keys, key)
+			}
+			header.Values[key] = value
+		}
+	}
+}
+
+// HDU is a header and data unit
+type HDU struct {
+	Header
+	Bitpix int
+	Axes   []int
+	Offset int64 // offset of the data in the file
+}
+
+// DataSize is the size of the data, without padding
+func (h HDU) DataSize() int64 {
+	if len(h.Axes) == 0 {
+		return 0
+	}
+	bytes := int64(h.Bitpix)
+	if bytes < 0 {
+		bytes = -bytes
+	}
+	bytes /= 8
+	elements := int64(1)
+	for _, axis := range h.Axes {
+		elements *= int64(axis)
+	}
+	// Extensions may have a heap (PCOUNT) and groups (GCOUNT)
+	pcount, _ := h.Int("PCOUNT")
+	gcount, ok := h.Int("GCOUNT")
+	if !ok {
+		gcount = 1
+	}
+	return bytes * int64(gcount) * (int64(pcount) + elements)
+}
+
+// paddedSize rounds the size up to the block size
+func paddedSize(size int64) int64 {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// newHDU validates the mandatory keywords of the header
+func newHDU(header Header, offset int64) (HDU, error) {
+	hdu := HDU{Header: header, Offset: offset}
+	var ok bool
+	if hdu.Bitpix, ok = header.Int("BITPIX"); !ok {
+		return HDU{}, fmt.Errorf("%w: missing BITPIX", NotFITSError)
+	}
+	naxis, ok := header.Int("NAXIS")
+	if !ok || naxis < 0 || naxis > 999 {
+		return HDU{}, fmt.Errorf("%w: invalid NAXIS", NotFITSError)
+	}
+	hdu.Axes = make([]int, 0, naxis)
+	for i := 1; i <= naxis; i++ {
+		axis, ok := header.Int(fmt.Sprintf("NAXIS%d", i))
+		if !ok || axis < 0 {
+			return HDU{}, fmt.Errorf("%w: invalid NAXIS%d", NotFITSError, i)
+		}
+		hdu.Axes = append(hdu.Axes, axis)
+	}
+	return hdu, nil
+}
+
+// File is a FITS file, with the HDU that holds the main image
+type File struct {
+	Primary HDU
+	Image   HDU // primary HDU, or first IMAGE extension if primary is empty
+	r       io.ReaderAt
+}
+
+// Open reads the headers of the FITS file. It returns TruncatedError
+// if the data of the image is not complete.
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	// Every FITS file starts with the SIMPLE keyword
+	signature := make([]byte, 10)
+	if _, err := r.ReadAt(signature, 0); err != nil || string(signature) != "SIMPLE  = " {
+		return nil, NotFITSError
+	}
+	reader := io.NewSectionReader(r, 0, size)
+	header, read, err := readHeader(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, TruncatedError
+		}
+		return nil, err
+	}
+	if simple, ok := header.Bool("SIMPLE"); !ok || !simple {
+		return nil, NotFITSError
+	}
+	primary, err := newHDU(header, read)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Primary: primary, Image: primary, r: r}
+	if len(primary.Axes) < 2 {
+		// Look for the first image extension
+		offset := read + paddedSize(primary.DataSize())
+		for {
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			header, read, err := readHeader(reader)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, NoImageError
+				}
+				return nil, err
+			}
+			hdu, err := newHDU(header, offset+read)
+			if err != nil {
+				return nil, err
+			}
+			if ext, _ := header.Get("XTENSION"); ext == "IMAGE" && len(hdu.Axes) >= 2 {
+				f.Image = hdu
+				break
+			}
+			offset = hdu.Offset + paddedSize(hdu.DataSize())
+		}
+	}
+	switch f.Image.Bitpix {
+	case 8, 16, 32, -32, -64:
+		break
+	default:
+		return nil, fmt.Errorf("%w: %d", UnsupportedBitpixError, f.Image.Bitpix)
+	}
+	// The last block may not be padded, but the data must be there
+	if f.Image.Offset+f.Image.DataSize() > size {
+		return nil, fmt.Errorf("%w: expected %d data bytes", TruncatedError, f.Image.DataSize())
+	}
+	return f, nil
+}
+
+// Width of the image
+func (f *File) Width() int {
+	return f.Image.Axes[0]
+}
+
+// Height of the image
+func (f *File) Height() int {
+	return f.Image.Axes[1]
+}
+
+// header of the keyword: the image HDU, falling back to the primary one
+func (f *File) header(key string) Header {
+	if _, ok := f.Image.Get(key); ok {
+		return f.Image.Header
+	}
+	return f.Primary.Header
+}
+
+// Metadata returns the main properties of the image. Keywords are
+// taken from the image HDU, falling back to the primary one.
+func (f *File) Metadata() map[string]string {
+	metadata := map[string]string{
+		"NAXIS1": strconv.Itoa(f.Width()),
+		"NAXIS2": strconv.Itoa(f.Height()),
+		"BITPIX": strconv.Itoa(f.Image.Bitpix),
+	}
+	for _, key := range []string{"EXPTIME", "EXPOSURE", "GAIN", "CCD-TEMP", "DATE-OBS", "INSTRUME", "BAYERPAT", "OBJECT"} {
+		if value, ok := f.header(key).Get(key); ok {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+// Exposure time, from the EXPTIME or the older EXPOSURE keyword
+func (f *File) Exposure() (time.Duration, bool) {
+	for _, key := range []string{"EXPTIME", "EXPOSURE"} {
+		if seconds, ok := f.header(key).Float(key); ok && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+// Gain of the sensor, from the GAIN keyword. Some capture
+// software writes it as a float, it is rounded.
+func (f *File) Gain() (int, bool) {
+	gain, ok := f.header("GAIN").Float("GAIN")
+	if !ok || gain <= 0 {
+		return 0, false
+	}
+	return int(math.Round(gain)), true
+}
+
+// Pixels returns the physical values (BZERO + BSCALE * raw) of the
+// first plane of the image, in the file order (bottom row first).
+func (f *File) Pixels() ([]float32, error) {
+	width, height := f.Width(), f.Height()
+	bzero, ok := f.Image.Float("BZERO")
+	if !ok {
+		bzero = 0
+	}
+	bscale, ok := f.Image.Float("BSCALE")
+	if !ok {
+		bscale = 1
+	}
+	bytesPerPixel := f.Image.Bitpix / 8
+	if bytesPerPixel < 0 {
+		bytesPerPixel = -bytesPerPixel
+	}
+	reader := bufio.NewReaderSize(io.NewSectionReader(f.r, f.Image.Offset, int64(width*height*bytesPerPixel)), 1<<16)
+	pixels := make([]float32, width*height)
+	raw := make([]byte, bytesPerPixel)
+	for i := range pixels {
+		if _, err := io.ReadFull(reader, raw); err != nil {
+			return nil, TruncatedError
+		}
+		var value float64
+		switch f.Image.Bitpix {
+		case 8:
+			value = float64(raw[0])
+		case 16:
+			value = float64(int16(binary.BigEndian.Uint16(raw)))
+		case 32:
+			value = float64(int32(binary.BigEndian.Uint32(raw)))
+		case -32:
+			value = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+		case -64:
+			value = math.Float64frombits(binary.BigEndian.Uint64(raw))
+		}
+		pixels[i] = float32(bzero + bscale*value)
+	}
+	return pixels, nil
+}
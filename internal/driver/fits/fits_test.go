@@ -0,0 +1,84 @@
+package fits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testFITS builds a 16 bit unsigned FITS image with a gradient
+func testFITS(width, height int) []byte {
+	var buf bytes.Buffer
+	cards := []string{
+		"SIMPLE  =                    T",
+		"BITPIX  =                   16",
+		"NAXIS   =                    2",
+		fmt.Sprintf("NAXIS1  = %20d", width),
+		fmt.Sprintf("NAXIS2  = %20d", height),
+		"BZERO   =                32768",
+		"BSCALE  =                    1",
+		"EXPTIME =                  2.5 / exposure in seconds",
+		"GAIN    =                120.0",
+		"INSTRUME= 'ZWO ASI294MC Pro'",
+		"COMMENT   some comment",
+		"END",
+	}
+	for _, card := range cards {
+		fmt.Fprintf(&buf, "%-80s", card)
+	}
+	buf.Write(bytes.Repeat([]byte(" "), blockSize-buf.Len()))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint16(y * 65535 / (height - 1))
+			binary.Write(&buf, binary.BigEndian, int16(int32(value)-32768))
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	data := testFITS(4, 3)
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := f.Metadata()
+	if metadata["EXPTIME"] != "2.5" || metadata["INSTRUME"] != "ZWO ASI294MC Pro" || metadata["NAXIS1"] != "4" {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+	if exposure, ok := f.Exposure(); !ok || exposure != 2500*time.Millisecond {
+		t.Errorf("unexpected exposure %v", exposure)
+	}
+	if gain, ok := f.Gain(); !ok || gain != 120 {
+		t.Errorf("unexpected gain %d", gain)
+	}
+	pixels, err := f.Pixels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pixels[0] != 0 || pixels[len(pixels)-1] != 65535 {
+		t.Fatalf("unexpected pixels %v", pixels)
+	}
+	preview, width, height, err := f.Preview(Stretch{Low: 0, High: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bottom row of the file is the last row of the preview
+	if width != 4 || height != 3 || preview[0] != 255 || preview[len(preview)-1] != 0 {
+		t.Fatalf("unexpected preview %v", preview)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := testFITS(4, 3)
+	data = data[:len(data)-2]
+	if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, TruncatedError) {
+		t.Fatalf("expected truncated, got %v", err)
+	}
+	if _, err := Open(bytes.NewReader([]byte("RIFF....AVI ")), 12); !errors.Is(err, NotFITSError) {
+		t.Fatalf("expected not FITS, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package fits
+
+import (
+	"math"
+	"sort"
+)
+
+// Stretch configures the conversion of the image to 8 bits
+type Stretch struct {
+	Low     float64 // fraction of pixels clipped to black
+	High    float64 // fraction of pixels not clipped to white
+	Asinh   float64 // strength of the asinh stretch, 0 for linear
+	MaxSize int     // maximum width or height of the preview, 0 for no limit
+}
+
+// DefaultStretch works well for most deep sky and planetary images
+var DefaultStretch = Stretch{
+	Low:     0.001,
+	High:    0.999,
+	Asinh:   10,
+	MaxSize: 1920,
+}
+
+// Number of pixels sampled to estimate the clipping levels
+const stretchSamples = 1 << 16
+
+// levels returns the values at the low and high percentiles
+func levels(pixels []float32, low, high float64) (float64, float64) {
+	step := len(pixels) / stretchSamples
+	if step < 1 {
+		step = 1
+	}
+	samples := make([]float64, 0, len(pixels)/step+1)
+	for i := 0; i < len(pixels); i += step {
+		if v := float64(pixels[i]); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			samples = append(samples, v)
+		}
+	}
+	if len(samples) == 0 {
+		return 0, 1
+	}
+	sort.Float64s(samples)
+	at := func(fraction float64) float64 {
+		index := int(fraction * float64(len(samples)-1))
+		if index < 0 {
+			index = 0
+		}
+		if index >= len(samples) {
+			index = len(samples) - 1
+		}
+		return samples[index]
+	}
+	black, white := at(low), at(high)
+	if white <= black {
+		white = black + 1
+	}
+	return black, white
+}
+
+// Preview renders the first plane of the image as 8 bit grayscale,
+// top row first. The image is binned down to fit in MaxSize.
+// Returns the pixels, width and height of the preview.
+func (f *File) Preview(stretch Stretch) ([]byte, int, int, error) {
+	pixels, err := f.Pixels()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	width, height := f.Width(), f.Height()
+	bin := 1
+	if stretch.MaxSize > 0 {
+		for width/bin > stretch.MaxSize || height/bin > stretch.MaxSize {
+			bin += 1
+		}
+	}
+	black, white := levels(pixels, stretch.Low, stretch.High)
+	scale := 1 / (white - black)
+	norm := 1.0
+	if stretch.Asinh > 0 {
+		norm = 1 / math.Asinh(stretch.Asinh)
+	}
+	outWidth, outHeight := width/bin, height/bin
+	if outWidth < 1 || outHeight < 1 {
+		return nil, 0, 0, NoImageError
+	}
+	output := make([]byte, outWidth*outHeight)
+	for y := 0; y < outHeight; y++ {
+		// FITS images are stored bottom row first
+		row := (outHeight - 1 - y) * outWidth
+		for x := 0; x < outWidth; x++ {
+			var sum float64
+			var count int
+			for by := 0; by < bin; by++ {
+				offset := (y*bin+by)*width + x*bin
+				for bx := 0; bx < bin; bx++ {
+					if v := float64(pixels[offset+bx]); !math.IsNaN(v) {
+						sum += v
+						count += 1
+					}
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			v := (sum/float64(count) - black) * scale
+			if v <= 0 {
+				continue
+			}
+			if v > 1 {
+				v = 1
+			}
+			if stretch.Asinh > 0 {
+				v = math.Asinh(v*stretch.Asinh) * norm
+			}
+			output[row+x] = byte(v*255 + 0.5)
+		}
+	}
+	return output, outWidth, outHeight, nil
+}
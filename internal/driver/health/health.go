@@ -0,0 +1,179 @@
+// Package health aggregates component checks into liveness
+// (/healthz) and readiness (/readyz) endpoints.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+var (
+	componentHealth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_component_healthy",
+			Help: "Result of the last health check of each component (1 healthy)",
+		},
+		[]string{"component"},
+	)
+)
+
+// Paths of the endpoints
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Maximum time allowed for all the checks
+const checkTimeout = 5 * time.Second
+
+// Kind of check
+type Kind int
+
+const (
+	// Liveness checks fail both /healthz and /readyz.
+	// Use them for conditions that require a restart.
+	Liveness Kind = iota
+	// Readiness checks only fail /readyz
+	Readiness
+)
+
+// Status of a check
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusFail Status = "fail"
+)
+
+// Check returns nil if the component is healthy. The detail
+// is included in the response, whatever the result.
+type Check func(ctx context.Context) (detail interface{}, err error)
+
+// Result of a component check
+type Result struct {
+	Status  Status      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+	Elapsed string      `json:"elapsed"`
+}
+
+// Report of all the checks
+type Report struct {
+	Status     Status            `json:"status"`
+	Time       time.Time         `json:"time"`
+	Components map[string]Result `json:"components"`
+}
+
+type component struct {
+	name  string
+	kind  Kind
+	check Check
+}
+
+// Registry of component checks
+type Registry struct {
+	mutex      sync.Mutex
+	components []component
+}
+
+// Register a check. Registering the same name replaces the check.
+func (r *Registry) Register(name string, kind Kind, check Check) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, c := range r.components {
+		if c.name == name {
+			r.components[i] = component{name: name, kind: kind, check: check}
+			return
+		}
+	}
+	r.components = append(r.components, component{name: name, kind: kind, check: check})
+	sort.Slice(r.components, func(i, j int) bool { return r.components[i].name < r.components[j].name })
+}
+
+// Run the checks of the given kinds concurrently
+func (r *Registry) Run(ctx context.Context, kinds ...Kind) Report {
+	r.mutex.Lock()
+	selected := make([]component, 0, len(r.components))
+	for _, c := range r.components {
+		for _, kind := range kinds {
+			if c.kind == kind {
+				selected = append(selected, c)
+				break
+			}
+		}
+	}
+	r.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	results := make([]Result, len(selected))
+	var wg sync.WaitGroup
+	for i, c := range selected {
+		wg.Add(1)
+		go func(i int, c component) {
+			defer wg.Done()
+			results[i] = run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	report := Report{
+		Status:     StatusOK,
+		Time:       time.Now(),
+		Components: make(map[string]Result, len(selected)),
+	}
+	for i, c := range selected {
+		report.Components[c.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, c component) Result {
+	start := time.Now()
+	detail, err := c.check(ctx)
+	result := Result{
+		Status:  StatusOK,
+		Detail:  detail,
+		Elapsed: time.Since(start).String(),
+	}
+	healthy := 1.0
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+		healthy = 0
+	}
+	componentHealth.WithLabelValues(c.name).Set(healthy)
+	return result
+}
+
+// Handler runs the checks of the given kinds, and replies with
+// 200 if all of them succeed, 503 otherwise.
+func (r *Registry) Handler(logger servicelog.Logger, kinds ...Kind) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := r.Run(req.Context(), kinds...)
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+			logger.Debug("health check failed", servicelog.String("path", req.URL.Path), servicelog.Any("report", report))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if req.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(report)
+		}
+	})
+}
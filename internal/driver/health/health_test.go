@@ -0,0 +1,47 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestHandler(t *testing.T) {
+	var registry Registry
+	registry.Register("pipeline", Liveness, func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	registry.Register("camera", Readiness, func(ctx context.Context) (interface{}, error) {
+		return map[string]int{"connected": 0}, errors.New("no camera detected")
+	})
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+
+	for _, tc := range []struct {
+		name       string
+		handler    http.Handler
+		status     int
+		components int
+	}{
+		{"liveness", registry.Handler(logger, Liveness), http.StatusOK, 1},
+		{"readiness", registry.Handler(logger, Liveness, Readiness), http.StatusServiceUnavailable, 2},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		var report Report
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Components) != tc.components {
+			t.Errorf("%s: expected %d components, got %d", tc.name, tc.components, len(report.Components))
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+var (
+	hookDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "asicamera_hook_duration",
+			Help: "Duration of pre-upload hooks (seconds)",
+			Buckets: []float64{
+				0.1, 1, 5, 30, 60, 300, 1800,
+			},
+		},
+		[]string{"hook", "result"},
+	)
+)
+
+type hookError string
+
+// Error implements error
+func (e hookError) Error() string {
+	return string(e)
+}
+
+const (
+	UnknownProcessorError = hookError("unknown processor")
+	MissingOutputError    = hookError("hook did not produce the output file")
+	OutputIsOriginalError = hookError("hook output must not be the original file")
+)
+
+// Mode decides what happens with the original file after the hook
+type Mode string
+
+const (
+	ModeReplace Mode = "replace" // upload the artefact instead of the original
+	ModeAppend  Mode = "append"  // upload the artefact in addition to the original
+)
+
+// Input describes the file being processed. It is also the
+// data available to the command and output templates.
+type Input struct {
+	Path     string // full path of the original file
+	Dir      string // folder of the original file
+	Base     string // file name, with extension
+	Name     string // file name, without extension
+	Ext      string // extension, including the dot
+	MimeType string
+	WorkDir  string // working folder of this invocation, not shared
+	Output   string // full path of the artefact to produce
+}
+
+// Processor is a hook implemented in Go. It must write
+// the artefact to input.Output.
+type Processor func(ctx context.Context, logger servicelog.Logger, input Input) error
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]Processor)
+)
+
+// Register a Go processor, so it can be referenced by name in a Hook
+func Register(name string, processor Processor) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[name] = processor
+}
+
+func lookup(name string) (Processor, bool) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	processor, ok := registry[name]
+	return processor, ok
+}
+
+// Hook configures a processing stage for some mime types.
+// Either Command or Processor must be set.
+type Hook struct {
+	Name       string
+	MimeTypes  []string      // mime type prefixes
+	Command    []string      // command and arguments, as templates over Input
+	Processor  string        // name of a registered Go processor
+	Output     string        // artefact path template, relative to WorkDir
+	OutputType string        // mime type of the artefact, defaults to the original
+	Mode       Mode          // replace or append
+	Timeout    time.Duration // 0 means no timeout
+	WorkDir    string        // parent of the working folders, defaults to the system temp dir
+	KeepOutput bool          // do not remove the artefact after upload
+}
+
+// Artefact to be uploaded
+type Artefact struct {
+	Path      string
+	MimeType  string
+	Generated bool // true if produced by a hook
+}
+
+// Result of processing a file
+type Result struct {
+	Original  string
+	Replaced  bool // true if the original was replaced by the artefact
+	Artefacts []Artefact
+	cleanup   []string
+}
+
+// Cleanup removes the artefacts generated by the hooks,
+// and their working folder. The original file is never removed.
+func (r Result) Cleanup() {
+	for _, path := range r.cleanup {
+		if samePath(path, r.Original) {
+			continue
+		}
+		os.RemoveAll(path)
+	}
+}
+
+// samePath returns true if both paths name the same file
+func samePath(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// within returns true if path is inside the folder dir
+func within(path, dir string) bool {
+	return strings.HasPrefix(filepath.Clean(path), filepath.Clean(dir)+string(filepath.Separator))
+}
+
+type compiledHook struct {
+	Hook
+	command   []*template.Template
+	output    *template.Template
+	processor Processor
+}
+
+// Runner runs the hooks matching each file
+type Runner struct {
+	logger servicelog.Logger
+	hooks  []compiledHook
+}
+
+// New builds a Runner for the given hooks. Templates and processor
+// names are validated here, so configuration errors surface at startup.
+func New(logger servicelog.Logger, hooks []Hook) (*Runner, error) {
+	r := &Runner{
+		logger: logger,
+		hooks:  make([]compiledHook, 0, len(hooks)),
+	}
+	for _, hook := range hooks {
+		compiled, err := compile(hook)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %w", hook.Name, err)
+		}
+		r.hooks = append(r.hooks, compiled)
+	}
+	return r, nil
+}
+
+// Validate the hook configuration without building a Runner
+func Validate(hooks []Hook) error {
+	for _, hook := range hooks {
+		if _, err := compile(hook); err != nil {
+			return fmt.Errorf("hook %s: %w", hook.Name, err)
+		}
+	}
+	return nil
+}
+
+func compile(hook Hook) (compiledHook, error) {
+	if hook.Mode == "" {
+		hook.Mode = ModeReplace
+	}
+	if hook.Mode != ModeReplace && hook.Mode != ModeAppend {
+		return compiledHook{}, fmt.Errorf("mode %q is not one of replace, append", hook.Mode)
+	}
+	if hook.WorkDir == "" {
+		hook.WorkDir = filepath.Join(os.TempDir(), "asicamera-hooks")
+	}
+	if hook.Output == "" {
+		hook.Output = "{{.Base}}"
+	}
+	compiled := compiledHook{Hook: hook}
+	var err error
+	if compiled.output, err = template.New("output").Parse(hook.Output); err != nil {
+		return compiledHook{}, err
+	}
+	// In place processing would remove the original after upload
+	probe := Input{
+		Path:    filepath.Join("probe", "folder", "capture.ext"),
+		Dir:     filepath.Join("probe", "folder"),
+		Base:    "capture.ext",
+		Name:    "capture",
+		Ext:     ".ext",
+		WorkDir: filepath.Join("probe", "work"),
+	}
+	if output, err := render(compiled.output, probe); err == nil && samePath(output, probe.Path) {
+		return compiledHook{}, OutputIsOriginalError
+	}
+	switch {
+	case len(hook.Command) > 0 && hook.Processor != "":
+		return compiledHook{}, errors.New("only one of command or processor can be set")
+	case len(hook.Command) > 0:
+		for i, arg := range hook.Command {
+			tmpl, err := template.New(fmt.Sprintf("arg%d", i)).Parse(arg)
+			if err != nil {
+				return compiledHook{}, err
+			}
+			compiled.command = append(compiled.command, tmpl)
+		}
+	case hook.Processor != "":
+		processor, ok := lookup(hook.Processor)
+		if !ok {
+			return compiledHook{}, fmt.Errorf("%w %s", UnknownProcessorError, hook.Processor)
+		}
+		compiled.processor = processor
+	default:
+		return compiledHook{}, errors.New("either command or processor must be set")
+	}
+	return compiled, nil
+}
+
+// match returns the first hook for the mime type, or nil
+func (r *Runner) match(mimeType string) *compiledHook {
+	if r == nil {
+		return nil
+	}
+	for i := range r.hooks {
+		for _, prefix := range r.hooks[i].MimeTypes {
+			if strings.HasPrefix(mimeType, prefix) {
+				return &r.hooks[i]
+			}
+		}
+	}
+	return nil
+}
+
+func render(tmpl *template.Template, input Input) (string, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, input); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// Process runs the first hook matching the mime type of the file,
+// and returns the artefacts to upload. If no hook matches, the only
+// artefact is the original file. A nil Runner does nothing.
+func (r *Runner) Process(ctx context.Context, path, mimeType string) (Result, error) {
+	original := Artefact{Path: path, MimeType: mimeType}
+	result := Result{Original: path, Artefacts: []Artefact{original}}
+	hook := r.match(mimeType)
+	if hook == nil {
+		return result, nil
+	}
+	logger := r.logger.With(servicelog.String("hook", hook.Name), servicelog.String("path", path))
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	input := Input{
+		Path:     path,
+		Dir:      filepath.Dir(path),
+		Base:     base,
+		Name:     strings.TrimSuffix(base, ext),
+		Ext:      ext,
+		MimeType: mimeType,
+	}
+	// Each invocation gets its own folder, so files with the
+	// same name in different folders do not overwrite each other.
+	if err := os.MkdirAll(hook.WorkDir, 0755); err != nil {
+		return result, fmt.Errorf("hook %s: failed to create workdir: %w", hook.Name, err)
+	}
+	workDir, err := os.MkdirTemp(hook.WorkDir, input.Name+"-")
+	if err != nil {
+		return result, fmt.Errorf("hook %s: failed to create workdir: %w", hook.Name, err)
+	}
+	input.WorkDir = workDir
+	output, err := render(hook.output, input)
+	if err != nil {
+		os.RemoveAll(workDir)
+		return result, fmt.Errorf("hook %s: failed to render output: %w", hook.Name, err)
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(workDir, output)
+	}
+	if samePath(output, path) {
+		os.RemoveAll(workDir)
+		return result, fmt.Errorf("hook %s: %w", hook.Name, OutputIsOriginalError)
+	}
+	input.Output = output
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+	logger.Info("running hook", servicelog.String("output", output))
+	start := time.Now()
+	if hook.processor != nil {
+		err = hook.processor(ctx, logger, input)
+	} else {
+		err = r.command(ctx, logger, hook, input)
+	}
+	if err == nil {
+		if _, statErr := os.Stat(output); statErr != nil {
+			err = fmt.Errorf("%w: %s", MissingOutputError, output)
+		}
+	}
+	if err != nil {
+		hookDuration.WithLabelValues(hook.Name, "failure").Observe(time.Since(start).Seconds())
+		logger.Error("hook failed", servicelog.Error(err))
+		os.Remove(output)
+		os.RemoveAll(workDir)
+		return result, fmt.Errorf("hook %s failed: %w", hook.Name, err)
+	}
+	hookDuration.WithLabelValues(hook.Name, "success").Observe(time.Since(start).Seconds())
+	outputType := hook.OutputType
+	if outputType == "" {
+		outputType = mimeType
+	}
+	artefact := Artefact{Path: output, MimeType: outputType, Generated: true}
+	if hook.Mode == ModeReplace {
+		result.Replaced = true
+		result.Artefacts = []Artefact{artefact}
+	} else {
+		result.Artefacts = append(result.Artefacts, artefact)
+	}
+	switch {
+	case !hook.KeepOutput:
+		result.cleanup = append(result.cleanup, output, workDir)
+	case !within(output, workDir):
+		// The artefact is kept elsewhere, the working folder is not needed
+		result.cleanup = append(result.cleanup, workDir)
+	}
+	return result, nil
+}
+
+// Maximum amount of command output kept for error messages
+const maxCommandOutput = 4096
+
+// command runs an external command hook
+func (r *Runner) command(ctx context.Context, logger servicelog.Logger, hook *compiledHook, input Input) error {
+	args := make([]string, 0, len(hook.command))
+	for _, tmpl := range hook.command {
+		arg, err := render(tmpl, input)
+		if err != nil {
+			return err
+		}
+		args = append(args, arg)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = input.WorkDir
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if output.Len() > 0 {
+		logger.Debug("hook output", servicelog.String("output", output.String()))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		text := strings.TrimSpace(output.String())
+		if len(text) > maxCommandOutput {
+			text = text[len(text)-maxCommandOutput:]
+		}
+		if text != "" {
+			return fmt.Errorf("%w: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestProcess(t *testing.T) {
+	Register("test-upper", func(ctx context.Context, logger servicelog.Logger, input Input) error {
+		return os.WriteFile(input.Output, []byte("processed"), 0644)
+	})
+	dir := t.TempDir()
+	original := filepath.Join(dir, "capture.avi")
+	if err := os.WriteFile(original, []byte("raw"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []Mode{ModeReplace, ModeAppend} {
+		t.Run(string(mode), func(t *testing.T) {
+			runner, err := New(servicelog.Logger{Logger: zap.NewNop()}, []Hook{{
+				Name:       "test",
+				MimeTypes:  []string{"video/"},
+				Processor:  "test-upper",
+				Output:     "{{.Name}}.mp4",
+				OutputType: "video/mp4",
+				Mode:       mode,
+				WorkDir:    filepath.Join(dir, "work"),
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := runner.Process(context.Background(), original, "video/x-msvideo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := result.Artefacts[len(result.Artefacts)-1]
+			output := last.Path
+			workDir := filepath.Dir(output)
+			if filepath.Base(output) != "capture.mp4" || filepath.Dir(workDir) != filepath.Join(dir, "work") || last.MimeType != "video/mp4" {
+				t.Fatalf("unexpected artefact %+v", last)
+			}
+			if want := map[Mode]int{ModeReplace: 1, ModeAppend: 2}[mode]; len(result.Artefacts) != want {
+				t.Fatalf("got %d artefacts, want %d", len(result.Artefacts), want)
+			}
+			result.Cleanup()
+			if _, err := os.Stat(output); !os.IsNotExist(err) {
+				t.Fatalf("artefact not cleaned up: %v", err)
+			}
+			if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+				t.Fatalf("workdir not cleaned up: %v", err)
+			}
+		})
+	}
+	// Files without a matching hook are uploaded as is
+	runner, _ := New(servicelog.Logger{Logger: zap.NewNop()}, nil)
+	result, err := runner.Process(context.Background(), original, "image/jpeg")
+	if err != nil || len(result.Artefacts) != 1 || result.Artefacts[0].Path != original {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+}
+
+func TestProcessSameName(t *testing.T) {
+	Register("test-copy", func(ctx context.Context, logger servicelog.Logger, input Input) error {
+		data, err := os.ReadFile(input.Path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(input.Output, data, 0644)
+	})
+	runner, err := New(servicelog.Logger{Logger: zap.NewNop()}, []Hook{{
+		Name:      "test",
+		MimeTypes: []string{"image/"},
+		Processor: "test-copy",
+		Output:    "{{.Name}}.preview.jpg",
+		Mode:      ModeAppend,
+		WorkDir:   t.TempDir(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files with the same name in different folders, processed
+	// before the previous artefact is uploaded and cleaned up
+	dir := t.TempDir()
+	var results []Result
+	for _, folder := range []string{"night1", "night2"} {
+		path := filepath.Join(dir, folder, "light.fits")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(folder), 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := runner.Process(context.Background(), path, "image/fits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer result.Cleanup()
+		results = append(results, result)
+	}
+	first, second := results[0].Artefacts[1].Path, results[1].Artefacts[1].Path
+	if first == second {
+		t.Fatalf("both artefacts written to %s", first)
+	}
+	if data, err := os.ReadFile(first); err != nil || string(data) != "night1" {
+		t.Errorf("first artefact overwritten: %q, %v", data, err)
+	}
+}
+
+func TestOutputIsOriginal(t *testing.T) {
+	for _, output := range []string{"{{.Path}}", "{{.Dir}}/{{.Base}}"} {
+		err := Validate([]Hook{{Name: "inplace", Command: []string{"true"}, Output: output}})
+		if !errors.Is(err, OutputIsOriginalError) {
+			t.Errorf("output %s: got error %v", output, err)
+		}
+	}
+}
+
+func TestKeepOutputSubfolder(t *testing.T) {
+	Register("test-nested", func(ctx context.Context, logger servicelog.Logger, input Input) error {
+		if err := os.MkdirAll(filepath.Dir(input.Output), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(input.Output, []byte("processed"), 0644)
+	})
+	runner, err := New(servicelog.Logger{Logger: zap.NewNop()}, []Hook{{
+		Name:       "test",
+		MimeTypes:  []string{"video/"},
+		Processor:  "test-nested",
+		Output:     "{{.Name}}/out.mp4",
+		WorkDir:    t.TempDir(),
+		KeepOutput: true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := filepath.Join(t.TempDir(), "capture.avi")
+	if err := os.WriteFile(original, []byte("raw"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := runner.Process(context.Background(), original, "video/x-msvideo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Cleanup()
+	if _, err := os.Stat(result.Artefacts[0].Path); err != nil {
+		t.Errorf("kept artefact removed: %v", err)
+	}
+	if _, err := os.Stat(original); err != nil {
+		t.Errorf("original removed: %v", err)
+	}
+}
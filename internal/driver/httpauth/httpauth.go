@@ -0,0 +1,243 @@
+// Package httpauth protects the routes of the local HTTP server
+// with per-prefix authentication policies.
+package httpauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+var (
+	authRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_http_auth",
+			Help: "Authentication results of the local HTTP server",
+		},
+		[]string{"prefix", "result"},
+	)
+)
+
+// Method of authentication
+type Method string
+
+const (
+	MethodBasic   Method = "basic"   // HTTP Basic auth against the configured users
+	MethodBearer  Method = "bearer"  // Static bearer tokens
+	MethodBackend Method = "backend" // HTTP Basic auth validated by the backend login
+)
+
+// Prefix of the passwords stored as a sha256 hex digest
+const sha256Prefix = "sha256:"
+
+// Policy for the paths starting with Prefix. The request is
+// accepted if any of the Methods succeeds. No Methods means
+// no authentication.
+type Policy struct {
+	Prefix  string
+	Methods []Method
+	Users   map[string]string // username to password, or sha256:<hex digest>
+	Tokens  []string
+}
+
+// LoginFunc validates the credentials against the backend
+type LoginFunc func(ctx context.Context, username, password string) error
+
+// Validate the policies
+func Validate(policies []Policy) error {
+	prefixes := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		if !strings.HasPrefix(policy.Prefix, "/") {
+			return fmt.Errorf("auth prefix %q must start with /", policy.Prefix)
+		}
+		if prefixes[policy.Prefix] {
+			return fmt.Errorf("auth prefix %q is duplicated", policy.Prefix)
+		}
+		prefixes[policy.Prefix] = true
+		for _, method := range policy.Methods {
+			switch method {
+			case MethodBasic:
+				if len(policy.Users) == 0 {
+					return fmt.Errorf("auth prefix %q: basic method requires users", policy.Prefix)
+				}
+			case MethodBearer:
+				if len(policy.Tokens) == 0 {
+					return fmt.Errorf("auth prefix %q: bearer method requires tokens", policy.Prefix)
+				}
+			case MethodBackend:
+			default:
+				return fmt.Errorf("auth prefix %q: method %q is not one of basic, bearer, backend", policy.Prefix, method)
+			}
+		}
+	}
+	return nil
+}
+
+// Authenticator applies the policies
+type Authenticator struct {
+	logger   servicelog.Logger
+	policies []Policy // sorted by decreasing prefix length
+	login    LoginFunc
+	cacheFor time.Duration
+	// Credentials recently accepted or rejected by the backend, by digest
+	mutex    sync.Mutex
+	accepted map[string]time.Time
+	rejected map[string]time.Time
+}
+
+// Rejected backend logins are cached for a short time, so that
+// clients retrying bad credentials do not load the backend
+const rejectFor = 30 * time.Second
+
+// New Authenticator. Backend logins are cached for the given duration,
+// login can be nil if no policy uses MethodBackend.
+func New(logger servicelog.Logger, policies []Policy, login LoginFunc, cacheFor time.Duration) (*Authenticator, error) {
+	if err := Validate(policies); err != nil {
+		return nil, err
+	}
+	sorted := make([]Policy, len(policies))
+	copy(sorted, policies)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	return &Authenticator{
+		logger:   logger,
+		policies: sorted,
+		login:    login,
+		cacheFor: cacheFor,
+		accepted: make(map[string]time.Time),
+		rejected: make(map[string]time.Time),
+	}, nil
+}
+
+// policy for the path, the one with the longest matching prefix
+func (a *Authenticator) policy(path string) (Policy, bool) {
+	for _, policy := range a.policies {
+		if strings.HasPrefix(path, policy.Prefix) {
+			return policy, true
+		}
+	}
+	return Policy{}, false
+}
+
+// Wrap the handler with authentication
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, found := a.policy(r.URL.Path)
+		if !found || len(policy.Methods) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.allowed(r, policy) {
+			authRequests.WithLabelValues(policy.Prefix, "accepted").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		authRequests.WithLabelValues(policy.Prefix, "rejected").Inc()
+		a.logger.Debug("unauthorized request", servicelog.String("path", r.URL.Path), servicelog.String("remote", r.RemoteAddr))
+		for _, method := range policy.Methods {
+			if method == MethodBasic || method == MethodBackend {
+				w.Header().Set("WWW-Authenticate", `Basic realm="asicamera", charset="UTF-8"`)
+				break
+			}
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (a *Authenticator) allowed(r *http.Request, policy Policy) bool {
+	username, password, hasBasic := r.BasicAuth()
+	token, hasBearer := bearerToken(r)
+	for _, method := range policy.Methods {
+		switch {
+		case method == MethodBasic && hasBasic:
+			if stored, ok := policy.Users[username]; ok && checkPassword(stored, password) {
+				return true
+			}
+		case method == MethodBearer && hasBearer:
+			for _, candidate := range policy.Tokens {
+				if equal(candidate, token) {
+					return true
+				}
+			}
+		case method == MethodBackend && hasBasic && a.login != nil:
+			if a.backendLogin(r.Context(), username, password) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backendLogin validates the credentials with the backend, or the cache
+func (a *Authenticator) backendLogin(ctx context.Context, username, password string) bool {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := string(sum[:])
+	now := time.Now()
+	a.mutex.Lock()
+	accepted, isAccepted := a.accepted[key]
+	rejected, isRejected := a.rejected[key]
+	a.mutex.Unlock()
+	if isAccepted && now.Before(accepted) {
+		return true
+	}
+	if isRejected && now.Before(rejected) {
+		return false
+	}
+	err := a.login(ctx, username, password)
+	if err != nil {
+		a.logger.Info("backend login rejected", servicelog.String("username", username), servicelog.Error(err))
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err != nil {
+		remember(a.rejected, key, now, now.Add(rejectFor))
+		return false
+	}
+	remember(a.accepted, key, now, now.Add(a.cacheFor))
+	return true
+}
+
+// remember the key until the given time, and expire the old
+// entries, so the cache does not grow forever
+func remember(cache map[string]time.Time, key string, now, until time.Time) {
+	for k, v := range cache {
+		if now.After(v) {
+			delete(cache, k)
+		}
+	}
+	cache[key] = until
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// checkPassword compares the password with the stored value,
+// which can be the plain password or its sha256 digest.
+func checkPassword(stored, password string) bool {
+	if strings.HasPrefix(stored, sha256Prefix) {
+		sum := sha256.Sum256([]byte(password))
+		return equal(strings.ToLower(strings.TrimPrefix(stored, sha256Prefix)), hex.EncodeToString(sum[:]))
+	}
+	return equal(stored, password)
+}
+
+// equal compares in constant time
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
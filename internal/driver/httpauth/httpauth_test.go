@@ -0,0 +1,77 @@
+package httpauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestWrap(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	logins := 0
+	login := func(ctx context.Context, username, password string) error {
+		logins += 1
+		if username == "operator" && password == "backend" {
+			return nil
+		}
+		return errors.New("rejected")
+	}
+	auth, err := New(servicelog.Logger{Logger: zap.NewNop()}, []Policy{
+		{Prefix: "/metrics", Methods: []Method{MethodBearer, MethodBasic}, Tokens: []string{"scraper"}, Users: map[string]string{"admin": "sha256:" + hex.EncodeToString(sum[:])}},
+		{Prefix: "/api/", Methods: []Method{MethodBackend}},
+		{Prefix: "/api/v1/public", Methods: nil},
+	}, login, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"open path", "/dashboard/", nil, http.StatusOK},
+		{"no credentials", "/metrics", nil, http.StatusUnauthorized},
+		{"bearer", "/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer scraper") }, http.StatusOK},
+		{"wrong bearer", "/metrics", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized},
+		{"basic hashed", "/metrics", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"basic wrong", "/metrics", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"backend", "/api/v1/tasks", func(r *http.Request) { r.SetBasicAuth("operator", "backend") }, http.StatusOK},
+		{"backend cached", "/api/v1/tasks", func(r *http.Request) { r.SetBasicAuth("operator", "backend") }, http.StatusOK},
+		{"backend rejected", "/api/v1/tasks", func(r *http.Request) { r.SetBasicAuth("operator", "wrong") }, http.StatusUnauthorized},
+		{"backend rejected cached", "/api/v1/tasks", func(r *http.Request) { r.SetBasicAuth("operator", "wrong") }, http.StatusUnauthorized},
+		{"longest prefix", "/api/v1/public", nil, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.setup != nil {
+			tc.setup(req)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+	if logins != 2 {
+		t.Errorf("expected 2 backend logins, got %d", logins)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate([]Policy{{Prefix: "/metrics", Methods: []Method{MethodBasic}}}); err == nil {
+		t.Error("basic without users should fail")
+	}
+	if err := Validate([]Policy{{Prefix: "metrics"}}); err == nil {
+		t.Error("relative prefix should fail")
+	}
+}
@@ -0,0 +1,133 @@
+// Package imgstats computes the statistics of raw 8 bit frames that
+// help to check the exposure and the focus remotely: the histogram,
+// mean, median and saturation of each channel, and the sharpness.
+package imgstats
+
+import (
+	"fmt"
+	"math"
+)
+
+// Bins of the full histogram, one per 8 bit value
+const Bins = 256
+
+// Channel statistics
+type Channel struct {
+	Name      string   `json:"name"`
+	Mean      float64  `json:"mean"`
+	Median    int      `json:"median"`
+	Saturated float64  `json:"saturated"` // percent of samples at 255
+	Histogram []uint32 `json:"histogram"`
+}
+
+// Stats of a frame
+type Stats struct {
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Samples  int       `json:"samples"` // pixels sampled
+	Channels []Channel `json:"channels"`
+	// Sharpness is the variance of the Laplacian of the luminance.
+	// Higher is sharper, but it depends on the scene: compare frames
+	// of the same scene while focusing.
+	Sharpness float64 `json:"sharpness"`
+}
+
+// Step between the pixels sampled in each direction, so that
+// about the given number of pixels are sampled
+func Step(width, height, samples int) int {
+	if samples <= 0 {
+		return 1
+	}
+	step := int(math.Sqrt(float64(width) * float64(height) / float64(samples)))
+	if step < 1 {
+		step = 1
+	}
+	return step
+}
+
+// Compute the stats of the pixels, sampling one pixel every step in each
+// direction. bpp is 1 (gray), 3 (RGB) or 4 (RGBA, the alpha is ignored).
+func Compute(pix []byte, width, height, pitch, bpp, step int) Stats {
+	names := []string{"gray"}
+	if bpp >= 3 {
+		names = []string{"red", "green", "blue"}
+	}
+	if step < 1 {
+		step = 1
+	}
+	stats := Stats{
+		Width:    width,
+		Height:   height,
+		Channels: make([]Channel, len(names)),
+	}
+	sums := make([]uint64, len(names))
+	for c, name := range names {
+		stats.Channels[c] = Channel{Name: name, Histogram: make([]uint32, Bins)}
+	}
+	// Laplacian of the luminance, at the sampled pixels not on the border
+	luma := func(offset int) float64 {
+		if bpp < 3 {
+			return float64(pix[offset])
+		}
+		return 0.299*float64(pix[offset]) + 0.587*float64(pix[offset+1]) + 0.114*float64(pix[offset+2])
+	}
+	var lapSum, lapSquares float64
+	var lapCount int
+	for y := step / 2; y < height; y += step {
+		for x := step / 2; x < width; x += step {
+			offset := y*pitch + x*bpp
+			for c := range names {
+				value := pix[offset+c]
+				stats.Channels[c].Histogram[value]++
+				sums[c] += uint64(value)
+			}
+			stats.Samples++
+			if x > 0 && y > 0 && x < width-1 && y < height-1 {
+				lap := luma(offset-bpp) + luma(offset+bpp) + luma(offset-pitch) + luma(offset+pitch) - 4*luma(offset)
+				lapSum += lap
+				lapSquares += lap * lap
+				lapCount++
+			}
+		}
+	}
+	if stats.Samples == 0 {
+		return stats
+	}
+	for c := range stats.Channels {
+		channel := &stats.Channels[c]
+		channel.Mean = float64(sums[c]) / float64(stats.Samples)
+		channel.Saturated = 100 * float64(channel.Histogram[Bins-1]) / float64(stats.Samples)
+		var count uint32
+		for value, bin := range channel.Histogram {
+			count += bin
+			if 2*int(count) >= stats.Samples {
+				channel.Median = value
+				break
+			}
+		}
+	}
+	if lapCount > 0 {
+		mean := lapSum / float64(lapCount)
+		stats.Sharpness = lapSquares/float64(lapCount) - mean*mean
+	}
+	return stats
+}
+
+// Rebin the histograms of the stats to the given number of bins,
+// which must divide 256
+func (s Stats) Rebin(bins int) (Stats, error) {
+	if bins <= 0 || bins > Bins || Bins%bins != 0 {
+		return s, fmt.Errorf("invalid number of bins %d, must divide %d", bins, Bins)
+	}
+	channels := make([]Channel, len(s.Channels))
+	for c, channel := range s.Channels {
+		histogram := make([]uint32, bins)
+		for value, bin := range channel.Histogram {
+			histogram[value*bins/Bins] += bin
+		}
+		channel.Histogram = histogram
+		channels[c] = channel
+	}
+	s.Channels = channels
+	return s, nil
+}
@@ -0,0 +1,70 @@
+package imgstats
+
+import (
+	"testing"
+)
+
+func TestCompute(t *testing.T) {
+	const width, height = 40, 30
+	// Half the frame dark, half saturated, in red only
+	pix := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := (y*width + x) * 3
+			pix[offset+1], pix[offset+2] = 100, 50
+			if x >= width/2 {
+				pix[offset] = 255
+			}
+		}
+	}
+	stats := Compute(pix, width, height, width*3, 3, 1)
+	if stats.Samples != width*height || len(stats.Channels) != 3 {
+		t.Fatalf("got %d samples and %d channels", stats.Samples, len(stats.Channels))
+	}
+	red, green := stats.Channels[0], stats.Channels[1]
+	if red.Saturated != 50 || red.Mean != 127.5 || green.Median != 100 || green.Saturated != 0 {
+		t.Errorf("unexpected stats %+v %+v", red, green)
+	}
+
+	// A blurred edge is less sharp than a hard one
+	sharp := Compute(edge(width, height, 0), width, height, width, 1, 1)
+	blurred := Compute(edge(width, height, 8), width, height, width, 1, 1)
+	if sharp.Sharpness <= blurred.Sharpness || blurred.Sharpness <= 0 {
+		t.Errorf("sharpness %f, blurred %f", sharp.Sharpness, blurred.Sharpness)
+	}
+}
+
+// edge is a gray image with a vertical edge, ramped over blur pixels
+func edge(width, height, blur int) []byte {
+	pix := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := 0
+			switch {
+			case x >= width/2+blur/2:
+				value = 200
+			case x >= width/2-blur/2 && blur > 0:
+				value = 200 * (x - width/2 + blur/2) / blur
+			}
+			pix[y*width+x] = byte(value)
+		}
+	}
+	return pix
+}
+
+func TestRebin(t *testing.T) {
+	stats := Compute([]byte{0, 1, 128, 255}, 4, 1, 4, 1, 1)
+	rebinned, err := stats.Rebin(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := rebinned.Channels[0].Histogram; len(h) != 2 || h[0] != 2 || h[1] != 2 {
+		t.Errorf("got %v", h)
+	}
+	if len(stats.Channels[0].Histogram) != Bins {
+		t.Error("original histogram modified")
+	}
+	if _, err := stats.Rebin(3); err == nil {
+		t.Error("expected error for 3 bins")
+	}
+}
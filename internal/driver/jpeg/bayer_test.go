@@ -0,0 +1,106 @@
+package jpeg
+
+import (
+	"testing"
+)
+
+// mosaic builds a raw frame where each channel has a constant value
+func mosaic(pattern BayerPattern, width, height int, values [3]uint16, bytes int, bigEndian bool) []byte {
+	d, err := NewBayerDecoder(BayerOptions{Pattern: pattern}, FrameCompressor{})
+	if err != nil {
+		panic(err)
+	}
+	sample := map[int]uint16{
+		siteRed:       values[0],
+		siteGreenRed:  values[1],
+		siteGreenBlue: values[1],
+		siteBlue:      values[2],
+	}
+	raw := make([]byte, width*height*bytes)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := sample[d.sites[y&1][x&1]]
+			i := (y*width + x) * bytes
+			switch {
+			case bytes == 1:
+				raw[i] = byte(value)
+			case bigEndian:
+				raw[i], raw[i+1] = byte(value>>8), byte(value)
+			default:
+				raw[i], raw[i+1] = byte(value), byte(value>>8)
+			}
+		}
+	}
+	return raw
+}
+
+func TestDemosaic(t *testing.T) {
+	const width, height = 8, 6
+	for pattern := range bayerPatternNames {
+		for _, algorithm := range []DemosaicAlgorithm{DemosaicBilinear, DemosaicMalvar} {
+			for _, depth := range []int{8, 16} {
+				bytes, values, expected := 1, [3]uint16{200, 100, 50}, [3]byte{200, 100, 50}
+				if depth == 16 {
+					bytes, values = 2, [3]uint16{200 * 257, 100 * 257, 50 * 257}
+				}
+				raw := mosaic(pattern, width, height, values, bytes, true)
+				d, err := NewBayerDecoder(BayerOptions{
+					Pattern:   pattern,
+					BitDepth:  depth,
+					BigEndian: true,
+					Algorithm: algorithm,
+				}, FrameCompressor{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				rgb := make([]byte, width*height*3)
+				if err := d.demosaic(raw, width, height, rgb, d.lut); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < len(rgb); i += 3 {
+					if got := [3]byte{rgb[i], rgb[i+1], rgb[i+2]}; got != expected {
+						t.Fatalf("%s algorithm %d depth %d: pixel %d is %v, expected %v", pattern, algorithm, depth, i/3, got, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDemosaicWhiteBalance(t *testing.T) {
+	const width, height = 4, 4
+	raw := mosaic(BayerGRBG, width, height, [3]uint16{100, 100, 100}, 1, false)
+	d, err := NewBayerDecoder(BayerOptions{
+		Pattern: BayerGRBG,
+		Gains:   WhiteBalance{Red: 1.5, Blue: 3},
+	}, FrameCompressor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgb := make([]byte, width*height*3)
+	if err := d.demosaic(raw, width, height, rgb, d.lut); err != nil {
+		t.Fatal(err)
+	}
+	if got := [3]byte{rgb[0], rgb[1], rgb[2]}; got != [3]byte{150, 100, 255} {
+		t.Errorf("got %v, expected saturated blue", got)
+	}
+	if err := d.demosaic(raw[:10], width, height, rgb, d.lut); err != ErrBayerSize {
+		t.Errorf("expected ErrBayerSize for a truncated frame, got %v", err)
+	}
+}
+
+func TestParseBayerPattern(t *testing.T) {
+	for name, expected := range map[string]BayerPattern{
+		"RGGB":         BayerRGGB,
+		"bggr":         BayerBGGR,
+		"GR":           BayerGRBG,
+		"ASI_BAYER_GB": BayerGBRG,
+	} {
+		if pattern, err := ParseBayerPattern(name); err != nil || pattern != expected {
+			t.Errorf("%s: got %s (%v), expected %s", name, pattern, err, expected)
+		}
+	}
+	if _, err := ParseBayerPattern("CYYM"); err == nil {
+		t.Error("expected error for unsupported pattern")
+	}
+}
@@ -0,0 +1,129 @@
+package jpeg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var pipelineFaults = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "asicamera_pipeline_faults",
+		Help: "Pipeline faults detected by the watchdogs, by kind",
+	},
+	[]string{"camera", "kind"},
+)
+
+// FaultKind identifies the watchdog that detected a fault
+type FaultKind string
+
+const (
+	// FaultNoFreeBuffers means the raw pool had no free buffer
+	// for a whole watchdog interval
+	FaultNoFreeBuffers FaultKind = "no_free_buffers"
+	// FaultFrameStuck means some reader kept a compressed frame
+	// locked for longer than frameStuckTimeout
+	FaultFrameStuck FaultKind = "frame_stuck"
+)
+
+// Time a compressed frame can be locked by readers before it is a fault
+const frameStuckTimeout = 10 * time.Second
+
+// Fault detected by the watchdogs of a pool or pipeline.
+// The pipeline keeps running, the handler decides how to recover.
+type Fault struct {
+	Camera  string
+	Kind    FaultKind
+	Message string
+}
+
+// Error implements error
+func (f Fault) Error() string {
+	return f.Message
+}
+
+// FaultHandler is called by the watchdogs when they detect a fault.
+// It is called from the watchdog goroutine, it must not block.
+type FaultHandler func(Fault)
+
+// faultReporter counts the faults and forwards them to the handler
+type faultReporter struct {
+	mutex   sync.Mutex
+	camera  string
+	handler FaultHandler
+}
+
+// set the camera and the handler
+func (r *faultReporter) set(camera string, handler FaultHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.camera, r.handler = camera, handler
+}
+
+// report a fault. Fault.Camera defaults to the camera of the reporter.
+func (r *faultReporter) report(fault Fault) {
+	r.mutex.Lock()
+	handler := r.handler
+	if fault.Camera == "" {
+		fault.Camera = r.camera
+	}
+	r.mutex.Unlock()
+	pipelineFaults.WithLabelValues(fault.Camera, string(fault.Kind)).Inc()
+	if handler != nil {
+		handler(fault)
+	}
+}
+
+// SetFaultHandler is notified when no raw buffer is freed for a whole
+// watchdog interval. The camera is used for the metrics and the Fault,
+// because the pool does not know the source.
+func (pool *Pool) SetFaultHandler(camera string, handler FaultHandler) {
+	pool.faults.set(camera, handler)
+}
+
+// SetFaultHandler is notified when a compressed frame is stuck.
+// Must be called before the first session.
+func (p *Pipeline) SetFaultHandler(handler FaultHandler) {
+	p.faults.set("", handler)
+}
+
+// Recycle replaces the buffers of the compressed frames. The previous
+// buffers are freed in the background, once the readers holding them
+// are done. Must be called with no session running.
+func (p *Pipeline) Recycle() {
+	retired := p.renditions
+	p.renditions = make([]*rendition, 0, len(retired))
+	for _, r := range retired {
+		p.renditions = append(p.renditions, &rendition{
+			Rendition: r.Rendition,
+			pool:      newJpegPool(len(r.pool.frames), r.pool.imageSize),
+		})
+	}
+	go func() {
+		// Leaks if some reader never calls Done, but the
+		// new buffers are already in use.
+		for _, r := range retired {
+			r.pool.Join()
+		}
+	}()
+}
+
+// Recycle stops the current session, if any, so that its readers
+// disconnect, and replaces the buffers of the pipeline. Readers
+// acquiring the manager afterwards start a new session.
+// It blocks until the frames of the session being compressed are done.
+func (m *SessionManager) Recycle() {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	if m.session != nil {
+		m.cancelFunc()
+		m.session.Join()
+		m.source.Stop()
+		m.session = nil
+	}
+	if !m.cancelled { // the pipeline is being freed otherwise
+		m.pipeline.Recycle()
+	}
+}
@@ -0,0 +1,40 @@
+package jpeg
+
+import (
+	"testing"
+)
+
+func TestFaultReporter(t *testing.T) {
+	var reporter faultReporter
+	reporter.report(Fault{Kind: FaultNoFreeBuffers}) // no handler, only counted
+	var faults []Fault
+	reporter.set("cam0", func(f Fault) { faults = append(faults, f) })
+	reporter.report(Fault{Kind: FaultNoFreeBuffers, Message: "no buffers"})
+	reporter.report(Fault{Camera: "cam1", Kind: FaultFrameStuck})
+	if len(faults) != 2 || faults[0].Camera != "cam0" || faults[1].Camera != "cam1" {
+		t.Errorf("unexpected faults %+v", faults)
+	}
+	if faults[0].Error() != "no buffers" {
+		t.Errorf("unexpected message %q", faults[0].Error())
+	}
+}
+
+func TestPipelineRecycle(t *testing.T) {
+	p := New(nil, nil, 4, 16, Rendition{Name: "full"}, Rendition{Name: "small", Width: 64})
+	before := p.renditions
+	// A reader holding a frame does not block the recycling
+	before[0].pool.frames[1].group.Add(1)
+	p.Recycle()
+	if len(p.renditions) != len(before) {
+		t.Fatalf("got %d renditions, expected %d", len(p.renditions), len(before))
+	}
+	for i, r := range p.renditions {
+		if r.Rendition != before[i].Rendition {
+			t.Errorf("rendition %d changed from %v to %v", i, before[i].Rendition, r.Rendition)
+		}
+		if r.pool == before[i].pool || len(r.pool.frames) != 4 || r.pool.imageSize != 16 {
+			t.Errorf("rendition %d pool not replaced", i)
+		}
+	}
+	before[0].pool.frames[1].group.Done()
+}
@@ -1,40 +1,73 @@
-package jpeg
-
-import (
-	"net/http"
-
-	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
-)
-
-// Track https://github.com/golang/go/issues/54136 for improvements on timeout handling
-func Handler(logger servicelog.Logger, mgr *SessionManager) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" && r.Method != "HEAD" {
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		session, err := mgr.Acquire(logger)
-		if err != nil {
-			logger.Error("Acquiring session failed", servicelog.Error(err))
-			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
-			return
-		}
-		defer mgr.Done()
-
-		frame, _, status := session.Next(1)
-		if frame == nil { // session died
-			logger.Info("session terminated, disconnecting client")
-			return
-		}
-		defer frame.Done()
-		if status != FrameReady {
-			http.Error(w, "Capturing frame failed", http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "image/jpeg")
-		w.WriteHeader(http.StatusOK)
-		w.Write(frame.Slice())
-	})
-}
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Manager provides sessions to the handler. Implemented by *SessionManager.
+type Manager interface {
+	Acquire(servicelog.Logger) (*Session, error)
+	Done()
+}
+
+// Handler returns a snapshot of the stream, with the frame metadata
+// in the headers, and supports conditional requests.
+// Track https://github.com/golang/go/issues/54136 for improvements on timeout handling
+func Handler(logger servicelog.Logger, mgr Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := mgr.Acquire(logger)
+		if err != nil {
+			logger.Error("Acquiring session failed", servicelog.Error(err))
+			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
+			return
+		}
+		defer mgr.Done()
+
+		rendition, err := session.Select(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subscription := session.Subscribe(rendition)
+		defer subscription.Close()
+
+		frame, _, status := subscription.Next(1)
+		if frame == nil { // session died
+			logger.Info("session terminated, disconnecting client")
+			return
+		}
+		if status != FrameReady {
+			frame.Done()
+			http.Error(w, "Capturing frame failed", http.StatusInternalServerError)
+			return
+		}
+		// The frame is copied before sending, so that slow
+		// clients do not keep the compressed frame locked.
+		content := append([]byte(nil), frame.Slice()...)
+		metadata := frame.Metadata()
+		frame.Done()
+
+		// Same image, same tag. Lets clients poll without
+		// downloading the frame again if it has not changed.
+		hash := fnv.New64a()
+		hash.Write(content)
+		for key, values := range metadata.Header() {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, hash.Sum64()))
+		// Handles If-None-Match, If-Modified-Since and HEAD
+		http.ServeContent(w, r, "", metadata.Timestamp, bytes.NewReader(content))
+	})
+}
@@ -1,94 +1,140 @@
-package jpeg
-
-import (
-	"bytes"
-	imagejpeg "image/jpeg"
-	"io"
-	"os"
-	"testing"
-)
-
-func BenchmarkDecompress(b *testing.B) {
-	d := NewDecompressor()
-	defer d.Free()
-
-	img := &Image{}
-	defer img.Free()
-	feat, err := d.ReadFile(os.DirFS("."), "samples/samples.jpg", img)
-	if err != nil {
-		b.Fatal(err)
-	}
-	b.ResetTimer()
-	out := &Image{}
-	for n := 0; n < b.N; n++ {
-		if _, err := d.Decompress(img, feat, out, PF_RGBA, 0); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
-
-func BenchmarkDecompressBuiltin(b *testing.B) {
-	infile, err := os.Open("samples/samples.jpg")
-	if err != nil {
-		b.Fatal(err)
-	}
-	buf, err := io.ReadAll(infile)
-	if err != nil {
-		b.Fatal(err)
-	}
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		if _, err := imagejpeg.Decode(bytes.NewReader(buf)); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
-
-func BenchmarkCompress(b *testing.B) {
-	d := NewDecompressor()
-	defer d.Free()
-
-	img := &Image{}
-	defer img.Free()
-	feat, err := d.ReadFile(os.DirFS("."), "samples/samples.jpg", img)
-	if err != nil {
-		b.Fatal(err)
-	}
-	out := &Image{}
-	defer out.Free()
-	rawFmt, err := d.Decompress(img, feat, out, PF_RGBA, 0)
-	if err != nil {
-		b.Fatal(err)
-	}
-
-	c := NewCompressor()
-	defer c.Free()
-	b.ResetTimer()
-
-	for n := 0; n < b.N; n++ {
-		if _, err := c.Compress(out, rawFmt, img, feat.Subsampling, 95, 0); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
-
-func BenchmarkCompressBuiltin(b *testing.B) {
-	infile, err := os.Open("samples/samples.jpg")
-	if err != nil {
-		b.Fatal(err)
-	}
-	buf, err := io.ReadAll(infile)
-	if err != nil {
-		b.Fatal(err)
-	}
-	image, err := imagejpeg.Decode(bytes.NewReader(buf))
-	w := bytes.NewBuffer(make([]byte, 0, len(buf)))
-
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		w.Reset()
-		if imagejpeg.Encode(w, image, &imagejpeg.Options{Quality: 95}); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
+package jpeg
+
+import (
+	"bytes"
+	imagejpeg "image/jpeg"
+	"io"
+	"os"
+	"testing"
+)
+
+func BenchmarkDecompress(b *testing.B) {
+	d := NewDecompressor()
+	defer d.Free()
+
+	img := &Image{}
+	defer img.Free()
+	feat, err := d.ReadFile(os.DirFS("."), "samples/samples.jpg", img)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	out := &Image{}
+	for n := 0; n < b.N; n++ {
+		if _, err := d.Decompress(img, feat, out, PF_RGBA, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecompressBuiltin(b *testing.B) {
+	infile, err := os.Open("samples/samples.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf, err := io.ReadAll(infile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := imagejpeg.Decode(bytes.NewReader(buf)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	d := NewDecompressor()
+	defer d.Free()
+
+	img := &Image{}
+	defer img.Free()
+	feat, err := d.ReadFile(os.DirFS("."), "samples/samples.jpg", img)
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := &Image{}
+	defer out.Free()
+	rawFmt, err := d.Decompress(img, feat, out, PF_RGBA, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	c := NewCompressor()
+	defer c.Free()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := c.Compress(out, rawFmt, img, feat.Subsampling, 95, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressBuiltin(b *testing.B) {
+	infile, err := os.Open("samples/samples.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf, err := io.ReadAll(infile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	image, err := imagejpeg.Decode(bytes.NewReader(buf))
+	w := bytes.NewBuffer(make([]byte, 0, len(buf)))
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		w.Reset()
+		if imagejpeg.Encode(w, image, &imagejpeg.Options{Quality: 95}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDemosaic(b *testing.B, algorithm DemosaicAlgorithm, depth int) {
+	// Full HD frame, about the size of a binned ASI frame
+	const width, height = 1920, 1080
+	bytes := 1
+	if depth > 8 {
+		bytes = 2
+	}
+	raw := make([]byte, width*height*bytes)
+	for i := range raw {
+		raw[i] = byte(i * 7)
+	}
+	d, err := NewBayerDecoder(BayerOptions{
+		Pattern:   BayerRGGB,
+		BitDepth:  depth,
+		Algorithm: algorithm,
+		Gains:     WhiteBalance{Red: 1.2, Blue: 1.5},
+	}, FrameCompressor{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	rgb := make([]byte, width*height*3)
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := d.demosaic(raw, width, height, rgb, d.lut); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDemosaicBilinear(b *testing.B) {
+	benchmarkDemosaic(b, DemosaicBilinear, 8)
+}
+
+func BenchmarkDemosaicBilinear16(b *testing.B) {
+	benchmarkDemosaic(b, DemosaicBilinear, 16)
+}
+
+func BenchmarkDemosaicMalvar(b *testing.B) {
+	benchmarkDemosaic(b, DemosaicMalvar, 8)
+}
+
+func BenchmarkDemosaicMalvar16(b *testing.B) {
+	benchmarkDemosaic(b, DemosaicMalvar, 16)
+}
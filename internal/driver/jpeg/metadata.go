@@ -0,0 +1,64 @@
+package jpeg
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Metadata of a frame. Sources provide it by implementing MetadataFrame,
+// the pipeline sets the Sequence and defaults the Timestamp.
+type Metadata struct {
+	Sequence  uint64        // frame number in the session
+	Timestamp time.Time     // capture time, or the time the source returned the frame
+	Path      string        // source file, if any
+	Exposure  time.Duration // exposure time, 0 if unknown
+	Gain      int           // sensor gain, 0 if unknown
+}
+
+// CameraSettings returns the exposure and gain the camera is set to,
+// 0 if unknown. Sources use them for the files that do not record them.
+type CameraSettings func() (exposure time.Duration, gain int)
+
+// WithSettings fills the exposure and gain missing in the metadata.
+// A nil settings does nothing.
+func (m Metadata) WithSettings(settings CameraSettings) Metadata {
+	if settings == nil || (m.Exposure > 0 && m.Gain > 0) {
+		return m
+	}
+	exposure, gain := settings()
+	if m.Exposure <= 0 {
+		m.Exposure = exposure
+	}
+	if m.Gain <= 0 {
+		m.Gain = gain
+	}
+	return m
+}
+
+// MetadataFrame is a SrcFrame that knows its capture metadata
+type MetadataFrame interface {
+	SrcFrame
+	Metadata() Metadata
+}
+
+// Header with the metadata, for the HTTP responses and MIME parts
+func (m Metadata) Header() http.Header {
+	header := make(http.Header)
+	header.Set("X-Frame-Number", strconv.FormatUint(m.Sequence, 10))
+	if !m.Timestamp.IsZero() {
+		header.Set("X-Timestamp", m.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	if m.Path != "" {
+		// Only the name, the folders of the server are nobody's business
+		header.Set("X-Source-File", filepath.Base(m.Path))
+	}
+	if m.Exposure > 0 {
+		header.Set("X-Exposure", strconv.FormatFloat(m.Exposure.Seconds(), 'f', -1, 64))
+	}
+	if m.Gain > 0 {
+		header.Set("X-Gain", strconv.Itoa(m.Gain))
+	}
+	return header
+}
@@ -1,522 +1,909 @@
-package jpeg
-
-import (
-	"context"
-	"sync"
-	"sync/atomic"
-	"time"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
-)
-
-// --------------------------------
-// Metrics
-// --------------------------------
-
-var (
-	compressionLatency = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "asicamera_compression_latency",
-			Help: "JPEG Compression latency",
-			Buckets: []float64{
-				10, 30, 60, 120, 250, 500, 1000, 2500,
-			},
-		},
-		[]string{"camera"},
-	)
-
-	streamingSessions = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "asicamera_pipeline_sessions",
-			Help: "Accumulated number of sessions",
-		},
-		[]string{"camera"},
-	)
-
-	sessionDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "asicamera_pipeline_session_duration",
-			Help: "Pipeline session duration (seconds)",
-			Buckets: []float64{
-				1, 60, 1800, 7200, 28800,
-			},
-		},
-		[]string{"camera"},
-	)
-
-	compressionStatus = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "asicamera_compression_status",
-			Help: "Compression results by status",
-		},
-		[]string{"camera", "status"},
-	)
-)
-
-// ---------------------------------
-// Raw Pool - implements a fixed pool of buffers
-// for raw images.
-// ---------------------------------
-
-// Pool manages raw image frames
-type Pool struct {
-	freeList chan *Image
-	poolSize int
-	free     chan struct{} // closed by Free to shutdown the watchdog
-}
-
-// Setup the stream with initial buffers
-func NewPool(poolSize int, imgSize int) *Pool {
-	pool := &Pool{
-		poolSize: poolSize,
-		freeList: make(chan *Image, poolSize),
-		free:     make(chan struct{}),
-	}
-	for i := 0; i < poolSize; i++ {
-		image := &Image{}
-		image.Alloc(imgSize)
-		pool.freeList <- image
-	}
-	go pool.watchdog()
-	return pool
-}
-
-// Adds additional utility information to SrcFrame
-type srcFrame struct {
-	number    uint64
-	camera    string
-	timestamp time.Time
-	SrcFrame
-}
-
-// Stream a source through a SrcFrame channel
-func (pool *Pool) stream(ctx context.Context, logger servicelog.Logger, source Source) chan srcFrame {
-	frames := make(chan srcFrame, pool.poolSize)
-	go func() {
-		defer close(frames)
-		var frameNumber uint64 = 1 // always skip frame 0
-		cameraName := source.Name()
-		for {
-			var (
-				srcImage *Image
-				ok       bool
-				err      error
-			)
-			select {
-			case <-ctx.Done():
-				return
-			case srcImage, ok = <-pool.freeList:
-				if !ok {
-					return
-				}
-				break
-			}
-			newFrame := srcFrame{
-				number: frameNumber,
-				camera: cameraName,
-			}
-			newFrame.SrcFrame, err = source.Next(ctx, srcImage)
-			if err != nil {
-				logger.Error("Failed to get next frame", servicelog.Error(err))
-				pool.freeList <- srcImage // return the image to the free list
-				return
-			}
-			select {
-			case <-ctx.Done():
-				pool.freeList <- srcImage
-				return
-			case frames <- newFrame:
-				frameNumber += 1
-				break
-			}
-		}
-	}()
-	return frames
-}
-
-// Monitors the free list
-func (pool *Pool) watchdog() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-	for {
-		// align with a tick interval
-		select {
-		case <-pool.free:
-			return
-		case <-ticker.C:
-			break
-		}
-		// try to acquire a free buffer before the next tick
-		select {
-		case <-pool.free:
-			return
-		case img, ok := <-pool.freeList:
-			if !ok {
-				return // list closed
-			}
-			pool.freeList <- img
-			break
-		case <-ticker.C:
-			panic("no free raw buffers for 10 seconds")
-		}
-	}
-}
-
-// Free all the resources of the pool
-func (pool *Pool) Free() {
-	close(pool.free) // stop the watchdog
-	// consume all freeList items
-	for i := 0; i < pool.poolSize; i++ {
-		frame := <-pool.freeList
-		frame.Free()
-	}
-	close(pool.freeList)
-}
-
-// -------------------------
-// Frame: contains info about a compressed image,
-// along with the compression status
-// -------------------------
-
-type FrameStatus int
-
-const (
-	FrameEmpty       FrameStatus = iota // Frame has no valid data
-	FrameCompressing                    // Frame is being compressed
-	FrameReady                          // Frame is ready to stream
-	FrameFailed                         // Frame failed to ocmpress
-	FrameStuck                          // frame was not processed because some reader had it locked
-)
-
-var frameStatusNames = []string{
-	"FrameEmpty",
-	"FrameCompressing",
-	"FrameReady",
-	"FrameFailed",
-	"FrameStuck",
-}
-
-// Compressed frame
-type JpegFrame struct {
-	number   uint64
-	image    Image
-	features JpegFeatures
-	status   FrameStatus
-	group    sync.WaitGroup // readers sending the image to clients
-}
-
-// Done tells the compressors they can overwrite the internal buffers
-func (frame *JpegFrame) Done() {
-	frame.group.Done()
-}
-
-// Return the frame content as a byte array.
-// Must not be used after Done
-func (frame *JpegFrame) Slice() []byte {
-	return frame.image.Slice()
-}
-
-// Wait for the frame to be available (nothing in the wait group)
-func (frame *JpegFrame) available(t time.Duration) bool {
-	available := make(chan struct{})
-	go func() {
-		defer close(available)
-		frame.group.Wait() // wait until no readers
-		// The goroutine will leak if there are readers stuck.
-		// But JpegPool will trigger a watchdog that will panic
-		// if the frame is stuck for too long, so this is ok.
-	}()
-	watchdog := time.NewTimer(t)
-	select {
-	case <-available: // everything fine
-		watchdog.Stop()
-		return true
-	case <-watchdog.C:
-		return false
-	}
-}
-
-// ----------------------------
-// JpegPool: hash buffer for compressed images.
-// Hash key is just the frame number - the pool is designed to store
-// consecutive frames.
-// The pool size must be larger than the RawPool buffer size,
-// to avoid overwriting a frame which is still being compressed.
-// ------------------------------
-
-// JpegPool holds a fixed size hash of compressed frames
-type jpegPool struct {
-	sync.Mutex
-	sync.Cond
-	frames []*JpegFrame // Buffer of compressed frames
-}
-
-// New compressed pool
-func newJpegPool(poolSize int, imageSize int) *jpegPool {
-	pool := &jpegPool{
-		frames: make([]*JpegFrame, poolSize),
-	}
-	pool.Cond.L = &(pool.Mutex)
-	for i := 0; i < poolSize; i++ {
-		frame := &JpegFrame{}
-		frame.image.Alloc(imageSize)
-		pool.frames[i] = frame
-	}
-	return pool
-}
-
-// Join waits for all readers to finish and frees compressed pool resources
-func (p *jpegPool) Join() {
-	for i := 0; i < len(p.frames); i++ {
-		p.frames[i].group.Wait()
-		p.frames[i].image.Free()
-	}
-}
-
-// lock a frame for compressing.
-func (pool *jpegPool) hold(frameNumber uint64) (frameIndex int, frame *JpegFrame, oldStatus FrameStatus) {
-	frame, frameIndex = pool.frameAt(frameNumber)
-	pool.Lock()
-	defer pool.Unlock()
-	oldStatus = frame.status
-	if oldStatus == FrameCompressing {
-		return 0, nil, oldStatus // should not happen
-	}
-	frame.number = frameNumber
-	frame.status = FrameCompressing
-	return
-}
-
-// release a frame after compression.
-func (pool *jpegPool) release(frameIndex int, status FrameStatus) {
-	pool.Lock()
-	defer pool.Unlock()
-	pool.frames[frameIndex].status = status
-	pool.Broadcast()
-}
-
-// frameAt returns the frame and frameIndex for the given frameNumber
-func (pool *jpegPool) frameAt(frameNumber uint64) (*JpegFrame, int) {
-	frameIndex := int(frameNumber % uint64(len(pool.frames)))
-	return pool.frames[frameIndex], frameIndex
-}
-
-// ---------------------------
-// Farm: fixed set of compressors
-// ---------------------------
-
-// Task running in a compression farm
-type farmTask struct {
-	rawFrame srcFrame        // Input frame to compress
-	freeList chan *Image     // Return raw image to free list when done
-	jpegPool *jpegPool       // Pool to use for compressed frames
-	group    *sync.WaitGroup // notify on compression finished
-}
-
-// Farm  of compression gophers
-type Farm struct {
-	// Compression gopher group
-	tasks chan farmTask
-	group sync.WaitGroup
-}
-
-// New compression pool
-func NewFarm(logger servicelog.Logger, farmSize, taskSize int) *Farm {
-	farm := &Farm{
-		tasks: make(chan farmTask, taskSize),
-	}
-	// launch the compressors
-	for i := 0; i < farmSize; i++ {
-		farm.group.Add(1)
-		go func() {
-			defer farm.group.Done()
-			compressor := NewCompressor()
-			defer func() {
-				compressor.Free()
-			}()
-			for task := range farm.tasks {
-				compressor = farm.run(logger, compressor, task)
-			}
-		}()
-	}
-	return farm
-}
-
-// Stop closes the task channel and stops accepting tasks
-func (farm *Farm) Stop() {
-	close(farm.tasks)
-	farm.group.Wait()
-}
-
-// Push a task to the pool. Panics if called after Stop()
-func (farm *Farm) push(task farmTask) {
-	farm.tasks <- task
-}
-
-// run a compression task
-func (farm *Farm) run(logger servicelog.Logger, compressor Compressor, task farmTask) Compressor {
-	// Notify the task and release resources at the end
-	defer func() {
-		task.freeList <- task.rawFrame.Buffer()
-		task.group.Done()
-	}()
-	// Get the buffer for compressed frame
-	frameIndex, frame, oldStatus := task.jpegPool.hold(task.rawFrame.number)
-	if frame == nil {
-		// Someone else compressing the frame, should not happen.
-		return compressor
-	}
-	// Prepare the cleanup functions
-	newStatus := FrameFailed
-	defer func() {
-		statusName := frameStatusNames[newStatus]
-		compressionStatus.WithLabelValues(task.rawFrame.camera, statusName).Inc()
-	}()
-	defer func() {
-		task.jpegPool.release(frameIndex, newStatus)
-	}()
-	// Make sure the frame is not stuck sending somewhere
-	if !frame.available(2 * time.Second) {
-		newStatus = FrameStuck
-		if oldStatus != FrameStuck {
-			// Start a watchdog if the frame was not stuck before
-			go func() {
-				if !frame.available(10 * time.Second) {
-					panic("compressed frame stuck for longer than 10 seconds")
-				}
-			}()
-		}
-		return compressor
-	}
-	// Once the frame is unused, overwrite it
-	var err error
-	frame.features, err = task.rawFrame.Compress(compressor, &frame.image)
-	if err != nil {
-		// Release the compressor, just in case
-		logger.Error("Compression failed", servicelog.Error(err))
-		compressor.Free()
-		compressor = NewCompressor()
-	} else {
-		newStatus = FrameReady
-		compressionLatency.WithLabelValues(task.rawFrame.camera).Observe(float64(time.Since(task.rawFrame.timestamp) / time.Second))
-	}
-	return compressor
-}
-
-// ------------------------------
-// Pipeline: holds the frame pools (both raw and compressed),
-// and the compression farm
-// ------------------------------
-
-type Pipeline struct {
-	rawPool  *Pool
-	jpegPool *jpegPool
-	features RawFeatures
-	farm     *Farm
-}
-
-// New creates a new compression pipeline.
-// A pipeline is only valid for a given set of RawFeatures,
-// because it must allocate buffers and the like.
-// It is also valid for a single combination of subsampling,
-// quality and flags, because images are encoded only once.
-// jpegPoolSize must be > rawPoolSize + farmSize`
-func New(pool *Pool, farm *Farm, jpegPoolSize, imageSize int) *Pipeline {
-	return &Pipeline{
-		rawPool:  pool,
-		jpegPool: newJpegPool(jpegPoolSize, imageSize),
-		farm:     farm,
-	}
-}
-
-// Features returnts the Features with which the pipeline was created
-func (p *Pipeline) Features() RawFeatures {
-	return p.features
-}
-
-// Join and free all resources. All Sessions must be joined before this.
-func (p *Pipeline) Join() {
-	p.jpegPool.Join()
-}
-
-// Session keeps streaming from the Source until cancelled
-type Session struct {
-	currentFrame  uint64 // latest frame sent for compression. Not running if 0.
-	pendingFrames sync.WaitGroup
-	jpegPool      *jpegPool
-}
-
-// session starts a streaming session from the given Source.
-// The source MUST BE compatible with the RawFeatures with which the
-// pipeline was created.
-func (pipeline *Pipeline) session(ctx context.Context, logger servicelog.Logger, source Source) *Session {
-	session := &Session{
-		currentFrame: 1, // 0 is reserved for closed stream
-		jpegPool:     pipeline.jpegPool,
-	}
-	session.pendingFrames.Add(1)
-	start := time.Now()
-	go func() {
-		defer func() {
-			sessionDuration.WithLabelValues(source.Name()).Observe(time.Since(start).Seconds())
-		}()
-		defer session.pendingFrames.Done()
-		defer func() {
-			// Store frame number 0 -> not running
-			atomic.StoreUint64(&(session.currentFrame), 0)
-			session.jpegPool.Broadcast() // let all the readers notice
-		}()
-		for rawFrame := range pipeline.rawPool.stream(ctx, logger, source) {
-			rawFrame := rawFrame // avoid aliasing the loop variable
-			atomic.StoreUint64(&(session.currentFrame), rawFrame.number)
-			session.pendingFrames.Add(1) // Will be flagged .Done() by compressor
-			pipeline.farm.push(farmTask{
-				rawFrame: rawFrame,
-				freeList: pipeline.rawPool.freeList,
-				jpegPool: pipeline.jpegPool,
-				group:    &(session.pendingFrames),
-			})
-		}
-	}()
-	streamingSessions.WithLabelValues(source.Name()).Inc()
-	return session
-}
-
-// Current frame number. If == 0, session is stopped.
-func (session *Session) CurrentFrame() uint64 {
-	return atomic.LoadUint64(&(session.currentFrame))
-}
-
-// Join the session once it has been cancelled
-func (session *Session) Join() {
-	session.pendingFrames.Wait()
-}
-
-// Next frame at or after the given frameNumber for this session.
-// Returns nil if the stream is closed
-func (session *Session) Next(frameNumber uint64) (*JpegFrame, uint64, FrameStatus) {
-	session.jpegPool.Lock()
-	defer session.jpegPool.Unlock()
-	for {
-		frame, _ := session.jpegPool.frameAt(frameNumber)
-		currentFrame := session.CurrentFrame()
-		switch {
-		case currentFrame == 0: // stopped
-			return nil, 0, FrameEmpty
-		case frame.number == frameNumber: // frame in the pool
-			if frame.status != FrameEmpty && frame.status != FrameCompressing {
-				frame.group.Add(1) // Increment the read count for this frame
-				return frame, frame.number, frame.status
-			}
-		case frameNumber > currentFrame: // future frame
-			frameNumber = currentFrame + 1
-		default:
-			// The frame number is past and no longer available.
-			// pick the current frame.
-			frameNumber = currentFrame
-		}
-		session.jpegPool.Wait()
-	}
-}
+package jpeg
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/overlay"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// --------------------------------
+// Metrics
+// --------------------------------
+
+var (
+	compressionLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "asicamera_compression_latency",
+			Help: "JPEG Compression latency, since the source returned the frame (milliseconds)",
+			Buckets: []float64{
+				10, 30, 60, 120, 250, 500, 1000, 2500,
+			},
+		},
+		[]string{"camera"},
+	)
+
+	streamingSessions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_pipeline_sessions",
+			Help: "Accumulated number of sessions",
+		},
+		[]string{"camera"},
+	)
+
+	sessionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "asicamera_pipeline_session_duration",
+			Help: "Pipeline session duration (seconds)",
+			Buckets: []float64{
+				1, 60, 1800, 7200, 28800,
+			},
+		},
+		[]string{"camera"},
+	)
+
+	compressionStatus = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_compression_status",
+			Help: "Compression results by status",
+		},
+		[]string{"camera", "status"},
+	)
+
+	pipelineResizes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_pipeline_resizes",
+			Help: "Buffer reallocations because the features of the frames changed",
+		},
+		[]string{"camera"},
+	)
+)
+
+// ---------------------------------
+// Raw Pool - implements a fixed pool of buffers
+// for raw images.
+// ---------------------------------
+
+// Pool manages raw image frames
+type Pool struct {
+	freeList  chan *Image
+	poolSize  int
+	imageSize int64         // buffers are reallocated to this size when leaving the free list
+	free      chan struct{} // closed by Free to shutdown the watchdog
+	lastFree  int64         // unix nanos of the last time the watchdog found a free buffer
+	faults    faultReporter
+}
+
+// Interval of the free list watchdog
+const watchdogInterval = 10 * time.Second
+
+// Setup the stream with initial buffers
+func NewPool(poolSize int, imgSize int) *Pool {
+	pool := &Pool{
+		poolSize:  poolSize,
+		imageSize: int64(imgSize),
+		freeList:  make(chan *Image, poolSize),
+		free:      make(chan struct{}),
+		lastFree:  time.Now().UnixNano(),
+	}
+	for i := 0; i < poolSize; i++ {
+		// If the allocation fails, the buffer is empty and
+		// the stream allocates it again when it is used.
+		image := &Image{}
+		image.Alloc(imgSize)
+		pool.freeList <- image
+	}
+	go pool.watchdog()
+	return pool
+}
+
+// Adds additional utility information to SrcFrame
+type srcFrame struct {
+	number    uint64
+	camera    string
+	timestamp time.Time // when the source returned the frame
+	metadata  Metadata
+	// Set by the farm, for the renditions
+	deep    DeepSrcFrame     // frame with more than 8 bits per sample, before decoding
+	overlay *overlay.Overlay // drawn on the pixels, if not nil
+	SrcFrame
+}
+
+// Stream a source through a SrcFrame channel
+func (pool *Pool) stream(ctx context.Context, logger servicelog.Logger, source Source) chan srcFrame {
+	frames := make(chan srcFrame, pool.poolSize)
+	go func() {
+		defer close(frames)
+		var frameNumber uint64 = 1 // always skip frame 0
+		cameraName := source.Name()
+		for {
+			var (
+				srcImage *Image
+				ok       bool
+				err      error
+			)
+			select {
+			case <-ctx.Done():
+				return
+			case srcImage, ok = <-pool.freeList:
+				if !ok {
+					return
+				}
+				break
+			}
+			if size := int(atomic.LoadInt64(&pool.imageSize)); srcImage.Cap() != size {
+				if err := srcImage.Alloc(size); err != nil {
+					logger.Error("Failed to resize raw buffer", servicelog.Int("size", size), servicelog.Error(err))
+					pool.freeList <- srcImage
+					return
+				}
+			}
+			newFrame := srcFrame{
+				number: frameNumber,
+				camera: cameraName,
+			}
+			newFrame.SrcFrame, err = source.Next(ctx, srcImage)
+			if err != nil {
+				logger.Error("Failed to get next frame", servicelog.Error(err))
+				pool.freeList <- srcImage // return the image to the free list
+				return
+			}
+			newFrame.timestamp = time.Now()
+			if withMetadata, ok := newFrame.SrcFrame.(MetadataFrame); ok {
+				newFrame.metadata = withMetadata.Metadata()
+			}
+			newFrame.metadata.Sequence = frameNumber
+			if newFrame.metadata.Timestamp.IsZero() {
+				newFrame.metadata.Timestamp = newFrame.timestamp
+			}
+			select {
+			case <-ctx.Done():
+				pool.freeList <- srcImage
+				return
+			case frames <- newFrame:
+				frameNumber += 1
+				break
+			}
+		}
+	}()
+	return frames
+}
+
+// resize the raw buffers. Buffers are reallocated when they leave
+// the free list, so the frames in flight are not affected.
+func (pool *Pool) resize(size int) {
+	atomic.StoreInt64(&pool.imageSize, int64(size))
+}
+
+// Monitors the free list. Reports a fault once each time
+// the free list stays empty for a whole interval.
+func (pool *Pool) watchdog() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	faulted := false
+	for {
+		// align with a tick interval
+		select {
+		case <-pool.free:
+			return
+		case <-ticker.C:
+			break
+		}
+		// try to acquire a free buffer before the next tick
+		select {
+		case <-pool.free:
+			return
+		case img, ok := <-pool.freeList:
+			if !ok {
+				return // list closed
+			}
+			pool.freeList <- img
+			atomic.StoreInt64(&pool.lastFree, time.Now().UnixNano())
+			faulted = false
+			break
+		case <-ticker.C:
+			if !faulted {
+				faulted = true
+				pool.faults.report(Fault{
+					Kind:    FaultNoFreeBuffers,
+					Message: fmt.Sprintf("no free raw buffers for %s", watchdogInterval),
+				})
+			}
+		}
+	}
+}
+
+// Check returns an error if the watchdog has not found
+// a free buffer recently, i.e. the pipeline is stuck.
+func (pool *Pool) Check() error {
+	last := time.Unix(0, atomic.LoadInt64(&pool.lastFree))
+	if since := time.Since(last); since > 2*watchdogInterval {
+		return fmt.Errorf("no free raw buffers for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// Free all the resources of the pool
+func (pool *Pool) Free() {
+	close(pool.free) // stop the watchdog
+	// consume all freeList items
+	for i := 0; i < pool.poolSize; i++ {
+		frame := <-pool.freeList
+		frame.Free()
+	}
+	close(pool.freeList)
+}
+
+// -------------------------
+// Frame: contains info about a compressed image,
+// along with the compression status
+// -------------------------
+
+type FrameStatus int
+
+const (
+	FrameEmpty       FrameStatus = iota // Frame has no valid data
+	FrameCompressing                    // Frame is being compressed
+	FrameReady                          // Frame is ready to stream
+	FrameFailed                         // Frame failed to ocmpress
+	FrameStuck                          // frame was not processed because some reader had it locked
+)
+
+var frameStatusNames = []string{
+	"FrameEmpty",
+	"FrameCompressing",
+	"FrameReady",
+	"FrameFailed",
+	"FrameStuck",
+}
+
+// Compressed frame
+type JpegFrame struct {
+	number   uint64
+	image    Image
+	features JpegFeatures
+	metadata Metadata
+	status   FrameStatus
+	group    sync.WaitGroup // readers sending the image to clients
+}
+
+// Done tells the compressors they can overwrite the internal buffers
+func (frame *JpegFrame) Done() {
+	frame.group.Done()
+}
+
+// Features of the compressed image.
+// Must not be used after Done
+func (frame *JpegFrame) Features() JpegFeatures {
+	return frame.features
+}
+
+// Metadata of the frame.
+// Must not be used after Done
+func (frame *JpegFrame) Metadata() Metadata {
+	return frame.metadata
+}
+
+// Return the frame content as a byte array.
+// Must not be used after Done
+func (frame *JpegFrame) Slice() []byte {
+	return frame.image.Slice()
+}
+
+// Wait for the frame to be available (nothing in the wait group)
+func (frame *JpegFrame) available(t time.Duration) bool {
+	available := make(chan struct{})
+	go func() {
+		defer close(available)
+		frame.group.Wait() // wait until no readers
+		// The goroutine will leak if there are readers stuck.
+		// But the farm reports a fault if the frame is stuck for
+		// too long, and the pipeline is recycled, so this is ok.
+	}()
+	watchdog := time.NewTimer(t)
+	select {
+	case <-available: // everything fine
+		watchdog.Stop()
+		return true
+	case <-watchdog.C:
+		return false
+	}
+}
+
+// ----------------------------
+// JpegPool: hash buffer for compressed images.
+// Hash key is just the frame number - the pool is designed to store
+// consecutive frames.
+// The pool size must be larger than the RawPool buffer size,
+// to avoid overwriting a frame which is still being compressed.
+// ------------------------------
+
+// JpegPool holds a fixed size hash of compressed frames
+type jpegPool struct {
+	sync.Mutex
+	sync.Cond
+	frames    []*JpegFrame // Buffer of compressed frames
+	imageSize int          // allocated on first use
+}
+
+// New compressed pool. The images are allocated when first compressed,
+// so that renditions nobody watches take no memory.
+func newJpegPool(poolSize int, imageSize int) *jpegPool {
+	pool := &jpegPool{
+		frames:    make([]*JpegFrame, poolSize),
+		imageSize: imageSize,
+	}
+	pool.Cond.L = &(pool.Mutex)
+	for i := 0; i < poolSize; i++ {
+		pool.frames[i] = &JpegFrame{}
+	}
+	return pool
+}
+
+// Join waits for all readers to finish and frees compressed pool resources
+func (p *jpegPool) Join() {
+	for i := 0; i < len(p.frames); i++ {
+		p.frames[i].group.Wait()
+		p.frames[i].image.Free()
+	}
+}
+
+// resize the compressed frames. Frames are reallocated when compressed,
+// once no reader holds them. Must be called with no frame being compressed.
+func (pool *jpegPool) resize(size int) {
+	pool.imageSize = size
+}
+
+// lock a frame for compressing.
+func (pool *jpegPool) hold(frameNumber uint64) (frameIndex int, frame *JpegFrame, oldStatus FrameStatus) {
+	frame, frameIndex = pool.frameAt(frameNumber)
+	pool.Lock()
+	defer pool.Unlock()
+	oldStatus = frame.status
+	if oldStatus == FrameCompressing {
+		return 0, nil, oldStatus // should not happen
+	}
+	frame.number = frameNumber
+	frame.status = FrameCompressing
+	return
+}
+
+// release a frame after compression.
+func (pool *jpegPool) release(frameIndex int, status FrameStatus) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.frames[frameIndex].status = status
+	pool.Broadcast()
+}
+
+// frameAt returns the frame and frameIndex for the given frameNumber
+func (pool *jpegPool) frameAt(frameNumber uint64) (*JpegFrame, int) {
+	frameIndex := int(frameNumber % uint64(len(pool.frames)))
+	return pool.frames[frameIndex], frameIndex
+}
+
+// ---------------------------
+// Farm: fixed set of compressors
+// ---------------------------
+
+// Task running in a compression farm
+type farmTask struct {
+	rawFrame srcFrame         // Input frame to compress
+	freeList chan *Image      // Return raw image to free list when done
+	targets  []*rendition     // Renditions to compress the frame into
+	overlay  *overlay.Overlay // drawn on the frame before compression, if not nil
+	stats    *statsState      // computed from the frame before the overlay, if not nil
+	faults   *faultReporter   // of the pipeline, for stuck frames
+	group    *sync.WaitGroup  // notify on compression finished
+}
+
+// Farm  of compression gophers
+type Farm struct {
+	// Compression gopher group
+	tasks chan farmTask
+	group sync.WaitGroup
+}
+
+// New compression pool
+func NewFarm(logger servicelog.Logger, farmSize, taskSize int) *Farm {
+	farm := &Farm{
+		tasks: make(chan farmTask, taskSize),
+	}
+	// launch the compressors
+	for i := 0; i < farmSize; i++ {
+		farm.group.Add(1)
+		go func() {
+			defer farm.group.Done()
+			w := newWorker()
+			defer w.Free()
+			for task := range farm.tasks {
+				farm.run(logger, w, task)
+			}
+		}()
+	}
+	return farm
+}
+
+// Stop closes the task channel and stops accepting tasks
+func (farm *Farm) Stop() {
+	close(farm.tasks)
+	farm.group.Wait()
+}
+
+// Push a task to the pool. Panics if called after Stop()
+func (farm *Farm) push(task farmTask) {
+	farm.tasks <- task
+}
+
+// run a compression task
+func (farm *Farm) run(logger servicelog.Logger, w *worker, task farmTask) {
+	// Notify the task and release resources at the end
+	defer func() {
+		task.freeList <- task.rawFrame.Buffer()
+		task.group.Done()
+	}()
+	rawFrame := task.rawFrame
+	rawFrame.overlay = task.overlay
+	if frame, ok := rawFrame.SrcFrame.(DeepSrcFrame); ok && frame.Bits() > 8 {
+		rawFrame.deep = frame
+	}
+	if frame, ok := rawFrame.SrcFrame.(DecodeSrcFrame); ok {
+		// On error, keep the frame so that the compression fails too
+		decoded, err := frame.Decode(&w.decoded)
+		if err != nil {
+			logger.Error("Decoding failed", servicelog.Error(err))
+		} else {
+			rawFrame.SrcFrame = decoded
+		}
+	}
+	if task.stats != nil {
+		if err := w.stats(rawFrame, task.stats); err != nil {
+			logger.Error("Frame statistics failed", servicelog.Error(err))
+		}
+	}
+	if rawFrame.overlay != nil {
+		if err := w.overlay(&rawFrame); err != nil {
+			logger.Error("Overlay failed", servicelog.Error(err))
+		}
+	}
+	for _, target := range task.targets {
+		farm.compress(logger, w, rawFrame, target, task.faults)
+	}
+}
+
+// compress the frame into the pool of the rendition
+func (farm *Farm) compress(logger servicelog.Logger, w *worker, rawFrame srcFrame, target *rendition, faults *faultReporter) {
+	// Get the buffer for compressed frame
+	frameIndex, frame, oldStatus := target.pool.hold(rawFrame.number)
+	if frame == nil {
+		// Someone else compressing the frame, should not happen.
+		return
+	}
+	// Prepare the cleanup functions
+	newStatus := FrameFailed
+	defer func() {
+		statusName := frameStatusNames[newStatus]
+		compressionStatus.WithLabelValues(rawFrame.camera, statusName).Inc()
+	}()
+	defer func() {
+		target.pool.release(frameIndex, newStatus)
+	}()
+	// Make sure the frame is not stuck sending somewhere
+	if !frame.available(2 * time.Second) {
+		newStatus = FrameStuck
+		if oldStatus != FrameStuck {
+			// Start a watchdog if the frame was not stuck before
+			go func() {
+				if !frame.available(frameStuckTimeout) {
+					logger.Error("Compressed frame stuck", servicelog.String("rendition", target.String()), servicelog.Uint64("frame", rawFrame.number))
+					faults.report(Fault{
+						Camera:  rawFrame.camera,
+						Kind:    FaultFrameStuck,
+						Message: fmt.Sprintf("compressed frame of rendition %s stuck for longer than %s", target.String(), frameStuckTimeout),
+					})
+				}
+			}()
+		}
+		return
+	}
+	// Once the frame is unused, overwrite it
+	if frame.image.Cap() != target.pool.imageSize {
+		if err := frame.image.Alloc(target.pool.imageSize); err != nil {
+			logger.Error("Allocation failed", servicelog.String("rendition", target.String()), servicelog.Error(err))
+			return
+		}
+	}
+	var err error
+	frame.features, err = w.encode(rawFrame, target.Rendition, &frame.image)
+	if err != nil {
+		// Release the compressors, just in case. The buffers are kept,
+		// the frame may still be needed by other renditions.
+		logger.Error("Compression failed", servicelog.String("rendition", target.String()), servicelog.Error(err))
+		w.reset()
+	} else {
+		newStatus = FrameReady
+		frame.metadata = rawFrame.metadata
+		renditionFrames.WithLabelValues(rawFrame.camera, target.String()).Inc()
+		compressionLatency.WithLabelValues(rawFrame.camera).Observe(float64(time.Since(rawFrame.timestamp)) / float64(time.Millisecond))
+	}
+}
+
+// worker holds the resources of a compression gopher
+type worker struct {
+	compressor   Compressor
+	decompressor Decompressor
+	encoded      Image // source frame, for frames without raw pixels
+	decoded      Image // source frame decompressed or demosaiced
+	scaled       Image // source frame scaled to the rendition
+	stretched    Image // source frame stretched for the rendition
+}
+
+func newWorker() *worker {
+	return &worker{
+		compressor:   NewCompressor(),
+		decompressor: NewDecompressor(),
+	}
+}
+
+// reset the compressor and decompressor
+func (w *worker) reset() {
+	w.compressor.Free()
+	w.decompressor.Free()
+	w.compressor = NewCompressor()
+	w.decompressor = NewDecompressor()
+}
+
+// Free the worker resources
+func (w *worker) Free() {
+	w.compressor.Free()
+	w.decompressor.Free()
+	w.encoded.Free()
+	w.decoded.Free()
+	w.scaled.Free()
+	w.stretched.Free()
+}
+
+// pixels returns the raw pixels of the frame. Frames without raw
+// pixels are decoded at the smallest scale at least width pixels wide.
+func (w *worker) pixels(frame srcFrame, width int) (*Image, RawFeatures, error) {
+	if raw, ok := frame.SrcFrame.(RawSrcFrame); ok {
+		img, feat := raw.Raw()
+		return img, feat, nil
+	}
+	jpegFeat, err := frame.Compress(w.compressor, &w.encoded)
+	if err != nil {
+		return nil, RawFeatures{}, err
+	}
+	format := PF_RGB
+	if jpegFeat.Subsampling == TJSAMP_GRAY {
+		format = PF_GRAY
+	}
+	rawFeat, err := w.decompressor.Decompress(&w.encoded, ScaledFeatures(jpegFeat, width), &w.decoded, format, 0)
+	if err != nil {
+		return nil, RawFeatures{}, err
+	}
+	return &w.decoded, rawFeat, nil
+}
+
+// overlay draws on the raw pixels of the frame. Frames without
+// raw pixels are decoded, and encoded from the decoded pixels.
+func (w *worker) overlay(frame *srcFrame) error {
+	img, feat, err := w.pixels(*frame, 0)
+	if err != nil {
+		return err
+	}
+	drawOverlay(*frame, img, feat)
+	if _, ok := frame.SrcFrame.(RawSrcFrame); !ok {
+		frame.SrcFrame = decodedFrame{
+			buffer:   frame.Buffer(),
+			image:    img,
+			features: feat,
+		}
+	}
+	return nil
+}
+
+// drawOverlay of the frame on the pixels
+func drawOverlay(frame srcFrame, img *Image, feat RawFeatures) {
+	metadata := frame.metadata
+	info := overlay.Info{
+		Camera:   frame.camera,
+		Time:     metadata.Timestamp,
+		Frame:    metadata.Sequence,
+		Exposure: metadata.Exposure,
+		Gain:     metadata.Gain,
+	}
+	if metadata.Path != "" {
+		info.File = filepath.Base(metadata.Path)
+	}
+	frame.overlay.Draw(overlay.Canvas{
+		Pix:    img.Slice(),
+		Width:  feat.Width,
+		Height: feat.Height,
+		Pitch:  feat.Pitch(),
+		BPP:    feat.Pitch() / feat.Width,
+	}, info)
+}
+
+// decodedFrame replaces a frame without raw pixels once decoded
+type decodedFrame struct {
+	buffer   *Image // buffer of the original frame, for the free list
+	image    *Image
+	features RawFeatures
+}
+
+// Buffer implements SrcFrame
+func (f decodedFrame) Buffer() *Image {
+	return f.buffer
+}
+
+// Raw implements RawSrcFrame
+func (f decodedFrame) Raw() (*Image, RawFeatures) {
+	return f.image, f.features
+}
+
+// Compress implements SrcFrame
+func (f decodedFrame) Compress(compressor Compressor, target *Image) (JpegFeatures, error) {
+	subsampling := TJSAMP_420
+	if f.features.Format == PF_GRAY {
+		subsampling = TJSAMP_GRAY
+	}
+	return compressor.Compress(f.image, f.features, target, subsampling, defaultRenditionQuality, TJFLAG_NOREALLOC)
+}
+
+// stretchDeep maps the samples of a deep frame with the stretch
+func (w *worker) stretchDeep(frame srcFrame, stretch Stretch) (*Image, RawFeatures, error) {
+	decoded, ok := frame.SrcFrame.(RawSrcFrame)
+	if !ok {
+		return nil, RawFeatures{}, fmt.Errorf("deep frame not decoded")
+	}
+	_, feat := decoded.Raw()
+	stretched, err := stretchDeep(stretch, frame.deep, feat.Width, feat.Height, &w.stretched)
+	if err != nil {
+		return nil, RawFeatures{}, err
+	}
+	img, feat := stretched.Raw()
+	if frame.overlay != nil {
+		drawOverlay(frame, img, feat)
+	}
+	return img, feat, nil
+}
+
+// encode the frame with the given rendition into target
+func (w *worker) encode(frame srcFrame, r Rendition, target *Image) (JpegFeatures, error) {
+	if r.source() {
+		return frame.Compress(w.compressor, target)
+	}
+	stretch := r.Stretch.mode() != StretchNone
+	var img *Image
+	var srcFeat RawFeatures
+	var err error
+	if stretch && frame.deep != nil {
+		// Stretched from the samples, the overlay must be drawn again
+		img, srcFeat, err = w.stretchDeep(frame, r.Stretch)
+	} else {
+		img, srcFeat, err = w.pixels(frame, r.Width)
+	}
+	if err != nil {
+		return JpegFeatures{}, err
+	}
+	feat := r.features(srcFeat)
+	if feat != srcFeat {
+		bpp := srcFeat.Pitch() / srcFeat.Width
+		if err := w.scaled.reserve(feat.Pitch() * feat.Height); err != nil {
+			return JpegFeatures{}, err
+		}
+		downscale(img.Slice(), srcFeat.Width, srcFeat.Height, srcFeat.Pitch(), w.scaled.Slice(), feat.Width, feat.Height, feat.Pitch(), bpp)
+		img = &w.scaled
+	}
+	if stretch && frame.deep == nil {
+		// Stretched after scaling, there are less pixels
+		bpp := feat.Pitch() / feat.Width
+		if img != &w.scaled {
+			if err := w.stretched.reserve(feat.Pitch() * feat.Height); err != nil {
+				return JpegFeatures{}, err
+			}
+			stretchPixels(r.Stretch, img.Slice(), w.stretched.Slice(), feat.Width, feat.Height, feat.Pitch(), bpp)
+			img = &w.stretched
+		} else {
+			stretchPixels(r.Stretch, img.Slice(), img.Slice(), feat.Width, feat.Height, feat.Pitch(), bpp)
+		}
+	}
+	subsampling := TJSAMP_420
+	if feat.Format == PF_GRAY {
+		subsampling = TJSAMP_GRAY
+	}
+	return w.compressor.Compress(img, feat, target, subsampling, r.quality(), TJFLAG_NOREALLOC)
+}
+
+// ------------------------------
+// Pipeline: holds the frame pools (both raw and compressed),
+// and the compression farm
+// ------------------------------
+
+type Pipeline struct {
+	rawPool    *Pool
+	renditions []*rendition
+	overlay    *overlay.Overlay
+	stats      *statsState
+	faults     faultReporter
+	farm       *Farm
+	// Features of the latest frame, the buffers are sized for them
+	featuresMutex sync.Mutex
+	features      RawFeatures
+}
+
+// New creates a new compression pipeline.
+// The buffers are allocated with imageSize bytes, and reallocated
+// whenever the RawFeatures of the frames change, e.g. when the
+// capture software switches resolution or binning.
+// Frames are encoded once per rendition, and only while some reader
+// is subscribed to it. Without renditions, frames are only encoded
+// with the subsampling, quality and flags of the source.
+// jpegPoolSize must be > rawPoolSize + farmSize`
+func New(pool *Pool, farm *Farm, jpegPoolSize, imageSize int, renditions ...Rendition) *Pipeline {
+	if len(renditions) == 0 {
+		renditions = []Rendition{{}}
+	}
+	pipeline := &Pipeline{
+		rawPool:    pool,
+		renditions: make([]*rendition, 0, len(renditions)),
+		farm:       farm,
+	}
+	for _, r := range renditions {
+		pipeline.renditions = append(pipeline.renditions, &rendition{
+			Rendition: r,
+			pool:      newJpegPool(jpegPoolSize, imageSize),
+		})
+	}
+	return pipeline
+}
+
+// SetOverlay draws the overlay on every frame, before compression.
+// Must be called before the first session.
+func (p *Pipeline) SetOverlay(o *overlay.Overlay) {
+	p.overlay = o
+}
+
+// Features of the latest frame of the pipeline. Zero if the
+// pipeline has not run yet, or the source does not know them.
+func (p *Pipeline) Features() RawFeatures {
+	p.featuresMutex.Lock()
+	defer p.featuresMutex.Unlock()
+	return p.features
+}
+
+// resize the buffers of the renditions and the raw pool for frames
+// with the given features. rawSize is the size of the raw buffer
+// the source needs. Must be called with no frame being compressed.
+func (p *Pipeline) resize(logger servicelog.Logger, camera string, renditions []*rendition, features RawFeatures, rawSize int) {
+	p.featuresMutex.Lock()
+	previous := p.features
+	p.features = features
+	p.featuresMutex.Unlock()
+	if rawSize > 0 {
+		p.rawPool.resize(rawSize)
+	}
+	subsampling := TJSAMP_444 // largest output, the source subsampling is not known
+	if features.Format == PF_GRAY {
+		subsampling = TJSAMP_GRAY
+	}
+	for _, r := range renditions {
+		r.pool.resize(BufSize(r.features(features).Features, subsampling))
+	}
+	if previous != (RawFeatures{}) {
+		logger.Info("frame features changed, buffers resized",
+			servicelog.Int("width", features.Width),
+			servicelog.Int("height", features.Height),
+			servicelog.Int("format", int(features.Format)))
+		pipelineResizes.WithLabelValues(camera).Inc()
+	}
+}
+
+// Join and free all resources. All Sessions must be joined before this.
+func (p *Pipeline) Join() {
+	for _, r := range p.renditions {
+		r.pool.Join()
+	}
+}
+
+// Session keeps streaming from the Source until cancelled
+type Session struct {
+	currentFrame  uint64 // latest frame sent for compression. Not running if 0.
+	pendingFrames sync.WaitGroup
+	compressing   sync.WaitGroup // frames in the farm
+	camera        string
+	renditions    []*rendition
+	subscribers   []int32     // readers subscribed to each rendition
+	stats         *statsState // nil if disabled
+	stopped       <-chan struct{}
+}
+
+// session starts a streaming session from the given Source.
+// When the features of the frames change, the frames in flight are
+// drained and the buffers resized, without stopping the session.
+func (pipeline *Pipeline) session(ctx context.Context, logger servicelog.Logger, source Source) *Session {
+	session := &Session{
+		currentFrame: 1, // 0 is reserved for closed stream
+		camera:       source.Name(),
+		renditions:   pipeline.renditions,
+		subscribers:  make([]int32, len(pipeline.renditions)),
+		stats:        pipeline.stats,
+		stopped:      ctx.Done(),
+	}
+	session.pendingFrames.Add(1)
+	start := time.Now()
+	go func() {
+		defer func() {
+			sessionDuration.WithLabelValues(source.Name()).Observe(time.Since(start).Seconds())
+		}()
+		defer session.pendingFrames.Done()
+		defer session.compressing.Wait()
+		defer func() {
+			// Store frame number 0 -> not running
+			atomic.StoreUint64(&(session.currentFrame), 0)
+			for _, r := range session.renditions {
+				r.pool.Broadcast() // let all the readers notice
+			}
+		}()
+		for rawFrame := range pipeline.rawPool.stream(ctx, logger, source) {
+			rawFrame := rawFrame // avoid aliasing the loop variable
+			if features, ok := frameFeatures(rawFrame.SrcFrame); ok {
+				// The buffer may be larger than the frame, size it from the
+				// features, so that it shrinks too, e.g. when binning.
+				size := frameSize(rawFrame.SrcFrame)
+				if features != pipeline.Features() || (size > 0 && int64(size) != atomic.LoadInt64(&pipeline.rawPool.imageSize)) {
+					// No frame may use the buffers while resizing
+					session.compressing.Wait()
+					pipeline.resize(logger, session.camera, session.renditions, features, size)
+				}
+			}
+			atomic.StoreUint64(&(session.currentFrame), rawFrame.number)
+			targets := session.subscribed()
+			var stats *statsState
+			if pipeline.stats != nil && pipeline.stats.due(rawFrame.timestamp) {
+				stats = pipeline.stats
+			}
+			if len(targets) == 0 && stats == nil {
+				// Nobody watching, do not waste time compressing
+				pipeline.rawPool.freeList <- rawFrame.Buffer()
+				continue
+			}
+			session.compressing.Add(1) // Will be flagged .Done() by compressor
+			pipeline.farm.push(farmTask{
+				rawFrame: rawFrame,
+				freeList: pipeline.rawPool.freeList,
+				targets:  targets,
+				overlay:  pipeline.overlay,
+				stats:    stats,
+				faults:   &pipeline.faults,
+				group:    &(session.compressing),
+			})
+		}
+	}()
+	streamingSessions.WithLabelValues(source.Name()).Inc()
+	return session
+}
+
+// Current frame number. If == 0, session is stopped.
+func (session *Session) CurrentFrame() uint64 {
+	return atomic.LoadUint64(&(session.currentFrame))
+}
+
+// Stopped is closed when the session is cancelled, e.g. when the
+// pipeline is recycled after a fault. Readers must disconnect.
+func (session *Session) Stopped() <-chan struct{} {
+	return session.stopped
+}
+
+// Join the session once it has been cancelled
+func (session *Session) Join() {
+	session.pendingFrames.Wait()
+}
@@ -0,0 +1,196 @@
+package jpeg
+
+import (
+	"bytes"
+	"context"
+	imagejpeg "image/jpeg"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestPipelineResize(t *testing.T) {
+	pool := NewPool(2, 16)
+	defer pool.Free()
+	p := New(pool, nil, 4, 16, Rendition{Name: "full"}, Rendition{Name: "small", Width: 320})
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+	features := RawFeatures{Features: Features{Width: 1280, Height: 960}, Format: PF_RGB}
+	p.resize(logger, "test", p.renditions, features, features.Pitch()*features.Height)
+	if p.Features() != features {
+		t.Errorf("got features %+v, expected %+v", p.Features(), features)
+	}
+	if size := pool.imageSize; size != int64(features.Pitch()*features.Height) {
+		t.Errorf("raw pool resized to %d", size)
+	}
+	full := BufSize(features.Features, TJSAMP_444)
+	small := BufSize(Features{Width: 320, Height: 240}, TJSAMP_444)
+	if p.renditions[0].pool.imageSize != full || p.renditions[1].pool.imageSize != small {
+		t.Errorf("jpeg pools resized to %d and %d, expected %d and %d",
+			p.renditions[0].pool.imageSize, p.renditions[1].pool.imageSize, full, small)
+	}
+	// Binning halves the frame
+	binned := RawFeatures{Features: Features{Width: 640, Height: 480}, Format: PF_GRAY}
+	p.resize(logger, "test", p.renditions, binned, 0)
+	if p.renditions[0].pool.imageSize != BufSize(binned.Features, TJSAMP_GRAY) {
+		t.Errorf("jpeg pool not resized for binned frames")
+	}
+	if pool.imageSize != int64(features.Pitch()*features.Height) {
+		t.Errorf("raw pool resized without a raw size")
+	}
+}
+
+func TestFrameFeatures(t *testing.T) {
+	features := RawFeatures{Features: Features{Width: 8, Height: 6}, Format: PF_GRAY}
+	var factory FrameCompressor
+	if got, ok := frameFeatures(factory.Frame("test", &Image{}, features)); !ok || got != features {
+		t.Errorf("raw frame: got %+v", got)
+	}
+	deep := factory.DeepFrame("test", &Image{}, features, 12, false)
+	if got, ok := frameFeatures(deep); !ok || got != features {
+		t.Errorf("deep frame: got %+v", got)
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	features := RawFeatures{Features: Features{Width: 8, Height: 6}, Format: PF_RGB}
+	binned := RawFeatures{Features: Features{Width: 4, Height: 3}, Format: PF_RGB}
+	var factory FrameCompressor
+	bayer, err := NewBayerDecoder(BayerOptions{Pattern: BayerRGGB, BitDepth: 16}, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The buffer is larger than the frame, the size comes from the features
+	img := &Image{}
+	if err := img.Alloc(1024); err != nil {
+		t.Fatal(err)
+	}
+	defer img.Free()
+	for _, tc := range []struct {
+		name  string
+		frame SrcFrame
+		size  int
+	}{
+		{"raw", factory.Frame("test", img, features), 8 * 6 * 3},
+		{"binned", factory.Frame("test", img, binned), 4 * 3 * 3},
+		{"deep", factory.DeepFrame("test", img, features, 12, false), 8 * 6 * 3 * 2},
+		{"bayer", bayer.Frame("test", img, features.Features), 8 * 6 * 2},
+	} {
+		if size := frameSize(tc.frame); size != tc.size {
+			t.Errorf("%s: got size %d, expected %d", tc.name, size, tc.size)
+		}
+	}
+}
+
+// binningSource serves gray frames, and switches to 2x2 binning
+// after some frames, like a camera reconfigured mid-stream
+type binningSource struct {
+	factory  FrameCompressor
+	full     RawFeatures
+	switchAt int
+	served   int
+}
+
+func (s *binningSource) Name() string                  { return "binning" }
+func (s *binningSource) Start(servicelog.Logger) error { return nil }
+func (s *binningSource) Stop()                         {}
+
+func (s *binningSource) Next(ctx context.Context, img *Image) (SrcFrame, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(5 * time.Millisecond):
+	}
+	features := s.full
+	if s.served >= s.switchAt {
+		features.Width, features.Height = features.Width/2, features.Height/2
+	}
+	s.served++
+	size := features.Pitch() * features.Height
+	if img.Cap() < size {
+		if err := img.Alloc(size); err != nil {
+			return nil, err
+		}
+	}
+	pixels := img.Slice()[:size]
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+	return s.factory.Frame(s.Name(), img, features), nil
+}
+
+func TestSessionFeaturesChange(t *testing.T) {
+	full := RawFeatures{Features: Features{Width: 64, Height: 48}, Format: PF_GRAY}
+	source := &binningSource{
+		factory:  FrameCompressor{Subsampling: TJSAMP_GRAY, Quality: 90},
+		full:     full,
+		switchAt: 10,
+	}
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+	pool := NewPool(4, full.Pitch()*full.Height)
+	farm := NewFarm(logger, 2, 8)
+	defer farm.Stop()
+	pipeline := New(pool, farm, 8, BufSize(full.Features, TJSAMP_GRAY), Rendition{Name: "full"})
+	var faults int32
+	pipeline.SetFaultHandler(func(Fault) { atomic.AddInt32(&faults, 1) })
+	manager := pipeline.Manage(source)
+	defer func() {
+		manager.Cancel()
+		manager.Join()
+		pipeline.Join()
+		pool.Free()
+	}()
+	session, err := manager.Acquire(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Done()
+	subscription := session.Subscribe(0)
+	defer subscription.Close()
+
+	var (
+		currentFrame uint64 = 1
+		binned       int
+		deadline     = time.Now().Add(10 * time.Second)
+	)
+	for binned < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d binned frames received", binned)
+		}
+		frame, frameNum, status := subscription.Next(currentFrame)
+		if frame == nil {
+			t.Fatal("session stopped")
+		}
+		currentFrame = frameNum + 1
+		if status != FrameReady {
+			frame.Done()
+			t.Fatalf("frame %d not compressed, status %s", frameNum, frameStatusNames[status])
+		}
+		features := frame.Features()
+		decoded, err := imagejpeg.Decode(bytes.NewReader(frame.Slice()))
+		frame.Done()
+		if err != nil {
+			t.Fatalf("frame %d: %v", frameNum, err)
+		}
+		if bounds := decoded.Bounds(); bounds.Dx() != features.Width || bounds.Dy() != features.Height {
+			t.Fatalf("frame %d: jpeg of %dx%d, features %+v", frameNum, bounds.Dx(), bounds.Dy(), features)
+		}
+		switch {
+		case features.Width == full.Width/2 && features.Height == full.Height/2:
+			binned++
+		case binned > 0:
+			t.Fatalf("frame %d: full frame after binning, %+v", frameNum, features)
+		case features.Width != full.Width || features.Height != full.Height:
+			t.Fatalf("frame %d: unexpected features %+v", frameNum, features)
+		}
+	}
+	// The raw buffers shrink with the frames
+	if size := atomic.LoadInt64(&pool.imageSize); size != int64(full.Pitch()*full.Height/4) {
+		t.Errorf("raw pool sized to %d after binning", size)
+	}
+	if n := atomic.LoadInt32(&faults); n > 0 {
+		t.Errorf("%d faults reported", n)
+	}
+}
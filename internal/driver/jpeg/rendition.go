@@ -0,0 +1,354 @@
+package jpeg
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	renditionFrames = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_rendition_frames",
+			Help: "Frames compressed by rendition",
+		},
+		[]string{"camera", "rendition"},
+	)
+
+	renditionSubscribers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_rendition_subscribers",
+			Help: "Readers subscribed to each rendition",
+		},
+		[]string{"camera", "rendition"},
+	)
+)
+
+// Quality of the renditions that do not specify one
+const defaultRenditionQuality = 90
+
+// Rendition of the frames of a pipeline. The zero Rendition
+// is the frame as encoded by the source.
+type Rendition struct {
+	Name    string  // identifies the rendition in the URL
+	Width   int     // maximum width in pixels, 0 keeps the source width
+	Quality int     // jpeg quality, 0 for the default (90)
+	Stretch Stretch // for display, the zero Stretch keeps the source levels
+	variant bool    // built by WithStretchVariants, only selected by stretch mode
+}
+
+// source is true if the rendition is the frame encoded by the source
+func (r Rendition) source() bool {
+	return r.Width <= 0 && r.Quality <= 0 && r.Stretch.mode() == StretchNone
+}
+
+// base name of the rendition, shared by its stretch variants
+func (r Rendition) base() string {
+	switch {
+	case r.Name != "":
+		return r.Name
+	case r.Width <= 0 && r.Quality <= 0:
+		return "source"
+	default:
+		return fmt.Sprintf("%dw-q%d", r.Width, r.quality())
+	}
+}
+
+// String implements Stringer
+func (r Rendition) String() string {
+	if r.variant {
+		return r.base() + "-" + string(r.Stretch.mode())
+	}
+	return r.base()
+}
+
+// WithStretchVariants applies the stretch to the renditions without
+// one, and appends a variant of each rendition for every other stretch
+// mode, so that viewers can choose the mode with the stretch query
+// parameter. The variants share the parameters of the stretch.
+func WithStretchVariants(renditions []Rendition, stretch Stretch) []Rendition {
+	result := make([]Rendition, 0, len(renditions)*len(StretchModes))
+	for _, r := range renditions {
+		if r.Stretch.mode() == StretchNone {
+			r.Stretch = stretch
+		}
+		result = append(result, r)
+	}
+	for _, r := range result[:len(renditions)] {
+		for _, mode := range StretchModes {
+			if mode == r.Stretch.mode() {
+				continue
+			}
+			variant := r
+			variant.Stretch.Mode = mode
+			variant.variant = true
+			result = append(result, variant)
+		}
+	}
+	return result
+}
+
+// quality of the jpeg encoding
+func (r Rendition) quality() int {
+	if r.Quality <= 0 {
+		return defaultRenditionQuality
+	}
+	return r.Quality
+}
+
+// features of the rendition of a raw frame with the given features
+func (r Rendition) features(src RawFeatures) RawFeatures {
+	if r.Width <= 0 || src.Width <= r.Width {
+		return src
+	}
+	height := (src.Height*r.Width + src.Width/2) / src.Width
+	if height < 1 {
+		height = 1
+	}
+	return RawFeatures{
+		Features: Features{Width: r.Width, Height: height},
+		Format:   src.Format,
+	}
+}
+
+// rendition of a pipeline, with its own pool of compressed frames
+type rendition struct {
+	Rendition
+	pool *jpegPool
+}
+
+// selectRendition picks the rendition best matching the query:
+//   - stretch: stretch mode. Without it, stretch variants are not selected.
+//   - rendition: name of the rendition.
+//   - width: the widest rendition not wider than this, or the narrowest one.
+//   - quality: the rendition with the closest quality.
+//
+// Returns 0, the first rendition, if the query is empty.
+func selectRendition(renditions []Rendition, query url.Values) (int, error) {
+	candidates := make([]int, 0, len(renditions))
+	if value := query.Get("stretch"); value != "" {
+		mode, err := ParseStretchMode(value)
+		if err != nil {
+			return 0, err
+		}
+		for index, r := range renditions {
+			if r.Stretch.mode() == mode {
+				candidates = append(candidates, index)
+			}
+		}
+		if len(candidates) == 0 {
+			return 0, fmt.Errorf("stretch %q not available", value)
+		}
+	} else {
+		for index, r := range renditions {
+			if !r.variant {
+				candidates = append(candidates, index)
+			}
+		}
+	}
+	if name := query.Get("rendition"); name != "" {
+		for _, index := range candidates {
+			if r := renditions[index]; r.base() == name || r.String() == name {
+				return index, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown rendition %q", name)
+	}
+	// The source rendition is as wide as it gets
+	widthOf := func(r Rendition) int {
+		if r.Width <= 0 {
+			return math.MaxInt32
+		}
+		return r.Width
+	}
+	if value := query.Get("width"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width <= 0 {
+			return 0, fmt.Errorf("invalid width %q", value)
+		}
+		fit, narrowest := 0, math.MaxInt32
+		for _, index := range candidates {
+			if w := widthOf(renditions[index]); w <= width && w > fit {
+				fit = w
+			}
+			if w := widthOf(renditions[index]); w < narrowest {
+				narrowest = w
+			}
+		}
+		if fit == 0 {
+			fit = narrowest
+		}
+		fitting := candidates[:0]
+		for _, index := range candidates {
+			if widthOf(renditions[index]) == fit {
+				fitting = append(fitting, index)
+			}
+		}
+		candidates = fitting
+	}
+	if value := query.Get("quality"); value != "" {
+		quality, err := strconv.Atoi(value)
+		if err != nil || quality <= 0 || quality > 100 {
+			return 0, fmt.Errorf("invalid quality %q", value)
+		}
+		// The quality of the source is not known, assume the best
+		qualityOf := func(r Rendition) int {
+			if r.source() {
+				return 100
+			}
+			return r.quality()
+		}
+		best, bestDistance := candidates[0], math.MaxInt32
+		for _, index := range candidates {
+			distance := qualityOf(renditions[index]) - quality
+			if distance < 0 {
+				distance = -distance
+			}
+			if distance < bestDistance {
+				best, bestDistance = index, distance
+			}
+		}
+		return best, nil
+	}
+	return candidates[0], nil
+}
+
+// Renditions of the session frames
+func (session *Session) Renditions() []Rendition {
+	result := make([]Rendition, 0, len(session.renditions))
+	for _, r := range session.renditions {
+		result = append(result, r.Rendition)
+	}
+	return result
+}
+
+// Select the rendition best matching the query parameters
+// `stretch`, `rendition`, `width` and `quality`. Returns the rendition index.
+func (session *Session) Select(query url.Values) (int, error) {
+	return selectRendition(session.Renditions(), query)
+}
+
+// Subscribe to a rendition. The rendition is only
+// compressed while there are subscribers.
+func (session *Session) Subscribe(index int) *Subscription {
+	atomic.AddInt32(&session.subscribers[index], 1)
+	renditionSubscribers.WithLabelValues(session.camera, session.renditions[index].String()).Inc()
+	return &Subscription{
+		session: session,
+		index:   index,
+		pool:    session.renditions[index].pool,
+	}
+}
+
+// subscribed returns the renditions with subscribers
+func (session *Session) subscribed() []*rendition {
+	var targets []*rendition
+	for index, r := range session.renditions {
+		if atomic.LoadInt32(&session.subscribers[index]) > 0 {
+			targets = append(targets, r)
+		}
+	}
+	return targets
+}
+
+// Subscription to a rendition of the session frames
+type Subscription struct {
+	session *Session
+	index   int
+	pool    *jpegPool
+	closed  int32
+}
+
+// Rendition subscribed to
+func (sub *Subscription) Rendition() Rendition {
+	return sub.session.renditions[sub.index].Rendition
+}
+
+// Close the subscription. Frames returned by Next must be Done apart.
+func (sub *Subscription) Close() {
+	if !atomic.CompareAndSwapInt32(&sub.closed, 0, 1) {
+		return
+	}
+	atomic.AddInt32(&sub.session.subscribers[sub.index], -1)
+	renditionSubscribers.WithLabelValues(sub.session.camera, sub.session.renditions[sub.index].String()).Dec()
+}
+
+// Next frame at or after the given frameNumber for this subscription.
+// Returns nil if the stream is closed
+func (sub *Subscription) Next(frameNumber uint64) (*JpegFrame, uint64, FrameStatus) {
+	sub.pool.Lock()
+	defer sub.pool.Unlock()
+	for {
+		frame, _ := sub.pool.frameAt(frameNumber)
+		currentFrame := sub.session.CurrentFrame()
+		switch {
+		case currentFrame == 0: // stopped
+			return nil, 0, FrameEmpty
+		case frame.number == frameNumber: // frame in the pool
+			if frame.status != FrameEmpty && frame.status != FrameCompressing {
+				frame.group.Add(1) // Increment the read count for this frame
+				return frame, frame.number, frame.status
+			}
+		case frameNumber > currentFrame: // future frame
+			frameNumber = currentFrame + 1
+		default:
+			// The frame number is past and no longer available.
+			// pick the current frame.
+			frameNumber = currentFrame
+		}
+		sub.pool.Wait()
+	}
+}
+
+// downscale the pixels in src to the size of dst, averaging the
+// source pixels covered by each target pixel. bpp is the number of
+// bytes per pixel of both images.
+func downscale(src []byte, srcW, srcH, srcPitch int, dst []byte, dstW, dstH, dstPitch, bpp int) {
+	// Source columns covered by each target column
+	cols := make([]int, dstW+1)
+	for x := 0; x <= dstW; x++ {
+		cols[x] = x * srcW / dstW
+	}
+	sums := make([]uint32, dstW*bpp)
+	for y := 0; y < dstH; y++ {
+		top, bottom := y*srcH/dstH, (y+1)*srcH/dstH
+		if bottom <= top {
+			bottom = top + 1
+		}
+		for i := range sums {
+			sums[i] = 0
+		}
+		for sy := top; sy < bottom; sy++ {
+			row := src[sy*srcPitch:]
+			for x := 0; x < dstW; x++ {
+				left, right := cols[x], cols[x+1]
+				if right <= left {
+					right = left + 1
+				}
+				sum := sums[x*bpp : (x+1)*bpp]
+				for sx := left; sx < right; sx++ {
+					pixel := row[sx*bpp : (sx+1)*bpp]
+					for c := range sum {
+						sum[c] += uint32(pixel[c])
+					}
+				}
+			}
+		}
+		row := dst[y*dstPitch:]
+		for x := 0; x < dstW; x++ {
+			left, right := cols[x], cols[x+1]
+			if right <= left {
+				right = left + 1
+			}
+			count := uint32((right - left) * (bottom - top))
+			for c := 0; c < bpp; c++ {
+				row[x*bpp+c] = byte((sums[x*bpp+c] + count/2) / count)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package jpeg
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSelectRendition(t *testing.T) {
+	renditions := []Rendition{
+		{Name: "full", Quality: 90},
+		{Name: "hd", Width: 1280, Quality: 75},
+		{Name: "hd-low", Width: 1280, Quality: 40},
+		{Name: "small", Width: 640, Quality: 60},
+	}
+	for _, tc := range []struct {
+		query    string
+		expected int
+	}{
+		{"", 0},
+		{"rendition=small", 3},
+		{"width=1920", 1},
+		{"width=1280&quality=50", 2},
+		{"width=320", 3},
+		{"quality=85", 0},
+	} {
+		query, _ := url.ParseQuery(tc.query)
+		index, err := selectRendition(renditions, query)
+		if err != nil {
+			t.Errorf("%q: %v", tc.query, err)
+			continue
+		}
+		if index != tc.expected {
+			t.Errorf("%q: got %d, expected %d", tc.query, index, tc.expected)
+		}
+	}
+	for _, query := range []string{"rendition=none", "width=abc", "quality=101"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := selectRendition(renditions, values); err == nil {
+			t.Errorf("%q: expected error", query)
+		}
+	}
+}
+
+func TestDownscale(t *testing.T) {
+	// 4x2 gray image, scaled to 2x1
+	src := []byte{
+		0, 10, 100, 200,
+		20, 30, 100, 0,
+	}
+	dst := make([]byte, 2)
+	downscale(src, 4, 2, 4, dst, 2, 1, 2, 1)
+	if dst[0] != 15 || dst[1] != 100 {
+		t.Errorf("unexpected pixels %v", dst)
+	}
+	// 3x1 RGB image, scaled to 2x1
+	src = []byte{10, 20, 30, 30, 40, 50, 60, 70, 80}
+	dst = make([]byte, 6)
+	downscale(src, 3, 1, 9, dst, 2, 1, 6, 3)
+	if dst[0] != 10 || dst[3] != 45 || dst[5] != 65 {
+		t.Errorf("unexpected pixels %v", dst)
+	}
+}
+
+func TestSelectStretch(t *testing.T) {
+	renditions := WithStretchVariants([]Rendition{
+		{Name: "full"},
+		{Name: "small", Width: 640, Stretch: Stretch{Mode: StretchGamma}},
+	}, Stretch{Mode: StretchSTF})
+	if len(renditions) != 2*len(StretchModes) {
+		t.Fatalf("got %d renditions", len(renditions))
+	}
+	if renditions[0].Stretch.Mode != StretchSTF || renditions[1].Stretch.Mode != StretchGamma {
+		t.Fatalf("default stretch not applied: %+v", renditions[:2])
+	}
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"", "full"},
+		{"width=640", "small"},
+		{"stretch=stf", "full"},
+		{"stretch=stf&width=640", "small-stf"},
+		{"stretch=none", "full-none"},
+		{"stretch=asinh&rendition=small", "small-asinh"},
+		{"rendition=small-auto&stretch=auto", "small-auto"},
+	} {
+		query, _ := url.ParseQuery(tc.query)
+		index, err := selectRendition(renditions, query)
+		if err != nil {
+			t.Errorf("%q: %v", tc.query, err)
+			continue
+		}
+		if got := renditions[index].String(); got != tc.expected {
+			t.Errorf("%q: got %s, expected %s", tc.query, got, tc.expected)
+		}
+	}
+	values, _ := url.ParseQuery("stretch=log")
+	if _, err := selectRendition(renditions, values); err == nil {
+		t.Error("expected error for unknown stretch")
+	}
+}
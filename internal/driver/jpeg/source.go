@@ -39,6 +39,57 @@ type SrcFrame interface {
 	Compress(compressor Compressor, target *Image) (JpegFeatures, error)
 }
 
+// RawSrcFrame is a SrcFrame that exposes the raw pixels,
+// so that other renditions can be encoded from them.
+type RawSrcFrame interface {
+	SrcFrame
+	Raw() (*Image, RawFeatures)
+}
+
+// DecodeSrcFrame is a SrcFrame that must be decoded before it can be
+// compressed or scaled, e.g. raw Bayer data. The compression farm
+// decodes it once into a buffer of its own, for all the renditions.
+type DecodeSrcFrame interface {
+	SrcFrame
+	Decode(target *Image) (RawFrame, error)
+}
+
+// FeaturesFrame is a SrcFrame that knows the features of its pixels
+// without decoding them, e.g. raw Bayer data or jpeg files.
+// The pipeline sizes its buffers from them.
+type FeaturesFrame interface {
+	SrcFrame
+	Features() RawFeatures
+}
+
+// frameFeatures returns the features of the pixels of the frame,
+// if known before decoding
+func frameFeatures(frame SrcFrame) (RawFeatures, bool) {
+	switch frame := frame.(type) {
+	case RawSrcFrame:
+		_, features := frame.Raw()
+		return features, true
+	case FeaturesFrame:
+		return frame.Features(), true
+	}
+	return RawFeatures{}, false
+}
+
+// frameSize returns the size of the raw buffer of the frame, from the
+// features of its samples, or 0 if unknown, e.g. for jpeg files.
+func frameSize(frame SrcFrame) int {
+	switch frame := frame.(type) {
+	case BayerFrame:
+		return frame.features.Width * frame.features.Height * frame.decoder.bytesPerSample()
+	case DeepFrame:
+		return 2 * frame.features.Pitch() * frame.features.Height // 16 bit samples
+	case RawSrcFrame:
+		_, features := frame.Raw()
+		return features.Pitch() * features.Height
+	}
+	return 0
+}
+
 // Source of frames
 type Source interface {
 	Name() string                                           // identifies the camera name
@@ -54,6 +105,7 @@ type FrameCompressor struct {
 
 type RawFrame struct {
 	srcFrame    *Image
+	metadata    Metadata
 	camera      string
 	subsampling Subsampling
 	quality     int
@@ -76,6 +128,22 @@ func (f RawFrame) Buffer() *Image {
 	return f.srcFrame
 }
 
+// WithMetadata returns a copy of the frame with the given metadata
+func (f RawFrame) WithMetadata(metadata Metadata) RawFrame {
+	f.metadata = metadata
+	return f
+}
+
+// Metadata implements MetadataFrame
+func (f RawFrame) Metadata() Metadata {
+	return f.metadata
+}
+
+// Raw implements RawSrcFrame
+func (f RawFrame) Raw() (*Image, RawFeatures) {
+	return f.srcFrame, f.features
+}
+
 func (f RawFrame) Compress(compressor Compressor, target *Image) (JpegFeatures, error) {
 	start := time.Now()
 	feat, err := compressor.Compress(
@@ -86,8 +154,8 @@ func (f RawFrame) Compress(compressor Compressor, target *Image) (JpegFeatures,
 		f.quality,
 		f.flags|TJFLAG_NOREALLOC,
 	)
-	if err != nil {
-		compressionTime.WithLabelValues(f.camera).Observe(float64(time.Since(start) / time.Second))
+	if err == nil {
+		compressionTime.WithLabelValues(f.camera).Observe(time.Since(start).Seconds())
 		compressedSize.WithLabelValues(f.camera).Observe(float64(target.Size()))
 	}
 	return feat, err
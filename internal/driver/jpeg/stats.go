@@ -0,0 +1,233 @@
+package jpeg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/imgstats"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+var (
+	frameMean = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_frame_mean",
+			Help: "Mean of the samples of the latest frame sampled, by channel (0-255)",
+		},
+		[]string{"camera", "channel"},
+	)
+
+	frameMedian = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_frame_median",
+			Help: "Median of the samples of the latest frame sampled, by channel (0-255)",
+		},
+		[]string{"camera", "channel"},
+	)
+
+	frameSaturated = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_frame_saturated_percent",
+			Help: "Percent of saturated samples of the latest frame sampled, by channel",
+		},
+		[]string{"camera", "channel"},
+	)
+
+	frameSharpness = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_frame_sharpness",
+			Help: "Variance of the Laplacian of the luminance of the latest frame sampled",
+		},
+		[]string{"camera"},
+	)
+
+	frameStatsTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_frame_stats_timestamp",
+			Help: "Timestamp of the latest frame sampled for the statistics (unix)",
+		},
+		[]string{"camera"},
+	)
+)
+
+// ErrStatsDisabled is returned when the pipeline does not compute stats
+const ErrStatsDisabled errString = "frame statistics are disabled"
+
+// Pixels sampled for the statistics, about
+const statsSamples = 1 << 18
+
+// Time to wait for the statistics of a new frame
+const statsTimeout = 30 * time.Second
+
+// FrameStats are the statistics of a raw frame, before compression
+type FrameStats struct {
+	Metadata Metadata
+	Computed time.Time // when the stats were computed
+	imgstats.Stats
+}
+
+// statsState keeps the latest stats of a pipeline
+type statsState struct {
+	interval time.Duration
+	last     int64 // UnixNano of the latest frame sampled, 0 to sample the next one
+	mutex    sync.Mutex
+	latest   *FrameStats
+	updated  chan struct{} // closed and replaced on every update
+}
+
+func newStatsState(interval time.Duration) *statsState {
+	return &statsState{
+		interval: interval,
+		updated:  make(chan struct{}),
+	}
+}
+
+// due returns true if the frame received at now must be sampled
+func (s *statsState) due(now time.Time) bool {
+	last := atomic.LoadInt64(&s.last)
+	if last != 0 && now.UnixNano()-last < int64(s.interval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&s.last, last, now.UnixNano())
+}
+
+// request the stats of the next frame
+func (s *statsState) request() {
+	atomic.StoreInt64(&s.last, 0)
+}
+
+// update the latest stats
+func (s *statsState) update(camera string, stats FrameStats) {
+	for _, channel := range stats.Channels {
+		frameMean.WithLabelValues(camera, channel.Name).Set(channel.Mean)
+		frameMedian.WithLabelValues(camera, channel.Name).Set(float64(channel.Median))
+		frameSaturated.WithLabelValues(camera, channel.Name).Set(channel.Saturated)
+	}
+	frameSharpness.WithLabelValues(camera).Set(stats.Sharpness)
+	frameStatsTimestamp.WithLabelValues(camera).Set(float64(stats.Computed.Unix()))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.latest = &stats
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// get the latest stats, and a channel closed on the next update
+func (s *statsState) get() (*FrameStats, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.latest, s.updated
+}
+
+// SetStatsInterval computes the statistics of a raw frame every
+// interval, while the pipeline is running. 0 disables them.
+// Must be called before the first session.
+func (p *Pipeline) SetStatsInterval(interval time.Duration) {
+	p.stats = nil
+	if interval > 0 {
+		p.stats = newStatsState(interval)
+	}
+}
+
+// Stats of the latest frame sampled, if not older than the interval.
+// Otherwise, waits for the stats of the next frame.
+func (session *Session) Stats(ctx context.Context) (FrameStats, error) {
+	if session.stats == nil {
+		return FrameStats{}, ErrStatsDisabled
+	}
+	latest, updated := session.stats.get()
+	if latest != nil && time.Since(latest.Computed) <= session.stats.interval {
+		return *latest, nil
+	}
+	session.stats.request()
+	select {
+	case <-ctx.Done():
+		return FrameStats{}, ctx.Err()
+	case <-updated:
+		latest, _ = session.stats.get()
+		return *latest, nil
+	}
+}
+
+// stats computes the statistics of the raw frame
+func (w *worker) stats(frame srcFrame, state *statsState) error {
+	img, feat, err := w.pixels(frame, 0)
+	if err != nil {
+		return err
+	}
+	bpp := feat.Pitch() / feat.Width
+	stats := imgstats.Compute(img.Slice(), feat.Width, feat.Height, feat.Pitch(), bpp, imgstats.Step(feat.Width, feat.Height, statsSamples))
+	state.update(frame.camera, FrameStats{
+		Metadata: frame.metadata,
+		Computed: time.Now(),
+		Stats:    stats,
+	})
+	return nil
+}
+
+// statsResponse is the JSON body of the StatsHandler
+type statsResponse struct {
+	Frame     uint64    `json:"frame"`
+	Timestamp time.Time `json:"timestamp"`
+	imgstats.Stats
+}
+
+// StatsHandler returns the statistics of the latest raw frame as JSON.
+// The query parameter bins reduces the histograms to fewer bins.
+func StatsHandler(logger servicelog.Logger, mgr Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		bins := imgstats.Bins
+		if value := r.URL.Query().Get("bins"); value != "" {
+			var err error
+			if bins, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "invalid bins", http.StatusBadRequest)
+				return
+			}
+		}
+
+		session, err := mgr.Acquire(logger)
+		if err != nil {
+			logger.Error("Acquiring session failed", servicelog.Error(err))
+			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
+			return
+		}
+		defer mgr.Done()
+
+		ctx, cancel := context.WithTimeout(r.Context(), statsTimeout)
+		defer cancel()
+		stats, err := session.Stats(ctx)
+		if err != nil {
+			if err == ErrStatsDisabled {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Frame statistics not available", http.StatusServiceUnavailable)
+			return
+		}
+		rebinned, err := stats.Stats.Rebin(bins)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(statsResponse{
+			Frame:     stats.Metadata.Sequence,
+			Timestamp: stats.Metadata.Timestamp,
+			Stats:     rebinned,
+		}); err != nil {
+			logger.Debug("Failed to send frame statistics", servicelog.Error(err))
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package jpeg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/warpcomdev/asicamera2/internal/driver/imgstats"
+)
+
+// gauge returns the value of the gauge
+func gauge(t *testing.T, g prometheus.Gauge) float64 {
+	var metric dto.Metric
+	if err := g.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestStatsUpdate(t *testing.T) {
+	state := newStatsState(time.Second)
+	computed := time.Now().Add(-time.Hour)
+	state.update("stats_cam", FrameStats{
+		Computed: computed,
+		Stats: imgstats.Stats{
+			Channels:  []imgstats.Channel{{Name: "L", Mean: 42}},
+			Sharpness: 7,
+		},
+	})
+	// The latest values are kept, with their timestamp, when the stream stops
+	if got := gauge(t, frameMean.WithLabelValues("stats_cam", "L")); got != 42 {
+		t.Errorf("got mean %v", got)
+	}
+	if got := gauge(t, frameSharpness.WithLabelValues("stats_cam")); got != 7 {
+		t.Errorf("got sharpness %v", got)
+	}
+	if got := gauge(t, frameStatsTimestamp.WithLabelValues("stats_cam")); got != float64(computed.Unix()) {
+		t.Errorf("got timestamp %v, expected %d", got, computed.Unix())
+	}
+}
@@ -0,0 +1,378 @@
+package jpeg
+
+import (
+	"fmt"
+	"math"
+)
+
+// StretchMode is the transfer function from the samples of
+// the frame to the 8 bit pixels that are displayed
+type StretchMode string
+
+const (
+	// StretchNone maps the samples linearly, as the source does
+	StretchNone StretchMode = "none"
+	// StretchAuto maps the clip percentiles to black and white (auto levels)
+	StretchAuto StretchMode = "auto"
+	// StretchSTF is the screen transfer function: the shadows are clipped
+	// below the background, and the midtones transfer function takes
+	// the median to the Target
+	StretchSTF StretchMode = "stf"
+	// StretchAsinh applies an inverse hyperbolic sine after the auto
+	// levels, brightening the faint details without saturating the stars
+	StretchAsinh StretchMode = "asinh"
+	// StretchGamma applies a gamma curve after the auto levels
+	StretchGamma StretchMode = "gamma"
+)
+
+// StretchModes supported, in the order variants are built
+var StretchModes = []StretchMode{StretchNone, StretchAuto, StretchSTF, StretchAsinh, StretchGamma}
+
+// ParseStretchMode validates the name of a mode. Empty means none.
+func ParseStretchMode(name string) (StretchMode, error) {
+	if name == "" {
+		return StretchNone, nil
+	}
+	for _, mode := range StretchModes {
+		if StretchMode(name) == mode {
+			return mode, nil
+		}
+	}
+	return StretchNone, fmt.Errorf("unknown stretch mode %q", name)
+}
+
+// Defaults of the stretch parameters
+const (
+	defaultStretchClip     = 0.05 // percent
+	defaultStretchTarget   = 0.25
+	defaultStretchStrength = 15
+	defaultStretchGamma    = 2.2
+	// Shadows clipping of the STF, in normalized MADs below the median
+	stfShadowsClip = -2.8
+	// Samples used for the statistics, about
+	stretchSamples = 1 << 16
+)
+
+// Stretch of the frames for display. The zero Stretch maps the
+// samples linearly.
+type Stretch struct {
+	Mode     StretchMode
+	Clip     float64 // percent of shadows and highlights clipped by auto, asinh and gamma (default 0.05)
+	Target   float64 // median after the stf, from 0 to 1 (default 0.25)
+	Strength float64 // factor of the asinh stretch (default 15)
+	Gamma    float64 // exponent of the gamma stretch (default 2.2)
+}
+
+// mode of the stretch, StretchNone if empty
+func (s Stretch) mode() StretchMode {
+	if s.Mode == "" {
+		return StretchNone
+	}
+	return s.Mode
+}
+
+// withDefaults fills the parameters not set
+func (s Stretch) withDefaults() Stretch {
+	s.Mode = s.mode()
+	if s.Clip <= 0 {
+		s.Clip = defaultStretchClip
+	}
+	if s.Target <= 0 || s.Target >= 1 {
+		s.Target = defaultStretchTarget
+	}
+	if s.Strength <= 0 {
+		s.Strength = defaultStretchStrength
+	}
+	if s.Gamma <= 0 {
+		s.Gamma = defaultStretchGamma
+	}
+	return s
+}
+
+// gridStep returns the step between the samples used for the statistics,
+// in both directions. The step is odd, so that every color of a Bayer
+// mosaic is sampled.
+func gridStep(width, height int) int {
+	step := int(math.Sqrt(float64(width) * float64(height) / stretchSamples))
+	if step < 1 {
+		step = 1
+	}
+	if step%2 == 0 {
+		step++
+	}
+	return step
+}
+
+// histogram of the samples, one bin per value
+type histogram struct {
+	bins  []uint32
+	total uint32
+}
+
+func newHistogram(bits int) *histogram {
+	return &histogram{bins: make([]uint32, 1<<bits)}
+}
+
+// add a sample to the histogram. Samples out of range are saturated.
+func (h *histogram) add(value uint16) {
+	if int(value) >= len(h.bins) {
+		value = uint16(len(h.bins) - 1)
+	}
+	h.bins[value]++
+	h.total++
+}
+
+// percentile returns the lowest value with at least the given
+// fraction of the samples at or below it
+func (h *histogram) percentile(fraction float64) int {
+	threshold := uint32(math.Ceil(fraction * float64(h.total)))
+	if threshold < 1 {
+		threshold = 1
+	}
+	var count uint32
+	for value, bin := range h.bins {
+		count += bin
+		if count >= threshold {
+			return value
+		}
+	}
+	return len(h.bins) - 1
+}
+
+// mad returns the median absolute deviation from the median
+func (h *histogram) mad(median int) int {
+	half := (h.total + 1) / 2
+	count := h.bins[median]
+	distance := 0
+	for count < half && distance < len(h.bins) {
+		distance++
+		if low := median - distance; low >= 0 {
+			count += h.bins[low]
+		}
+		if high := median + distance; high < len(h.bins) {
+			count += h.bins[high]
+		}
+	}
+	return distance
+}
+
+// mtf is the midtones transfer function with balance m
+func mtf(m, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	case m <= 0:
+		return 1
+	}
+	return (m - 1) * x / ((2*m-1)*x - m)
+}
+
+// lut maps every value of the histogram to 8 bits
+func (s Stretch) lut(h *histogram) []byte {
+	s = s.withDefaults()
+	maxValue := float64(len(h.bins) - 1)
+	lut := make([]byte, len(h.bins))
+	if h.total == 0 || s.Mode == StretchNone {
+		for value := range lut {
+			lut[value] = byte(math.Round(float64(value) * 255 / maxValue))
+		}
+		return lut
+	}
+	// Normalized black and white points, and transfer function
+	var black, white float64
+	var transfer func(x float64) float64
+	if s.Mode == StretchSTF {
+		median := h.percentile(0.5)
+		madn := 1.4826 * float64(h.mad(median)) / maxValue
+		black = math.Max(0, float64(median)/maxValue+stfShadowsClip*madn)
+		white = 1
+		// At least one level between the black point and the median
+		background := math.Max(float64(median)/maxValue-black, 1/maxValue)
+		balance := mtf(s.Target, background)
+		transfer = func(x float64) float64 { return mtf(balance, x) }
+	} else {
+		black = float64(h.percentile(s.Clip/100)) / maxValue
+		white = float64(h.percentile(1-s.Clip/100)) / maxValue
+		switch s.Mode {
+		case StretchAsinh:
+			norm := math.Asinh(s.Strength)
+			transfer = func(x float64) float64 { return math.Asinh(s.Strength*x) / norm }
+		case StretchGamma:
+			transfer = func(x float64) float64 { return math.Pow(x, 1/s.Gamma) }
+		default:
+			transfer = func(x float64) float64 { return x }
+		}
+	}
+	if white <= black {
+		white = black + 1/maxValue
+	}
+	for value := range lut {
+		x := (float64(value)/maxValue - black) / (white - black)
+		x = math.Max(0, math.Min(1, x))
+		lut[value] = byte(math.Round(255 * math.Max(0, math.Min(1, transfer(x)))))
+	}
+	return lut
+}
+
+// stretchPixels stretches 8 bit pixels from src into dst, which may be the
+// same. The alpha channel of RGBA pixels is kept.
+func stretchPixels(s Stretch, src []byte, dst []byte, width, height, pitch, bpp int) {
+	channels := bpp
+	if channels > 3 {
+		channels = 3
+	}
+	h := newHistogram(8)
+	step := gridStep(width, height)
+	for y := step / 2; y < height; y += step {
+		row := src[y*pitch:]
+		for x := step / 2; x < width; x += step {
+			for c := 0; c < channels; c++ {
+				h.add(uint16(row[x*bpp+c]))
+			}
+		}
+	}
+	lut := s.lut(h)
+	for y := 0; y < height; y++ {
+		in, out := src[y*pitch:y*pitch+width*bpp], dst[y*pitch:]
+		for i, value := range in {
+			if i%bpp < channels {
+				out[i] = lut[value]
+			} else {
+				out[i] = value
+			}
+		}
+	}
+}
+
+// DeepSrcFrame is a SrcFrame with more than 8 bits per sample, e.g.
+// RAW16. Stretched renditions are mapped from the samples rather
+// than from the 8 bit pixels, to keep the detail of the shadows.
+type DeepSrcFrame interface {
+	SrcFrame
+	// Bits per sample
+	Bits() int
+	// Samples calls add with one sample every step pixels, in both directions
+	Samples(step int, add func(value uint16))
+	// Map the samples through the lut into 8 bit pixels in target
+	Map(target *Image, lut []byte) (RawFrame, error)
+}
+
+// stretchDeep maps the samples of the frame with the stretch
+func stretchDeep(s Stretch, frame DeepSrcFrame, width, height int, target *Image) (RawFrame, error) {
+	h := newHistogram(frame.Bits())
+	frame.Samples(gridStep(width, height), h.add)
+	return frame.Map(target, s.lut(h))
+}
+
+// DeepFrame is a monochrome or RGB frame with up to 16 bits per
+// sample. It implements DecodeSrcFrame and DeepSrcFrame.
+type DeepFrame struct {
+	srcFrame   *Image
+	camera     string
+	features   RawFeatures // of the 8 bit pixels, PF_GRAY or PF_RGB
+	bits       int
+	bigEndian  bool
+	compressor FrameCompressor
+	metadata   Metadata
+}
+
+// DeepFrame wraps an image with 16 bit samples, of which only the
+// given bits are significant, in the format of the features
+func (f *FrameCompressor) DeepFrame(camera string, img *Image, features RawFeatures, bits int, bigEndian bool) DeepFrame {
+	return DeepFrame{
+		srcFrame:   img,
+		camera:     camera,
+		features:   features,
+		bits:       bits,
+		bigEndian:  bigEndian,
+		compressor: *f,
+	}
+}
+
+// Buffer implements SrcFrame
+func (f DeepFrame) Buffer() *Image {
+	return f.srcFrame
+}
+
+// WithMetadata returns a copy of the frame with the given metadata
+func (f DeepFrame) WithMetadata(metadata Metadata) DeepFrame {
+	f.metadata = metadata
+	return f
+}
+
+// Metadata implements MetadataFrame
+func (f DeepFrame) Metadata() Metadata {
+	return f.metadata
+}
+
+// Features implements FeaturesFrame, of the 8 bit pixels
+func (f DeepFrame) Features() RawFeatures {
+	return f.features
+}
+
+// Bits implements DeepSrcFrame
+func (f DeepFrame) Bits() int {
+	return f.bits
+}
+
+// sample at index i
+func (f DeepFrame) sample(samples []byte, i int) uint16 {
+	if f.bigEndian {
+		return uint16(samples[2*i])<<8 | uint16(samples[2*i+1])
+	}
+	return uint16(samples[2*i]) | uint16(samples[2*i+1])<<8
+}
+
+// Samples implements DeepSrcFrame
+func (f DeepFrame) Samples(step int, add func(value uint16)) {
+	samples := f.srcFrame.Slice()
+	channels := f.features.Pitch() / f.features.Width
+	for y := step / 2; y < f.features.Height; y += step {
+		for x := step / 2; x < f.features.Width; x += step {
+			for c := 0; c < channels; c++ {
+				add(f.sample(samples, (y*f.features.Width+x)*channels+c))
+			}
+		}
+	}
+}
+
+// Map implements DeepSrcFrame
+func (f DeepFrame) Map(target *Image, lut []byte) (RawFrame, error) {
+	size := f.features.Pitch() * f.features.Height
+	samples := f.srcFrame.Slice()
+	if len(samples) < 2*size {
+		return RawFrame{}, fmt.Errorf("frame has %d bytes, expected %d", len(samples), 2*size)
+	}
+	if err := target.reserve(size); err != nil {
+		return RawFrame{}, err
+	}
+	pixels := target.Slice()
+	maxValue := uint16(len(lut) - 1)
+	for i := range pixels {
+		value := f.sample(samples, i)
+		if value > maxValue {
+			value = maxValue
+		}
+		pixels[i] = lut[value]
+	}
+	return f.compressor.Frame(f.camera, target, f.features).WithMetadata(f.metadata), nil
+}
+
+// Decode implements DecodeSrcFrame, mapping the samples linearly
+func (f DeepFrame) Decode(target *Image) (RawFrame, error) {
+	return f.Map(target, Stretch{}.lut(newHistogram(f.bits)))
+}
+
+// Compress implements SrcFrame. Decodes into a temporary buffer,
+// the farm uses Decode instead to reuse the buffers of the workers.
+func (f DeepFrame) Compress(compressor Compressor, target *Image) (JpegFeatures, error) {
+	var pixels Image
+	defer pixels.Free()
+	frame, err := f.Decode(&pixels)
+	if err != nil {
+		return JpegFeatures{}, err
+	}
+	return frame.Compress(compressor, target)
+}
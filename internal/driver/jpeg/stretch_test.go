@@ -0,0 +1,85 @@
+package jpeg
+
+import (
+	"math"
+	"testing"
+)
+
+// skyHistogram is a dark background with some noise and a few stars
+func skyHistogram(bits int) *histogram {
+	h := newHistogram(bits)
+	scale := uint16(1 << (bits - 8))
+	for i := 0; i < 10000; i++ {
+		h.add(scale * uint16(10+i%5))
+	}
+	for i := 0; i < 10; i++ {
+		h.add(scale * 250)
+	}
+	return h
+}
+
+func TestHistogram(t *testing.T) {
+	h := skyHistogram(8)
+	if median := h.percentile(0.5); median != 12 {
+		t.Errorf("median %d, expected 12", median)
+	}
+	if mad := h.mad(12); mad != 1 {
+		t.Errorf("mad %d, expected 1", mad)
+	}
+	if top := h.percentile(1); top != 250 {
+		t.Errorf("max %d, expected 250", top)
+	}
+}
+
+func TestStretchLUT(t *testing.T) {
+	for _, bits := range []int{8, 16} {
+		scale := 1 << (bits - 8)
+		h := skyHistogram(bits)
+		medians := make(map[StretchMode]byte)
+		for _, mode := range StretchModes {
+			lut := Stretch{Mode: mode}.lut(h)
+			if len(lut) != 1<<bits {
+				t.Fatalf("%s: lut has %d values", mode, len(lut))
+			}
+			for i := 1; i < len(lut); i++ {
+				if lut[i] < lut[i-1] {
+					t.Fatalf("%s %d bits: lut decreases at %d", mode, bits, i)
+				}
+			}
+			medians[mode] = lut[12*scale]
+			if mode != StretchNone && mode != StretchSTF {
+				// Levels from the darkest background to the stars
+				if lut[10*scale] != 0 || lut[250*scale] != 255 {
+					t.Errorf("%s %d bits: black %d, star %d", mode, bits, lut[10*scale], lut[250*scale])
+				}
+			}
+		}
+		if medians[StretchNone] != 12 {
+			t.Errorf("%d bits: linear median %d", bits, medians[StretchNone])
+		}
+		// The background gets to the target, 0.25
+		if math.Abs(float64(medians[StretchSTF])-0.25*255) > 4 {
+			t.Errorf("%d bits: stf median %d", bits, medians[StretchSTF])
+		}
+		// Non linear stretches brighten the background
+		if medians[StretchAsinh] <= medians[StretchAuto] || medians[StretchGamma] <= medians[StretchAuto] {
+			t.Errorf("%d bits: medians %v", bits, medians)
+		}
+	}
+}
+
+func TestStretchPixels(t *testing.T) {
+	const width, height = 16, 16
+	src := make([]byte, width*height*4)
+	for i := range src {
+		src[i] = byte(10 + i%3)
+		if i%4 == 3 {
+			src[i] = 200 // alpha
+		}
+	}
+	dst := make([]byte, len(src))
+	stretchPixels(Stretch{Mode: StretchAuto}, src, dst, width, height, width*4, 4)
+	if dst[0] != 0 || dst[2] != 255 || dst[3] != 200 {
+		t.Errorf("got %v, expected levels from 0 to 255 and alpha kept", dst[:4])
+	}
+}
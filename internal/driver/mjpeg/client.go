@@ -0,0 +1,222 @@
+package mjpeg
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	framesDelivered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_mjpeg_frames_delivered",
+			Help: "Frames delivered to streaming clients",
+		},
+		[]string{"camera"},
+	)
+
+	framesSkipped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_mjpeg_frames_skipped",
+			Help: "Frames skipped by streaming clients, because of the frame rate limit or a slow link",
+		},
+		[]string{"camera"},
+	)
+
+	bytesSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_mjpeg_bytes_sent",
+			Help: "Bytes of frames sent to streaming clients",
+		},
+		[]string{"camera"},
+	)
+)
+
+const (
+	// Maximum time to write a single frame before giving up on the client
+	stallTimeout = 20 * time.Second
+	// The link is left idle for half the time it takes to write a frame,
+	// so that frames do not pile up in the network buffers.
+	congestionFactor = 1.5
+	// Weight of the latest write time in the moving average
+	smoothing = 0.25
+)
+
+// disconnectOnStop closes the connection to the client when the
+// session stops, so that a recycled pipeline does not wait for stalled
+// clients. Closing unblocks a write in progress, a deadline would be
+// overwritten by the next frame. The returned function must be called
+// when the handler returns.
+func disconnectOnStop(session Session, conn io.Closer) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-session.Stopped():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// pacer decides when to send the next frame to a client
+type pacer struct {
+	minInterval time.Duration // from the requested frame rate
+	writeTime   time.Duration // moving average of the time to write a frame
+	last        time.Time     // start of the latest write
+}
+
+// newPacer limits the frame rate to fps. 0 means no limit.
+func newPacer(fps float64) *pacer {
+	p := &pacer{}
+	p.limit(fps)
+	return p
+}
+
+// limit the frame rate to fps. 0 means no limit.
+func (p *pacer) limit(fps float64) {
+	p.minInterval = 0
+	if fps > 0 {
+		p.minInterval = time.Duration(float64(time.Second) / fps)
+	}
+}
+
+// observe the time it took to write a frame
+func (p *pacer) observe(start time.Time, elapsed time.Duration) {
+	p.last = start
+	if p.writeTime == 0 {
+		p.writeTime = elapsed
+		return
+	}
+	p.writeTime += time.Duration(smoothing * float64(elapsed-p.writeTime))
+}
+
+// delay until the next frame should be sent
+func (p *pacer) delay(now time.Time) time.Duration {
+	interval := p.minInterval
+	if adaptive := time.Duration(congestionFactor * float64(p.writeTime)); adaptive > interval {
+		interval = adaptive
+	}
+	return p.last.Add(interval).Sub(now)
+}
+
+// parseFPS reads the frame rate limit of the client from the query
+func parseFPS(query url.Values) (float64, error) {
+	value := query.Get("fps")
+	if value == "" {
+		return 0, nil
+	}
+	fps, err := strconv.ParseFloat(value, 64)
+	if err != nil || fps <= 0 {
+		return 0, fmt.Errorf("invalid fps %q", value)
+	}
+	return fps, nil
+}
+
+// clientStats are the statistics of a connected client
+type clientStats struct {
+	camera    string
+	client    string
+	rendition string
+	delivered uint64
+	skipped   uint64
+	bytes     uint64
+	lag       int64 // nanoseconds to deliver the latest frame
+}
+
+// deliver records a frame sent to the client
+func (s *clientStats) deliver(size int, lag time.Duration) {
+	atomic.AddUint64(&s.delivered, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+	atomic.StoreInt64(&s.lag, int64(lag))
+	framesDelivered.WithLabelValues(s.camera).Inc()
+	bytesSent.WithLabelValues(s.camera).Add(float64(size))
+}
+
+// skip records frames the client did not receive
+func (s *clientStats) skip(frames uint64) {
+	if frames == 0 {
+		return
+	}
+	atomic.AddUint64(&s.skipped, frames)
+	framesSkipped.WithLabelValues(s.camera).Add(float64(frames))
+}
+
+var (
+	clientLabels    = []string{"camera", "client", "rendition"}
+	clientDelivered = prometheus.NewDesc("asicamera_mjpeg_client_frames_delivered", "Frames delivered to each connected client", clientLabels, nil)
+	clientSkipped   = prometheus.NewDesc("asicamera_mjpeg_client_frames_skipped", "Frames skipped by each connected client", clientLabels, nil)
+	clientBytes     = prometheus.NewDesc("asicamera_mjpeg_client_bytes_sent", "Bytes sent to each connected client", clientLabels, nil)
+	clientLag       = prometheus.NewDesc("asicamera_mjpeg_client_lag_seconds", "Time to deliver the latest frame to each connected client", clientLabels, nil)
+)
+
+// clientCollector exports the stats of the connected clients.
+// Clients are forgotten when they disconnect, to keep the
+// cardinality of the metrics bounded.
+type clientCollector struct {
+	mutex   sync.Mutex
+	clients map[*clientStats]struct{}
+}
+
+var clients = &clientCollector{
+	clients: make(map[*clientStats]struct{}),
+}
+
+func init() {
+	prometheus.MustRegister(clients)
+}
+
+// add a client
+func (c *clientCollector) add(camera, client, rendition string) *clientStats {
+	stats := &clientStats{
+		camera:    camera,
+		client:    client,
+		rendition: rendition,
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clients[stats] = struct{}{}
+	return stats
+}
+
+// remove a client
+func (c *clientCollector) remove(stats *clientStats) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.clients, stats)
+}
+
+// rename the rendition of a client
+func (c *clientCollector) rename(stats *clientStats, rendition string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats.rendition = rendition
+}
+
+// Describe implements prometheus.Collector
+func (c *clientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientDelivered
+	ch <- clientSkipped
+	ch <- clientBytes
+	ch <- clientLag
+}
+
+// Collect implements prometheus.Collector
+func (c *clientCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for stats := range c.clients {
+		labels := []string{stats.camera, stats.client, stats.rendition}
+		ch <- prometheus.MustNewConstMetric(clientDelivered, prometheus.CounterValue, float64(atomic.LoadUint64(&stats.delivered)), labels...)
+		ch <- prometheus.MustNewConstMetric(clientSkipped, prometheus.CounterValue, float64(atomic.LoadUint64(&stats.skipped)), labels...)
+		ch <- prometheus.MustNewConstMetric(clientBytes, prometheus.CounterValue, float64(atomic.LoadUint64(&stats.bytes)), labels...)
+		ch <- prometheus.MustNewConstMetric(clientLag, prometheus.GaugeValue, time.Duration(atomic.LoadInt64(&stats.lag)).Seconds(), labels...)
+	}
+}
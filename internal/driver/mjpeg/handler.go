@@ -1,151 +1,199 @@
-package mjpeg
-
-import (
-	"errors"
-	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
-	"net/http"
-	"net/textproto"
-	"time"
-
-	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
-	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
-)
-
-type Session interface {
-	Next(frameNumber uint64) (*jpeg.JpegFrame, uint64, jpeg.FrameStatus)
-}
-
-type SessionManager interface {
-	Acquire(servicelog.Logger) (Session, error)
-	Done()
-}
-
-// Track https://github.com/golang/go/issues/54136 for improvements on timeout handling
-func Handler(logger servicelog.Logger, mgr SessionManager) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" && r.Method != "HEAD" {
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		protocol := r.Proto
-		hijacker, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Protocol Not Supported", http.StatusMethodNotAllowed)
-			return
-		}
-
-		session, err := mgr.Acquire(logger)
-		if err != nil {
-			logger.Error("Acquiring session failed", servicelog.Error(err))
-			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
-			return
-		}
-		defer mgr.Done()
-
-		conn, rw, err := hijacker.Hijack()
-		if err != nil {
-			logger.Error("Hijacking failed", servicelog.Error(err))
-			http.Error(w, "Hijacking failed", http.StatusMethodNotAllowed)
-			return
-		}
-		defer conn.Close()
-		conn.SetDeadline(time.Now().Add(5 * time.Second)) // 5 seconds deadline to set the streaming up
-
-		// keep monitoring the conn while increasing the read deadline
-		keepAlive := make(chan struct{})
-		go func() {
-			defer close(keepAlive)
-			one := make([]byte, 1)
-			for {
-				if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-					logger.Error("SetReadDeadline failed", servicelog.Error(err))
-					return
-				}
-				if _, err := rw.Read(one); errors.Is(err, io.EOF) {
-					logger.Error("Read failed", servicelog.Error(err))
-					return
-				}
-				rw.Discard(rw.Available())
-			}
-		}()
-
-		mimeWriter := multipart.NewWriter(rw)
-		defer mimeWriter.Close()
-
-		// Write the HTTP headers by hand
-		rw.WriteString(protocol)
-		rw.WriteString(" 200 OK\n")
-		rw.WriteString("Connection: close\n")
-		rw.WriteString("Cache-Control: no-store, no-cache\n")
-		rw.WriteString("Content-Type: ")
-		rw.WriteString(fmt.Sprintf("multipart/x-mixed-replace;boundary=%s", mimeWriter.Boundary()))
-		rw.WriteString("\n\n")
-		rw.Flush()
-
-		// Build a channel for pushing frames
-		frames := make(chan *jpeg.JpegFrame)
-		go func() {
-			defer close(frames)
-			var currentFrame uint64 = 1
-			for {
-				frame, frameNum, status := session.Next(currentFrame)
-				if frame == nil { // session died
-					log.Print("session terminated, disconnecting client")
-					return
-				}
-				if status != jpeg.FrameReady {
-					log.Printf("frame %d is not ready (status %d), skipping", frameNum, status)
-					frame.Done()
-					continue
-				}
-				select {
-				case <-keepAlive:
-					log.Print("keepAlive expired")
-					frame.Done()
-					return
-				case frames <- frame:
-					currentFrame = frameNum + 1
-					break
-				}
-			}
-		}()
-
-		for frame := range frames {
-			err = func() error { // embedded in a function, to be able to defer
-				defer frame.Done()
-				conn.SetWriteDeadline(time.Now().Add(2 * time.Second)) // max 2 seconds to deliver the payload
-				partHeader := make(textproto.MIMEHeader)
-				partHeader.Add("Content-Type", "image/jpeg")
-
-				partWriter, err := mimeWriter.CreatePart(partHeader)
-				if err != nil {
-					return fmt.Errorf("mjpeg: createPart: %w", err)
-				}
-
-				if _, err := partWriter.Write(frame.Slice()); err != nil {
-					return fmt.Errorf("mjpeg: write: %w", err)
-				}
-
-				if err := rw.Flush(); err != nil {
-					return fmt.Errorf("mjpeg: flush: %w", err)
-				}
-				return nil
-			}()
-			if err != nil {
-				// If we missed a frame, we don't know how is the stream
-				// actually ... better disconnect and force start again
-				logger.Error("Failed to send MIME part", servicelog.Error(err))
-				// exhaust the frame goroutine
-				conn.Close()
-				for discardedFrame := range frames {
-					discardedFrame.Done()
-				}
-				return
-			}
-		}
-	})
-}
+package mjpeg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Session of a stream, implemented by *jpeg.Session
+type Session interface {
+	Renditions() []jpeg.Rendition
+	Select(query url.Values) (int, error)
+	Subscribe(rendition int) *jpeg.Subscription
+	Stopped() <-chan struct{}
+}
+
+type SessionManager interface {
+	Acquire(servicelog.Logger) (Session, error)
+	Done()
+}
+
+// Handler streams the frames of the camera as MJPEG.
+// Clients can limit the frame rate with the `fps` query parameter.
+// Frames are skipped when the client link is too slow to keep up.
+// Track https://github.com/golang/go/issues/54136 for improvements on timeout handling
+func Handler(logger servicelog.Logger, camera string, mgr SessionManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fps, err := parseFPS(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		protocol := r.Proto
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Protocol Not Supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := mgr.Acquire(logger)
+		if err != nil {
+			logger.Error("Acquiring session failed", servicelog.Error(err))
+			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
+			return
+		}
+		defer mgr.Done()
+
+		rendition, err := session.Select(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subscription := session.Subscribe(rendition)
+		defer subscription.Close()
+
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			logger.Error("Hijacking failed", servicelog.Error(err))
+			http.Error(w, "Hijacking failed", http.StatusMethodNotAllowed)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second)) // 5 seconds deadline to set the streaming up
+		defer disconnectOnStop(session, conn)()
+
+		// keep monitoring the conn while increasing the read deadline
+		keepAlive := make(chan struct{})
+		go func() {
+			defer close(keepAlive)
+			one := make([]byte, 1)
+			for {
+				if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+					logger.Error("SetReadDeadline failed", servicelog.Error(err))
+					return
+				}
+				if _, err := rw.Read(one); errors.Is(err, io.EOF) {
+					logger.Error("Read failed", servicelog.Error(err))
+					return
+				}
+				rw.Discard(rw.Available())
+			}
+		}()
+
+		mimeWriter := multipart.NewWriter(rw)
+		defer mimeWriter.Close()
+
+		// Write the HTTP headers by hand
+		rw.WriteString(protocol)
+		rw.WriteString(" 200 OK\n")
+		rw.WriteString("Connection: close\n")
+		rw.WriteString("Cache-Control: no-store, no-cache\n")
+		rw.WriteString("Content-Type: ")
+		rw.WriteString(fmt.Sprintf("multipart/x-mixed-replace;boundary=%s", mimeWriter.Boundary()))
+		rw.WriteString("\n\n")
+		rw.Flush()
+
+		stats := clients.add(camera, r.RemoteAddr, subscription.Rendition().String())
+		defer clients.remove(stats)
+		defer func() {
+			logger.Info("client disconnected",
+				servicelog.String("client", stats.client),
+				servicelog.Uint64("delivered", atomic.LoadUint64(&stats.delivered)),
+				servicelog.Uint64("skipped", atomic.LoadUint64(&stats.skipped)),
+				servicelog.Uint64("bytes", atomic.LoadUint64(&stats.bytes)))
+		}()
+
+		// Frames are copied before sending, so that slow clients
+		// do not keep the compressed frames locked.
+		var (
+			buffer       []byte
+			currentFrame uint64 = 1
+			lastFrame    uint64
+		)
+		pace := newPacer(fps)
+		for {
+			if wait := pace.delay(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-keepAlive:
+					timer.Stop()
+					logger.Info("keepAlive expired")
+					return
+				case <-timer.C:
+				}
+			}
+			frame, frameNum, status := subscription.Next(currentFrame)
+			if frame == nil { // session died
+				logger.Info("session terminated, disconnecting client")
+				return
+			}
+			currentFrame = frameNum + 1
+			if status != jpeg.FrameReady {
+				logger.Debug("frame is not ready, skipping", servicelog.Uint64("frame", frameNum), servicelog.Int("status", int(status)))
+				frame.Done()
+				continue
+			}
+			ready := time.Now()
+			buffer = append(buffer[:0], frame.Slice()...)
+			metadata := frame.Metadata()
+			frame.Done()
+			select {
+			case <-keepAlive:
+				logger.Info("keepAlive expired")
+				return
+			default:
+			}
+			if lastFrame > 0 {
+				stats.skip(frameNum - lastFrame - 1)
+			}
+			start := time.Now()
+			conn.SetWriteDeadline(start.Add(stallTimeout)) // only give up on stalled clients
+			if err := writePart(mimeWriter, rw, metadata, buffer); err != nil {
+				// If we missed a frame, we don't know how is the stream
+				// actually ... better disconnect and force start again
+				logger.Error("Failed to send MIME part", servicelog.Error(err))
+				return
+			}
+			pace.observe(start, time.Since(start))
+			stats.deliver(len(buffer), time.Since(ready))
+			lastFrame = frameNum
+		}
+	})
+}
+
+// writePart sends a frame as a MIME part
+func writePart(mimeWriter *multipart.Writer, rw *bufio.ReadWriter, metadata jpeg.Metadata, frame []byte) error {
+	partHeader := textproto.MIMEHeader(metadata.Header())
+	partHeader.Set("Content-Type", "image/jpeg")
+
+	partWriter, err := mimeWriter.CreatePart(partHeader)
+	if err != nil {
+		return fmt.Errorf("mjpeg: createPart: %w", err)
+	}
+
+	if _, err := partWriter.Write(frame); err != nil {
+		return fmt.Errorf("mjpeg: write: %w", err)
+	}
+
+	if err := rw.Flush(); err != nil {
+		return fmt.Errorf("mjpeg: flush: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package mjpeg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+const (
+	// Interval of the pings sent to paused clients, to detect dead connections
+	pingInterval = 30 * time.Second
+	// Maximum size of the control messages received
+	controlReadLimit = 64 * 1024
+)
+
+// Only same origin requests are upgraded, the default of gorilla
+var upgrader = websocket.Upgrader{}
+
+// wsConn serializes the writes to the connection, which supports
+// a single concurrent writer. The write deadline is only changed by
+// send, under the same lock.
+type wsConn struct {
+	*websocket.Conn
+	mutex sync.Mutex
+}
+
+// send a message holding the write lock. Only stalled clients
+// are given up on.
+func (c *wsConn) send(messageType int, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(stallTimeout)); err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// close sends a close message and closes the connection
+func (c *wsConn) close() {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+// FrameHeader precedes the jpeg image in each binary message.
+// The message is the length of the header in 4 bytes (big endian),
+// the header in JSON, and the jpeg image.
+type FrameHeader struct {
+	Frame     uint64    `json:"frame"`
+	Timestamp time.Time `json:"timestamp"` // capture time
+	Camera    string    `json:"camera"`
+	Rendition string    `json:"rendition"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int       `json:"size"`
+	File      string    `json:"file,omitempty"`     // source file name
+	Exposure  float64   `json:"exposure,omitempty"` // seconds
+	Gain      int       `json:"gain,omitempty"`
+}
+
+// Control message sent by the client as JSON text. Only the fields
+// present are applied: pause or resume the stream, change the frame
+// rate limit (0 for none), or change the rendition.
+type Control struct {
+	Pause     *bool    `json:"pause,omitempty"`
+	FPS       *float64 `json:"fps,omitempty"`
+	Rendition *string  `json:"rendition,omitempty"`
+	Width     *int     `json:"width,omitempty"`
+	Quality   *int     `json:"quality,omitempty"`
+	Stretch   *string  `json:"stretch,omitempty"`
+}
+
+// query with the rendition parameters of the control message
+func (c Control) query() url.Values {
+	query := make(url.Values)
+	if c.Rendition != nil {
+		query.Set("rendition", *c.Rendition)
+	}
+	if c.Width != nil {
+		query.Set("width", strconv.Itoa(*c.Width))
+	}
+	if c.Quality != nil {
+		query.Set("quality", strconv.Itoa(*c.Quality))
+	}
+	if c.Stretch != nil {
+		query.Set("stretch", *c.Stretch)
+	}
+	return query
+}
+
+// controlError is sent back to the client when a control message fails
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// appendFrame builds the binary message of a frame
+func appendFrame(buffer []byte, header FrameHeader, image []byte) []byte {
+	encoded, _ := json.Marshal(header) // cannot fail
+	buffer = append(buffer[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buffer, uint32(len(encoded)))
+	buffer = append(buffer, encoded...)
+	return append(buffer, image...)
+}
+
+// WebSocketHandler streams the frames of the camera over a websocket,
+// one binary message per frame. It accepts the same query parameters
+// as Handler, and Control messages to change them on the fly.
+func WebSocketHandler(logger servicelog.Logger, camera string, mgr SessionManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		fps, err := parseFPS(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !websocket.IsWebSocketUpgrade(r) {
+			http.Error(w, "Websocket Upgrade Required", http.StatusBadRequest)
+			return
+		}
+
+		session, err := mgr.Acquire(logger)
+		if err != nil {
+			logger.Error("Acquiring session failed", servicelog.Error(err))
+			http.Error(w, "Acquiring session failed", http.StatusInternalServerError)
+			return
+		}
+		defer mgr.Done()
+
+		rendition, err := session.Select(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		upgraded, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("Websocket upgrade failed", servicelog.Error(err))
+			return
+		}
+		upgraded.SetReadLimit(controlReadLimit)
+		conn := &wsConn{Conn: upgraded}
+		defer conn.close()
+		defer disconnectOnStop(session, upgraded.UnderlyingConn())()
+
+		// Read the control messages until the client leaves
+		controls := make(chan Control)
+		gone := make(chan struct{})
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer close(gone)
+			for {
+				opcode, message, err := conn.ReadMessage()
+				if err != nil {
+					var closeErr *websocket.CloseError
+					if !errors.As(err, &closeErr) {
+						logger.Info("websocket read failed", servicelog.Error(err))
+					}
+					return
+				}
+				if opcode != websocket.TextMessage {
+					continue
+				}
+				var control Control
+				if err := json.Unmarshal(message, &control); err != nil {
+					reply, _ := json.Marshal(controlError{Error: "invalid control message: " + err.Error()})
+					conn.send(websocket.TextMessage, reply)
+					continue
+				}
+				select {
+				case controls <- control:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		subscription := session.Subscribe(rendition)
+		defer func() {
+			if subscription != nil {
+				subscription.Close()
+			}
+		}()
+		stats := clients.add(camera, r.RemoteAddr, subscription.Rendition().String())
+		defer clients.remove(stats)
+		defer func() {
+			logger.Info("websocket client disconnected",
+				servicelog.String("client", stats.client),
+				servicelog.Uint64("delivered", atomic.LoadUint64(&stats.delivered)),
+				servicelog.Uint64("skipped", atomic.LoadUint64(&stats.skipped)),
+				servicelog.Uint64("bytes", atomic.LoadUint64(&stats.bytes)))
+		}()
+
+		var (
+			buffer       []byte
+			currentFrame uint64 = 1
+			lastFrame    uint64
+			paused       bool
+		)
+		pace := newPacer(fps)
+		// apply a control message. The subscription is closed while
+		// paused, so that the rendition is not compressed for nothing.
+		apply := func(control Control) error {
+			query := control.query()
+			if len(query) > 0 {
+				index, err := session.Select(query)
+				if err != nil {
+					return err
+				}
+				if subscription != nil {
+					subscription.Close()
+					subscription = session.Subscribe(index)
+				}
+				rendition = index
+				clients.rename(stats, session.Renditions()[index].String())
+			}
+			if control.FPS != nil {
+				if *control.FPS < 0 {
+					return errors.New("invalid fps")
+				}
+				pace.limit(*control.FPS)
+			}
+			if control.Pause != nil && *control.Pause != paused {
+				paused = *control.Pause
+				if paused {
+					subscription.Close()
+					subscription = nil
+				} else {
+					subscription = session.Subscribe(rendition)
+					lastFrame = 0 // do not count the frames missed while paused
+				}
+			}
+			return nil
+		}
+		handle := func(control Control) bool {
+			if err := apply(control); err != nil {
+				reply, _ := json.Marshal(controlError{Error: err.Error()})
+				if err := conn.send(websocket.TextMessage, reply); err != nil {
+					return false
+				}
+			}
+			return true
+		}
+
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+		for {
+			if paused {
+				select {
+				case <-gone:
+					return
+				case control := <-controls:
+					if !handle(control) {
+						return
+					}
+				case <-ping.C:
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(stallTimeout)); err != nil {
+						return
+					}
+				}
+				continue
+			}
+			select {
+			case <-gone:
+				return
+			case control := <-controls:
+				if !handle(control) {
+					return
+				}
+				continue
+			default:
+			}
+			if wait := pace.delay(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-gone:
+					timer.Stop()
+					return
+				case control := <-controls:
+					timer.Stop()
+					if !handle(control) {
+						return
+					}
+					continue
+				case <-timer.C:
+				}
+			}
+			frame, frameNum, status := subscription.Next(currentFrame)
+			if frame == nil { // session died
+				logger.Info("session terminated, disconnecting client")
+				return
+			}
+			currentFrame = frameNum + 1
+			if status != jpeg.FrameReady {
+				frame.Done()
+				continue
+			}
+			ready := time.Now()
+			features, metadata := frame.Features(), frame.Metadata()
+			header := FrameHeader{
+				Frame:     frameNum,
+				Timestamp: metadata.Timestamp,
+				Camera:    camera,
+				Rendition: stats.rendition,
+				Width:     features.Width,
+				Height:    features.Height,
+				Size:      len(frame.Slice()),
+				Exposure:  metadata.Exposure.Seconds(),
+				Gain:      metadata.Gain,
+			}
+			if metadata.Path != "" {
+				header.File = filepath.Base(metadata.Path)
+			}
+			buffer = appendFrame(buffer, header, frame.Slice())
+			frame.Done()
+			if lastFrame > 0 {
+				stats.skip(frameNum - lastFrame - 1)
+			}
+			start := time.Now()
+			if err := conn.send(websocket.BinaryMessage, buffer); err != nil {
+				logger.Error("Failed to send websocket frame", servicelog.Error(err))
+				return
+			}
+			pace.observe(start, time.Since(start))
+			stats.deliver(len(buffer), time.Since(ready))
+			lastFrame = frameNum
+		}
+	})
+}
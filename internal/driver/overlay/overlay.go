@@ -0,0 +1,346 @@
+// Package overlay burns text and graphics into raw frames before
+// they are compressed: a caption with the time, site and exposure,
+// a compass rose, a crosshair, a grid and a logo.
+package overlay
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Corner of the image where an element is drawn
+type Corner string
+
+const (
+	TopLeft     Corner = "top-left"
+	TopRight    Corner = "top-right"
+	BottomLeft  Corner = "bottom-left"
+	BottomRight Corner = "bottom-right"
+)
+
+// Valid checks the corner name. Empty is valid and means the default.
+func (c Corner) Valid() bool {
+	switch c {
+	case "", TopLeft, TopRight, BottomLeft, BottomRight:
+		return true
+	}
+	return false
+}
+
+// Options of the overlay
+type Options struct {
+	// Lines of text. These placeholders are replaced with the frame info:
+	// {time}, {camera}, {site}, {frame}, {exposure}, {gain}, {file}.
+	Text       []string
+	TextCorner Corner // default TopLeft
+	TimeFormat string // Go time layout, default "2006-01-02 15:04:05 MST"
+	Site       string // replaces {site}
+	Scale      int    // pixels per font dot, default proportional to the image height
+	Color      string // "#RRGGBB", default white
+	Background bool   // draw the text over a dark box
+	// Compass rose: N/E/S/W labels around the center of the image.
+	Compass    bool
+	NorthAngle float64 // degrees clockwise from the top of the image to the north
+	SkyView    bool    // image of the sky seen from below, east is counter clockwise from north
+	Crosshair  bool    // cross in the center of the image
+	Grid       int     // number of cells of the grid in each direction, 0 for no grid
+	Logo       string  // path of a PNG file
+	LogoCorner Corner  // default BottomRight
+}
+
+// Info about the frame, to fill the placeholders of the text
+type Info struct {
+	Camera   string
+	Time     time.Time
+	Frame    uint64
+	Exposure time.Duration
+	Gain     int
+	File     string
+}
+
+// Canvas is a raw image to draw on
+type Canvas struct {
+	Pix    []byte
+	Width  int
+	Height int
+	Pitch  int // bytes per row
+	BPP    int // bytes per pixel: 1 (gray), 3 (RGB) or 4 (RGBA)
+}
+
+// Overlay draws the configured elements on the frames.
+// It is safe for concurrent use.
+type Overlay struct {
+	options Options
+	color   [3]byte
+	logo    *image.NRGBA
+}
+
+// New overlay. The logo, if any, is loaded once.
+func New(options Options) (*Overlay, error) {
+	if !options.TextCorner.Valid() || !options.LogoCorner.Valid() {
+		return nil, fmt.Errorf("invalid corner %q or %q", options.TextCorner, options.LogoCorner)
+	}
+	if options.TextCorner == "" {
+		options.TextCorner = TopLeft
+	}
+	if options.LogoCorner == "" {
+		options.LogoCorner = BottomRight
+	}
+	if options.TimeFormat == "" {
+		options.TimeFormat = "2006-01-02 15:04:05 MST"
+	}
+	o := &Overlay{
+		options: options,
+		color:   [3]byte{255, 255, 255},
+	}
+	if options.Color != "" {
+		color, err := parseColor(options.Color)
+		if err != nil {
+			return nil, err
+		}
+		o.color = color
+	}
+	if options.Logo != "" {
+		logo, err := loadLogo(options.Logo)
+		if err != nil {
+			return nil, err
+		}
+		o.logo = logo
+	}
+	return o, nil
+}
+
+// parseColor parses a #RRGGBB color
+func parseColor(value string) ([3]byte, error) {
+	var color [3]byte
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) != 6 {
+		return color, fmt.Errorf("invalid color %q, expected #RRGGBB", value)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color, fmt.Errorf("invalid color %q, expected #RRGGBB", value)
+	}
+	return [3]byte{byte(rgb >> 16), byte(rgb >> 8), byte(rgb)}, nil
+}
+
+// loadLogo reads the PNG file
+func loadLogo(path string) (*image.NRGBA, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("logo %s: %w", path, err)
+	}
+	logo := image.NewNRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(logo, logo.Bounds(), img, img.Bounds().Min, draw.Src)
+	return logo, nil
+}
+
+// Lines of text for the frame
+func (o *Overlay) Lines(info Info) []string {
+	exposure := ""
+	if info.Exposure > 0 {
+		exposure = strconv.FormatFloat(info.Exposure.Seconds(), 'f', -1, 64) + "s"
+	}
+	gain := ""
+	if info.Gain > 0 {
+		gain = strconv.Itoa(info.Gain)
+	}
+	timestamp := ""
+	if !info.Time.IsZero() {
+		timestamp = info.Time.Format(o.options.TimeFormat)
+	}
+	replacer := strings.NewReplacer(
+		"{time}", timestamp,
+		"{camera}", info.Camera,
+		"{site}", o.options.Site,
+		"{frame}", strconv.FormatUint(info.Frame, 10),
+		"{exposure}", exposure,
+		"{gain}", gain,
+		"{file}", info.File,
+	)
+	lines := make([]string, 0, len(o.options.Text))
+	for _, line := range o.options.Text {
+		lines = append(lines, replacer.Replace(line))
+	}
+	return lines
+}
+
+// Draw the overlay on the canvas
+func (o *Overlay) Draw(canvas Canvas, info Info) {
+	if canvas.Width <= 0 || canvas.Height <= 0 {
+		return
+	}
+	scale := o.options.Scale
+	if scale <= 0 {
+		// About 1/50 of the height per line of text
+		scale = canvas.Height / (50 * glyphHeight)
+		if scale < 1 {
+			scale = 1
+		}
+	}
+	if o.options.Grid > 0 {
+		o.drawGrid(canvas, o.options.Grid)
+	}
+	if o.options.Crosshair {
+		o.drawCrosshair(canvas, scale)
+	}
+	if o.options.Compass {
+		o.drawCompass(canvas, scale)
+	}
+	if o.logo != nil {
+		o.drawLogo(canvas, scale)
+	}
+	if lines := o.Lines(info); len(lines) > 0 {
+		width, height := textSize(lines)
+		x, y := place(canvas, o.options.TextCorner, width*scale, height*scale, 2*scale)
+		if o.options.Background {
+			canvas.fill(x-scale, y-scale, (width+2)*scale, (height+2)*scale, [3]byte{}, 160)
+		}
+		for _, line := range lines {
+			canvas.text(x, y, line, scale, o.color)
+			y += (glyphHeight + lineSpacing) * scale
+		}
+	}
+}
+
+// place returns the top left position of a box of the given size in the corner
+func place(canvas Canvas, corner Corner, width, height, margin int) (int, int) {
+	x, y := margin, margin
+	if corner == TopRight || corner == BottomRight {
+		x = canvas.Width - width - margin
+	}
+	if corner == BottomLeft || corner == BottomRight {
+		y = canvas.Height - height - margin
+	}
+	return x, y
+}
+
+// blend a pixel with the color, alpha from 0 (transparent) to 255
+func (c Canvas) blend(x, y int, color [3]byte, alpha int) {
+	if x < 0 || y < 0 || x >= c.Width || y >= c.Height {
+		return
+	}
+	pixel := c.Pix[y*c.Pitch+x*c.BPP:]
+	mix := func(old, new byte) byte {
+		return byte((int(old)*(255-alpha) + int(new)*alpha) / 255)
+	}
+	if c.BPP < 3 {
+		luma := byte((299*int(color[0]) + 587*int(color[1]) + 114*int(color[2])) / 1000)
+		pixel[0] = mix(pixel[0], luma)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		pixel[i] = mix(pixel[i], color[i])
+	}
+}
+
+// fill a rectangle
+func (c Canvas) fill(x, y, width, height int, color [3]byte, alpha int) {
+	for row := y; row < y+height; row++ {
+		for col := x; col < x+width; col++ {
+			c.blend(col, row, color, alpha)
+		}
+	}
+}
+
+// text draws a line of text with the top left corner at x, y
+func (c Canvas) text(x, y int, line string, scale int, color [3]byte) {
+	for _, r := range line {
+		g := glyph(r)
+		for col := 0; col < glyphWidth; col++ {
+			for row := 0; row < glyphHeight; row++ {
+				if g[col]&(1<<row) != 0 {
+					c.fill(x+col*scale, y+row*scale, scale, scale, color, 255)
+				}
+			}
+		}
+		x += (glyphWidth + glyphSpacing) * scale
+	}
+}
+
+// line draws a line between two points, width pixels wide
+func (c Canvas) line(x0, y0, x1, y1, width int, color [3]byte, alpha int) {
+	dx, dy := float64(x1-x0), float64(y1-y0)
+	steps := int(math.Max(math.Abs(dx), math.Abs(dy)))
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		x := x0 + int(math.Round(dx*float64(i)/float64(steps)))
+		y := y0 + int(math.Round(dy*float64(i)/float64(steps)))
+		c.fill(x-width/2, y-width/2, width, width, color, alpha)
+	}
+}
+
+func (o *Overlay) drawGrid(canvas Canvas, cells int) {
+	for i := 1; i < cells; i++ {
+		x := canvas.Width * i / cells
+		y := canvas.Height * i / cells
+		canvas.line(x, 0, x, canvas.Height-1, 1, o.color, 96)
+		canvas.line(0, y, canvas.Width-1, y, 1, o.color, 96)
+	}
+}
+
+func (o *Overlay) drawCrosshair(canvas Canvas, scale int) {
+	cx, cy := canvas.Width/2, canvas.Height/2
+	size := minInt(canvas.Width, canvas.Height) / 20
+	gap := size / 4
+	canvas.line(cx-size, cy, cx-gap, cy, scale, o.color, 255)
+	canvas.line(cx+gap, cy, cx+size, cy, scale, o.color, 255)
+	canvas.line(cx, cy-size, cx, cy-gap, scale, o.color, 255)
+	canvas.line(cx, cy+gap, cx, cy+size, scale, o.color, 255)
+}
+
+func (o *Overlay) drawCompass(canvas Canvas, scale int) {
+	cx, cy := float64(canvas.Width)/2, float64(canvas.Height)/2
+	radius := float64(minInt(canvas.Width, canvas.Height)) * 0.45
+	labelW, labelH := glyphWidth*scale, glyphHeight*scale
+	// Seen from below, the sky is mirrored: east is left of north
+	east := 90.0
+	if o.options.SkyView {
+		east = -90
+	}
+	for i, label := range []string{"N", "E", "S", "W"} {
+		angle := (o.options.NorthAngle + float64(i)*east) * math.Pi / 180
+		sin, cos := math.Sin(angle), math.Cos(angle)
+		// Tick from the edge of the circle inwards, label outside it
+		tick := radius * 0.08
+		canvas.line(int(cx+sin*radius), int(cy-cos*radius), int(cx+sin*(radius-tick)), int(cy-cos*(radius-tick)), scale, o.color, 255)
+		lx := int(cx+sin*(radius+float64(labelH))) - labelW/2
+		ly := int(cy-cos*(radius+float64(labelH))) - labelH/2
+		canvas.text(lx, ly, label, scale, o.color)
+	}
+}
+
+func (o *Overlay) drawLogo(canvas Canvas, scale int) {
+	bounds := o.logo.Bounds()
+	x0, y0 := place(canvas, o.options.LogoCorner, bounds.Dx(), bounds.Dy(), 2*scale)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			pixel := o.logo.NRGBAAt(x, y)
+			if pixel.A == 0 {
+				continue
+			}
+			canvas.blend(x0+x, y0+y, [3]byte{pixel.R, pixel.G, pixel.B}, int(pixel.A))
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package overlay
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFont(t *testing.T) {
+	if len(font) != '~'-' '+1 {
+		t.Fatalf("font has %d glyphs", len(font))
+	}
+	if glyph('ó') != glyph('o') || glyph('€') != glyph('?') {
+		t.Error("unexpected glyph folding")
+	}
+}
+
+func TestLines(t *testing.T) {
+	o, err := New(Options{
+		Text:       []string{"{site} {camera}", "{time} #{frame}", "{exposure} g{gain} {file}"},
+		Site:       "Observatorio",
+		TimeFormat: "15:04:05",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := o.Lines(Info{
+		Camera:   "cam0",
+		Time:     time.Date(2024, 3, 1, 22, 30, 5, 0, time.UTC),
+		Frame:    7,
+		Exposure: 1500 * time.Millisecond,
+		Gain:     120,
+		File:     "a.jpg",
+	})
+	expected := []string{"Observatorio cam0", "22:30:05 #7", "1.5s g120 a.jpg"}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("line %d: got %q, expected %q", i, lines[i], expected[i])
+		}
+	}
+}
+
+func TestDraw(t *testing.T) {
+	// Red logo, 2x2 pixels
+	logoPath := filepath.Join(t.TempDir(), "logo.png")
+	logo := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < 4; i++ {
+		logo.Set(i%2, i/2, color.NRGBA{R: 255, A: 255})
+	}
+	file, err := os.Create(logoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, logo); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	o, err := New(Options{
+		Text:      []string{"I"},
+		Scale:     1,
+		Color:     "#00FF00",
+		Crosshair: true,
+		Logo:      logoPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	canvas := Canvas{Width: 100, Height: 80, BPP: 3}
+	canvas.Pitch = canvas.Width * canvas.BPP
+	canvas.Pix = make([]byte, canvas.Pitch*canvas.Height)
+	o.Draw(canvas, Info{})
+	at := func(x, y int) [3]byte {
+		p := canvas.Pix[y*canvas.Pitch+x*canvas.BPP:]
+		return [3]byte{p[0], p[1], p[2]}
+	}
+	// The stem of the I, in the third column of the glyph, at margin 2
+	if at(2+2, 2+3) != [3]byte{0, 255, 0} || at(2, 2+3) != [3]byte{} {
+		t.Error("text not drawn as expected")
+	}
+	// Crosshair, outside the gap
+	if at(50-3, 40) != [3]byte{0, 255, 0} || at(50, 40) != [3]byte{} {
+		t.Error("crosshair not drawn as expected")
+	}
+	// Logo in the bottom right corner
+	if at(100-2-1, 80-2-1) != [3]byte{255, 0, 0} {
+		t.Error("logo not drawn")
+	}
+
+	// Gray images get the luminance
+	gray := Canvas{Width: 20, Height: 20, BPP: 1, Pitch: 20, Pix: make([]byte, 400)}
+	o.Draw(gray, Info{})
+	if gray.Pix[(2+3)*20+2+2] == 0 {
+		t.Error("text not drawn on gray image")
+	}
+
+	if _, err := New(Options{Color: "green"}); err == nil {
+		t.Error("expected error for invalid color")
+	}
+	if _, err := New(Options{TextCorner: "middle"}); err == nil {
+		t.Error("expected error for invalid corner")
+	}
+}
@@ -0,0 +1,374 @@
+// Package preview serves live MJPEG, JPEG and websocket streams.
+// The compression pipeline of each stream is built when the first
+// viewer connects, and the source is stopped when the last one leaves.
+package preview
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/mjpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/overlay"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Path prefixes of the streams
+const (
+	MJPEGPrefix     = "/mjpeg/"
+	JPEGPrefix      = "/jpeg/"
+	WebSocketPrefix = "/ws/"
+	StatsPrefix     = "/stats/"
+)
+
+// SourceFactory builds the source of a stream. It is called
+// when the pipeline is built, i.e. on the first connection.
+type SourceFactory func(logger servicelog.Logger) (jpeg.ResumableSource, error)
+
+// Options of the pipelines
+type Options struct {
+	FramesPerSecond int // frame rate of the source
+	RawPoolSize     int // raw frames buffered, per stream
+	JpegPoolSize    int // compressed frames buffered, per stream. Must be > RawPoolSize + Threads.
+	ImageSize       int // initial size of the buffers, in bytes
+	Threads         int // compression threads, shared by all streams
+	// Renditions of each stream. Viewers choose one with the
+	// rendition, width and quality query parameters.
+	Renditions []jpeg.Rendition
+	// Interval between the statistics of the raw frames, 0 to disable them
+	StatsInterval time.Duration
+	// Panic if a faulted pipeline cannot be recycled in RecycleTimeout.
+	// Last resort, the whole service is restarted.
+	PanicOnStuck bool
+}
+
+// Time a faulted pipeline has to recycle before PanicOnStuck applies
+const RecycleTimeout = 30 * time.Second
+
+// FaultHandler is notified when the pipeline of a stream faults, and
+// again with recovered true once the pipeline has been recycled
+type FaultHandler func(fault jpeg.Fault, recovered bool)
+
+// Server holds the streams and the shared compression farm
+type Server struct {
+	logger  servicelog.Logger
+	options Options
+	mutex   sync.Mutex
+	farm    *jpeg.Farm
+	streams map[string]*Stream
+	faults  FaultHandler
+}
+
+// New preview server
+func New(logger servicelog.Logger, options Options) *Server {
+	if options.FramesPerSecond < 1 {
+		options.FramesPerSecond = 1
+	}
+	if options.Threads < 1 {
+		options.Threads = 1
+	}
+	if options.RawPoolSize < 1 {
+		options.RawPoolSize = 3 * options.FramesPerSecond
+	}
+	if options.JpegPoolSize <= options.RawPoolSize+options.Threads {
+		options.JpegPoolSize = options.RawPoolSize + options.Threads + 1
+	}
+	if options.ImageSize < 1 {
+		options.ImageSize = 1 << 20
+	}
+	return &Server{
+		logger:  logger,
+		options: options,
+		streams: make(map[string]*Stream),
+	}
+}
+
+// Add a stream for the camera
+func (s *Server) Add(camera string, factory SourceFactory) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stream := &Stream{
+		server:  s,
+		camera:  camera,
+		factory: factory,
+	}
+	s.streams[camera] = stream
+	return stream
+}
+
+// Stream returns the stream for the camera, or nil
+func (s *Server) Stream(camera string) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[camera]
+}
+
+// SetFaultHandler is notified of the faults of every stream
+func (s *Server) SetFaultHandler(handler FaultHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = handler
+}
+
+// notify the fault handler, if any
+func (s *Server) notify(fault jpeg.Fault, recovered bool) {
+	s.mutex.Lock()
+	handler := s.faults
+	s.mutex.Unlock()
+	if handler != nil {
+		handler(fault, recovered)
+	}
+}
+
+// sharedFarm starts the compression farm, if not started yet
+func (s *Server) sharedFarm() *jpeg.Farm {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.farm == nil {
+		s.farm = jpeg.NewFarm(s.logger, s.options.Threads, s.options.FramesPerSecond)
+	}
+	return s.farm
+}
+
+// Close all the streams and the farm. Streams must not be used after this.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mutex.Unlock()
+	for _, stream := range streams {
+		stream.close()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.farm != nil {
+		s.farm.Stop()
+		s.farm = nil
+	}
+}
+
+// Check the pipelines of the streams already built. Returns the
+// names of the streams running, and an error if any is stuck.
+func (s *Server) Check() ([]string, error) {
+	s.mutex.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.mutex.Unlock()
+	running := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		stream.mutex.Lock()
+		pool := stream.pool
+		stream.mutex.Unlock()
+		if pool == nil {
+			continue
+		}
+		running = append(running, stream.camera)
+		if err := pool.Check(); err != nil {
+			return running, fmt.Errorf("stream %s: %w", stream.camera, err)
+		}
+	}
+	return running, nil
+}
+
+// Handler serves the MJPEG, JPEG and websocket streams, and the frame
+// statistics, by camera name
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			camera  string
+			handler func(servicelog.Logger, *Stream) http.Handler
+		)
+		switch {
+		case strings.HasPrefix(r.URL.Path, MJPEGPrefix):
+			camera = strings.TrimPrefix(r.URL.Path, MJPEGPrefix)
+			handler = func(logger servicelog.Logger, stream *Stream) http.Handler {
+				return mjpeg.Handler(logger, camera, mjpegManager{stream})
+			}
+		case strings.HasPrefix(r.URL.Path, JPEGPrefix):
+			camera = strings.TrimPrefix(r.URL.Path, JPEGPrefix)
+			handler = func(logger servicelog.Logger, stream *Stream) http.Handler {
+				return jpeg.Handler(logger, stream)
+			}
+		case strings.HasPrefix(r.URL.Path, StatsPrefix):
+			camera = strings.TrimPrefix(r.URL.Path, StatsPrefix)
+			handler = func(logger servicelog.Logger, stream *Stream) http.Handler {
+				return jpeg.StatsHandler(logger, stream)
+			}
+		case strings.HasPrefix(r.URL.Path, WebSocketPrefix):
+			camera = strings.TrimPrefix(r.URL.Path, WebSocketPrefix)
+			handler = func(logger servicelog.Logger, stream *Stream) http.Handler {
+				return mjpeg.WebSocketHandler(logger, camera, mjpegManager{stream})
+			}
+		}
+		stream := s.Stream(camera)
+		if stream == nil || handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		logger := s.logger.With(servicelog.String("camera", camera))
+		handler(logger, stream).ServeHTTP(w, r)
+	})
+}
+
+// Stream of a camera. Implements jpeg.Manager.
+type Stream struct {
+	server  *Server
+	camera  string
+	factory SourceFactory
+	stretch jpeg.Stretch     // default of the renditions
+	overlay *overlay.Overlay // nil for none
+	// Built on first use
+	mutex     sync.Mutex
+	closed    bool
+	pool      *jpeg.Pool
+	pipeline  *jpeg.Pipeline
+	manager   *jpeg.SessionManager
+	recycling bool // a fault is being recovered
+}
+
+// SetStretch sets the default stretch of the renditions of the stream.
+// Viewers can choose other modes with the stretch query parameter.
+// Applies when the pipeline is built, i.e. on the first connection.
+func (s *Stream) SetStretch(stretch jpeg.Stretch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stretch = stretch
+}
+
+// SetOverlay sets the overlay drawn on the frames of the stream,
+// nil for none. Applies when the pipeline is built.
+func (s *Stream) SetOverlay(o *overlay.Overlay) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.overlay = o
+}
+
+// build the pipeline, if not built yet
+func (s *Stream) build(logger servicelog.Logger) (*jpeg.SessionManager, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, jpeg.ErrManagerCancelled
+	}
+	if s.manager != nil {
+		return s.manager, nil
+	}
+	source, err := s.factory(logger)
+	if err != nil {
+		return nil, err
+	}
+	options := s.server.options
+	logger.Info("building preview pipeline", servicelog.Int("rawPool", options.RawPoolSize), servicelog.Int("jpegPool", options.JpegPoolSize))
+	s.pool = jpeg.NewPool(options.RawPoolSize, options.ImageSize)
+	renditions := options.Renditions
+	if len(renditions) == 0 {
+		renditions = []jpeg.Rendition{{}}
+	}
+	renditions = jpeg.WithStretchVariants(renditions, s.stretch)
+	s.pipeline = jpeg.New(s.pool, s.server.sharedFarm(), options.JpegPoolSize, options.ImageSize, renditions...)
+	if s.overlay != nil {
+		s.pipeline.SetOverlay(s.overlay)
+	}
+	s.pipeline.SetStatsInterval(options.StatsInterval)
+	s.pipeline.SetFaultHandler(s.fault)
+	s.pool.SetFaultHandler(s.camera, s.fault)
+	s.manager = s.pipeline.Manage(source)
+	return s.manager, nil
+}
+
+// Acquire implements jpeg.Manager
+func (s *Stream) Acquire(logger servicelog.Logger) (*jpeg.Session, error) {
+	manager, err := s.build(logger)
+	if err != nil {
+		return nil, err
+	}
+	return manager.Acquire(logger)
+}
+
+// Done implements jpeg.Manager
+func (s *Stream) Done() {
+	s.mutex.Lock()
+	manager := s.manager
+	s.mutex.Unlock()
+	manager.Done()
+}
+
+// fault recycles the session and the buffers of the pipeline, so that
+// the readers disconnect and the stream starts afresh when they reconnect.
+func (s *Stream) fault(fault jpeg.Fault) {
+	logger := s.server.logger.With(servicelog.String("camera", s.camera))
+	s.mutex.Lock()
+	manager := s.manager
+	if manager == nil || s.closed || s.recycling {
+		s.mutex.Unlock()
+		logger.Error("pipeline fault", servicelog.String("kind", string(fault.Kind)), servicelog.Error(fault))
+		return
+	}
+	s.recycling = true
+	s.mutex.Unlock()
+	logger.Error("pipeline fault, recycling", servicelog.String("kind", string(fault.Kind)), servicelog.Error(fault))
+	s.server.notify(fault, false)
+	go func() {
+		recycled := make(chan struct{})
+		go func() {
+			defer close(recycled)
+			manager.Recycle()
+		}()
+		timer := time.NewTimer(RecycleTimeout)
+		defer timer.Stop()
+		select {
+		case <-recycled:
+		case <-timer.C:
+			if s.server.options.PanicOnStuck {
+				panic(fmt.Sprintf("stream %s: pipeline not recycled in %s after %s", s.camera, RecycleTimeout, fault.Kind))
+			}
+			logger.Error("pipeline not recycled yet", servicelog.String("kind", string(fault.Kind)))
+			<-recycled
+		}
+		logger.Info("pipeline recycled", servicelog.String("kind", string(fault.Kind)))
+		s.mutex.Lock()
+		s.recycling = false
+		s.mutex.Unlock()
+		s.server.notify(fault, true)
+	}()
+}
+
+// close waits for the viewers to leave and frees the pipeline
+func (s *Stream) close() {
+	s.mutex.Lock()
+	s.closed = true
+	manager := s.manager
+	s.mutex.Unlock()
+	if manager == nil {
+		return
+	}
+	// Join without holding the lock, viewers need it to call Done
+	manager.Cancel()
+	manager.Join()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pipeline.Join()
+	s.pool.Free()
+	s.manager, s.pipeline, s.pool = nil, nil, nil
+}
+
+// mjpegManager adapts the Stream to mjpeg.SessionManager
+type mjpegManager struct {
+	*Stream
+}
+
+// Acquire implements mjpeg.SessionManager
+func (m mjpegManager) Acquire(logger servicelog.Logger) (mjpeg.Session, error) {
+	session, err := m.Stream.Acquire(logger)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
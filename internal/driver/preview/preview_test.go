@@ -0,0 +1,134 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/mjpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/overlay"
+	"github.com/warpcomdev/asicamera2/internal/driver/ser"
+	"github.com/warpcomdev/asicamera2/internal/driver/sersource"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+const (
+	width, height = 128, 96
+)
+
+// writeSER writes an 8 bit mono SER video with a gradient
+func writeSER(t *testing.T, path string, frames int) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("LUCAM-RECORDER")
+	for _, v := range []int32{0, int32(ser.MONO), 1, width, height, 8, int32(frames)} {
+		binary.Write(&buf, le, v)
+	}
+	buf.Write(make([]byte, 3*40+2*8))
+	for i := 0; i < frames; i++ {
+		for p := 0; p < width*height; p++ {
+			buf.WriteByte(byte(p % 128))
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addSER adds a stream replaying the SER file, with the overlay text
+func addSER(t *testing.T, server *Server, camera, path, text string, settings jpeg.CameraSettings) {
+	o, err := overlay.New(overlay.Options{Text: []string{text}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := server.Add(camera, func(logger servicelog.Logger) (jpeg.ResumableSource, error) {
+		source, err := sersource.New(path, 10, jpeg.FrameCompressor{Subsampling: jpeg.TJSAMP_GRAY, Quality: 90})
+		if err != nil {
+			return nil, err
+		}
+		source.SetCameraSettings(settings)
+		return source, nil
+	})
+	stream.SetOverlay(o)
+}
+
+// TestFrameSettings checks the exposure and gain of the frames get from
+// the files or the camera to the headers, the websocket and the overlay
+func TestFrameSettings(t *testing.T) {
+	folder := t.TempDir()
+	sidecarPath := filepath.Join(folder, "sidecar.ser")
+	writeSER(t, sidecarPath, 2)
+	if err := os.WriteFile(filepath.Join(folder, "sidecar.txt"), []byte("Shutter=10.000ms\nGain=300 (50%)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(folder, "plain.ser")
+	writeSER(t, plainPath, 2)
+	camera := func() (time.Duration, int) {
+		return 10 * time.Millisecond, 300
+	}
+
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+	server := New(logger, Options{FramesPerSecond: 10, ImageSize: width * height * 3})
+	defer server.Close()
+	addSER(t, server, "sidecar", sidecarPath, "{exposure} {gain}", nil)
+	addSER(t, server, "camera", plainPath, "{exposure} {gain}", camera)
+	addSER(t, server, "literal", plainPath, "0.01s 300", nil)
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	frames := make(map[string][]byte, 3)
+	for _, name := range []string{"sidecar", "camera", "literal"} {
+		resp, err := http.Get(srv.URL + JPEGPrefix + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames[name], err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d, error %v", name, resp.StatusCode, err)
+		}
+		if name == "literal" {
+			if resp.Header.Get("X-Exposure") != "" || resp.Header.Get("X-Gain") != "" {
+				t.Errorf("%s: unexpected settings %v", name, resp.Header)
+			}
+			continue
+		}
+		if exposure, gain := resp.Header.Get("X-Exposure"), resp.Header.Get("X-Gain"); exposure != "0.01" || gain != "300" {
+			t.Errorf("%s: got exposure %q and gain %q", name, exposure, gain)
+		}
+	}
+	// The placeholders are drawn like the literal text
+	if !bytes.Equal(frames["sidecar"], frames["literal"]) || !bytes.Equal(frames["camera"], frames["literal"]) {
+		t.Error("overlay placeholders do not match the settings")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+WebSocketPrefix+"sidecar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	messageType, message, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage || len(message) < 4 {
+		t.Fatalf("unexpected message %d, error %v", messageType, err)
+	}
+	size := binary.BigEndian.Uint32(message)
+	var header mjpeg.FrameHeader
+	if err := json.Unmarshal(message[4:4+size], &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Exposure != 0.01 || header.Gain != 300 || header.File != "sidecar.ser" {
+		t.Errorf("unexpected frame header %+v", header)
+	}
+}
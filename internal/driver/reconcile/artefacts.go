@@ -0,0 +1,126 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+)
+
+// Media uploaded to the backend for a local file
+type Media struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// HookMedia returns the media to upload for the result of the hooks,
+// in the same order as the artefacts. An artefact replacing the
+// original file is uploaded with the ID of the original.
+func HookMedia(cameraID string, result hooks.Result) ([]Media, error) {
+	media := make([]Media, 0, len(result.Artefacts))
+	for _, artefact := range result.Artefacts {
+		info, err := os.Stat(artefact.Path)
+		if err != nil {
+			return nil, err
+		}
+		id := backend.MediaID(cameraID, artefact.Path)
+		if result.Replaced {
+			id = backend.MediaID(cameraID, result.Original)
+		}
+		media = append(media, Media{ID: id, Size: info.Size()})
+	}
+	return media, nil
+}
+
+// Artefacts records the media uploaded for the local files processed
+// by hooks, which do not match the ID or size of the local file.
+// It is saved to a JSON file after every change.
+type Artefacts struct {
+	mutex sync.Mutex
+	path  string
+	media map[string][]Media
+}
+
+// LoadArtefacts reads the artefacts file, if it exists. Entries of
+// local files that no longer exist are dropped.
+func LoadArtefacts(path string) (*Artefacts, error) {
+	a := &Artefacts{
+		path:  path,
+		media: make(map[string][]Media),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.media); err != nil {
+		return nil, err
+	}
+	for local := range a.media {
+		if _, err := os.Stat(local); os.IsNotExist(err) {
+			delete(a.media, local)
+		}
+	}
+	return a, nil
+}
+
+// Lookup the media uploaded for the local file. A nil Artefacts
+// has no entries.
+func (a *Artefacts) Lookup(local string) ([]Media, bool) {
+	if a == nil {
+		return nil, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	media, ok := a.media[local]
+	return media, ok
+}
+
+// Record the media uploaded for the local file, and save the file.
+// Empty media forgets the file, e.g. when no hook applies to it anymore.
+// A nil Artefacts records nothing.
+func (a *Artefacts) Record(local string, media []Media) error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, found := a.media[local]; !found && len(media) == 0 {
+		return nil
+	}
+	if len(media) == 0 {
+		delete(a.media, local)
+	} else {
+		a.media[local] = media
+	}
+	return a.save()
+}
+
+// save to a temporary file and rename, so the file is never truncated
+func (a *Artefacts) save() error {
+	data, err := json.Marshal(a.media)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(a.path), "artefacts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), a.path)
+}
@@ -0,0 +1,169 @@
+package reconcile
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+)
+
+var (
+	reconcileItems = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_reconcile_items",
+			Help: "Number of items found by the last reconciliation, by kind",
+		},
+		[]string{"camera", "kind"},
+	)
+
+	reconcileTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_reconcile_timestamp",
+			Help: "Timestamp of the last reconciliation (unix)",
+		},
+		[]string{"camera"},
+	)
+)
+
+// Item found by the reconciliation
+type Item struct {
+	ID         string     `json:"id"`
+	Path       string     `json:"path,omitempty"`
+	LocalSize  int64      `json:"localSize,omitempty"`
+	RemoteSize int64      `json:"remoteSize,omitempty"`
+	Uploaded   *time.Time `json:"uploaded,omitempty"` // nil if never uploaded
+	MediaType  string     `json:"mediaType,omitempty"`
+}
+
+// Report of the reconciliation between local and backend media
+type Report struct {
+	Camera       string    `json:"camera"`
+	Timestamp    time.Time `json:"timestamp"`
+	Local        int       `json:"local"`   // number of local files
+	Remote       int       `json:"remote"`  // number of backend media
+	Pending      int       `json:"pending"` // local files still within the monitoring window
+	Rotated      int       `json:"rotated"` // backend media older than the local files
+	Missing      []Item    `json:"missing"` // local files not in the backend
+	Extra        []Item    `json:"extra"`   // newer backend media with no local file
+	SizeMismatch []Item    `json:"sizeMismatch"`
+}
+
+// Diff compares the local inventory with the backend media list.
+// Files modified less than `grace` ago are still being monitored,
+// and are not reported as missing. Backend media older than the
+// oldest local file were rotated out of the folder, and are only
+// counted. Files processed by hooks are compared with the media
+// recorded in artefacts, which may be nil.
+func Diff(cameraID string, local []watcher.InventoryEntry, remote []backend.RemoteMedia, grace time.Duration, artefacts *Artefacts) Report {
+	now := time.Now()
+	report := Report{
+		Camera:       cameraID,
+		Timestamp:    now,
+		Local:        len(local),
+		Remote:       len(remote),
+		Missing:      make([]Item, 0, 16),
+		Extra:        make([]Item, 0, 16),
+		SizeMismatch: make([]Item, 0, 16),
+	}
+	remoteByID := make(map[string]backend.RemoteMedia, len(remote))
+	for _, media := range remote {
+		remoteByID[media.ID] = media
+	}
+	localIDs := make(map[string]struct{}, len(local))
+	var oldest time.Time
+	for _, entry := range local {
+		if oldest.IsZero() || entry.ModTime.Before(oldest) {
+			oldest = entry.ModTime
+		}
+		expected, found := artefacts.Lookup(entry.Path)
+		if !found {
+			expected = []Media{{ID: backend.MediaID(cameraID, entry.Path), Size: entry.Size}}
+		}
+		for _, m := range expected {
+			localIDs[m.ID] = struct{}{}
+		}
+		// Report each file once, so it is requeued once
+		for _, m := range expected {
+			item := Item{
+				ID:        m.ID,
+				Path:      entry.Path,
+				LocalSize: m.Size,
+			}
+			if !entry.Uploaded.IsZero() {
+				uploaded := entry.Uploaded
+				item.Uploaded = &uploaded
+			}
+			media, found := remoteByID[m.ID]
+			if !found {
+				if entry.Uploaded.IsZero() && now.Sub(entry.ModTime) < grace {
+					report.Pending += 1
+					break
+				}
+				report.Missing = append(report.Missing, item)
+				break
+			}
+			// Backends that do not report size cannot be checked
+			if media.Size > 0 && media.Size != m.Size {
+				item.RemoteSize = media.Size
+				item.MediaType = media.MediaType
+				report.SizeMismatch = append(report.SizeMismatch, item)
+				break
+			}
+		}
+	}
+	for _, media := range remote {
+		if _, found := localIDs[media.ID]; !found {
+			if rotated(media, oldest) {
+				report.Rotated += 1
+				continue
+			}
+			report.Extra = append(report.Extra, Item{
+				ID:         media.ID,
+				RemoteSize: media.Size,
+				MediaType:  media.MediaType,
+			})
+		}
+	}
+	sortItems := func(items []Item) {
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	}
+	sortItems(report.Missing)
+	sortItems(report.Extra)
+	sortItems(report.SizeMismatch)
+	reconcileItems.WithLabelValues(cameraID, "local").Set(float64(report.Local))
+	reconcileItems.WithLabelValues(cameraID, "remote").Set(float64(report.Remote))
+	reconcileItems.WithLabelValues(cameraID, "pending").Set(float64(report.Pending))
+	reconcileItems.WithLabelValues(cameraID, "missing").Set(float64(len(report.Missing)))
+	reconcileItems.WithLabelValues(cameraID, "rotated").Set(float64(report.Rotated))
+	reconcileItems.WithLabelValues(cameraID, "extra").Set(float64(len(report.Extra)))
+	reconcileItems.WithLabelValues(cameraID, "size_mismatch").Set(float64(len(report.SizeMismatch)))
+	reconcileTimestamp.WithLabelValues(cameraID).Set(float64(now.Unix()))
+	return report
+}
+
+// rotated returns true if the media was captured before the oldest
+// local file, i.e. the local file was removed by the retention policy.
+// With no local files, all media are rotated.
+func rotated(media backend.RemoteMedia, oldest time.Time) bool {
+	timestamp, err := time.Parse(time.RFC3339, media.Timestamp)
+	if err != nil {
+		return false
+	}
+	return oldest.IsZero() || timestamp.Before(oldest)
+}
+
+// Requeue returns the paths of the local files that must be uploaded
+// again: the missing ones, and the ones with a size mismatch.
+func (r Report) Requeue() []string {
+	paths := make([]string, 0, len(r.Missing)+len(r.SizeMismatch))
+	for _, item := range r.Missing {
+		paths = append(paths, item.Path)
+	}
+	for _, item := range r.SizeMismatch {
+		paths = append(paths, item.Path)
+	}
+	return paths
+}
@@ -0,0 +1,128 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/backend"
+	"github.com/warpcomdev/asicamera2/internal/driver/hooks"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/watcher"
+	"go.uber.org/zap"
+)
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	local := []watcher.InventoryEntry{
+		{Path: "ok.jpg", Size: 10, ModTime: old, Uploaded: old},
+		{Path: "missing.jpg", Size: 10, ModTime: old, Uploaded: old},
+		{Path: "resized.jpg", Size: 10, ModTime: old, Uploaded: old},
+		{Path: "recent.jpg", Size: 10, ModTime: now},
+	}
+	remote := []backend.RemoteMedia{
+		{ID: backend.MediaID("cam", "ok.jpg"), Size: 10},
+		{ID: backend.MediaID("cam", "resized.jpg"), Size: 5},
+		{ID: "orphan", Size: 20, Timestamp: now.Format(time.RFC3339)},
+		{ID: "rotated", Size: 20, Timestamp: old.Add(-time.Hour).Format(time.RFC3339)},
+	}
+	report := Diff("cam", local, remote, 10*time.Minute, nil)
+	if report.Local != 4 || report.Remote != 4 || report.Pending != 1 || report.Rotated != 1 {
+		t.Fatalf("unexpected counts %+v", report)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Path != "missing.jpg" {
+		t.Errorf("unexpected missing %+v", report.Missing)
+	}
+	if len(report.SizeMismatch) != 1 || report.SizeMismatch[0].RemoteSize != 5 {
+		t.Errorf("unexpected size mismatch %+v", report.SizeMismatch)
+	}
+	if len(report.Extra) != 1 || report.Extra[0].ID != "orphan" {
+		t.Errorf("unexpected extra %+v", report.Extra)
+	}
+	if report.Missing[0].Uploaded == nil || report.SizeMismatch[0].Uploaded == nil {
+		t.Errorf("upload time not reported")
+	}
+	encoded, err := json.Marshal(Item{ID: "never"})
+	if err != nil || string(encoded) != `{"id":"never"}` {
+		t.Errorf("never uploaded item encoded as %s", encoded)
+	}
+	requeue := report.Requeue()
+	if len(requeue) != 2 || requeue[0] != "missing.jpg" || requeue[1] != "resized.jpg" {
+		t.Errorf("unexpected requeue %v", requeue)
+	}
+}
+
+func TestDiffHookArtefacts(t *testing.T) {
+	hooks.Register("test-reconcile", func(ctx context.Context, logger servicelog.Logger, input hooks.Input) error {
+		return os.WriteFile(input.Output, []byte("smaller"), 0644)
+	})
+	dir := t.TempDir()
+	artefacts, err := LoadArtefacts(filepath.Join(dir, "history", "artefacts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := make([]watcher.InventoryEntry, 0, 2)
+	remote := make([]backend.RemoteMedia, 0, 3)
+	old := time.Now().Add(-time.Hour)
+	for _, mode := range []hooks.Mode{hooks.ModeReplace, hooks.ModeAppend} {
+		runner, err := hooks.New(servicelog.Logger{Logger: zap.NewNop()}, []hooks.Hook{{
+			Name:      "test",
+			MimeTypes: []string{"video/"},
+			Processor: "test-reconcile",
+			Output:    "{{.Name}}.mp4",
+			Mode:      mode,
+			WorkDir:   filepath.Join(dir, "work"),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, string(mode)+".avi")
+		if err := os.WriteFile(path, []byte("original capture"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := runner.Process(context.Background(), path, "video/x-msvideo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		media, err := HookMedia("cam", result)
+		result.Cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The backend stores the artefacts as uploaded
+		for _, m := range media {
+			remote = append(remote, backend.RemoteMedia{ID: m.ID, Size: m.Size})
+		}
+		if err := artefacts.Record(path, media); err != nil {
+			t.Fatal(err)
+		}
+		local = append(local, watcher.InventoryEntry{Path: path, Size: 16, ModTime: old, Uploaded: old})
+	}
+
+	// Without the artefacts, the replaced file does not match
+	report := Diff("cam", local, remote, 0, nil)
+	if len(report.SizeMismatch) != 1 || len(report.Extra) != 1 {
+		t.Errorf("expected size mismatch and extra without artefacts, got %+v", report)
+	}
+	// With the artefacts, reloaded from disk, everything matches
+	artefacts, err = LoadArtefacts(filepath.Join(dir, "history", "artefacts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = Diff("cam", local, remote, 0, artefacts)
+	if len(report.Missing) != 0 || len(report.SizeMismatch) != 0 || len(report.Extra) != 0 {
+		t.Errorf("unexpected differences %+v", report)
+	}
+	// A missing artefact requeues the original file, once
+	report = Diff("cam", local, remote[:2], 0, artefacts)
+	if len(report.Missing) != 1 || report.Missing[0].Path != local[1].Path {
+		t.Errorf("unexpected missing %+v", report.Missing)
+	}
+	if requeue := report.Requeue(); len(requeue) != 1 || requeue[0] != local[1].Path {
+		t.Errorf("unexpected requeue %v", requeue)
+	}
+}
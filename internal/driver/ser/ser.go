@@ -0,0 +1,372 @@
+// Package ser reads SER video files, as written by planetary and
+// meteor capture software: a 178 byte header, the raw frames, and
+// an optional trailer with the timestamp of each frame.
+package ser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+type serError string
+
+// Error implements error
+func (e serError) Error() string {
+	return string(e)
+}
+
+const (
+	NotSERError     = serError("not a SER file")
+	TruncatedError  = serError("truncated SER file")
+	FrameRangeError = serError("frame index out of range")
+)
+
+// HeaderSize is the size of the SER header
+const HeaderSize = 178
+
+const fileID = "LUCAM-RECORDER"
+
+// ColorID describes the layout of the pixels
+type ColorID int32
+
+const (
+	MONO       ColorID = 0
+	BAYER_RGGB ColorID = 8
+	BAYER_GRBG ColorID = 9
+	BAYER_GBRG ColorID = 10
+	BAYER_BGGR ColorID = 11
+	BAYER_CYYM ColorID = 16
+	BAYER_YCMY ColorID = 17
+	BAYER_YMCY ColorID = 18
+	BAYER_MYYC ColorID = 19
+	RGB        ColorID = 100
+	BGR        ColorID = 101
+)
+
+var colorNames = map[ColorID]string{
+	MONO:       "MONO",
+	BAYER_RGGB: "BAYER_RGGB",
+	BAYER_GRBG: "BAYER_GRBG",
+	BAYER_GBRG: "BAYER_GBRG",
+	BAYER_BGGR: "BAYER_BGGR",
+	BAYER_CYYM: "BAYER_CYYM",
+	BAYER_YCMY: "BAYER_YCMY",
+	BAYER_YMCY: "BAYER_YMCY",
+	BAYER_MYYC: "BAYER_MYYC",
+	RGB:        "RGB",
+	BGR:        "BGR",
+}
+
+// String implements fmt.Stringer
+func (c ColorID) String() string {
+	if name, ok := colorNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// Planes returns the number of color planes per pixel
+func (c ColorID) Planes() int {
+	if c == RGB || c == BGR {
+		return 3
+	}
+	return 1
+}
+
+// Header of a SER file
+type Header struct {
+	LuID         int32
+	ColorID      ColorID
+	LittleEndian bool // byte order of 16 bit pixels, checked against the frames by Open
+	Width        int
+	Height       int
+	PixelDepth   int // bits per plane, 1 to 16
+	FrameCount   int
+	Observer     string
+	Instrument   string
+	Telescope    string
+	DateTime     time.Time // start of capture, local time
+	DateTimeUTC  time.Time // start of capture, UTC
+}
+
+// BytesPerPlane is 1 for depths up to 8 bits, 2 otherwise
+func (h Header) BytesPerPlane() int {
+	if h.PixelDepth > 8 {
+		return 2
+	}
+	return 1
+}
+
+// FrameSize is the size in bytes of a raw frame
+func (h Header) FrameSize() int64 {
+	return int64(h.Width) * int64(h.Height) * int64(h.ColorID.Planes()) * int64(h.BytesPerPlane())
+}
+
+// Dates are stored as .NET ticks, 100ns intervals since 0001-01-01
+const ticksToUnix = 621355968000000000
+
+func ticksTime(ticks int64) time.Time {
+	if ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ticks-ticksToUnix)*100).UTC()
+}
+
+// text trims the zero and space padding of a header string
+func text(b []byte) string {
+	if end := bytes.IndexByte(b, 0); end >= 0 {
+		b = b[:end]
+	}
+	return string(bytes.TrimRight(b, " "))
+}
+
+// parseHeader decodes the SER header
+func parseHeader(buf []byte) (Header, error) {
+	if len(buf) < HeaderSize || string(buf[:len(fileID)]) != fileID {
+		return Header{}, NotSERError
+	}
+	le := binary.LittleEndian
+	h := Header{
+		LuID:    int32(le.Uint32(buf[14:])),
+		ColorID: ColorID(int32(le.Uint32(buf[18:]))),
+		// The specification says 1 means little endian
+		LittleEndian: le.Uint32(buf[22:]) != 0,
+		Width:        int(int32(le.Uint32(buf[26:]))),
+		Height:       int(int32(le.Uint32(buf[30:]))),
+		PixelDepth:   int(int32(le.Uint32(buf[34:]))),
+		FrameCount:   int(int32(le.Uint32(buf[38:]))),
+		Observer:     text(buf[42:82]),
+		Instrument:   text(buf[82:122]),
+		Telescope:    text(buf[122:162]),
+		DateTime:     ticksTime(int64(le.Uint64(buf[162:]))),
+		DateTimeUTC:  ticksTime(int64(le.Uint64(buf[170:]))),
+	}
+	if h.Width <= 0 || h.Height <= 0 || h.PixelDepth < 1 || h.PixelDepth > 16 || h.FrameCount < 0 {
+		return Header{}, fmt.Errorf("%w: invalid header", NotSERError)
+	}
+	// The frames and their timestamps must fit in a file
+	if maxPlanes := int64(3 * 2); int64(h.Width)*int64(h.Height) > math.MaxInt64/maxPlanes ||
+		(h.FrameCount > 0 && h.FrameSize()+8 > (math.MaxInt64-HeaderSize)/int64(h.FrameCount)) {
+		return Header{}, fmt.Errorf("%w: invalid frame size", NotSERError)
+	}
+	return h, nil
+}
+
+// File is an open SER file
+type File struct {
+	Header
+	HasTimestamps bool
+	r             io.ReaderAt
+}
+
+// Open reads and validates the header of the SER file against its size.
+// TruncatedError is returned if the frames or the timestamp trailer are
+// incomplete, or if the frame count is still zero (file being recorded).
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	buf := make([]byte, HeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, NotSERError
+		}
+		return nil, err
+	}
+	header, err := parseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	dataEnd := HeaderSize + header.FrameSize()*int64(header.FrameCount)
+	trailerEnd := dataEnd + 8*int64(header.FrameCount)
+	switch {
+	case header.FrameCount == 0 && size > HeaderSize:
+		return nil, fmt.Errorf("%w: frame count not set", TruncatedError)
+	case size < dataEnd:
+		return nil, fmt.Errorf("%w: expected %d frames of %d bytes", TruncatedError, header.FrameCount, header.FrameSize())
+	case size > dataEnd && size < trailerEnd:
+		return nil, fmt.Errorf("%w: incomplete timestamp trailer", TruncatedError)
+	}
+	f := &File{
+		Header:        header,
+		HasTimestamps: header.FrameCount > 0 && size >= trailerEnd,
+		r:             r,
+	}
+	if err := f.checkByteOrder(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Samples of the first frame used to check the byte order
+const byteOrderSamples = 1 << 16
+
+// checkByteOrder fixes the byte order flag of the header if the samples
+// of the first frame do not match it, since many writers set it inverted.
+// Samples with more bits than the pixel depth in one order only are
+// decisive. With 16 bit samples, the order with the smoothest changes
+// between neighbours wins by a wide margin, otherwise the flag is kept.
+func (f *File) checkByteOrder() error {
+	if f.BytesPerPlane() != 2 || f.FrameCount == 0 {
+		return nil
+	}
+	raw, err := f.ReadFrame(0, nil)
+	if err != nil {
+		return err
+	}
+	samples := len(raw) / 2
+	if samples > byteOrderSamples {
+		samples = byteOrderSamples
+	}
+	var flagged, swapped binary.ByteOrder = binary.BigEndian, binary.LittleEndian
+	if f.LittleEndian {
+		flagged, swapped = swapped, flagged
+	}
+	maxValue := uint16(1<<uint(f.PixelDepth) - 1)
+	var overFlagged, overSwapped int
+	var roughFlagged, roughSwapped uint64
+	var prevFlagged, prevSwapped uint16
+	for i := 0; i < samples; i++ {
+		a, b := flagged.Uint16(raw[2*i:]), swapped.Uint16(raw[2*i:])
+		if a > maxValue {
+			overFlagged++
+		}
+		if b > maxValue {
+			overSwapped++
+		}
+		if i > 0 {
+			roughFlagged += absDiff(a, prevFlagged)
+			roughSwapped += absDiff(b, prevSwapped)
+		}
+		prevFlagged, prevSwapped = a, b
+	}
+	if f.PixelDepth < 16 {
+		if overFlagged > 0 && overSwapped == 0 {
+			f.LittleEndian = !f.LittleEndian
+		}
+		return nil
+	}
+	if 4*roughSwapped < roughFlagged {
+		f.LittleEndian = !f.LittleEndian
+	}
+	return nil
+}
+
+func absDiff(a, b uint16) uint64 {
+	if a > b {
+		return uint64(a - b)
+	}
+	return uint64(b - a)
+}
+
+// ReadFrame reads the raw data of the frame with the given index.
+// The buffer is reused if it is big enough.
+func (f *File) ReadFrame(index int, buf []byte) ([]byte, error) {
+	if index < 0 || index >= f.FrameCount {
+		return nil, FrameRangeError
+	}
+	size := f.FrameSize()
+	if int64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := f.r.ReadAt(buf, HeaderSize+int64(index)*size); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Timestamps returns the UTC timestamp of each frame, or nil
+// if the file has no trailer.
+func (f *File) Timestamps() ([]time.Time, error) {
+	if !f.HasTimestamps {
+		return nil, nil
+	}
+	buf := make([]byte, 8*f.FrameCount)
+	if _, err := f.r.ReadAt(buf, HeaderSize+f.FrameSize()*int64(f.FrameCount)); err != nil {
+		return nil, err
+	}
+	stamps := make([]time.Time, f.FrameCount)
+	for i := range stamps {
+		stamps[i] = ticksTime(int64(binary.LittleEndian.Uint64(buf[8*i:])))
+	}
+	return stamps, nil
+}
+
+// Metadata returns the properties of the video in a format
+// suitable for media metadata
+func (f *File) Metadata() (map[string]string, error) {
+	metadata := map[string]string{
+		"colorID":    f.ColorID.String(),
+		"width":      strconv.Itoa(f.Width),
+		"height":     strconv.Itoa(f.Height),
+		"pixelDepth": strconv.Itoa(f.PixelDepth),
+		"frames":     strconv.Itoa(f.FrameCount),
+	}
+	for key, value := range map[string]string{
+		"observer":   f.Observer,
+		"instrument": f.Instrument,
+		"telescope":  f.Telescope,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if !f.DateTimeUTC.IsZero() {
+		metadata["dateTimeUTC"] = f.DateTimeUTC.Format(time.RFC3339Nano)
+	}
+	stamps, err := f.Timestamps()
+	if err != nil {
+		return nil, err
+	}
+	if len(stamps) > 0 {
+		first, last := stamps[0], stamps[len(stamps)-1]
+		metadata["firstFrame"] = first.Format(time.RFC3339Nano)
+		metadata["lastFrame"] = last.Format(time.RFC3339Nano)
+		if duration := last.Sub(first); duration > 0 {
+			metadata["duration"] = strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+			if len(stamps) > 1 {
+				fps := float64(len(stamps)-1) / duration.Seconds()
+				metadata["frameRate"] = strconv.FormatFloat(fps, 'f', 3, 64)
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// To8Bits converts a raw frame to 8 bits per plane, keeping the
+// planes in RGB order (BGR frames are swapped). Bayer frames are
+// not demosaiced. Returns the converted frame.
+func (f *File) To8Bits(raw []byte, out []byte) []byte {
+	planes := f.ColorID.Planes()
+	pixels := f.Width * f.Height
+	if cap(out) < pixels*planes {
+		out = make([]byte, pixels*planes)
+	}
+	out = out[:pixels*planes]
+	if f.BytesPerPlane() == 1 {
+		copy(out, raw)
+	} else {
+		var order binary.ByteOrder = binary.BigEndian
+		if f.LittleEndian {
+			order = binary.LittleEndian
+		}
+		shift := uint(f.PixelDepth - 8)
+		for i := range out {
+			value := order.Uint16(raw[2*i:]) >> shift
+			if value > 255 {
+				value = 255
+			}
+			out[i] = byte(value)
+		}
+	}
+	if f.ColorID == BGR {
+		for i := 0; i+2 < len(out); i += 3 {
+			out[i], out[i+2] = out[i+2], out[i]
+		}
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package ser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testSER builds a 16 bit mono SER file with the given frames
+func testSER(frames int, timestamps bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fileID)
+	le := binary.LittleEndian
+	for _, v := range []int32{0, int32(MONO), 1, 4, 2, 12, int32(frames)} {
+		binary.Write(&buf, le, v)
+	}
+	for _, s := range []string{"observer", "ZWO ASI462MC", "C11"} {
+		field := make([]byte, 40)
+		copy(field, s)
+		buf.Write(field)
+	}
+	start := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	ticks := func(t time.Time) int64 {
+		return t.UnixNano()/100 + ticksToUnix
+	}
+	binary.Write(&buf, le, ticks(start))
+	binary.Write(&buf, le, ticks(start))
+	for i := 0; i < frames; i++ {
+		for p := 0; p < 8; p++ {
+			binary.Write(&buf, le, uint16(p*512))
+		}
+	}
+	if timestamps {
+		for i := 0; i < frames; i++ {
+			binary.Write(&buf, le, ticks(start.Add(time.Duration(i)*100*time.Millisecond)))
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	data := testSER(3, true)
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Width != 4 || f.Height != 2 || f.FrameCount != 3 || !f.HasTimestamps || f.Instrument != "ZWO ASI462MC" {
+		t.Fatalf("unexpected header %+v", f.Header)
+	}
+	metadata, err := f.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["frameRate"] != "10.000" || metadata["duration"] != "0.200" {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+	raw, err := f.ReadFrame(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := f.To8Bits(raw, nil)
+	if len(out) != 8 || out[1] != 512>>4 || out[7] != 7*512>>4 {
+		t.Fatalf("unexpected conversion %v", out)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	// No trailer is fine
+	data := testSER(3, false)
+	if f, err := Open(bytes.NewReader(data), int64(len(data))); err != nil || f.HasTimestamps {
+		t.Fatalf("unexpected result %v", err)
+	}
+	for _, size := range []int{len(data) - 1, len(data) + 4} {
+		data := testSER(3, true)[:size]
+		if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, TruncatedError) {
+			t.Fatalf("expected truncated for size %d, got %v", size, err)
+		}
+	}
+	data = testSER(0, false)
+	data = append(data, make([]byte, 16)...)
+	if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, TruncatedError) {
+		t.Fatalf("expected truncated for zero frame count, got %v", err)
+	}
+}
+
+// frameSER builds a SER file with one 4x2 mono frame of little endian
+// samples, and the given depth and byte order flag
+func frameSER(depth int, littleEndianFlag bool, samples []uint16) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fileID)
+	le := binary.LittleEndian
+	flag := int32(0)
+	if littleEndianFlag {
+		flag = 1
+	}
+	for _, v := range []int32{0, int32(MONO), flag, 4, 2, int32(depth), 1} {
+		binary.Write(&buf, le, v)
+	}
+	buf.Write(make([]byte, 3*40+2*8))
+	for _, sample := range samples {
+		binary.Write(&buf, le, sample)
+	}
+	return buf.Bytes()
+}
+
+func TestByteOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		depth   int
+		flag    bool
+		samples []uint16
+	}{
+		{"12 bit flag right", 12, true, []uint16{3, 4095, 1000, 17, 2048, 300, 5, 4000}},
+		{"12 bit flag inverted", 12, false, []uint16{3, 4095, 1000, 17, 2048, 300, 5, 4000}},
+		{"16 bit flag right", 16, true, []uint16{20003, 20011, 20007, 20015, 20001, 20009, 20012, 20005}},
+		{"16 bit flag inverted", 16, false, []uint16{20003, 20011, 20007, 20015, 20001, 20009, 20012, 20005}},
+	} {
+		data := frameSER(tc.depth, tc.flag, tc.samples)
+		f, err := Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !f.LittleEndian {
+			t.Errorf("%s: little endian samples not detected", tc.name)
+		}
+	}
+}
+
+func TestInvalidFrameSize(t *testing.T) {
+	for _, header := range [][]int32{
+		{0, int32(RGB), 1, 1<<31 - 1, 1<<31 - 1, 16, 1},
+		{0, int32(RGB), 1, 1 << 20, 1 << 20, 16, 1 << 30},
+	} {
+		var buf bytes.Buffer
+		buf.WriteString(fileID)
+		for _, v := range header {
+			binary.Write(&buf, binary.LittleEndian, v)
+		}
+		buf.Write(make([]byte, 3*40+2*8))
+		data := buf.Bytes()
+		if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, NotSERError) {
+			t.Errorf("header %v: expected invalid header, got %v", header, err)
+		}
+	}
+}
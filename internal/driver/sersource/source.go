@@ -0,0 +1,266 @@
+package sersource
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/ser"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/sidecar"
+)
+
+// Source replays the frames of a SER file, in a loop.
+// It implements jpeg.ResumableSource.
+type Source struct {
+	name   string
+	path   string
+	newest func() (string, error) // chooses the file on Start, if not nil
+	// Pattern of the MONO files written by color cameras, if not nil
+	monoBayer func() (jpeg.BayerPattern, bool)
+	// Exposure and gain of the files without sidecar settings, if not nil
+	camera  jpeg.CameraSettings
+	fps     int
+	factory jpeg.FrameCompressor
+	// Configured for the current file
+	compressor jpeg.FrameCompressor
+	features   jpeg.RawFeatures
+	bayer      *jpeg.BayerDecoder // for frames of color cameras
+	deep       bool               // frames of more than 8 bits, decoded by the farm
+	// Replay state, valid between Start and Stop
+	file    *os.File
+	video   *ser.File
+	frame   int
+	stamps  []time.Time // per frame timestamps, if the file has them
+	capture sidecar.Settings
+	raw     []byte
+	pixels  []byte
+	rate    *time.Ticker
+}
+
+// Name implements jpeg.Source
+func (s *Source) Name() string {
+	return s.name
+}
+
+// Features of the frames generated by the source
+func (s *Source) Features() jpeg.RawFeatures {
+	return s.features
+}
+
+// Next implements jpeg.Source
+func (s *Source) Next(ctx context.Context, img *jpeg.Image) (jpeg.SrcFrame, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.rate.C:
+		break
+	}
+	var err error
+	if s.raw, err = s.video.ReadFrame(s.frame, s.raw); err != nil {
+		return nil, err
+	}
+	metadata := jpeg.Metadata{
+		Path:      s.path,
+		Timestamp: s.video.DateTimeUTC,
+		Exposure:  s.capture.Exposure,
+		Gain:      s.capture.Gain,
+	}
+	if s.frame < len(s.stamps) {
+		metadata.Timestamp = s.stamps[s.frame]
+	}
+	metadata = metadata.WithSettings(s.camera)
+	s.frame = (s.frame + 1) % s.video.FrameCount
+	if s.bayer != nil || s.deep {
+		// Decoded by the compression farm
+		if img.Cap() < len(s.raw) {
+			img.Free()
+			if err := img.Alloc(len(s.raw)); err != nil {
+				return nil, err
+			}
+		}
+		copy(img.Slice(), s.raw)
+		if s.bayer != nil {
+			return s.bayer.Frame(s.name, img, s.features.Features).WithMetadata(metadata), nil
+		}
+		return s.compressor.DeepFrame(s.name, img, s.features, s.video.PixelDepth, !s.video.LittleEndian).WithMetadata(metadata), nil
+	}
+	s.pixels = s.video.To8Bits(s.raw, s.pixels)
+	if img.Cap() < len(s.pixels) {
+		img.Free()
+		if err := img.Alloc(len(s.pixels)); err != nil {
+			return nil, err
+		}
+	}
+	copy(img.Slice(), s.pixels)
+	return s.compressor.Frame(s.name, img, s.features).WithMetadata(metadata), nil
+}
+
+// open the file and parse the header
+func (s *Source) open() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	video, err := ser.Open(file, info.Size())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if video.FrameCount == 0 {
+		file.Close()
+		return ser.FrameRangeError
+	}
+	s.file, s.video = file, video
+	return nil
+}
+
+// Start implements jpeg.ResumableSource
+func (s *Source) Start(logger servicelog.Logger) error {
+	if s.newest != nil {
+		path, err := s.newest()
+		if err != nil {
+			logger.Error("failed to find SER file", servicelog.Error(err))
+			return err
+		}
+		if path != s.path {
+			logger.Info("replaying SER file", servicelog.String("path", path))
+			if err := s.configure(path); err != nil {
+				logger.Error("failed to read SER file", servicelog.String("path", path), servicelog.Error(err))
+				return err
+			}
+		}
+	}
+	if err := s.open(); err != nil {
+		logger.Error("failed to open SER file", servicelog.String("path", s.path), servicelog.Error(err))
+		return err
+	}
+	s.frame = 0
+	stamps, err := s.video.Timestamps()
+	if err != nil {
+		logger.Error("failed to read SER timestamps", servicelog.String("path", s.path), servicelog.Error(err))
+	}
+	s.stamps = stamps
+	// SER files do not record the exposure and gain, the capture software
+	// may have saved them next to the file
+	s.capture, _ = sidecar.Read(s.path)
+	s.rate = time.NewTicker(time.Second / time.Duration(s.fps))
+	return nil
+}
+
+// Stop implements jpeg.ResumableSource
+func (s *Source) Stop() {
+	s.rate.Stop()
+	s.file.Close()
+	s.file, s.video, s.stamps = nil, nil, nil
+	s.capture = sidecar.Settings{}
+}
+
+// Bayer patterns of the SER files that can be demosaiced
+var bayerPatterns = map[ser.ColorID]jpeg.BayerPattern{
+	ser.BAYER_RGGB: jpeg.BayerRGGB,
+	ser.BAYER_GRBG: jpeg.BayerGRBG,
+	ser.BAYER_GBRG: jpeg.BayerGBRG,
+	ser.BAYER_BGGR: jpeg.BayerBGGR,
+}
+
+// New creates a Source for the SER file. RGB, BGR and RGB Bayer
+// frames are streamed in color, other frames in grayscale. Frames
+// of more than 8 bits keep their depth for the stretched renditions.
+func New(path string, fps int, factory jpeg.FrameCompressor) (*Source, error) {
+	s := newSource(path, fps, factory)
+	if err := s.configure(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewNewest creates a Source that replays the SER file returned by
+// newest, chosen again every time the source starts. The name
+// identifies the source, e.g. the folder of the files.
+func NewNewest(name string, newest func() (string, error), fps int, factory jpeg.FrameCompressor) *Source {
+	s := newSource(name, fps, factory)
+	s.newest = newest
+	return s
+}
+
+func newSource(name string, fps int, factory jpeg.FrameCompressor) *Source {
+	if fps < 1 {
+		fps = 1
+	}
+	return &Source{
+		name:    name,
+		fps:     fps,
+		factory: factory,
+	}
+}
+
+// SetMonoBayer sets how to find the Bayer pattern of MONO files.
+// Some capture software saves the raw frames of color cameras as
+// MONO, without the pattern. Must be called before Start.
+func (s *Source) SetMonoBayer(pattern func() (jpeg.BayerPattern, bool)) {
+	s.monoBayer = pattern
+}
+
+// SetCameraSettings sets the exposure and gain of the frames of the files
+// without sidecar settings, usually those of the camera that captures them.
+// Must be called before Start.
+func (s *Source) SetCameraSettings(settings jpeg.CameraSettings) {
+	s.camera = settings
+}
+
+// configure the source for the frames of the SER file
+func (s *Source) configure(path string) error {
+	s.path = path
+	if err := s.open(); err != nil {
+		return err
+	}
+	defer func() {
+		s.file.Close()
+		s.file, s.video = nil, nil
+	}()
+	format := jpeg.PF_GRAY
+	if s.video.ColorID.Planes() == 3 {
+		format = jpeg.PF_RGB
+	}
+	s.bayer, s.deep = nil, false
+	pattern, ok := bayerPatterns[s.video.ColorID]
+	if !ok && s.video.ColorID == ser.MONO && s.monoBayer != nil {
+		pattern, ok = s.monoBayer()
+	}
+	if ok {
+		bayer, err := jpeg.NewBayerDecoder(jpeg.BayerOptions{
+			Pattern:   pattern,
+			BitDepth:  s.video.PixelDepth,
+			BigEndian: !s.video.LittleEndian,
+		}, s.factory)
+		if err != nil {
+			return err
+		}
+		s.bayer = bayer
+		format = jpeg.PF_RGB
+	}
+	// BGR frames are swapped while converted to 8 bits
+	if s.bayer == nil && s.video.BytesPerPlane() > 1 && s.video.ColorID != ser.BGR {
+		s.deep = true
+	}
+	s.features = jpeg.RawFeatures{
+		Features: jpeg.Features{
+			Width:  s.video.Width,
+			Height: s.video.Height,
+		},
+		Format: format,
+	}
+	// Grayscale frames must be compressed without chroma
+	s.compressor = s.factory
+	if format == jpeg.PF_GRAY {
+		s.compressor.Subsampling = jpeg.TJSAMP_GRAY
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sersource
+
+import (
+	"bytes"
+	"encoding/binary"
+	imagejpeg "image/jpeg"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/jpeg"
+	"github.com/warpcomdev/asicamera2/internal/driver/ser"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+// writeSER writes a dark 12 bit mono SER video
+func writeSER(t *testing.T, path string, width, height, frames int) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("LUCAM-RECORDER")
+	for _, v := range []int32{0, int32(ser.MONO), 1, int32(width), int32(height), 12, int32(frames)} {
+		binary.Write(&buf, le, v)
+	}
+	buf.Write(make([]byte, 3*40+2*8))
+	for i := 0; i < frames; i++ {
+		for p := 0; p < width*height; p++ {
+			binary.Write(&buf, le, uint16(p%200)) // below 5% of the range
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// meanOf decodes the jpeg and returns the mean of the luminance
+func meanOf(t *testing.T, data []byte) float64 {
+	img, err := imagejpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum, count float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += float64(r+g+b) / 3 / 257
+			count++
+		}
+	}
+	return sum / count
+}
+
+func TestDeepStretch(t *testing.T) {
+	const width, height = 64, 48
+	path := filepath.Join(t.TempDir(), "capture.ser")
+	writeSER(t, path, width, height, 2)
+	source, err := New(path, 10, jpeg.FrameCompressor{Subsampling: jpeg.TJSAMP_420, Quality: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !source.deep || source.Features().Format != jpeg.PF_GRAY {
+		t.Fatalf("expected deep grayscale frames, got %+v", source.Features())
+	}
+
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+	pool := jpeg.NewPool(2, width*height*2)
+	farm := jpeg.NewFarm(logger, 1, 4)
+	defer farm.Stop()
+	pipeline := jpeg.New(pool, farm, 8, width*height,
+		jpeg.Rendition{Name: "linear"},
+		jpeg.Rendition{Name: "stretched", Stretch: jpeg.Stretch{Mode: jpeg.StretchAuto}},
+	)
+	manager := pipeline.Manage(source)
+	defer func() {
+		manager.Cancel()
+		manager.Join()
+		pipeline.Join()
+		pool.Free()
+	}()
+	session, err := manager.Acquire(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Done()
+
+	means := make(map[string]float64, 2)
+	for _, name := range []string{"linear", "stretched"} {
+		rendition, err := session.Select(url.Values{"rendition": {name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subscription := session.Subscribe(rendition)
+		frame, _, status := subscription.Next(1)
+		if frame == nil || status != jpeg.FrameReady {
+			subscription.Close()
+			t.Fatalf("%s: no frame, status %v", name, status)
+		}
+		means[name] = meanOf(t, frame.Slice())
+		frame.Done()
+		subscription.Close()
+	}
+	// Linear, the 12 bit samples below 200 are almost black. Stretched
+	// from the full depth, they spread over the whole 8 bit range.
+	if means["linear"] > 16 || means["stretched"] < 64 {
+		t.Errorf("unexpected brightness: linear %.1f, stretched %.1f", means["linear"], means["stretched"])
+	}
+}
@@ -45,6 +45,10 @@ func Int(name string, value int) Attrib {
 	return zap.Int(name, value)
 }
 
+func Uint64(name string, value uint64) Attrib {
+	return zap.Uint64(name, value)
+}
+
 func Time(name string, value time.Time) Attrib {
 	return zap.Time(name, value)
 }
@@ -53,6 +57,14 @@ func Duration(name string, value time.Duration) Attrib {
 	return zap.Duration(name, value)
 }
 
+// Level of the loggers built by New, can be changed at runtime
+var level = zap.NewAtomicLevel()
+
+// SetLevel changes the logging level: debug, info, warn or error
+func SetLevel(name string) error {
+	return level.UnmarshalText([]byte(name))
+}
+
 func New(root service.Logger, logDir string, fileSizeMb int, fileNum int, debug bool) (Logger, error) {
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return Logger{}, err
@@ -76,6 +88,8 @@ func New(root service.Logger, logDir string, fileSizeMb int, fileNum int, debug
 	} else {
 		config = zap.NewProductionConfig()
 	}
+	level.SetLevel(config.Level.Level())
+	config.Level = level
 	config.OutputPaths = []string{"lumberjack://asicamera2.log"}
 	logger, err := config.Build()
 	if err != nil {
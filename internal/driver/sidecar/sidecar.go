@@ -0,0 +1,140 @@
+// Package sidecar reads the capture settings that capture software
+// saves in a text file next to the videos, since neither SER nor AVI
+// files record the exposure or the gain.
+//
+// SharpCap writes NAME.CameraSettings.txt, FireCapture and ASICap
+// write NAME.txt, with one "key=value" or "key: value" per line.
+package sidecar
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings of the capture, 0 if unknown
+type Settings struct {
+	Exposure time.Duration
+	Gain     int
+}
+
+// Metadata returns the settings in a format suitable for media metadata
+func (s Settings) Metadata() map[string]string {
+	metadata := make(map[string]string, 2)
+	if s.Exposure > 0 {
+		metadata["exposure"] = strconv.FormatFloat(s.Exposure.Seconds(), 'f', -1, 64)
+	}
+	if s.Gain > 0 {
+		metadata["gain"] = strconv.Itoa(s.Gain)
+	}
+	return metadata
+}
+
+// Names of the sidecar files of the capture, by preference
+func candidates(path string) []string {
+	name := strings.TrimSuffix(path, filepath.Ext(path))
+	return []string{
+		name + ".CameraSettings.txt",
+		name + ".txt",
+		path + ".txt",
+	}
+}
+
+// Read the settings of the capture from its sidecar file.
+// Returns false if there is no sidecar file.
+func Read(path string) (Settings, bool) {
+	for _, candidate := range candidates(path) {
+		file, err := os.Open(candidate)
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+		return Parse(file), true
+	}
+	return Settings{}, false
+}
+
+// Keys of the exposure time. Values without unit are seconds,
+// unless the key says otherwise.
+var exposureKeys = map[string]time.Duration{
+	"exposure":      time.Second,
+	"exposure time": time.Second,
+	"exptime":       time.Second,
+	"shutter":       time.Second,
+	"exposure(ms)":  time.Millisecond,
+	"exposure (ms)": time.Millisecond,
+	"exposure(us)":  time.Microsecond,
+	"exposure (us)": time.Microsecond,
+}
+
+// Units of the exposure values, longest first so that
+// "ms" is not taken for "s"
+var exposureUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"us", time.Microsecond},
+	{"µs", time.Microsecond},
+	{"s", time.Second},
+}
+
+// Parse the settings, ignoring the lines not understood
+func Parse(r io.Reader) Settings {
+	var settings Settings
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:sep]))
+		value := strings.TrimSpace(line[sep+1:])
+		if unit, ok := exposureKeys[key]; ok && settings.Exposure == 0 {
+			settings.Exposure = parseExposure(value, unit)
+		} else if key == "gain" && settings.Gain == 0 {
+			settings.Gain = parseGain(value)
+		}
+	}
+	return settings
+}
+
+// parseExposure parses "10.5ms", "0.01 s" or "0.01"
+func parseExposure(value string, unit time.Duration) time.Duration {
+	number := leadingNumber(value)
+	rest := strings.ToLower(strings.TrimSpace(value[len(number):]))
+	for _, u := range exposureUnits {
+		if strings.HasPrefix(rest, u.suffix) {
+			unit = u.unit
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f <= 0 {
+		return 0
+	}
+	return time.Duration(f * float64(unit))
+}
+
+// parseGain parses "300" or "300 (50%)"
+func parseGain(value string) int {
+	f, err := strconv.ParseFloat(leadingNumber(value), 64)
+	if err != nil || f <= 0 {
+		return 0
+	}
+	return int(f + 0.5)
+}
+
+// leadingNumber returns the decimal number at the start of the value
+func leadingNumber(value string) string {
+	end := 0
+	for end < len(value) && (value[end] >= '0' && value[end] <= '9' || value[end] == '.') {
+		end++
+	}
+	return value[:end]
+}
@@ -0,0 +1,45 @@
+package sidecar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		expected Settings
+	}{
+		{"[ZWO ASI224MC]\nExposure=0.025\nGain=300\n", Settings{Exposure: 25 * time.Millisecond, Gain: 300}},
+		{"Camera=ZWO ASI290MM\nShutter=10.000ms\nGain=250 (41%)\n", Settings{Exposure: 10 * time.Millisecond, Gain: 250}},
+		{"Exposure (us): 1500\nGain: 12.6\n", Settings{Exposure: 1500 * time.Microsecond, Gain: 13}},
+		{"Exposure = 2 s\n", Settings{Exposure: 2 * time.Second}},
+		{"Exposure=auto\nGain=\nComment: none\n", Settings{}},
+	} {
+		if got := Parse(strings.NewReader(test.text)); got != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.text, got, test.expected)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, "jupiter.ser")
+	if _, ok := Read(path); ok {
+		t.Fatal("expected no sidecar")
+	}
+	if err := os.WriteFile(filepath.Join(folder, "jupiter.txt"), []byte("Shutter=5ms\nGain=100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, ok := Read(path)
+	if !ok || settings != (Settings{Exposure: 5 * time.Millisecond, Gain: 100}) {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	metadata := settings.Metadata()
+	if metadata["exposure"] != "0.005" || metadata["gain"] != "100" {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+}
@@ -0,0 +1,27 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsure(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+	generated, err := Ensure(certFile, keyFile, []string{"localhost", "127.0.0.1"})
+	if err != nil || !generated {
+		t.Fatalf("expected certificate to be generated, got %v, %v", generated, err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 1 {
+		t.Errorf("expected one certificate, got %d", len(pair.Certificate))
+	}
+	generated, err = Ensure(certFile, keyFile, nil)
+	if err != nil || generated {
+		t.Errorf("expected existing certificate to be kept, got %v, %v", generated, err)
+	}
+}
@@ -0,0 +1,156 @@
+// Package tracing records spans of the upload pipeline with OpenTelemetry.
+//
+// Spans are exported with OTLP/HTTP to a collector, or as JSON lines to
+// a local file. The trace context is propagated to the backend with the
+// W3C traceparent and baggage headers, by the otelhttp transport.
+package tracing
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	spansExported = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asicamera_trace_spans_exported",
+		Help: "Number of spans exported",
+	})
+
+	spansDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asicamera_trace_spans_dropped",
+		Help: "Number of spans dropped because the export failed",
+	})
+)
+
+const (
+	// Name of the instrumentation scope
+	scopeName = "github.com/warpcomdev/asicamera2"
+	// Maximum time to flush the pending spans on Close
+	closeTimeout = 5 * time.Second
+)
+
+// NewOTLPExporter sends the spans to the OTLP/HTTP traces endpoint,
+// e.g. http://collector:4318/v1/traces
+func NewOTLPExporter(ctx context.Context, endpoint string, headers map[string]string) (sdktrace.SpanExporter, error) {
+	return otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithHeaders(headers),
+	)
+}
+
+// NewFileExporter writes the spans to the file, one JSON object per line,
+// rotated when it reaches sizeMb, keeping up to files old files.
+func NewFileExporter(path string, sizeMb, files int) (sdktrace.SpanExporter, error) {
+	writer := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    sizeMb,
+		MaxBackups: files,
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(writer))
+	if err != nil {
+		return nil, err
+	}
+	return fileExporter{SpanExporter: exporter, writer: writer}, nil
+}
+
+// fileExporter closes the file when the exporter shuts down
+type fileExporter struct {
+	sdktrace.SpanExporter
+	writer io.Closer
+}
+
+// Shutdown implements sdktrace.SpanExporter
+func (f fileExporter) Shutdown(ctx context.Context) error {
+	err := f.SpanExporter.Shutdown(ctx)
+	if closeErr := f.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countingExporter keeps the export metrics
+type countingExporter struct {
+	sdktrace.SpanExporter
+	logger servicelog.Logger
+}
+
+// ExportSpans implements sdktrace.SpanExporter
+func (c countingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if err := c.SpanExporter.ExportSpans(ctx, spans); err != nil {
+		c.logger.Error("failed to export spans", servicelog.Int("spans", len(spans)), servicelog.Error(err))
+		spansDropped.Add(float64(len(spans)))
+		return err
+	}
+	spansExported.Add(float64(len(spans)))
+	return nil
+}
+
+// Tracer owns the provider that batches and exports the spans
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+}
+
+// New creates a tracer. sampleRatio is the fraction of traces recorded,
+// between 0 and 1. attributes describe the service, e.g. service.name.
+func New(logger servicelog.Logger, exporter sdktrace.SpanExporter, sampleRatio float64, attributes ...attribute.KeyValue) *Tracer {
+	if sampleRatio <= 0 || sampleRatio > 1 {
+		sampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(countingExporter{SpanExporter: exporter, logger: logger}),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attributes...)),
+	)
+	return &Tracer{provider: provider}
+}
+
+// Close exports the pending spans and shuts down the exporter
+func (t *Tracer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return t.provider.Shutdown(ctx)
+}
+
+// SetTracer installs the tracer and the W3C propagators globally.
+// nil disables tracing.
+func SetTracer(t *Tracer) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if t == nil {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return
+	}
+	otel.SetTracerProvider(t.provider)
+}
+
+// Start a span, child of the span in the context if any
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(scopeName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// RecordError marks the span as failed. nil errors are ignored.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+// memoryExporter keeps the spans after shutdown
+type memoryExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (m memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestSpans(t *testing.T) {
+	// Tracing disabled, spans are not recorded
+	SetTracer(nil)
+	ctx, span := Start(context.Background(), "disabled")
+	RecordError(span, errors.New("ignored"))
+	span.End()
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Fatal("expected no span when tracing is disabled")
+	}
+
+	exporter := memoryExporter{tracetest.NewInMemoryExporter()}
+	tracer := New(servicelog.Logger{Logger: zap.NewNop()}, exporter, 1, attribute.String("service.name", "test"))
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	// The backend receives the context of the span in the request
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+	ctx, root := Start(ctx, "root", attribute.String("path", "a.jpg"))
+	childCtx, child := Start(ctx, "child")
+	req, err := http.NewRequestWithContext(childCtx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	RecordError(child, errors.New("failed"))
+	RecordError(root, nil)
+	child.End()
+	root.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	gotRequest, gotChild, gotRoot := spans[0], spans[1], spans[2]
+	if gotChild.SpanContext.TraceID() != gotRoot.SpanContext.TraceID() || gotChild.Parent.SpanID() != gotRoot.SpanContext.SpanID() {
+		t.Errorf("child is not linked to root: %+v %+v", gotChild, gotRoot)
+	}
+	if gotChild.Status.Code != codes.Error || gotChild.Status.Description != "failed" || gotRoot.Status.Code != codes.Unset {
+		t.Errorf("unexpected status %+v %+v", gotChild.Status, gotRoot.Status)
+	}
+	if gotRequest.Parent.SpanID() != gotChild.SpanContext.SpanID() {
+		t.Errorf("request is not linked to child: %+v", gotRequest)
+	}
+	if !strings.Contains(traceparent, gotRequest.SpanContext.SpanID().String()) {
+		t.Errorf("propagated %q, expected span %s", traceparent, gotRequest.SpanContext.SpanID())
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	exporter, err := NewFileExporter(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := New(servicelog.Logger{Logger: zap.NewNop()}, exporter, 1)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	_, span := Start(context.Background(), "upload", attribute.Int64("size", 42))
+	span.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	span.End() // after close, must not panic
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 || !strings.Contains(string(data), `"Name":"upload"`) {
+		t.Errorf("unexpected trace file %q", data)
+	}
+}
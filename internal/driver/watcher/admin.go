@@ -0,0 +1,125 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// Folder returns the folder being watched
+func (f *FileWatch) Folder() string {
+	return f.folder
+}
+
+// HistoryEntry describes a file in the upload history
+type HistoryEntry struct {
+	Path       string    `json:"path"`
+	Uploaded   time.Time `json:"uploaded,omitempty"` // zero if never uploaded
+	Monitoring bool      `json:"monitoring"`         // file being monitored for changes
+}
+
+// History returns a snapshot of the upload history, sorted by path.
+// It runs in the dispatch goroutine, so the folder must be watched.
+func (f *FileWatch) History(ctx context.Context) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := f.exec(ctx, func(handle func(fsnotify.Event)) {
+		entries = make([]HistoryEntry, 0, len(f.FileHistory.history))
+		for path, task := range f.FileHistory.history {
+			entries = append(entries, HistoryEntry{
+				Path:       path,
+				Uploaded:   task.Uploaded,
+				Monitoring: task.Events != nil,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// owns checks the path belongs to the watched folder, and returns
+// it in the same format as the history keys
+func (f *FileWatch) owns(path string) (string, error) {
+	absFolder, err := filepath.Abs(f.folder)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(absFolder, path)
+	}
+	path = filepath.Clean(path)
+	if !strings.HasPrefix(path, absFolder+string(filepath.Separator)) {
+		return "", NotInFolderError
+	}
+	return path, nil
+}
+
+// ForceUpload uploads the file right away, even if it has not changed
+// since the last upload or is still being monitored.
+func (f *FileWatch) ForceUpload(ctx context.Context, path string) error {
+	path, err := f.owns(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	err = f.exec(ctx, func(handle func(fsnotify.Event)) {
+		f.logger.Info("forcing upload", servicelog.String("file", path))
+		f.FileHistory.Forget(path)
+		handle(fsnotify.Event{Name: path, Op: fsnotify.Create})
+	})
+	if err != nil {
+		return err
+	}
+	f.status.force(path)
+	return nil
+}
+
+// RetryFailed schedules again the upload of the files that failed.
+// Returns the list of files requeued.
+func (f *FileWatch) RetryFailed(ctx context.Context) ([]string, error) {
+	failures := f.Failures()
+	paths := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		paths = append(paths, failure.Path)
+	}
+	if len(paths) == 0 {
+		return paths, nil
+	}
+	return paths, f.Requeue(ctx, paths)
+}
+
+// Forget the upload history of the file, so it is uploaded again
+// the next time it is detected (e.g. on the next rescan).
+func (f *FileWatch) Forget(ctx context.Context, path string) error {
+	path, err := f.owns(path)
+	if err != nil {
+		return err
+	}
+	f.status.forgetFailure(path)
+	return f.exec(ctx, func(handle func(fsnotify.Event)) {
+		f.logger.Info("forgetting file", servicelog.String("file", path))
+		f.FileHistory.Forget(path)
+		f.FileHistory.Save()
+	})
+}
+
+// Rescan triggers a scan of the folder. Returns false if a
+// rescan is already pending.
+func (f *FileWatch) Rescan() bool {
+	select {
+	case f.rescan <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
 	"go.uber.org/atomic"
 )
@@ -25,6 +26,10 @@ const (
 	// Error returned when the event channel for a folder is closed
 	ChannelClosedError = stringError("channel closed")
 	NotDirectoryError  = stringError("path must be a directory")
+	// Error returned by Server.Upload when the file is incomplete
+	HeldBackError = stringError("upload held back")
+	// Error returned when a path does not belong to the watched folder
+	NotInFolderError = stringError("path is not in the watched folder")
 )
 
 type FileHistory struct {
@@ -33,7 +38,7 @@ type FileHistory struct {
 	historyFolder string
 	historyFile   string
 	history       map[string]fileTask
-	expiration    time.Duration
+	expiration    atomic.Duration // can be updated while watching
 }
 
 // New creates a new FileHistory object
@@ -44,8 +49,8 @@ func NewHistory(logger servicelog.Logger, historyFolder, historyFile string, exp
 		historyFolder: historyFolder,
 		historyFile:   historyFile,
 		history:       make(map[string]fileTask),
-		expiration:    expiration,
 	}
+	f.expiration.Store(expiration)
 	return f
 }
 
@@ -58,14 +63,16 @@ func (f *FileHistory) LastUpdate() time.Time {
 // after many adds and removals
 func (f *FileHistory) Remap() {
 	newMap := make(map[string]fileTask)
+	expiration := f.expiration.Load()
 	for _, task := range f.history {
 		// Remove files that have been uploaded for long enough
 		keep := true
-		if !task.Uploaded.IsZero() && f.expiration > 0 && time.Since(task.Uploaded) > f.expiration {
+		if !task.Uploaded.IsZero() && expiration > 0 && time.Since(task.Uploaded) > expiration {
 			logger := f.logger.With(servicelog.String("path", task.Path))
 			err := os.Remove(task.Path)
 			if err == nil {
 				logger.Info("removed expired file from history")
+				audit.Log(audit.Record{Event: audit.Expired, Path: task.Path})
 				keep = false
 			} else {
 				// If there was an error, check if it was file not exist
@@ -270,3 +277,13 @@ func (f *FileHistory) CompleteTask(task fileTask) {
 	}
 	f.history[originalTask.Path] = originalTask
 }
+
+// Forget the upload time of the file, so it is uploaded again
+// next time it is detected.
+func (f *FileHistory) Forget(fullName string) {
+	task, taskExist := f.history[fullName]
+	if taskExist {
+		task.Uploaded = time.Time{}
+		f.history[fullName] = task
+	}
+}
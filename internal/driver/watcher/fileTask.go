@@ -2,6 +2,7 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,7 +11,10 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"github.com/warpcomdev/asicamera2/internal/driver/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -59,6 +63,15 @@ var (
 			"folder",
 		})
 
+	upload_held = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_upload_held",
+			Help: "Number of file uploads held back because the file is incomplete",
+		},
+		[]string{
+			"folder",
+		})
+
 	upload_duration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "asicamera_upload_duration",
@@ -70,7 +83,9 @@ var (
 		})
 )
 
-// Server is the interface that must be implemented by the server
+// Server is the interface that must be implemented by the server.
+// Upload may return an error wrapping HeldBackError if the file is
+// not ready to be uploaded yet.
 type Server interface {
 	CameraID() string
 	Upload(ctx context.Context, path string) error
@@ -85,7 +100,7 @@ type fileTask struct {
 	Events   chan fsnotify.Event
 }
 
-func (t fileTask) upload(ctx context.Context, logger servicelog.Logger, server Server, tasks chan<- fileTask, monitorFor time.Duration) {
+func (t fileTask) upload(ctx context.Context, logger servicelog.Logger, server Server, tasks chan<- fileTask, monitorFor time.Duration, status *statusBoard, force <-chan struct{}) {
 	// Notify when we are done
 	defer func() {
 		tasks <- t
@@ -105,6 +120,59 @@ func (t fileTask) upload(ctx context.Context, logger servicelog.Logger, server S
 	// (up to 5 minutes per file)
 	inactivity := time.NewTimer(monitorFor)
 	defer inactivity.Stop()
+	// Trace the wait for the file to settle, and the upload
+	ctx, span := tracing.Start(ctx, "watcher.upload", attribute.String("file.path", t.Path))
+	defer span.End()
+	_, waitSpan := tracing.Start(ctx, "watcher.quiescence", attribute.Int64("monitorFor.ms", monitorFor.Milliseconds()))
+	defer waitSpan.End()
+	events := 0
+	// trigger the upload and record the result
+	trigger := func() {
+		waitSpan.SetAttributes(attribute.Int("events", events))
+		waitSpan.End()
+		status.uploading(t.Path)
+		start := time.Now()
+		previous := t.Uploaded
+		var err error
+		t.Uploaded, err = t.triggered(ctx, logger, server)
+		result := UploadResult{
+			Path:     t.Path,
+			Time:     time.Now(),
+			Duration: time.Since(start),
+			Status:   ResultSuccess,
+		}
+		switch {
+		case errors.Is(err, HeldBackError):
+			result.Status = ResultHeld
+			result.Error = err.Error()
+		case err != nil:
+			logger.Error("upload failed", servicelog.Error(err))
+			result.Status = ResultFailure
+			result.Error = err.Error()
+		case t.Uploaded == previous:
+			result.Status = ResultSkipped
+		}
+		status.finish(result)
+		record := audit.Record{
+			Time:       result.Time,
+			Event:      audit.Success,
+			Path:       t.Path,
+			DurationMs: result.Duration.Milliseconds(),
+			Error:      result.Error,
+		}
+		switch result.Status {
+		case ResultHeld:
+			record.Event = audit.Held
+		case ResultFailure:
+			record.Event = audit.Failure
+		case ResultSkipped:
+			record.Event = audit.Skipped
+		}
+		if info, err := os.Stat(t.Path); err == nil {
+			record.Size = info.Size()
+		}
+		audit.Log(record)
+	}
 	// This loops watches for events until the file stops changing
 	logger = logger.With(servicelog.String("file", t.Path))
 	for {
@@ -116,22 +184,26 @@ func (t fileTask) upload(ctx context.Context, logger servicelog.Logger, server S
 				logger.Debug("file removed, quitting", servicelog.String("file", t.Path))
 				folder := filepath.Dir(t.Path)
 				upload_cancel.WithLabelValues(folder).Inc()
+				status.remove(t.Path)
+				span.SetAttributes(attribute.Bool("removed", true))
 				return
 			}
 			// Otherwise, reset the inactivity timer
+			events++
 			logger.Debug("reset of inactivity timer", servicelog.String("file", t.Path))
 			if !inactivity.Stop() {
 				<-inactivity.C
 			}
 			inactivity.Reset(monitorFor)
+			status.touch(t.Path, monitorFor)
 		case <-inactivity.C:
 			// When the inactivity timer expires, trigger an upload
 			logger.Info("inactivity expired, triggering upload", servicelog.Duration("monitorFor", monitorFor))
-			var err error
-			t.Uploaded, err = t.triggered(ctx, logger, server)
-			if err != nil {
-				logger.Error("upload failed", servicelog.Error(err))
-			}
+			trigger()
+			return
+		case <-force:
+			logger.Info("upload forced")
+			trigger()
 			return
 		}
 	}
@@ -139,6 +211,14 @@ func (t fileTask) upload(ctx context.Context, logger servicelog.Logger, server S
 
 func (t fileTask) triggered(ctx context.Context, logger servicelog.Logger, server Server) (uploaded time.Time, uploadErr error) {
 	// The upload has been triggered!
+	ctx, span := tracing.Start(ctx, "watcher.triggered")
+	defer func() {
+		if !errors.Is(uploadErr, HeldBackError) {
+			tracing.RecordError(span, uploadErr)
+		}
+		span.SetAttributes(attribute.Bool("uploaded", uploadErr == nil && uploaded != t.Uploaded))
+		span.End()
+	}()
 	folder := filepath.Dir(t.Path)
 	var start time.Time
 	// Update metrics and alerts
@@ -146,6 +226,15 @@ func (t fileTask) triggered(ctx context.Context, logger servicelog.Logger, serve
 	defer func() {
 		alertName := "upload_file"
 		alertID := fmt.Sprintf("%s_%s_%s", alertName, server.CameraID(), t.Path)
+		if errors.Is(uploadErr, HeldBackError) {
+			// The file will be uploaded when it changes again. But it has not
+			// changed for the whole monitoring window, so the capture may have
+			// been interrupted and the file left incomplete for good.
+			logger.Info("upload held back", servicelog.Error(uploadErr))
+			upload_held.WithLabelValues(folder).Inc()
+			server.SendAlert(ctx, alertID, alertName, "warning", fmt.Sprintf("file incomplete after the monitoring window: %v", uploadErr))
+			return
+		}
 		if uploadErr != nil {
 			upload_error.WithLabelValues(folder).Inc()
 			server.SendAlert(ctx, alertID, alertName, "error", uploadErr.Error())
@@ -177,6 +266,7 @@ func (t fileTask) triggered(ctx context.Context, logger servicelog.Logger, serve
 		return t.Uploaded, nil
 	}
 	logger.Debug("uploading file")
+	audit.Log(audit.Record{Event: audit.Attempt, Path: t.Path, Size: info.Size()})
 	// try to upload the file to the server
 	start = time.Now()
 	if err := server.Upload(ctx, t.Path); err != nil {
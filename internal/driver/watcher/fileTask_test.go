@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+// alertServer records the alerts, and fails the uploads with err
+type alertServer struct {
+	err    error
+	alerts map[string]string // severity by alert ID
+}
+
+func (s *alertServer) CameraID() string {
+	return "cam"
+}
+
+func (s *alertServer) Upload(ctx context.Context, path string) error {
+	return s.err
+}
+
+func (s *alertServer) SendAlert(ctx context.Context, id, name, severity, message string) {
+	s.alerts[id] = severity
+}
+
+func (s *alertServer) ClearAlert(ctx context.Context, id string) {
+	delete(s.alerts, id)
+}
+
+func TestTriggeredHeldBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.avi")
+	if err := os.WriteFile(path, []byte("RIFF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger := servicelog.Logger{Logger: zap.NewNop()}
+	server := &alertServer{
+		err:    fmt.Errorf("%w: truncated", HeldBackError),
+		alerts: make(map[string]string),
+	}
+	task := fileTask{Path: path}
+	// Incomplete after the monitoring window, the file is not
+	// uploaded but an alert is raised
+	uploaded, err := task.triggered(context.Background(), logger, server)
+	if err == nil || !uploaded.IsZero() {
+		t.Fatalf("expected held back, got %v, %v", uploaded, err)
+	}
+	if len(server.alerts) != 1 {
+		t.Fatalf("expected an alert, got %v", server.alerts)
+	}
+	for _, severity := range server.alerts {
+		if severity != "warning" {
+			t.Errorf("unexpected severity %s", severity)
+		}
+	}
+	// Cleared once the file is complete and uploaded
+	server.err = nil
+	if _, err := task.triggered(context.Background(), logger, server); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.alerts) != 0 {
+		t.Errorf("alert not cleared: %v", server.alerts)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/warpcomdev/asicamera2/internal/driver/audit"
 	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
 )
 
@@ -21,15 +22,25 @@ import (
 type FileWatch struct {
 	FileHistory *FileHistory
 	logger      servicelog.Logger
-	fileTypes   map[string]struct{}
 	server      Server
 	folder      string
-	monitorFor  time.Duration
-	denyList    []string
+	watchConfig WatchConfig
+	// Settings that can be updated while watching
+	settingsMutex sync.Mutex
+	fileTypes     map[string]struct{}
+	monitorFor    time.Duration
+	denyList      []string
+	commands      chan command // run in the dispatch goroutine
+	rescan        chan struct{}
+	status        *statusBoard
 }
 
+// command to be run by the dispatch goroutine. It receives
+// the function used to handle file events.
+type command func(handle func(fsnotify.Event))
+
 // New creates a new FileWatch object
-func New(logger servicelog.Logger, historyFolder string, server Server, folder string, fileTypes map[string]struct{}, monitorFor time.Duration, expiration time.Duration, denyList []string) *FileWatch {
+func New(logger servicelog.Logger, historyFolder string, server Server, folder string, fileTypes map[string]struct{}, monitorFor time.Duration, expiration time.Duration, denyList []string, watchConfig WatchConfig) *FileWatch {
 	// Generate unique history file name from folder name
 	hash := fnv.New64a()
 	hash.Write([]byte(folder))
@@ -45,6 +56,10 @@ func New(logger servicelog.Logger, historyFolder string, server Server, folder s
 		fileTypes:   fileTypes,
 		monitorFor:  monitorFor,
 		denyList:    cleanDenyList(logger, denyList),
+		watchConfig: watchConfig,
+		commands:    make(chan command),
+		rescan:      make(chan struct{}, 1),
+		status:      newStatusBoard(),
 	}
 	return f
 }
@@ -65,6 +80,57 @@ func cleanDenyList(logger servicelog.Logger, denyList []string) []string {
 	return buffer
 }
 
+// Settings of the watcher that can be updated while it runs
+type Settings struct {
+	FileTypes  map[string]struct{}
+	MonitorFor time.Duration // only applies to files detected after the update
+	Expiration time.Duration
+	DenyList   []string
+}
+
+// Update the settings. Files already being monitored keep
+// their inactivity timeout.
+func (f *FileWatch) Update(settings Settings) {
+	denyList := cleanDenyList(f.logger, settings.DenyList)
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	f.fileTypes = settings.FileTypes
+	f.monitorFor = settings.MonitorFor
+	f.denyList = denyList
+	f.FileHistory.expiration.Store(settings.Expiration)
+}
+
+// isFileType checks if the extension is one of the types watched
+func (f *FileWatch) isFileType(ext string) bool {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	_, ok := f.fileTypes[ext]
+	return ok
+}
+
+// currentMonitorFor returns the inactivity timeout for new files
+func (f *FileWatch) currentMonitorFor() time.Duration {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	return f.monitorFor
+}
+
+// denied checks if the file name matches the deny list,
+// and returns the matching entry
+func (f *FileWatch) denied(path string) (string, bool) {
+	f.settingsMutex.Lock()
+	denyList := f.denyList
+	f.settingsMutex.Unlock()
+	baseName := filepath.Base(path)
+	for _, deny := range denyList {
+		match, err := filepath.Match(deny, baseName)
+		if err == nil && match {
+			return deny, true
+		}
+	}
+	return "", false
+}
+
 // Watch the folder for changes
 func (f *FileWatch) Watch(ctx context.Context) error {
 	// Make sure the folder exists
@@ -93,40 +159,22 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 	defer func() {
 		f.FileHistory.Cleanup()
 	}()
-	// Create a notify watcher
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logger.Error("failed to create watcher", servicelog.Error(err))
-		return err
-	}
-	defer watcher.Close()
 	// Start listening for events.
 	failContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var (
 		wg          sync.WaitGroup
 		dispatchErr error
-		watcherErr  error
+		sourceErr   error
 	)
-	// Watch the error channel
+	// Generate file events using notifications, polling or both
+	notifications := make(chan fsnotify.Event, 16)
+	source := newEventSource(logger, f.watchConfig, absPath, notifications)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer cancel() // Cancel the context if the watcher errors
-		for {
-			select {
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					watcherErr = ChannelClosedError
-					return
-				}
-				logger.Error("watcher error", servicelog.Error(err))
-				watcherErr = err
-				return
-			case <-failContext.Done():
-				return
-			}
-		}
+		defer cancel() // Cancel the context if the source fails
+		sourceErr = source.run(failContext)
 	}()
 	// Merge events both from file and from synthetic events
 	syntheticEvents := make(chan fsnotify.Event, 16)
@@ -138,13 +186,9 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 		ext := strings.ToLower(filepath.Ext(event.Name))
 		logger.Debug("screening event", servicelog.String("ext", ext))
 		// Check if the file name matches the deny list
-		baseName := filepath.Base(event.Name)
-		for _, deny := range f.denyList {
-			match, err := filepath.Match(deny, baseName)
-			if err == nil && match {
-				logger.Debug("skipping denied file because of match", servicelog.String("deny", deny))
-				return
-			}
+		if deny, denied := f.denied(event.Name); denied {
+			logger.Debug("skipping denied file because of match", servicelog.String("deny", deny))
+			return
 		}
 		// Check if it is a new directory. We don't neeed to watch for renames
 		// because the watcher will do that automatically.
@@ -159,7 +203,7 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 					logger.Debug("skipping directory")
 					return
 				}
-				err := watcher.Add(event.Name)
+				err := source.watchDir(event.Name)
 				if err != nil {
 					logger.Error("failed to add directory watcher", servicelog.Error(err))
 					// it will be retried on next scan
@@ -170,7 +214,7 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 		}
 		// Otherwise, check if it is an interesting file
 		if ext != "" {
-			if _, ok := f.fileTypes[ext]; !ok {
+			if !f.isFileType(ext) {
 				logger.Debug("Unrecognized extension", servicelog.String("ext", ext))
 			} else {
 				events <- event
@@ -182,7 +226,7 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 	go func() {
 		defer wg.Done()
 		defer close(events)
-		f.merge(failContext, watcher.Events, syntheticEvents, screen)
+		f.merge(failContext, notifications, syntheticEvents, screen)
 	}()
 	// Generate synthetic events periodically
 	wg.Add(1)
@@ -194,6 +238,9 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 			case <-timer.C:
 				f.scan(failContext, absPath, syntheticEvents)
 				timer.Reset(2 * time.Hour)
+			case <-f.rescan:
+				logger.Info("rescan requested")
+				f.scan(failContext, absPath, syntheticEvents)
 			case <-failContext.Done():
 				return
 			}
@@ -206,20 +253,13 @@ func (f *FileWatch) Watch(ctx context.Context) error {
 		defer cancel()
 		dispatchErr = f.dispatch(failContext, absPath, events)
 	}()
-	// Add a path to watch
-	notifyErr := watcher.Add(absPath)
-	if notifyErr != nil {
-		logger.Error("failed to watch folder", servicelog.Error(err))
-		cancel()
-	}
 	wg.Wait()
 	// If all errors are "context cancelled", we are good
-	if (notifyErr == nil || errors.Is(notifyErr, context.Canceled)) &&
-		(dispatchErr == nil || errors.Is(dispatchErr, context.Canceled)) &&
-		(watcherErr == nil || errors.Is(watcherErr, context.Canceled)) {
+	if (sourceErr == nil || errors.Is(sourceErr, context.Canceled)) &&
+		(dispatchErr == nil || errors.Is(dispatchErr, context.Canceled)) {
 		return context.Canceled
 	}
-	return errors.Join(notifyErr, dispatchErr, watcherErr)
+	return errors.Join(sourceErr, dispatchErr)
 }
 
 // Merge info from two channels into a single forwarder
@@ -269,6 +309,50 @@ func (f *FileWatch) dispatch(ctx context.Context, absPath string, events chan fs
 	// Make sure we cancel all tasks if we exit for something besides main context cancellation
 	cancelCtx, cancelFunc := context.WithCancel(ctx)
 	defer cancelFunc()
+	// handle a file event
+	handle := func(event fsnotify.Event) {
+		fullName := filepath.Join(event.Name)
+		logger := f.logger.With(servicelog.String("file", fullName))
+		logger.Debug("detected file event")
+		// If a file is removed, we must remove the entry in the log
+		if event.Op&fsnotify.Remove == fsnotify.Remove {
+			logger.Info("file removed")
+			f.FileHistory.RemoveTask(fullName)
+		} else {
+			// If a file is renamed, we must watch it until it is complete.
+			// We can't delete it from the map, though, because we don't know
+			// the prev name.
+			mustUpdate := event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Rename)
+			if mustUpdate {
+				logger.Debug("dispatch detected file")
+				task, newChannel := f.FileHistory.CreateTask(fullName)
+				// send the information on the channel before creating a goroutine,
+				// to avoid having the inactivity timer trigger before there is actually
+				// any change in the file
+				select {
+				case task.Events <- event:
+				default:
+					logger.Debug("failed dispatch to busy task")
+				}
+				// If the channel is new, start a new uploader routine
+				if newChannel {
+					record := audit.Record{Event: audit.Detected, Path: fullName}
+					if info, err := os.Stat(fullName); err == nil {
+						record.Size = info.Size()
+					}
+					audit.Log(record)
+					monitorFor := f.currentMonitorFor()
+					force := f.status.add(fullName, monitorFor)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						logger.Info("started monitoring file")
+						task.upload(cancelCtx, f.logger, f.server, tasks, monitorFor, f.status, force)
+					}()
+				}
+			}
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -294,40 +378,9 @@ func (f *FileWatch) dispatch(ctx context.Context, absPath string, events chan fs
 				f.logger.Debug("stopping folder watcher")
 				return ChannelClosedError
 			}
-			fullName := filepath.Join(event.Name)
-			logger := f.logger.With(servicelog.String("file", fullName))
-			logger.Debug("detected file event")
-			// If a file is removed, we must remove the entry in the log
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				logger.Info("file removed")
-				f.FileHistory.RemoveTask(fullName)
-			} else {
-				// If a file is renamed, we must watch it until it is complete.
-				// We can't delete it from the map, though, because we don't know
-				// the prev name.
-				mustUpdate := event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Rename)
-				if mustUpdate {
-					logger.Debug("dispatch detected file")
-					task, newChannel := f.FileHistory.CreateTask(fullName)
-					// send the information on the channel before creating a goroutine,
-					// to avoid having the inactivity timer trigger before there is actually
-					// any change in the file
-					select {
-					case task.Events <- event:
-					default:
-						logger.Debug("failed dispatch to busy task")
-					}
-					// If the channel is new, start a new uploader routine
-					if newChannel {
-						wg.Add(1)
-						go func() {
-							defer wg.Done()
-							logger.Info("started monitoring file")
-							task.upload(cancelCtx, f.logger, f.server, tasks, f.monitorFor)
-						}()
-					}
-				}
-			}
+			handle(event)
+		case cmd := <-f.commands:
+			cmd(handle)
 		}
 	}
 }
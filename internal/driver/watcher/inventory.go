@@ -0,0 +1,97 @@
+package watcher
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+// InventoryEntry describes a local file eligible for upload
+type InventoryEntry struct {
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	Uploaded time.Time // zero if never uploaded
+}
+
+// Inventory lists the files in the folder that would be uploaded,
+// along with their upload time according to the history file.
+// It reads the history file on its own, so it can be used whether
+// the folder is being watched or not.
+func (f *FileWatch) Inventory() ([]InventoryEntry, error) {
+	absPath, err := filepath.Abs(f.folder)
+	if err != nil {
+		return nil, err
+	}
+	history := NewHistory(f.logger, f.FileHistory.historyFolder, f.FileHistory.historyFile, 0)
+	if err := history.Load(); err != nil {
+		return nil, err
+	}
+	entries := make([]InventoryEntry, 0, len(history.history))
+	err = filepath.WalkDir(absPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			f.logger.Error("failed to walk path", servicelog.String("path", path), servicelog.Error(err))
+			if path == absPath {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if _, denied := f.denied(path); denied {
+			return nil
+		}
+		if !f.isFileType(strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, InventoryEntry{
+			Path:     path,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Uploaded: history.history[path].Uploaded,
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// exec runs the function in the dispatch goroutine and waits for it
+// to complete. Fails if the context is cancelled before the
+// dispatcher is available.
+func (f *FileWatch) exec(ctx context.Context, fn func(handle func(fsnotify.Event))) error {
+	done := make(chan struct{})
+	cmd := func(handle func(fsnotify.Event)) {
+		defer close(done)
+		fn(handle)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.commands <- cmd:
+		<-done
+		return nil
+	}
+}
+
+// Requeue forgets the upload history of the given files, and
+// schedules them for upload again.
+func (f *FileWatch) Requeue(ctx context.Context, paths []string) error {
+	return f.exec(ctx, func(handle func(fsnotify.Event)) {
+		for _, path := range paths {
+			f.logger.Info("requeuing file", servicelog.String("file", path))
+			f.FileHistory.Forget(path)
+			handle(fsnotify.Event{Name: path, Op: fsnotify.Create})
+		}
+		f.FileHistory.Save()
+	})
+}
@@ -0,0 +1,393 @@
+package watcher
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+)
+
+var (
+	watch_mode = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "asicamera_watch_mode",
+			Help: "Active change detection mode of the folder (1 = active)",
+		},
+		[]string{
+			"folder",
+			"mode",
+		})
+
+	watch_fallback = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asicamera_watch_fallback",
+			Help: "Number of times the watcher fell back from notify to poll",
+		},
+		[]string{
+			"folder",
+		})
+)
+
+// WatchMode selects how changes in a folder are detected
+type WatchMode string
+
+const (
+	WatchNotify WatchMode = "notify" // Filesystem notifications only
+	WatchPoll   WatchMode = "poll"   // Periodic directory snapshots only
+	WatchHybrid WatchMode = "hybrid" // Notifications, polling while they fail
+)
+
+// WatchConfig configures change detection for a folder
+type WatchConfig struct {
+	Mode         WatchMode
+	PollInterval time.Duration
+}
+
+// How many poll intervals to wait before trying to recover notifications
+const recoverAfterPolls = 10
+
+// fileState is the stat information kept by the poller
+type fileState struct {
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// poller detects changes in a folder tree by diffing stat snapshots
+type poller struct {
+	root     string
+	snapshot map[string]fileState
+}
+
+func newPoller(root string) *poller {
+	return &poller{
+		root:     root,
+		snapshot: make(map[string]fileState),
+	}
+}
+
+// poll takes a new snapshot of the folder and returns the events
+// that turn the previous snapshot into the new one.
+func (p *poller) poll() ([]fsnotify.Event, error) {
+	current := make(map[string]fileState, len(p.snapshot))
+	err := filepath.WalkDir(p.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == p.root {
+				return err
+			}
+			// Skip unreadable entries, they will be retried next poll
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == p.root {
+			return nil
+		}
+		if strings.HasSuffix(path, ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		current[path] = fileState{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			dir:     info.IsDir(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := make([]fsnotify.Event, 0, 16)
+	for path, state := range current {
+		prev, found := p.snapshot[path]
+		switch {
+		case !found:
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		case !state.dir && (state.size != prev.size || !state.modTime.Equal(prev.modTime)):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+	for path := range p.snapshot {
+		if _, found := current[path]; !found {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+	p.snapshot = current
+	return events, nil
+}
+
+// eventSource generates raw file events for a folder, using
+// filesystem notifications, polling, or both.
+type eventSource struct {
+	logger servicelog.Logger
+	config WatchConfig
+	root   string
+	output chan<- fsnotify.Event
+	// current notify watcher, nil while polling
+	mutex  sync.Mutex
+	notify *fsnotify.Watcher
+}
+
+func newEventSource(logger servicelog.Logger, config WatchConfig, root string, output chan<- fsnotify.Event) *eventSource {
+	if config.PollInterval <= 0 {
+		config.PollInterval = 30 * time.Second
+	}
+	switch config.Mode {
+	case WatchNotify, WatchPoll, WatchHybrid:
+		break
+	default:
+		config.Mode = WatchNotify
+	}
+	return &eventSource{
+		logger: logger,
+		config: config,
+		root:   root,
+		output: output,
+	}
+}
+
+// watchDir adds a new directory to the notify watcher, if any.
+// When polling, directories are already included in the snapshot.
+func (s *eventSource) watchDir(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.notify == nil {
+		return nil
+	}
+	return s.notify.Add(path)
+}
+
+// setMode updates the active notify watcher and mode metrics
+func (s *eventSource) setMode(mode WatchMode, notify *fsnotify.Watcher) {
+	s.mutex.Lock()
+	s.notify = notify
+	s.mutex.Unlock()
+	for _, m := range []WatchMode{WatchNotify, WatchPoll} {
+		active := 0.0
+		if m == mode {
+			active = 1
+		}
+		watch_mode.WithLabelValues(s.root, string(m)).Set(active)
+	}
+}
+
+// emit an event, unless the context is cancelled
+func (s *eventSource) emit(ctx context.Context, event fsnotify.Event) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.output <- event:
+		return nil
+	}
+}
+
+// run generates events until the context is cancelled or
+// the source fails.
+func (s *eventSource) run(ctx context.Context) error {
+	defer s.setMode("", nil)
+	switch s.config.Mode {
+	case WatchPoll:
+		_, err := s.poll(ctx, false, false)
+		return err
+	case WatchHybrid:
+		return s.hybrid(ctx)
+	default:
+		watcher, err := s.startNotify()
+		if err != nil {
+			return err
+		}
+		return s.forward(ctx, watcher)
+	}
+}
+
+// hybrid uses notifications while they work, and polling otherwise
+func (s *eventSource) hybrid(ctx context.Context) error {
+	watcher, err := s.startNotify()
+	for {
+		if err == nil {
+			err = s.forward(ctx, watcher)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.logger.Error("notifications failed, falling back to polling", servicelog.Error(err))
+		watch_fallback.WithLabelValues(s.root).Inc()
+		watcher, err = s.poll(ctx, true, true)
+		if err != nil {
+			// poll only returns error if the context is cancelled,
+			// or the folder is no longer reachable.
+			return err
+		}
+		s.logger.Info("notifications recovered, stopped polling")
+	}
+}
+
+// startNotify creates a notify watcher for the root folder and subfolders
+func (s *eventSource) startNotify() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.logger.Error("failed to create watcher", servicelog.Error(err))
+		return nil, err
+	}
+	if err := watcher.Add(s.root); err != nil {
+		s.logger.Error("failed to watch folder", servicelog.Error(err))
+		watcher.Close()
+		return nil, err
+	}
+	// Notifications are not recursive, add existing subfolders too
+	filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == s.root {
+			return nil
+		}
+		if strings.HasSuffix(path, ".") {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			s.logger.Error("failed to add directory watcher", servicelog.String("path", path), servicelog.Error(err))
+		}
+		return nil
+	})
+	return watcher, nil
+}
+
+// forward events from the notify watcher until it fails.
+// The watcher is closed on return.
+func (s *eventSource) forward(ctx context.Context, watcher *fsnotify.Watcher) error {
+	s.setMode(WatchNotify, watcher)
+	defer func() {
+		s.setMode("", nil)
+		watcher.Close()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return ChannelClosedError
+			}
+			if err := s.emit(ctx, event); err != nil {
+				return err
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return ChannelClosedError
+			}
+			s.logger.Error("watcher error", servicelog.Error(err))
+			return err
+		}
+	}
+}
+
+// poll the folder periodically. If emitAll, the first snapshot generates
+// events for every file found (so nothing changed while switching modes
+// is lost). If recoverNotify, it periodically tries to set up notifications
+// again, and returns the new watcher once it has worked for a full
+// poll interval.
+func (s *eventSource) poll(ctx context.Context, emitAll, recoverNotify bool) (*fsnotify.Watcher, error) {
+	s.setMode(WatchPoll, nil)
+	logger := s.logger.With(servicelog.Duration("pollInterval", s.config.PollInterval))
+	logger.Info("polling folder")
+	p := newPoller(s.root)
+	if !emitAll {
+		// Take a baseline, the initial scan already reports every file
+		if _, err := p.poll(); err != nil {
+			logger.Error("failed to poll folder", servicelog.Error(err))
+			return nil, err
+		}
+	}
+	var (
+		probe     *fsnotify.Watcher
+		probeFrom time.Time
+		polls     int
+	)
+	// Cleanup the probe watcher if we quit before it is handed over
+	defer func() {
+		if probe != nil {
+			probe.Close()
+		}
+	}()
+	var (
+		probeEvents <-chan fsnotify.Event
+		probeErrors <-chan error
+	)
+	dropProbe := func() {
+		s.mutex.Lock()
+		s.notify = nil
+		s.mutex.Unlock()
+		probe.Close()
+		probe, probeEvents, probeErrors = nil, nil, nil
+	}
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case event, ok := <-probeEvents:
+				if ok {
+					if err := s.emit(ctx, event); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				logger.Debug("notify probe closed")
+				dropProbe()
+				continue
+			case err := <-probeErrors:
+				logger.Debug("notify probe failed", servicelog.Error(err))
+				dropProbe()
+				continue
+			case <-ticker.C:
+				break
+			}
+		}
+		events, err := p.poll()
+		if err != nil {
+			logger.Error("failed to poll folder", servicelog.Error(err))
+			if _, statErr := os.Stat(s.root); statErr != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, event := range events {
+			if err := s.emit(ctx, event); err != nil {
+				return nil, err
+			}
+		}
+		if !recoverNotify {
+			continue
+		}
+		// The probe has been running without errors for a full interval,
+		// hand it over. We have been polling in parallel, so nothing is lost.
+		if probe != nil && time.Since(probeFrom) >= s.config.PollInterval {
+			watcher := probe
+			probe = nil
+			return watcher, nil
+		}
+		if polls += 1; probe == nil && polls >= recoverAfterPolls {
+			polls = 0
+			if watcher, err := s.startNotify(); err == nil {
+				logger.Debug("probing notifications")
+				probe, probeFrom = watcher, time.Now()
+				probeEvents, probeErrors = watcher.Events, watcher.Errors
+				s.mutex.Lock()
+				s.notify = watcher // so new folders are added to it
+				s.mutex.Unlock()
+			}
+		}
+	}
+}
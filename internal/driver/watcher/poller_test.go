@@ -0,0 +1,163 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/warpcomdev/asicamera2/internal/driver/servicelog"
+	"go.uber.org/zap"
+)
+
+func TestPollerPoll(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) func() error {
+		return func() error {
+			return os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+	}
+	p := newPoller(dir)
+	for _, tc := range []struct {
+		name   string
+		change func() error
+		events []fsnotify.Event
+	}{
+		{
+			name:   "empty",
+			change: func() error { return nil },
+		},
+		{
+			name:   "create",
+			change: write("a.jpg", "a"),
+			events: []fsnotify.Event{{Name: filepath.Join(dir, "a.jpg"), Op: fsnotify.Create}},
+		},
+		{
+			name:   "unchanged",
+			change: func() error { return nil },
+		},
+		{
+			name:   "modify",
+			change: write("a.jpg", "longer"),
+			events: []fsnotify.Event{{Name: filepath.Join(dir, "a.jpg"), Op: fsnotify.Write}},
+		},
+		{
+			name: "create folder",
+			change: func() error {
+				if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+					return err
+				}
+				return write(filepath.Join("sub", "b.jpg"), "b")()
+			},
+			events: []fsnotify.Event{
+				{Name: filepath.Join(dir, "sub"), Op: fsnotify.Create},
+				{Name: filepath.Join(dir, "sub", "b.jpg"), Op: fsnotify.Create},
+			},
+		},
+		{
+			name:   "delete",
+			change: func() error { return os.Remove(filepath.Join(dir, "a.jpg")) },
+			events: []fsnotify.Event{{Name: filepath.Join(dir, "a.jpg"), Op: fsnotify.Remove}},
+		},
+		{
+			name:   "delete folder",
+			change: func() error { return os.RemoveAll(filepath.Join(dir, "sub")) },
+			events: []fsnotify.Event{
+				{Name: filepath.Join(dir, "sub"), Op: fsnotify.Remove},
+				{Name: filepath.Join(dir, "sub", "b.jpg"), Op: fsnotify.Remove},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.change(); err != nil {
+				t.Fatal(err)
+			}
+			events, err := p.poll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+			if len(events) != len(tc.events) {
+				t.Fatalf("got events %v, expected %v", events, tc.events)
+			}
+			for i, event := range events {
+				if event != tc.events[i] {
+					t.Errorf("got event %v, expected %v", event, tc.events[i])
+				}
+			}
+		})
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.poll(); err == nil {
+		t.Error("expected error polling a missing folder")
+	}
+}
+
+func TestPollHandsOverNotify(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan fsnotify.Event, 16)
+	config := WatchConfig{Mode: WatchHybrid, PollInterval: 5 * time.Millisecond}
+	source := newEventSource(servicelog.Logger{Logger: zap.NewNop()}, config, dir, output)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Falling back from notify: existing files are reported, and
+	// notifications are probed and handed over once they work
+	watcher, err := source.poll(ctx, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	select {
+	case event := <-output:
+		if event.Name != filepath.Join(dir, "a.jpg") || event.Op != fsnotify.Create {
+			t.Errorf("unexpected event %v", event)
+		}
+	default:
+		t.Error("existing file not reported")
+	}
+	source.mutex.Lock()
+	notify := source.notify
+	source.mutex.Unlock()
+	if notify != watcher {
+		t.Error("new folders are not added to the handed over watcher")
+	}
+}
+
+func TestPollModeOnlyReportsChanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan fsnotify.Event, 16)
+	config := WatchConfig{Mode: WatchPoll, PollInterval: 5 * time.Millisecond}
+	source := newEventSource(servicelog.Logger{Logger: zap.NewNop()}, config, dir, output)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- source.run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "b.jpg"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-output:
+		if event.Name != filepath.Join(dir, "b.jpg") || event.Op != fsnotify.Create {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("new file not reported")
+	}
+}
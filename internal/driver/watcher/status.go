@@ -0,0 +1,188 @@
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	buffer "github.com/warpcomdev/asicamera2/internal/driver/fifo"
+)
+
+// TaskState is the state of a file being monitored
+type TaskState string
+
+const (
+	TaskWaiting   TaskState = "waiting"   // waiting for the file to stop changing
+	TaskUploading TaskState = "uploading" // upload in progress
+)
+
+// TaskStatus describes a file being monitored or uploaded
+type TaskStatus struct {
+	Path     string    `json:"path"`
+	State    TaskState `json:"state"`
+	Since    time.Time `json:"since"`              // first event detected
+	Deadline time.Time `json:"deadline,omitempty"` // expiration of the inactivity timer
+	Events   int       `json:"events"`             // number of events received
+}
+
+// ResultStatus is the outcome of a triggered upload
+type ResultStatus string
+
+const (
+	ResultSuccess ResultStatus = "success"
+	ResultFailure ResultStatus = "failure"
+	ResultHeld    ResultStatus = "held"    // file not complete, held back
+	ResultSkipped ResultStatus = "skipped" // file not modified since last upload
+)
+
+// UploadResult describes a completed upload attempt
+type UploadResult struct {
+	Path     string        `json:"path"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Status   ResultStatus  `json:"status"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Number of recent results kept
+const recentResults = 256
+
+type taskEntry struct {
+	TaskStatus
+	force chan struct{}
+}
+
+// statusBoard keeps track of tasks and results, so they can be
+// inspected from other goroutines.
+type statusBoard struct {
+	mutex    sync.Mutex
+	tasks    map[string]*taskEntry
+	recent   *buffer.Fifo[UploadResult]
+	failures map[string]UploadResult // latest failure of each file, until it succeeds
+}
+
+func newStatusBoard() *statusBoard {
+	return &statusBoard{
+		tasks:    make(map[string]*taskEntry),
+		recent:   buffer.New[UploadResult](recentResults),
+		failures: make(map[string]UploadResult),
+	}
+}
+
+// add a new task. Returns the channel used to force the upload.
+func (b *statusBoard) add(path string, monitorFor time.Duration) <-chan struct{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	entry := &taskEntry{
+		TaskStatus: TaskStatus{
+			Path:     path,
+			State:    TaskWaiting,
+			Since:    now,
+			Deadline: now.Add(monitorFor),
+		},
+		force: make(chan struct{}, 1),
+	}
+	b.tasks[path] = entry
+	return entry.force
+}
+
+// touch resets the inactivity deadline of the task
+func (b *statusBoard) touch(path string, monitorFor time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if entry, ok := b.tasks[path]; ok {
+		entry.Events += 1
+		entry.Deadline = time.Now().Add(monitorFor)
+	}
+}
+
+// uploading marks the task as in-flight
+func (b *statusBoard) uploading(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if entry, ok := b.tasks[path]; ok {
+		entry.State = TaskUploading
+		entry.Deadline = time.Time{}
+	}
+}
+
+// remove the task without a result
+func (b *statusBoard) remove(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.tasks, path)
+}
+
+// finish the task with the given result
+func (b *statusBoard) finish(result UploadResult) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.tasks, result.Path)
+	b.recent.Push(result)
+	switch result.Status {
+	case ResultFailure:
+		b.failures[result.Path] = result
+	case ResultSuccess:
+		delete(b.failures, result.Path)
+	}
+}
+
+// force the upload of a waiting task. Returns false if there is
+// no such task.
+func (b *statusBoard) force(path string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entry, ok := b.tasks[path]
+	if !ok {
+		return false
+	}
+	select {
+	case entry.force <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// forgetFailure removes the file from the failure list
+func (b *statusBoard) forgetFailure(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.failures, path)
+}
+
+// Tasks returns the files currently monitored or being uploaded,
+// sorted by path
+func (f *FileWatch) Tasks() []TaskStatus {
+	b := f.status
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	tasks := make([]TaskStatus, 0, len(b.tasks))
+	for _, entry := range b.tasks {
+		tasks = append(tasks, entry.TaskStatus)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Path < tasks[j].Path })
+	return tasks
+}
+
+// Results returns the recent upload results, oldest first
+func (f *FileWatch) Results() []UploadResult {
+	b := f.status
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.recent.Items()
+}
+
+// Failures returns the latest failure of each file that has not
+// been uploaded successfully since, sorted by path
+func (f *FileWatch) Failures() []UploadResult {
+	b := f.status
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	failures := make([]UploadResult, 0, len(b.failures))
+	for _, result := range b.failures {
+		failures = append(failures, result)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Path < failures[j].Path })
+	return failures
+}